@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// Inspects and converts cache snapshot files offline, without starting a server
+const usage = `Usage: cacheflow-snapshot <command> [flags] <file>
+
+Commands:
+  list      List the keys in a snapshot
+  dump      Print the items and tombstones in a snapshot as JSON lines
+  stats     Print counts, a value size histogram and the TTL distribution
+  verify    Check the integrity of a snapshot, exiting with status 1 if it is damaged
+  convert   Convert a snapshot to the JSON or binary format: convert -to <format> <in> <out>
+
+Snapshots in any supported format are read: binary or JSON, compressed or not, encrypted or not.
+Run cacheflow-snapshot <command> -h for the flags of a command.
+`
+
+// Environment variable holding the encryption keys when no key file is given, as for the server
+const encryptionKeysEnv = "CACHEFLOW_ENCRYPTION_KEYS";
+
+// Flags shared by all commands
+type options struct {
+	prefix string;
+	salvage bool;
+	keyFile string;
+}
+
+// The DTO for items printed by dump
+type dumpedItem struct {
+	Key			string			`json:"key"`
+	Type		string			`json:"type,omitempty"`		// Encoding of the value, empty for plain JSON values
+	Value		json.RawMessage	`json:"value"`
+	Expiration	int64			`json:"expiration"`
+	TTL			float64			`json:"ttl,omitempty"`		// Seconds left to live, negative once expired
+	LastAccess	int64			`json:"lastAccess"`
+	Version		uint64			`json:"version"`
+	AccessCount	int				`json:"accessCount"`
+	Timestamp	*cache.Timestamp	`json:"timestamp,omitempty"`
+	Deleted		bool			`json:"deleted,omitempty"`		// A tombstone of a deleted key, without a value
+	Lease		*cache.Lease	`json:"lease,omitempty"`		// The lease of the lock named by the key instead of an item
+}
+
+func main () {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage);
+		os.Exit(2);
+	}
+
+	command, args := os.Args[1], os.Args[2:];
+	switch command {
+	case "list":
+		runList(args);
+	case "dump":
+		runDump(args);
+	case "stats":
+		runStats(args);
+	case "verify":
+		runVerify(args);
+	case "convert":
+		runConvert(args);
+	case "help", "-h", "--help":
+		fmt.Print(usage);
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage);
+		os.Exit(2);
+	}
+}
+
+// Creates the flag set of a command with the shared flags
+func newFlagSet (command, arguments string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError);
+	fs.Usage = func () {
+		fmt.Fprintf(fs.Output(), "Usage: cacheflow-snapshot %s [flags] %s\n", command, arguments);
+		fs.PrintDefaults();
+	}
+
+	fs.StringVar(&opts.prefix, "prefix", "", "Only include keys starting with this prefix");
+	fs.StringVar(&opts.keyFile, "key-file", "", "File with the keys to decrypt with (or set " + encryptionKeysEnv + ")");
+	if command != "verify" {
+		fs.BoolVar(&opts.salvage, "salvage", false, "Read the valid records of a damaged snapshot");
+	}
+
+	return fs;
+}
+
+// Parses the flags and checks the number of positional arguments
+func parseArgs (fs *flag.FlagSet, args []string, count int) []string {
+	fs.Parse(args);
+	if fs.NArg() != count {
+		fs.Usage();
+		os.Exit(2);
+	}
+
+	return fs.Args();
+}
+
+// Prints an error and exits
+func fail (format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "cacheflow-snapshot: " + format + "\n", args...);
+	os.Exit(1);
+}
+
+// Reads the snapshot at path, "-" for stdin, calling fn for every record with the prefix
+func readRecords (path string, opts options, fn func(cache.SnapshotRecord) error) (cache.SnapshotReport, error) {
+	keyring, err := loadEncryptionKeys(opts.keyFile);
+	if err != nil {
+		return cache.SnapshotReport{}, fmt.Errorf("invalid encryption keys: %w", err);
+	}
+
+	var r io.Reader = os.Stdin;
+	if path != "-" {
+		file, err := os.Open(path);
+		if err != nil {
+			return cache.SnapshotReport{}, err;
+		}
+		defer file.Close();
+		r = file;
+	}
+
+	return cache.ReadSnapshotFile(r, keyring, opts.salvage, func (rec cache.SnapshotRecord) error {
+		if !strings.HasPrefix(rec.Key, opts.prefix) {
+			return nil;
+		}
+
+		return fn(rec);
+	})
+}
+
+// Reports damage found while salvaging, which is not an error in itself
+func warnDamage (report cache.SnapshotReport) {
+	if report.Corrupted || !report.Complete {
+		fmt.Fprintf(os.Stderr, "cacheflow-snapshot: snapshot is damaged, %d records salvaged, %d bytes skipped\n", report.Records, report.SkippedBytes);
+	}
+}
+
+// Lists the keys, with their type, value size and TTL if -long is set
+func runList (args []string) {
+	var opts options;
+	fs := newFlagSet("list", "<file>", &opts);
+	long := fs.Bool("long", false, "Also print the type, value size in bytes and TTL of every key");
+	path := parseArgs(fs, args, 1)[0];
+
+	out := bufio.NewWriter(os.Stdout);
+	defer out.Flush();
+
+	now := time.Now().UnixNano();
+	report, err := readRecords(path, opts, func (rec cache.SnapshotRecord) error {
+		if rec.Deleted || rec.Lease != nil {
+			return nil;
+		}
+
+		if !*long {
+			fmt.Fprintln(out, rec.Key);
+			return nil;
+		}
+
+		encoding, value, err := cache.EncodeValue(rec.Value);
+		if err != nil {
+			return err;
+		}
+		if encoding == "" {
+			encoding = "json";
+		}
+
+		fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", rec.Key, encoding, len(value), formatTTL(rec.Expiration, now));
+		return nil;
+	})
+	if err != nil {
+		out.Flush();
+		fail("%v", err);
+	}
+	warnDamage(report);
+}
+
+// Prints every item as a line of JSON
+func runDump (args []string) {
+	var opts options;
+	fs := newFlagSet("dump", "<file>", &opts);
+	path := parseArgs(fs, args, 1)[0];
+
+	out := bufio.NewWriter(os.Stdout);
+	defer out.Flush();
+	encoder := json.NewEncoder(out);
+
+	now := time.Now().UnixNano();
+	report, err := readRecords(path, opts, func (rec cache.SnapshotRecord) error {
+		item := dumpedItem{
+			Key: rec.Key,
+			Expiration: rec.Expiration,
+			LastAccess: rec.LastAccess,
+			Version: rec.Version,
+			AccessCount: rec.AccessCount,
+			Deleted: rec.Deleted,
+			Lease: rec.Lease,
+		}
+		if !rec.Timestamp.IsZero() {
+			item.Timestamp = &rec.Timestamp;
+		}
+
+		if !rec.Deleted && rec.Lease == nil {
+			var err error;
+			item.Type, item.Value, err = cache.EncodeValue(rec.Value);
+			if err != nil {
+				return err;
+			}
+		}
+
+		if rec.Expiration > 0 {
+			item.TTL = time.Duration(rec.Expiration - now).Seconds();
+		}
+
+		return encoder.Encode(item);
+	})
+	if err != nil {
+		out.Flush();
+		fail("%v", err);
+	}
+	warnDamage(report);
+}
+
+// Reads the whole snapshot, reporting all damage instead of stopping at the first
+func runVerify (args []string) {
+	var opts options;
+	fs := newFlagSet("verify", "<file>", &opts);
+	asJson := fs.Bool("json", false, "Print the report as JSON");
+	path := parseArgs(fs, args, 1)[0];
+
+	opts.salvage = true;
+	report, err := readRecords(path, opts, func (rec cache.SnapshotRecord) error {
+		return nil;
+	})
+	if err != nil {
+		fail("%v", err);
+	}
+
+	ok := !report.Corrupted && report.Complete;
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(report);
+	} else {
+		status := "OK";
+		if !ok {
+			status = "DAMAGED";
+		}
+
+		fmt.Printf("Status:          %s\n", status);
+		fmt.Printf("Format version:  %d\n", report.FormatVersion);
+		if !report.CreatedAt.IsZero() {
+			fmt.Printf("Created at:      %s\n", report.CreatedAt.Format(time.RFC3339));
+		}
+		fmt.Printf("Valid records:   %d\n", report.Records);
+		fmt.Printf("Complete:        %t\n", report.Complete);
+		fmt.Printf("Skipped bytes:   %d\n", report.SkippedBytes);
+		for _, problem := range report.Problems {
+			fmt.Printf("Problem:         %s\n", problem);
+		}
+	}
+
+	if !ok {
+		os.Exit(1);
+	}
+}
+
+// Rewrites a snapshot in another format, writing to a temp file that replaces out once complete
+func runConvert (args []string) {
+	var opts options;
+	fs := newFlagSet("convert", "<in> <out>", &opts);
+	format := fs.String("to", "", "Format to convert to (json or binary)");
+	compression := fs.String("compression", cache.SnapshotCompressionNone, "Compression of the output (none or gzip)");
+	encrypt := fs.Bool("encrypt", false, "Encrypt the output with the current key");
+	paths := parseArgs(fs, args, 2);
+
+	if *format != "json" && *format != "binary" {
+		fail("-to must be json or binary");
+	}
+
+	var keyring *cache.Keyring;
+	if *encrypt {
+		var err error;
+		keyring, err = loadEncryptionKeys(opts.keyFile);
+		if err != nil {
+			fail("invalid encryption keys: %v", err);
+		}
+		if keyring == nil {
+			fail("-encrypt needs -key-file or %s", encryptionKeysEnv);
+		}
+	}
+
+	count, err := convert(paths[0], paths[1], *format, *compression, keyring, opts);
+	if err != nil {
+		fail("%v", err);
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %d records to %s\n", count, paths[1]);
+}
+
+// Writes the records of the snapshot at in to out and returns their count
+func convert (in, out, format, compression string, keyring *cache.Keyring, opts options) (uint64, error) {
+	tempPath := filepath.Join(filepath.Dir(out), "." + filepath.Base(out) + ".tmp");
+	file, err := os.Create(tempPath);
+	if err != nil {
+		return 0, err;
+	}
+	defer os.Remove(tempPath);
+	defer file.Close();
+
+	fileWriter, err := cache.NewSnapshotFileWriter(file, compression, keyring);
+	if err != nil {
+		return 0, err;
+	}
+
+	var writer interface {
+		WriteRecord(cache.SnapshotRecord) error
+		Close() error
+		Count() uint64
+	};
+	if format == "json" {
+		writer, err = cache.NewJSONSnapshotWriter(fileWriter);
+	} else {
+		writer, err = cache.NewSnapshotWriter(fileWriter);
+	}
+	if err != nil {
+		return 0, err;
+	}
+
+	report, err := readRecords(in, opts, writer.WriteRecord);
+	if err != nil {
+		return 0, err;
+	}
+	warnDamage(report);
+
+	if err := writer.Close(); err != nil {
+		return 0, err;
+	}
+	if err := fileWriter.Close(); err != nil {
+		return 0, err;
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err;
+	}
+
+	if err := os.Rename(tempPath, out); err != nil {
+		return 0, err;
+	}
+
+	return writer.Count(), nil;
+}
+
+// Formats the time left until expiration
+func formatTTL (expiration, now int64) string {
+	if expiration == 0 {
+		return "-";
+	}
+	if expiration < now {
+		return "expired";
+	}
+
+	return time.Duration(expiration - now).Round(time.Second).String();
+}
+
+// Loads the encryption keys from the key file, or else the environment.
+// Returns nil if neither is set. Unencrypted snapshots are still read, so they can be inspected and encrypted.
+func loadEncryptionKeys (keyFile string) (*cache.Keyring, error) {
+	text := os.Getenv(encryptionKeysEnv);
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile);
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err);
+		}
+		text = string(data);
+	}
+
+	if text == "" {
+		return nil, nil;
+	}
+
+	keys, err := cache.ParseEncryptionKeys(text);
+	if err != nil {
+		return nil, err;
+	}
+
+	keyring, err := cache.NewKeyring(keys);
+	if err != nil {
+		return nil, err;
+	}
+
+	keyring.AllowPlaintext();
+	return keyring, nil;
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// A bucket of a histogram, counting the values up to its bound
+type bucket struct {
+	Label	string	`json:"label"`
+	Count	uint64	`json:"count"`
+}
+
+// Upper bounds of the value size histogram in bytes, the last bucket holds everything bigger
+var sizeBounds = []int{64, 256, 1024, 4 * 1024, 16 * 1024, 64 * 1024, 256 * 1024, 1024 * 1024};
+
+// Upper bounds of the TTL distribution
+var ttlBounds = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour};
+
+// The DTO for stats output
+type snapshotStats struct {
+	Items		uint64				`json:"items"`
+	Tombstones	uint64				`json:"tombstones"`
+	Leases		uint64				`json:"leases"`
+	KeyBytes	uint64				`json:"keyBytes"`
+	ValueBytes	uint64				`json:"valueBytes"`	// Size of the values encoded as JSON
+	LargestKey	string				`json:"largestKey,omitempty"`
+	LargestSize	int					`json:"largestSize"`
+	Types		map[string]uint64	`json:"types"`
+	Sizes		[]bucket			`json:"sizes"`
+	TTLs		[]bucket			`json:"ttls"`
+	Report		cache.SnapshotReport	`json:"report"`
+}
+
+// Creates empty stats with a bucket for every bound
+func newSnapshotStats () *snapshotStats {
+	stats := &snapshotStats{Types: make(map[string]uint64)};
+
+	for _, bound := range sizeBounds {
+		stats.Sizes = append(stats.Sizes, bucket{Label: "<= " + formatBytes(bound)});
+	}
+	stats.Sizes = append(stats.Sizes, bucket{Label: "> " + formatBytes(sizeBounds[len(sizeBounds) - 1])});
+
+	stats.TTLs = append(stats.TTLs, bucket{Label: "no ttl"}, bucket{Label: "expired"});
+	for _, bound := range ttlBounds {
+		stats.TTLs = append(stats.TTLs, bucket{Label: "<= " + formatDuration(bound)});
+	}
+	stats.TTLs = append(stats.TTLs, bucket{Label: "> " + formatDuration(ttlBounds[len(ttlBounds) - 1])});
+
+	return stats;
+}
+
+// Counts a record into the stats
+func (s *snapshotStats) add (rec cache.SnapshotRecord, now int64) error {
+	if rec.Lease != nil {
+		s.Leases++;
+		return nil;
+	}
+
+	if rec.Deleted {
+		s.Tombstones++;
+		return nil;
+	}
+
+	encoding, value, err := cache.EncodeValue(rec.Value);
+	if err != nil {
+		return err;
+	}
+	if encoding == "" {
+		encoding = "json";
+	}
+
+	s.Items++;
+	s.KeyBytes += uint64(len(rec.Key));
+	s.ValueBytes += uint64(len(value));
+	s.Types[encoding]++;
+
+	if len(value) > s.LargestSize || s.LargestKey == "" {
+		s.LargestKey = rec.Key;
+		s.LargestSize = len(value);
+	}
+
+	i := 0;
+	for i < len(sizeBounds) && len(value) > sizeBounds[i] {
+		i++;
+	}
+	s.Sizes[i].Count++;
+
+	switch {
+	case rec.Expiration == 0:
+		s.TTLs[0].Count++;
+	case rec.Expiration < now:
+		s.TTLs[1].Count++;
+	default:
+		ttl := time.Duration(rec.Expiration - now);
+		i := 0;
+		for i < len(ttlBounds) && ttl > ttlBounds[i] {
+			i++;
+		}
+		s.TTLs[2 + i].Count++;
+	}
+
+	return nil;
+}
+
+// Prints counts, the value size histogram and the TTL distribution
+func runStats (args []string) {
+	var opts options;
+	fs := newFlagSet("stats", "<file>", &opts);
+	asJson := fs.Bool("json", false, "Print the stats as JSON");
+	path := parseArgs(fs, args, 1)[0];
+
+	stats := newSnapshotStats();
+	now := time.Now().UnixNano();
+	report, err := readRecords(path, opts, func (rec cache.SnapshotRecord) error {
+		return stats.add(rec, now);
+	})
+	if err != nil {
+		fail("%v", err);
+	}
+	stats.Report = report;
+
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(stats);
+		return;
+	}
+
+	warnDamage(report);
+	fmt.Printf("Items:        %d\n", stats.Items);
+	fmt.Printf("Tombstones:   %d\n", stats.Tombstones);
+	fmt.Printf("Leases:       %d\n", stats.Leases);
+	fmt.Printf("Key bytes:    %s\n", formatBytes(int(stats.KeyBytes)));
+	fmt.Printf("Value bytes:  %s\n", formatBytes(int(stats.ValueBytes)));
+	if stats.Items > 0 {
+		fmt.Printf("Largest:      %s (%s)\n", stats.LargestKey, formatBytes(stats.LargestSize));
+	}
+
+	types := make([]string, 0, len(stats.Types));
+	for t := range stats.Types {
+		types = append(types, t);
+	}
+	sort.Strings(types);
+
+	fmt.Println("\nTypes:");
+	for _, t := range types {
+		fmt.Printf("  %-12s %d\n", t, stats.Types[t]);
+	}
+
+	fmt.Println("\nValue sizes:");
+	printHistogram(stats.Sizes, stats.Items);
+
+	fmt.Println("\nTTLs:");
+	printHistogram(stats.TTLs, stats.Items);
+}
+
+// Prints the buckets with a bar proportional to their share of total
+func printHistogram (buckets []bucket, total uint64) {
+	const width = 40;
+
+	for _, b := range buckets {
+		bar := 0;
+		if total > 0 {
+			bar = int(b.Count * width / total);
+		}
+
+		fmt.Printf("  %-12s %10d  %s\n", b.Label, b.Count, strings.Repeat("#", bar));
+	}
+}
+
+// Formats a size in bytes with a binary unit
+func formatBytes (n int) string {
+	switch {
+	case n >= 1024 * 1024 && n % (1024 * 1024) == 0:
+		return fmt.Sprintf("%dMB", n / (1024 * 1024));
+	case n >= 1024 * 1024:
+		return fmt.Sprintf("%.1fMB", float64(n) / (1024 * 1024));
+	case n >= 1024 && n % 1024 == 0:
+		return fmt.Sprintf("%dKB", n / 1024);
+	case n >= 1024:
+		return fmt.Sprintf("%.1fKB", float64(n) / 1024);
+	default:
+		return fmt.Sprintf("%dB", n);
+	}
+}
+
+// Formats a duration in the largest whole unit
+func formatDuration (d time.Duration) string {
+	switch {
+	case d >= 24 * time.Hour && d % (24 * time.Hour) == 0:
+		return fmt.Sprintf("%dd", d / (24 * time.Hour));
+	case d >= time.Hour && d % time.Hour == 0:
+		return fmt.Sprintf("%dh", d / time.Hour);
+	default:
+		return fmt.Sprintf("%dm", d / time.Minute);
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +21,7 @@ import (
 	"github.com/simritkaul/cacheflow/internal/api"
 	"github.com/simritkaul/cacheflow/internal/cache"
 	"github.com/simritkaul/cacheflow/internal/cluster"
+	"github.com/simritkaul/cacheflow/internal/pubsub"
 )
 
 func main () {
@@ -28,7 +33,35 @@ func main () {
 	seedNode := flag.String("seed", "", "Seed node address to join the cluster");
 	dataDir := flag.String("data-dir", "./data", "Directory for cache persistence");
 	replicaCount := flag.Int("replicas", 2, "Number of replicas for each key");
+	writeConsistency := flag.String("write-consistency", cache.ConsistencyOne, "Acknowledgements a write waits for unless the request asks otherwise (one, quorum or all)");
+	readConsistency := flag.String("read-consistency", cache.ConsistencyPrimary, "Nodes a read is served by unless the request asks otherwise (one, quorum, all or primary)");
+	siblingPrefixes := flag.String("sibling-prefixes", "", "Comma-separated key prefixes whose keys keep concurrent writes as siblings instead of the last write winning");
+	tombstoneTTL := flag.Duration("tombstone-ttl", time.Hour, "How long deleted keys are remembered, so older writes of them replicated late are rejected");
+	replicationTimeout := flag.Duration("replication-timeout", 2 * time.Second, "How long a write waits for replicas to acknowledge it, and a read for replicas to answer");
+	hintMaxMemory := flag.Int("hint-max-memory", 10000, "Writes missed by unreachable replicas kept in memory to replay once they are back (0 disables hinted handoff)");
+	hintMaxSpill := flag.Int64("hint-max-spill", 64, "Size in MB of the hints spilled to the data directory once the memory limit is reached (0 disables spilling)");
+	readRepairInterval := flag.Duration("read-repair-interval", 10 * time.Second, "How often sample keys are read from all their nodes to repair out-of-date copies (0 disables)");
+	readRepairSamples := flag.Int("read-repair-samples", 20, "Number of keys read from all their nodes every read repair interval");
+	antiEntropyInterval := flag.Duration("anti-entropy-interval", time.Minute, "How often the keys shared with each peer are compared through Merkle trees and converged (0 disables)");
+	replicationBatchSize := flag.Int("replication-batch-size", 128, "Maximum number of writes sent to a replica in one request");
+	replicationQueueSize := flag.Int("replication-queue-size", 1024, "Writes that may wait to be sent to a replica before writers are held back");
 	persistenceEnabled := flag.Bool("persistence", true, "Enable persistence");
+	aofEnabled := flag.Bool("aof", false, "Record every write in an append-only log between snapshots");
+	aofFsync := flag.String("aof-fsync", cache.FsyncEverySec, "When to fsync the append-only log (always, everysec or no)");
+	aofRewriteSize := flag.Int64("aof-rewrite-size", 64, "Append-only log size in MB that triggers a rewrite into a snapshot");
+	saveRules := flag.String("save", "30 1", "Save after <seconds> if at least <changes> writes were made, as pairs like \"900 1 60 1000\" (empty disables)");
+	snapshotCompression := flag.String("snapshot-compression", cache.SnapshotCompressionNone, "Compression of snapshots (none or gzip)");
+	snapshotRetention := flag.Int("snapshot-retention", 3, "Number of snapshots kept on disk");
+	snapshotStore := flag.String("snapshot-store", "local", "Where snapshots are kept (local or s3)");
+	s3Endpoint := flag.String("s3-endpoint", "", "Endpoint of the S3-compatible object store for snapshots");
+	s3Bucket := flag.String("s3-bucket", "", "Bucket for snapshots in the object store");
+	s3Prefix := flag.String("s3-prefix", "", "Prefix of snapshot object keys in the bucket");
+	s3Region := flag.String("s3-region", "us-east-1", "Region used to sign object store requests");
+	diskTierDir := flag.String("disk-tier-dir", "", "Directory for the disk tier holding items evicted from memory (empty disables)");
+	diskTierMaxItems := flag.Int("disk-tier-max-items", 100000, "Maximum capacity of items in the disk tier");
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30 * time.Second, "Deadline for draining requests, handing off keys and the final save on shutdown");
+	encryptionKeyFile := flag.String("encryption-key-file", "", "File with the keys that encrypt persistence files, current key first (or set "+encryptionKeysEnv+")");
+	encryptionAllowPlaintext := flag.Bool("encryption-allow-plaintext", false, "Load unencrypted persistence files when encryption is enabled, to migrate an existing node");
 	flag.Parse();
 
 	// Generate a new node id if not provided
@@ -43,8 +76,37 @@ func main () {
 		}
 	}
 
-	// Create a new cache
+	keyring, err := loadEncryptionKeys(*encryptionKeyFile);
+	if err != nil {
+		log.Fatalf("Invalid encryption keys: %v", err);
+	}
+	if keyring != nil && *encryptionAllowPlaintext {
+		keyring.AllowPlaintext();
+	}
+
+	// Create a new cache, stamping its writes with the node ID
 	c := cache.NewCache(*evictionType, *maxItems);
+	c.SetClock(cache.NewHybridClock(*nodeId));
+	c.SetTombstoneTTL(*tombstoneTTL);
+	if *siblingPrefixes != "" {
+		c.SetSiblingPrefixes(strings.Split(*siblingPrefixes, ","));
+	}
+
+	// Spill items evicted from memory to disk if enabled
+	if *diskTierDir != "" {
+		if err := os.MkdirAll(*diskTierDir, 0755); err != nil {
+			log.Fatalf("Failed to create disk tier directory: %v", err);
+		}
+		diskTierPath := filepath.Join(*diskTierDir, fmt.Sprintf("tier-%s.log", *nodeId));
+		if err := c.EnableDiskTier(diskTierPath, *diskTierMaxItems, keyring); err != nil {
+			log.Fatalf("Failed to enable the disk tier: %v", err);
+		}
+	}
+
+	// Publish keyspace events from the cache and reclaim expired keys in the background
+	hub := pubsub.NewHub(*nodeId);
+	c.SetEventListener(hub.PublishKeyspaceEvent);
+	c.StartExpirationSweep(1 * time.Second);
 
 	// Create node address
 	addr := fmt.Sprintf(":%d", *port);
@@ -58,30 +120,117 @@ func main () {
 
 	// Create a new HTTP server and setup handlers
 	server := api.NewServer(c, mux);
+	server.SetHub(hub);
 	server.SetupHandlers();
 
 	// Set up node management handlers
 	nm.SetupHTTPHandlers(mux);
+	server.SetNodeManager(nm);
 
 	// Create replication manager
 	rm := cache.NewReplicationManager(c, *replicaCount, nm, *nodeId);
+	if err := rm.SetWriteConsistency(*writeConsistency, *replicationTimeout); err != nil {
+		log.Fatalf("Invalid write consistency: %v", err);
+	}
+	if err := rm.SetReadConsistency(*readConsistency); err != nil {
+		log.Fatalf("Invalid read consistency: %v", err);
+	}
+	if err := rm.SetReplicationQueues(*replicationBatchSize, *replicationQueueSize); err != nil {
+		log.Fatalf("Invalid replication queue settings: %v", err);
+	}
 	rm.SetupHTTPHandlers(mux);
 	server.SetReplicationManager(rm);
 
+	// Keep the writes unreachable replicas miss and replay them once the replicas are back
+	if *hintMaxMemory > 0 {
+		hintDir := "";
+		if *persistenceEnabled && *hintMaxSpill > 0 {
+			hintDir = filepath.Join(*dataDir, fmt.Sprintf("hints-%s", *nodeId));
+		}
+		if err := rm.EnableHints(hintDir, *hintMaxMemory, *hintMaxSpill * 1024 * 1024, keyring); err != nil {
+			log.Fatalf("Failed to enable hinted handoff: %v", err);
+		}
+	}
+
+	nm.SetStatusListener(func (id string, status cluster.NodeStatus) {
+		switch status {
+		case cluster.NodeStatusUp:
+			rm.ReplayHints(id);
+		case cluster.NodeStatusLeft:
+			rm.RemovePeer(id);
+			rm.DropHints(id);
+		}
+	})
+
 	// Create persistence manager if enabled
 	var persistenceManager *cache.PersistenceManager;
 	if *persistenceEnabled {
 		persistencePath := filepath.Join(*dataDir, fmt.Sprintf("cache-%s.dat", *nodeId));
 		persistenceManager = cache.NewPersistenceManager(c, persistencePath, 30 * time.Second);
+		rules, err := cache.ParseSaveRules(*saveRules);
+		if err != nil {
+			log.Fatalf("Invalid save rules: %v", err);
+		}
+		persistenceManager.SetSaveRules(rules);
+		if err := persistenceManager.SetSnapshotPolicy(*snapshotCompression, *snapshotRetention); err != nil {
+			log.Fatalf("Invalid snapshot settings: %v", err);
+		}
+		if *aofEnabled {
+			if err := persistenceManager.EnableAppendOnlyLog(*aofFsync, *aofRewriteSize * 1024 * 1024); err != nil {
+				log.Fatalf("Invalid append-only log settings: %v", err);
+			}
+		}
+		switch *snapshotStore {
+		case "local":
+		case "s3":
+			// Credentials come from the standard AWS environment variables, unsigned requests if unset
+			store, err := cache.NewS3SnapshotStore(*s3Endpoint, *s3Bucket, *s3Prefix, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"));
+			if err != nil {
+				log.Fatalf("Invalid snapshot store settings: %v", err);
+			}
+			persistenceManager.SetSnapshotStore(store);
+		default:
+			log.Fatalf("Unknown snapshot store %q", *snapshotStore);
+		}
+		if keyring != nil {
+			persistenceManager.SetEncryption(keyring);
+			log.Printf("Encrypting persistence files with key %s", keyring.CurrentKeyId());
+		}
 		persistenceManager.Start();
+		server.SetPersistenceManager(persistenceManager);
 	}
 
 	// Start health check
 	nm.StartHealthCheck();
 
-	// Connect to seed node if provided
-	if *seedNode != "" {
-		go func () {
+	// Repair keys that are rarely read in the background
+	if *readRepairInterval > 0 && *readRepairSamples > 0 {
+		rm.StartRepairSampler(*readRepairInterval, *readRepairSamples);
+	}
+
+	// Converge the keys shared with each peer that is up, including the ones never read
+	if *antiEntropyInterval > 0 {
+		rm.StartAntiEntropy(*antiEntropyInterval, func () []string {
+			var peers []string;
+			for _, node := range nm.GetAllNodes() {
+				if node.ID != *nodeId && node.Status == cluster.NodeStatusUp {
+					peers = append(peers, node.ID);
+				}
+			}
+			return peers;
+		})
+	}
+
+	// Serve traffic and join the cluster only once the data on disk is loaded
+	go func () {
+		if persistenceManager != nil {
+			<-persistenceManager.Ready();
+		}
+		server.MarkReady();
+		log.Printf("Node %s is ready", *nodeId);
+
+		// Connect to seed node if provided
+		if *seedNode != "" {
 			// Wait a little to ensure our server has started
 			time.Sleep(1 * time.Second);
 
@@ -89,14 +238,24 @@ func main () {
 			if err := registerWithSeedNode(*seedNode, *nodeId, nodeAddr); err != nil {
 				log.Printf("Failed to register with seed node: %v", err);
 			}
-		}();
+		}
+	}();
 
+	// Streaming requests (subscriptions, watches) are cancelled once shutdown starts, so they do not hold up draining
+	requestCtx, cancelRequests := context.WithCancel(context.Background());
+	httpServer := &http.Server{
+		Addr: addr,
+		Handler: server.Handler(),
+		BaseContext: func (net.Listener) context.Context {
+			return requestCtx;
+		},
 	}
+	httpServer.RegisterOnShutdown(cancelRequests);
 
 	// Start the server in a goroutine
 	go func() {
 		log.Printf("Starting server on port %d with node ID %s...", *port, *nodeId)
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
@@ -107,11 +266,84 @@ func main () {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM);
 	<-quit	// Waits here till it receives any signal from the quit channel
 
-	log.Println("Shutting down the server ...");
-	// Potential cleanup logic
+	log.Printf("Shutting down the server within %s ...", *shutdownTimeout);
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout);
+	defer cancel();
+
+	if err := shutdown(ctx, httpServer, nm, rm, persistenceManager); err != nil {
+		log.Printf("Shutdown did not complete: %v", err);
+		os.Exit(1);
+	}
 	log.Println("Server gracefully stopped");
 }
 
+// Stops the node in order: leave the cluster while still serving, so peers route to the remaining
+// nodes instead of a closed port, then stop accepting requests and drain the ones in flight, hand
+// the node's keys off to its successors, flush replication and save one last time.
+// Steps still run after an earlier one fails, each bounded by ctx.
+func shutdown (ctx context.Context, httpServer *http.Server, nm *cluster.NodeManager, rm *cache.ReplicationManager, pm *cache.PersistenceManager) error {
+	var errs []error;
+
+	handedOff, err := rm.HandOff(ctx, func () {
+		if err := nm.Leave(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("leaving the cluster: %w", err));
+		}
+		log.Println("Left the cluster");
+
+		// Writes peers sent before they deregistered us are drained before the keys are handed off
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("draining requests: %w", err));
+		}
+		log.Println("Stopped accepting requests");
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("handing off keys: %w", err));
+	}
+	log.Printf("Handed off %d keys to successor nodes", handedOff);
+
+	if err := rm.Flush(ctx); err != nil {
+		errs = append(errs, err);
+	}
+	rm.CloseHints();
+
+	if pm != nil {
+		if err := pm.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("final save: %w", err));
+		} else {
+			log.Println("Final snapshot saved");
+		}
+	}
+
+	return errors.Join(errs...);
+}
+
+// Environment variable holding the encryption keys when no key file is given
+const encryptionKeysEnv = "CACHEFLOW_ENCRYPTION_KEYS";
+
+// Loads the persistence encryption keys from the key file, or else the environment.
+// Returns nil if neither is set, leaving encryption disabled.
+func loadEncryptionKeys (keyFile string) (*cache.Keyring, error) {
+	text := os.Getenv(encryptionKeysEnv);
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile);
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err);
+		}
+		text = string(data);
+	}
+
+	if text == "" {
+		return nil, nil;
+	}
+
+	keys, err := cache.ParseEncryptionKeys(text);
+	if err != nil {
+		return nil, err;
+	}
+
+	return cache.NewKeyring(keys);
+}
+
 func registerWithSeedNode (seedNode, nodeId, nodeAddr string) error {
 	url := fmt.Sprintf("%s/nodes/register", seedNode);
 	data := map[string]string {
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// The DTO for restore requests
+type restoreRequest struct {
+	Snapshot	string	`json:"snapshot"`	// Name of the snapshot, as listed by /admin/snapshots
+	Mode		string	`json:"mode"`		// replace or merge, replace if empty
+	Salvage		bool	`json:"salvage"`	// Restore the valid records of a damaged snapshot
+}
+
+// Handle POST requests to save the node's cache.
+// Waits for the snapshot unless background=true, in which case 202 Accepted is returned right away.
+func (s *Server) handleAdminSave (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if !s.requirePersistence(w) {
+		return;
+	}
+
+	if r.URL.Query().Get("background") == "true" {
+		if err := s.persistenceManager.BackgroundSave(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict);
+			return;
+		}
+
+		w.Header().Set("Content-Type", "application/json");
+		w.WriteHeader(http.StatusAccepted);
+		json.NewEncoder(w).Encode(map[string]string {
+			"status": "started",
+		})
+		return;
+	}
+
+	status, err := s.persistenceManager.Save();
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError);
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(status);
+}
+
+// Handle GET requests for the outcome of the last save
+func (s *Server) handleAdminSaveStatus (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if !s.requirePersistence(w) {
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(s.persistenceManager.LastSave());
+}
+
+// Handle GET requests for the save rules, and PUT requests to replace them
+func (s *Server) handleAdminSaveRules (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if !s.requirePersistence(w) {
+		return;
+	}
+
+	if r.Method == http.MethodPut {
+		var data struct {
+			Rules []cache.SaveRule `json:"rules"`
+		};
+		if !decodeBody(w, r, &data) {
+			return;
+		}
+
+		if err := s.persistenceManager.SetSaveRules(data.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest);
+			return;
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"rules": s.persistenceManager.SaveRules(),
+		"changes": s.cache.Changes(),
+	})
+}
+
+// Handle GET requests to list the node's snapshots, newest first
+func (s *Server) handleAdminSnapshots (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if !s.requirePersistence(w) {
+		return;
+	}
+
+	snapshots, err := s.persistenceManager.ListSnapshots();
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError);
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"snapshots": snapshots,
+	})
+}
+
+// Handle POST requests to load a snapshot into the running node
+func (s *Server) handleAdminRestore (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if !s.requirePersistence(w) {
+		return;
+	}
+
+	var data restoreRequest;
+	if !decodeBody(w, r, &data) {
+		return;
+	}
+
+	if data.Snapshot == "" {
+		http.Error(w, "Snapshot is required", http.StatusBadRequest);
+		return;
+	}
+
+	if data.Mode == "" {
+		data.Mode = cache.RestoreReplace;
+	}
+
+	result, err := s.persistenceManager.Restore(data.Snapshot, data.Mode, data.Salvage);
+	if errors.Is(err, cache.ErrSnapshotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound);
+		return;
+	}
+	if errors.Is(err, cache.ErrSnapshotCorrupt) {
+		// The report says what is damaged, so the caller can decide to salvage
+		w.Header().Set("Content-Type", "application/json");
+		w.WriteHeader(http.StatusUnprocessableEntity);
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"error": err.Error(),
+			"report": result.Report,
+		})
+		return;
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(result);
+}
+
+// Writes 503 Service Unavailable if persistence is disabled. Returns false if it did.
+func (s *Server) requirePersistence (w http.ResponseWriter) bool {
+	if s.persistenceManager == nil {
+		http.Error(w, "Persistence is disabled", http.StatusServiceUnavailable);
+		return false;
+	}
+
+	return true;
+}
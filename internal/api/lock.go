@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// The DTO for lock requests
+type lockRequest struct {
+	Name	string	`json:"name"`
+	Owner	string	`json:"owner"`
+	Token	uint64	`json:"token"`
+	TTL		int64	`json:"ttl"` // ttl in seconds
+}
+
+// Handle POST requests to acquire a lock
+func (s *Server) handleLockAcquire (w http.ResponseWriter, r *http.Request) {
+	data, ok := s.decodeLockRequest(w, r);
+	if !ok {
+		return;
+	}
+
+	if data.TTL <= 0 {
+		http.Error(w, "TTL must be positive", http.StatusBadRequest);
+		return;
+	}
+
+	lease, err := s.cache.AcquireLock(data.Name, data.Owner, time.Duration(data.TTL) * time.Second);
+	s.writeLockResponse(w, lease, err);
+}
+
+// Handle POST requests to renew a held lock
+func (s *Server) handleLockRenew (w http.ResponseWriter, r *http.Request) {
+	data, ok := s.decodeLockRequest(w, r);
+	if !ok {
+		return;
+	}
+
+	if data.TTL <= 0 {
+		http.Error(w, "TTL must be positive", http.StatusBadRequest);
+		return;
+	}
+
+	lease, err := s.cache.RenewLock(data.Name, data.Owner, data.Token, time.Duration(data.TTL) * time.Second);
+	s.writeLockResponse(w, lease, err);
+}
+
+// Handle POST requests to release a held lock
+func (s *Server) handleLockRelease (w http.ResponseWriter, r *http.Request) {
+	data, ok := s.decodeLockRequest(w, r);
+	if !ok {
+		return;
+	}
+
+	lease, err := s.cache.ReleaseLock(data.Name, data.Owner, data.Token);
+	s.writeLockResponse(w, lease, err);
+}
+
+// Decodes and validates a lock request, forwarding it if another node owns the lock.
+// Returns false if a response has already been written.
+func (s *Server) decodeLockRequest (w http.ResponseWriter, r *http.Request) (lockRequest, bool) {
+	var data lockRequest;
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return data, false;
+	}
+
+	if !decodeBody(w, r, &data) {
+		return data, false;
+	}
+
+	if data.Name == "" || data.Owner == "" {
+		http.Error(w, "Lock name and owner are required", http.StatusBadRequest);
+		return data, false;
+	}
+
+	// Locks are served by the first live node among the lock's replicas,
+	// so a replica takes over the lease if the primary goes down
+	if s.nodeManager != nil {
+		count := 1;
+		if s.replicationManager != nil {
+			count += s.replicationManager.ReplicaCount();
+		}
+
+		node := s.nodeManager.GetLiveNodeForKey(data.Name, count);
+		if node != nil && node.ID != s.nodeManager.GetLocalNode().ID {
+			s.forwardRequest(w, r, node);
+			return data, false;
+		}
+	}
+
+	return data, true;
+}
+
+// Writes the result of a lock operation. On success the lease is first replicated to a quorum
+// of the lock's nodes, so the client is not handed a token a replica taking over would not know.
+func (s *Server) writeLockResponse (w http.ResponseWriter, lease cache.Lease, err error) {
+	if errors.Is(err, cache.ErrLockHeld) || errors.Is(err, cache.ErrLockNotHeld) {
+		http.Error(w, err.Error(), http.StatusConflict);
+		return;
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError);
+		return;
+	}
+
+	if s.replicationManager != nil {
+		if _, err := s.replicationManager.ReplicateLease(lease); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable);
+			return;
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(lease);
+}
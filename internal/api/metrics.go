@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// The DTO for metrics responses
+type metricsResponse struct {
+	Tiers	cache.TierStats	`json:"tiers"`	// Capacity, usage and hits of the memory and disk tiers
+	Replication	*cache.ReplicationStats	`json:"replication,omitempty"`	// Writes queued for and sent to replicas
+	Hints	*cache.HintStats	`json:"hints,omitempty"`	// Writes kept for unreachable replicas, if hinted handoff is enabled
+	ReadRepair	*cache.RepairStats	`json:"readRepair,omitempty"`	// Out-of-date copies found by reads and written over
+	AntiEntropy	*cache.AntiEntropyStats	`json:"antiEntropy,omitempty"`	// Key ranges compared with peers and keys sent to them
+}
+
+// Handle GET requests for the node's metrics
+func (s *Server) handleMetrics (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	response := metricsResponse{
+		Tiers: s.cache.TierStats(),
+	}
+	if s.replicationManager != nil {
+		replication := s.replicationManager.ReplicationStats();
+		response.Replication = &replication;
+		response.Hints = s.replicationManager.HintStats();
+		repairs := s.replicationManager.RepairStats();
+		response.ReadRepair = &repairs;
+		antiEntropy := s.replicationManager.AntiEntropyStats();
+		response.AntiEntropy = &antiEntropy;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(response);
+}
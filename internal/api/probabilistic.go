@@ -0,0 +1,261 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// Defaults used when a bloom filter is created without explicit sizing
+const (
+	defaultBloomCapacity = 10000;
+	defaultBloomErrorRate = 0.01;
+)
+
+// Handle POST requests to add items to a bloom filter
+func (s *Server) handleBloomAdd (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	// The DTO for the request body
+	var data struct {
+		Key			string		`json:"key"`
+		Items		[]string	`json:"items"`
+		Capacity	uint64		`json:"capacity"`	// Only used when the filter is created
+		ErrorRate	float64		`json:"errorRate"`	// Only used when the filter is created
+		TTL			int64		`json:"ttl"`		// ttl in seconds, 0 for no expiration
+		Consistency	string		`json:"consistency"`	// one, quorum or all, the node's default if empty
+	}
+
+	if !decodeBody(w, r, &data) {
+		return;
+	}
+
+	if data.Key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, data.Key) {
+		return;
+	}
+
+	if data.Capacity == 0 {
+		data.Capacity = defaultBloomCapacity;
+	}
+	if data.ErrorRate == 0 {
+		data.ErrorRate = defaultBloomErrorRate;
+	}
+
+	added, err := s.cache.BloomAdd(data.Key, data.Items, data.Capacity, data.ErrorRate, time.Duration(data.TTL) * time.Second);
+	if err != nil {
+		writeValueError(w, err);
+		return;
+	}
+
+	// Only ship the filter to replicas if any bits changed
+	for _, a := range added {
+		if a {
+			if !s.replicateMergeable(w, data.Key, data.Consistency) {
+				return;
+			}
+			break;
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"key": data.Key,
+		"added": added,
+	})
+}
+
+// Handle GET requests to check items against a bloom filter
+func (s *Server) handleBloomCheck (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	key := r.URL.Query().Get("key");
+	items := r.URL.Query()["item"];
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, key) {
+		return;
+	}
+
+	results, err := s.cache.BloomCheck(key, items);
+	if err != nil {
+		writeValueError(w, err);
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"key": key,
+		"exists": results,
+	})
+}
+
+// Handle POST requests to add items to a HyperLogLog
+func (s *Server) handleHLLAdd (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	// The DTO for the request body
+	var data struct {
+		Key		string		`json:"key"`
+		Items	[]string	`json:"items"`
+		TTL		int64		`json:"ttl"` // ttl in seconds, 0 for no expiration
+		Consistency	string	`json:"consistency"` // one, quorum or all, the node's default if empty
+	}
+
+	if !decodeBody(w, r, &data) {
+		return;
+	}
+
+	if data.Key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, data.Key) {
+		return;
+	}
+
+	changed, err := s.cache.HLLAdd(data.Key, data.Items, time.Duration(data.TTL) * time.Second);
+	if err != nil {
+		writeValueError(w, err);
+		return;
+	}
+
+	if changed && !s.replicateMergeable(w, data.Key, data.Consistency) {
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"key": data.Key,
+		"changed": changed,
+	})
+}
+
+// Handle GET requests to count the distinct items of one or more HyperLogLogs.
+// Multiple keys are served by the owner of the first key and count the union of the keys it holds.
+func (s *Server) handleHLLCount (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	keys := r.URL.Query()["key"];
+	if len(keys) == 0 {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, keys[0]) {
+		return;
+	}
+
+	count, err := s.cache.HLLCount(keys...);
+	if err != nil {
+		writeValueError(w, err);
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"keys": keys,
+		"count": count,
+	})
+}
+
+// Handle POST requests to merge HyperLogLogs into a destination key.
+// Served by the owner of the destination, using the source keys it holds.
+func (s *Server) handleHLLMerge (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	// The DTO for the request body
+	var data struct {
+		Dest	string		`json:"dest"`
+		Sources	[]string	`json:"sources"`
+		Consistency	string	`json:"consistency"` // one, quorum or all, the node's default if empty
+	}
+
+	if !decodeBody(w, r, &data) {
+		return;
+	}
+
+	if data.Dest == "" {
+		http.Error(w, "Destination key is required", http.StatusBadRequest);
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, data.Dest) {
+		return;
+	}
+
+	if err := s.cache.HLLMerge(data.Dest, data.Sources...); err != nil {
+		writeValueError(w, err);
+		return;
+	}
+
+	if !s.replicateMergeable(w, data.Dest, data.Consistency) {
+		return;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]string {
+		"status": "success",
+	})
+}
+
+// Sends a copy of the mergeable value at key to its replicas at the consistency level.
+// Returns false if an error response has been written.
+func (s *Server) replicateMergeable (w http.ResponseWriter, key, consistency string) bool {
+	if s.replicationManager == nil {
+		return true;
+	}
+
+	level, ok := parseConsistency(w, consistency);
+	if !ok {
+		return false;
+	}
+
+	value, ttl, stamp, found := s.cache.GetMergeable(key);
+	if !found {
+		return true;
+	}
+
+	if _, err := s.replicationManager.ReplicateSet(key, value, ttl, stamp, level); err != nil {
+		writeReplicationError(w, err);
+		return false;
+	}
+
+	return true;
+}
+
+// Writes the error of a typed value operation with a matching status code
+func writeValueError (w http.ResponseWriter, err error) {
+	if errors.Is(err, cache.ErrWrongType) {
+		http.Error(w, err.Error(), http.StatusConflict);
+		return;
+	}
+
+	http.Error(w, err.Error(), http.StatusBadRequest);
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cluster"
+	"github.com/simritkaul/cacheflow/internal/pubsub"
+)
+
+// How long publishing waits for each other node to deliver a message
+const publishFanOutTimeout = 2 * time.Second;
+
+// Handle POST requests to publish a message on a channel.
+// The message is delivered to local subscribers and fanned out to every other node in the cluster,
+// unless scope=local is given (which is how nodes hand messages to each other).
+func (s *Server) handlePublish (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if s.hub == nil {
+		http.Error(w, "Notifications are not enabled", http.StatusServiceUnavailable);
+		return;
+	}
+
+	var msg pubsub.Message;
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	if msg.Channel == "" {
+		http.Error(w, "Channel is required", http.StatusBadRequest);
+		return;
+	}
+
+	if msg.Channel == pubsub.KeyspaceChannel {
+		http.Error(w, "Channel is reserved for keyspace events", http.StatusBadRequest);
+		return;
+	}
+
+	local := r.URL.Query().Get("scope") == "local";
+	if !local {
+		// Stamp messages published by clients with this node as the origin
+		msg = s.hub.NewMessage(msg.Channel, msg.Data);
+	}
+
+	receivers := s.hub.Publish(msg);
+	if !local && s.nodeManager != nil {
+		receivers += s.fanOutMessage(msg);
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"status": "success",
+		"receivers": receivers,
+	})
+}
+
+// Delivers a message to the local subscribers of every other known node.
+// Returns the total number of subscribers that received it.
+func (s *Server) fanOutMessage (msg pubsub.Message) int {
+	jsonData, err := json.Marshal(msg);
+	if err != nil {
+		log.Printf("Error marshaling message for fan-out: %v", err);
+		return 0;
+	}
+
+	client := &http.Client{Timeout: publishFanOutTimeout};
+	localId := s.nodeManager.GetLocalNode().ID;
+
+	var wg sync.WaitGroup;
+	var mu sync.Mutex;
+	receivers := 0;
+
+	for _, node := range s.nodeManager.GetAllNodes() {
+		if node.ID == localId {
+			continue;
+		}
+
+		wg.Add(1);
+		go func (node *cluster.Node) {
+			defer wg.Done();
+
+			count, err := publishToNode(client, node.Address, jsonData);
+			if err != nil {
+				log.Printf("Error publishing to node %s: %v", node.ID, err);
+				return;
+			}
+
+			mu.Lock();
+			receivers += count;
+			mu.Unlock();
+		}(node);
+	}
+
+	wg.Wait();
+	return receivers;
+}
+
+// Publishes an encoded message to the local subscribers of a node
+func publishToNode (client *http.Client, address string, jsonData []byte) (int, error) {
+	url := fmt.Sprintf("%s/publish?scope=local", address);
+
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData));
+	if err != nil {
+		return 0, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("publish returned status %d", resp.StatusCode);
+	}
+
+	var result struct {
+		Receivers int `json:"receivers"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err;
+	}
+
+	return result.Receivers, nil;
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Paths served while the node is still loading: the readiness probe and cluster membership
+var readinessExemptPaths = []string{"/ready", "/nodes/"};
+
+// Marks the node as ready, letting requests through once its data is loaded
+func (s *Server) MarkReady () {
+	s.ready.Store(true);
+}
+
+// Checks if the node has finished loading its data
+func (s *Server) IsReady () bool {
+	return s.ready.Load();
+}
+
+// Returns the handler for all of the node's endpoints. Until the node is marked ready, requests
+// other than the readiness probe and cluster membership are answered with 503 Service Unavailable,
+// so clients and other nodes never see a partially loaded cache.
+func (s *Server) Handler () http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if !s.IsReady() && !isReadinessExempt(r.URL.Path) {
+			w.Header().Set("Retry-After", "1");
+			http.Error(w, "Node is loading its data", http.StatusServiceUnavailable);
+			return;
+		}
+
+		s.mux.ServeHTTP(w, r);
+	})
+}
+
+// Checks if the path is served before the node is ready
+func isReadinessExempt (path string) bool {
+	for _, exempt := range readinessExemptPaths {
+		if path == exempt || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt)) {
+			return true;
+		}
+	}
+
+	return false;
+}
+
+// Handle GET requests for the readiness probe.
+// Returns 200 once the node serves traffic, 503 with the loading progress before that.
+func (s *Server) handleReady (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	response := map[string]interface{} {
+		"ready": s.IsReady(),
+	}
+	if s.persistenceManager != nil {
+		response["loaded"] = s.persistenceManager.LoadProgress();
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	if !s.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable);
+	}
+	json.NewEncoder(w).Encode(response);
+}
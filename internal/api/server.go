@@ -3,13 +3,16 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/simritkaul/cacheflow/internal/cache"
 	"github.com/simritkaul/cacheflow/internal/cluster"
+	"github.com/simritkaul/cacheflow/internal/pubsub"
 )
 
 type Server struct {
@@ -17,6 +20,9 @@ type Server struct {
 	mux *http.ServeMux
 	nodeManager *cluster.NodeManager
 	replicationManager *cache.ReplicationManager
+	hub *pubsub.Hub
+	persistenceManager *cache.PersistenceManager
+	ready atomic.Bool // Set once the node's data is loaded
 }
 
 // Creates a new HTTP server for the cache
@@ -37,11 +43,39 @@ func (s *Server) SetReplicationManager (rm *cache.ReplicationManager) {
 	s.replicationManager = rm;
 }
 
+// Sets the notification hub streamed by the subscribe endpoint
+func (s *Server) SetHub (hub *pubsub.Hub) {
+	s.hub = hub;
+}
+
+// Sets the Persistence Manager driven by the admin endpoints
+func (s *Server) SetPersistenceManager (pm *cache.PersistenceManager) {
+	s.persistenceManager = pm;
+}
+
 // SetupHandlers sets up the HTTP handlers
 func (s *Server) SetupHandlers() {
 	s.mux.HandleFunc("/get", s.handleGet)
 	s.mux.HandleFunc("/set", s.handleSet)
 	s.mux.HandleFunc("/delete", s.handleDelete)
+	s.mux.HandleFunc("/lock/acquire", s.handleLockAcquire)
+	s.mux.HandleFunc("/lock/renew", s.handleLockRenew)
+	s.mux.HandleFunc("/lock/release", s.handleLockRelease)
+	s.mux.HandleFunc("/bloom/add", s.handleBloomAdd)
+	s.mux.HandleFunc("/bloom/check", s.handleBloomCheck)
+	s.mux.HandleFunc("/hll/add", s.handleHLLAdd)
+	s.mux.HandleFunc("/hll/count", s.handleHLLCount)
+	s.mux.HandleFunc("/hll/merge", s.handleHLLMerge)
+	s.mux.HandleFunc("/subscribe", s.handleSubscribe)
+	s.mux.HandleFunc("/publish", s.handlePublish)
+	s.mux.HandleFunc("/watch", s.handleWatch)
+	s.mux.HandleFunc("/ready", s.handleReady)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/admin/save", s.handleAdminSave)
+	s.mux.HandleFunc("/admin/save/status", s.handleAdminSaveStatus)
+	s.mux.HandleFunc("/admin/save/rules", s.handleAdminSaveRules)
+	s.mux.HandleFunc("/admin/snapshots", s.handleAdminSnapshots)
+	s.mux.HandleFunc("/admin/restore", s.handleAdminRestore)
 }
 
 // Handle GET requests to retrieve values from cache
@@ -57,6 +91,25 @@ func (s *Server) handleGet (w http.ResponseWriter, r *http.Request) {
 		return;
 	}
 
+	level := cache.ConsistencyPrimary;
+	if s.replicationManager != nil {
+		level = s.replicationManager.ReadConsistency();
+	}
+	if r.URL.Query().Get("consistency") != "" {
+		var err error;
+		level, err = cache.ParseReadConsistency(r.URL.Query().Get("consistency"));
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest);
+			return;
+		}
+	}
+
+	// Reads below primary consistency are served by the key's replicas too
+	if level != cache.ConsistencyPrimary && s.replicationManager != nil {
+		s.handleReplicaRead(w, key, level);
+		return;
+	}
+
 	// Check if we have a node manager and the key belongs to some other node
 	if s.nodeManager != nil  {
 		node := s.nodeManager.GetNodeForKey(key);
@@ -67,17 +120,34 @@ func (s *Server) handleGet (w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	value, found := s.cache.Get(key);
+	value, version, found := s.cache.GetVersioned(key);
 
 	if !found {
 		http.Error(w, "Key not found", http.StatusNotFound);
 		return;
 	}
 
-	w.Header().Set("Content-Type", "application/json");
-	json.NewEncoder(w).Encode(map[string]interface{} {
-		"key": key,
-		"value": value,
+	writeValue(w, key, value, map[string]interface{} {
+		"version": version,
+	})
+}
+
+// Reads a key from its primary and replicas at a consistency level other than primary
+func (s *Server) handleReplicaRead (w http.ResponseWriter, key, level string) {
+	result, err := s.replicationManager.Read(key, level);
+	if err != nil {
+		writeReplicationError(w, err);
+		return;
+	}
+
+	if !result.Found {
+		http.Error(w, "Key not found", http.StatusNotFound);
+		return;
+	}
+
+	writeValue(w, key, result.Value, map[string]interface{} {
+		"version": result.Version,
+		"node": result.Node,
 	})
 }
 
@@ -93,10 +163,11 @@ func (s *Server) handleSet (w http.ResponseWriter, r *http.Request) {
 		Key string `json:"key"`
 		Value interface{} `json:"value"`
 		TTL int64	`json:"ttl"` // ttl in seconds
+		Consistency string `json:"consistency"` // one, quorum or all, the node's default if empty
+		Context string `json:"context"` // Causal context of a read, for keys in sibling mode
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest);
+	if !decodeBody(w, r, &data) {
 		return;
 	}
 
@@ -115,14 +186,34 @@ func (s *Server) handleSet (w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	level, ok := parseConsistency(w, data.Consistency);
+	if !ok {
+		return;
+	}
+
 	ttl := time.Duration(data.TTL) * time.Second;
 
-	s.cache.Set(data.Key, data.Value, ttl);
+	if s.cache.UsesSiblings(data.Key) {
+		s.writeSibling(w, data.Key, data.Value, false, data.Context, ttl, level);
+		return;
+	}
+
+	stamp := s.cache.SetStamped(data.Key, data.Value, ttl);
+
+	acks := 1;
+	if s.replicationManager != nil {
+		var err error;
+		acks, err = s.replicationManager.ReplicateSet(data.Key, data.Value, ttl, stamp, level);
+		if err != nil {
+			writeReplicationError(w, err);
+			return;
+		}
+	}
 
-	w.WriteHeader(http.StatusCreated);
 	w.Header().Set("Content-Type", "application/json");
-	json.NewEncoder(w).Encode(map[string]string {
+	json.NewEncoder(w).Encode(map[string]interface{} {
 		"status": "success",
+		"acks": acks,
 	})
 }
 
@@ -139,14 +230,100 @@ func (s *Server) handleDelete (w http.ResponseWriter, r *http.Request) {
 		return;
 	}
 
-	s.cache.Delete(key);
+	level, ok := parseConsistency(w, r.URL.Query().Get("consistency"));
+	if !ok {
+		return;
+	}
+
+	if s.forwardIfRemote(w, r, key) {
+		return;
+	}
+
+	if s.cache.UsesSiblings(key) {
+		s.writeSibling(w, key, nil, true, r.URL.Query().Get("context"), 0, level);
+		return;
+	}
+
+	stamp := s.cache.DeleteStamped(key);
+
+	acks := 1;
+	if s.replicationManager != nil {
+		var err error;
+		acks, err = s.replicationManager.ReplicateDelete(key, stamp, level);
+		if err != nil {
+			writeReplicationError(w, err);
+			return;
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json");
-	json.NewEncoder(w).Encode(map[string]string {
+	json.NewEncoder(w).Encode(map[string]interface{} {
 		"status": "success",
+		"acks": acks,
 	})
 }
 
+// Parses the consistency level a write asked for, empty for the node's default.
+// Returns false if an error response has been written.
+func parseConsistency (w http.ResponseWriter, level string) (string, bool) {
+	if level == "" {
+		return "", true;
+	}
+
+	level, err := cache.ParseConsistency(level);
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return "", false;
+	}
+
+	return level, true;
+}
+
+// Writes the error of a read or write that did not meet its consistency level. A write has been
+// applied locally and may have reached some replicas, but not enough to meet the level.
+func writeReplicationError (w http.ResponseWriter, err error) {
+	if errors.Is(err, cache.ErrConsistencyNotMet) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable);
+		return;
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError);
+}
+
+// Forwards the request to the node that owns the key if that is not the local node.
+// Returns true if the request was forwarded.
+func (s *Server) forwardIfRemote (w http.ResponseWriter, r *http.Request, key string) bool {
+	if s.nodeManager == nil {
+		return false;
+	}
+
+	node := s.nodeManager.GetNodeForKey(key);
+	if node == nil || node.ID == s.nodeManager.GetLocalNode().ID {
+		return false;
+	}
+
+	s.forwardRequest(w, r, node);
+	return true;
+}
+
+// Decodes a JSON request body into v, keeping the body readable in case the request is forwarded.
+// Returns false if an error response has been written.
+func decodeBody (w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	bodyBytes, err := io.ReadAll(r.Body);
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError);
+		return false;
+	}
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes));
+
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return false;
+	}
+
+	return true;
+}
+
 // Forwards a request to another node
 func (s *Server) forwardRequest (w http.ResponseWriter, r *http.Request, node *cluster.Node) {
 	
@@ -204,6 +381,4 @@ func (s *Server) forwardRequest (w http.ResponseWriter, r *http.Request, node *c
 
 	// Copy the response body
 	io.Copy(w, resp.Body);
-
-	http.Error(w, fmt.Sprintf("Key belongs to node %s at %s", node.ID, node.Address), http.StatusTemporaryRedirect);
 }
\ No newline at end of file
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/cache"
+)
+
+// Writes the response of a read. Keys in sibling mode answer with the values of all their concurrent
+// versions and the context to write them back with, and are not found if their versions were deleted.
+func writeValue (w http.ResponseWriter, key string, value interface{}, fields map[string]interface{}) {
+	response := map[string]interface{} {"key": key};
+	for name, field := range fields {
+		response[name] = field;
+	}
+
+	if set, ok := value.(*cache.SiblingSet); ok {
+		values, err := set.Values();
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError);
+			return;
+		}
+
+		if len(values) == 0 {
+			http.Error(w, "Key not found", http.StatusNotFound);
+			return;
+		}
+
+		response["siblings"] = values;
+		response["context"] = set.Context().Encode();
+	} else {
+		response["value"] = value;
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(response);
+}
+
+// Writes a version of a key in sibling mode and replicates the key's versions, which replicas
+// merge into theirs. The versions the context covers are replaced, all others are kept.
+func (s *Server) writeSibling (w http.ResponseWriter, key string, value interface{}, deleted bool, context string, ttl time.Duration, level string) {
+	clock, err := cache.DecodeVectorClock(context);
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	set, stamp, err := s.cache.PutSibling(key, value, deleted, clock, ttl);
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	acks := 1;
+	if s.replicationManager != nil {
+		acks, err = s.replicationManager.ReplicateSet(key, set, ttl, stamp, level);
+		if err != nil {
+			writeReplicationError(w, err);
+			return;
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"status": "success",
+		"acks": acks,
+		"siblings": len(set.Siblings),
+		"context": set.Context().Encode(),
+	})
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/simritkaul/cacheflow/internal/pubsub"
+)
+
+// How often an idle stream sends a comment to keep the connection alive
+const streamHeartbeat = 15 * time.Second;
+
+// How often a subscription looks for newly joined nodes to relay from
+const relayDiscoveryInterval = 5 * time.Second;
+
+// Longest wait between attempts to reconnect to a node's stream
+const maxRelayBackoff = 30 * time.Second;
+
+// Handle GET requests to stream notifications as Server-Sent Events.
+// Each keyspace event is delivered once, by the node that owns the key. Unless scope=local
+// is given, the stream also relays the matching events of every other node in the cluster.
+// Channel messages need no relaying, since publishing already fans them out to every node.
+func (s *Server) handleSubscribe (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	if s.hub == nil {
+		http.Error(w, "Notifications are not enabled", http.StatusServiceUnavailable);
+		return;
+	}
+
+	query := r.URL.Query();
+	filter := pubsub.Filter{
+		KeyPatterns: query["pattern"],
+		Channels: query["channel"],
+		ChannelPatterns: query["channel-pattern"],
+	}
+
+	if len(filter.KeyPatterns) == 0 && !filter.HasChannels() {
+		http.Error(w, "At least one pattern, channel or channel-pattern is required", http.StatusBadRequest);
+		return;
+	}
+
+	flusher, ok := w.(http.Flusher);
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError);
+		return;
+	}
+
+	sub := s.hub.Subscribe(filter);
+	defer sub.Close();
+
+	w.Header().Set("Content-Type", "text/event-stream");
+	w.Header().Set("Cache-Control", "no-cache");
+	w.Header().Set("Connection", "keep-alive");
+	w.WriteHeader(http.StatusOK);
+	flusher.Flush();
+
+	ctx := r.Context();
+	if query.Get("scope") != "local" && s.nodeManager != nil && len(filter.KeyPatterns) > 0 {
+		go s.relayFromPeers(ctx, sub, filter.KeyPatterns);
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat);
+	defer heartbeat.Stop();
+
+	for {
+		select {
+		case <-ctx.Done():
+			return;
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return;
+			}
+
+			if !s.shouldStream(msg) {
+				continue;
+			}
+
+			data, err := json.Marshal(msg);
+			if err != nil {
+				log.Printf("Error marshaling notification: %v", err);
+				continue;
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", streamEventName(msg), data); err != nil {
+				return;
+			}
+			flusher.Flush();
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return;
+			}
+			flusher.Flush();
+		}
+	}
+}
+
+// Checks if a message should be written to a stream on this node.
+// Keyspace events raised locally for keys owned by another node (such as writes applied
+// by replication) are left to the owner, so subscribers see each event once.
+func (s *Server) shouldStream (msg pubsub.Message) bool {
+	if s.nodeManager == nil || msg.Channel != pubsub.KeyspaceChannel {
+		return true;
+	}
+
+	localId := s.nodeManager.GetLocalNode().ID;
+	if msg.Node != localId {
+		return true;
+	}
+
+	owner := s.nodeManager.GetNodeForKey(msg.Key);
+	return owner == nil || owner.ID == localId;
+}
+
+// Returns the SSE event name for a message
+func streamEventName (msg pubsub.Message) string {
+	if msg.Channel == pubsub.KeyspaceChannel {
+		return "keyspace";
+	}
+
+	return "message";
+}
+
+// A relay of one node's events into a subscription
+type peerRelay struct {
+	address string;
+	cancel context.CancelFunc;
+}
+
+// Relays matching keyspace events from every other known node into the subscription until ctx is done.
+// Membership is checked every relayDiscoveryInterval: relays start for nodes that joined, stop for nodes
+// that left, and restart for nodes that registered again at another address.
+func (s *Server) relayFromPeers (ctx context.Context, sub *pubsub.Subscription, keyPatterns []string) {
+	query := url.Values{
+		"pattern": keyPatterns,
+		"scope": {"local"},
+	};
+
+	relays := make(map[string]peerRelay);
+	localId := s.nodeManager.GetLocalNode().ID;
+
+	ticker := time.NewTicker(relayDiscoveryInterval);
+	defer ticker.Stop();
+
+	for {
+		members := make(map[string]bool);
+		for _, node := range s.nodeManager.GetAllNodes() {
+			id, address := node.ID, node.Address;
+			if id == localId {
+				continue;
+			}
+			members[id] = true;
+
+			relay, found := relays[id];
+			if found && relay.address == address {
+				continue;
+			}
+			if found {
+				relay.cancel();
+			}
+
+			relayCtx, cancel := context.WithCancel(ctx);
+			relays[id] = peerRelay{address: address, cancel: cancel};
+			go s.relayFromPeer(relayCtx, sub, id, address, query);
+		}
+
+		for id, relay := range relays {
+			if !members[id] {
+				relay.cancel();
+				delete(relays, id);
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return;
+		case <-ticker.C:
+		}
+	}
+}
+
+// Streams the local keyspace events of one node into the subscription, reconnecting until ctx is done
+func (s *Server) relayFromPeer (ctx context.Context, sub *pubsub.Subscription, id, address string, query url.Values) {
+	backoff := time.Second;
+	for {
+		err := streamFromNode(ctx, address + "/subscribe?" + query.Encode(), sub);
+		if ctx.Err() != nil {
+			return;
+		}
+
+		if err != nil {
+			log.Printf("Notification relay from node %s failed: %v", id, err);
+		} else {
+			// The stream ended cleanly, so start over with a short wait
+			backoff = time.Second;
+		}
+
+		select {
+		case <-ctx.Done():
+			return;
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2;
+		if backoff > maxRelayBackoff {
+			backoff = maxRelayBackoff;
+		}
+	}
+}
+
+// Reads an SSE stream and sends every message it carries to the subscription
+func streamFromNode (ctx context.Context, streamUrl string, sub *pubsub.Subscription) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamUrl, nil);
+	if err != nil {
+		return err;
+	}
+
+	resp, err := http.DefaultClient.Do(req);
+	if err != nil {
+		return err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream returned status %d", resp.StatusCode);
+	}
+
+	scanner := bufio.NewScanner(resp.Body);
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024);
+
+	for scanner.Scan() {
+		line := scanner.Text();
+		if !strings.HasPrefix(line, "data: ") {
+			continue;
+		}
+
+		var msg pubsub.Message;
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+			log.Printf("Error decoding relayed notification: %v", err);
+			continue;
+		}
+
+		sub.Send(msg);
+	}
+
+	return scanner.Err();
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default and maximum time a watch waits for a change
+const (
+	defaultWatchTimeout = 30 * time.Second;
+	maxWatchTimeout = 5 * time.Minute;
+)
+
+// Handle GET requests that wait for a key to change.
+// Returns as soon as the key's version differs from the given one (immediately if it already does),
+// or 304 Not Modified once the timeout (in seconds) passes without a change.
+func (s *Server) handleWatch (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	query := r.URL.Query();
+	key := query.Get("key");
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	var version uint64;
+	if v := query.Get("version"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64);
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest);
+			return;
+		}
+		version = parsed;
+	}
+
+	timeout := defaultWatchTimeout;
+	if t := query.Get("timeout"); t != "" {
+		seconds, err := strconv.Atoi(t);
+		if err != nil || seconds <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest);
+			return;
+		}
+		timeout = min(time.Duration(seconds) * time.Second, maxWatchTimeout);
+	}
+
+	// Only the owner sees every write to the key
+	if s.forwardIfRemote(w, r, key) {
+		return;
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout);
+	defer cancel();
+
+	if !s.cache.WaitForChange(ctx, key, version) {
+		w.WriteHeader(http.StatusNotModified);
+		return;
+	}
+
+	value, newVersion, found := s.cache.GetVersioned(key);
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"key": key,
+		"value": value,
+		"version": newVersion,
+		"found": found,
+	})
+}
@@ -0,0 +1,507 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Merkle trees have 1 << merkleDepth leaves, each covering an equal range of hash ring positions
+const merkleDepth = 10;
+
+// How long a node reuses the tree it built for a peer, so a peer descending it level by level sees one tree.
+// Every round starts at the root, which rebuilds it.
+const merkleTreeTTL = 10 * time.Second;
+
+// The version of a key one node holds, as compared by anti-entropy
+type merkleEntry struct {
+	Key			string		`json:"key"`
+	Digest		uint64		`json:"digest"`		// Of the key and its version, equal on nodes holding the same version
+	Timestamp	Timestamp	`json:"timestamp"`
+	Deleted		bool		`json:"deleted,omitempty"`	// The key's tombstone
+	Merge		bool		`json:"merge,omitempty"`	// Mergeable values are merged rather than ordered by timestamp
+}
+
+// A Merkle tree over the keys a node shares with a peer. hashes[1] is the root and the children of
+// hashes[i] are hashes[2i] and hashes[2i+1], so the leaves are hashes[1 << merkleDepth:].
+type merkleTree struct {
+	hashes []uint64;
+	leaves map[int][]merkleEntry;	// Entries of each non-empty leaf, by tree index
+	built time.Time;
+}
+
+// Counters of anti-entropy
+type AntiEntropyStats struct {
+	Rounds		uint64	`json:"rounds"`		// Trees compared with a peer
+	Diverged	uint64	`json:"diverged"`	// Leaf ranges that differed from the peer's
+	Pushed		uint64	`json:"pushed"`		// Keys sent to peers whose copy was missing or older
+	Failed		uint64	`json:"failed"`		// Rounds that could not be completed
+}
+
+// Anti-entropy state of a replication manager
+type antiEntropy struct {
+	trees map[string]*merkleTree;	// Built for each peer that asked for one
+	mu sync.Mutex;
+	rounds atomic.Uint64;
+	diverged atomic.Uint64;
+	pushed atomic.Uint64;
+	failed atomic.Uint64;
+}
+
+// The DTO for requests of the hashes of tree nodes
+type merkleHashesRequest struct {
+	Peer	string	`json:"peer"`	// The node asking, whose shared keys the tree covers
+	Nodes	[]int	`json:"nodes"`
+}
+
+// The DTO for requests of the entries of leaves
+type merkleLeavesRequest struct {
+	Peer	string	`json:"peer"`
+	Leaves	[]int	`json:"leaves"`
+}
+
+// Returns the position of a key on the hash ring, as placed by the consistent hash
+func ringPosition (key string) uint32 {
+	sum := md5.Sum([]byte(key));
+	return binary.LittleEndian.Uint32(sum[:4]);
+}
+
+// Returns the tree index of the leaf covering a key
+func merkleLeaf (key string) int {
+	return 1 << merkleDepth + int(ringPosition(key) >> (32 - merkleDepth));
+}
+
+// Builds the entry of a copy of key. Timestamps identify the version of a key, except for mergeable
+// values, which change by merging, and values written before timestamps existed. Those are compared
+// by a hash of their content.
+func newMerkleEntry (key string, value interface{}, ts Timestamp, deleted bool) (merkleEntry, error) {
+	entry := merkleEntry{Key: key, Timestamp: ts, Deleted: deleted};
+
+	var version []byte;
+	switch value := value.(type) {
+	case *SiblingSet:
+		entry.Merge = true;
+		version = []byte("siblings:" + value.Context().Encode());
+	case Mergeable:
+		entry.Merge = true;
+		encoding, data, err := EncodeValue(value);
+		if err != nil {
+			return entry, err;
+		}
+		version = append([]byte(encoding + ":"), data...);
+	default:
+		if deleted {
+			version = []byte("deleted:" + ts.String());
+		} else if !ts.IsZero() {
+			version = []byte("set:" + ts.String());
+		} else {
+			// Written before timestamps existed
+			_, data, err := EncodeValue(value);
+			if err != nil {
+				return entry, err;
+			}
+			version = append([]byte("value:"), data...);
+		}
+	}
+
+	h := fnv.New64a();
+	h.Write([]byte(key));
+	h.Write([]byte{0});
+	h.Write(version);
+	entry.Digest = h.Sum64();
+	return entry, nil;
+}
+
+// Calls fn with the entries of the live items, disk tier items and tombstones of the cache. Entries are
+// built in batches, each under the read lock, so writes are not held up for the whole keyspace, and items
+// in the disk tier are not read back.
+func (c *Cache) merkleEntries (fn func(merkleEntry)) {
+	c.mu.RLock();
+	keys := make([]string, 0, len(c.items) + len(c.tombstones));
+	for key := range c.items {
+		keys = append(keys, key);
+	}
+	if c.disk != nil {
+		keys = append(keys, c.disk.keys()...);
+	}
+	for key := range c.tombstones {
+		keys = append(keys, key);
+	}
+	c.mu.RUnlock();
+
+	entries := make([]merkleEntry, 0, snapshotBatchSize);
+	for start := 0; start < len(keys); start += snapshotBatchSize {
+		end := min(start + snapshotBatchSize, len(keys));
+
+		entries = entries[:0];
+		c.mu.RLock();
+		now := time.Now().UnixNano();
+		for _, key := range keys[start:end] {
+			if entry, found := c.merkleEntry(key, now); found {
+				entries = append(entries, entry);
+			}
+		}
+		c.mu.RUnlock();
+
+		for _, entry := range entries {
+			fn(entry);
+		}
+	}
+}
+
+// Builds the entry of key from its live item, disk tier item or tombstone. Must hold c.mu for reading.
+func (c *Cache) merkleEntry (key string, now int64) (merkleEntry, bool) {
+	if item, found := c.items[key]; found {
+		if item.Expiration > 0 && item.Expiration < now {
+			return merkleEntry{}, false;
+		}
+
+		entry, err := newMerkleEntry(key, item.Value, item.Timestamp, false);
+		if err != nil {
+			log.Printf("Leaving key %s out of anti-entropy: %v", key, err);
+			return merkleEntry{}, false;
+		}
+		return entry, true;
+	}
+
+	if c.disk != nil {
+		if stored, found := c.disk.index[key]; found {
+			if stored.expiration > 0 && stored.expiration < now {
+				return merkleEntry{}, false;
+			}
+			return merkleEntry{Key: key, Digest: stored.digest, Timestamp: stored.timestamp, Merge: stored.merge}, true;
+		}
+	}
+
+	if ts, found := c.tombstones[key]; found {
+		entry, err := newMerkleEntry(key, nil, ts, true);
+		return entry, err == nil;
+	}
+
+	return merkleEntry{}, false;
+}
+
+// Returns the entries of the keys this node shares with each of the peers, where sharing a key
+// means both are among the nodes responsible for it
+func (rm *ReplicationManager) sharedEntries (peers []string) map[string][]merkleEntry {
+	placement := rm.nodeManager.KeyPlacement(rm.replicaCount+1);
+
+	shared := make(map[string][]merkleEntry, len(peers));
+	rm.cache.merkleEntries(func (entry merkleEntry) {
+		nodes := placement(entry.Key);
+		if !containsNode(nodes, rm.localNode) {
+			return;
+		}
+
+		for _, peer := range peers {
+			if containsNode(nodes, peer) {
+				shared[peer] = append(shared[peer], entry);
+			}
+		}
+	});
+
+	return shared;
+}
+
+// Builds the Merkle tree of entries. A leaf hashes its entries together regardless of their order
+// and an inner node hashes its children, so equal subtrees hold the same versions of the same keys.
+func buildMerkleTree (entries []merkleEntry) *merkleTree {
+	tree := &merkleTree{
+		hashes: make([]uint64, 2 << merkleDepth),
+		leaves: make(map[int][]merkleEntry),
+		built: time.Now(),
+	}
+
+	for _, entry := range entries {
+		leaf := merkleLeaf(entry.Key);
+		tree.leaves[leaf] = append(tree.leaves[leaf], entry);
+		tree.hashes[leaf] ^= entry.Digest;
+	}
+
+	buf := make([]byte, 16);
+	for i := 1 << merkleDepth - 1; i >= 1; i-- {
+		left, right := tree.hashes[2*i], tree.hashes[2*i+1];
+		if left == 0 && right == 0 {
+			continue;
+		}
+
+		binary.LittleEndian.PutUint64(buf[:8], left);
+		binary.LittleEndian.PutUint64(buf[8:], right);
+		h := fnv.New64a();
+		h.Write(buf);
+		tree.hashes[i] = h.Sum64();
+	}
+
+	return tree;
+}
+
+// Returns the tree of the keys shared with a peer that asked for it, reusing a recent one unless rebuild is set
+func (rm *ReplicationManager) peerTree (peer string, rebuild bool) *merkleTree {
+	rm.antiEntropy.mu.Lock();
+	defer rm.antiEntropy.mu.Unlock();
+
+	if tree, exists := rm.antiEntropy.trees[peer]; exists && !rebuild && time.Since(tree.built) < merkleTreeTTL {
+		return tree;
+	}
+
+	if rm.antiEntropy.trees == nil {
+		rm.antiEntropy.trees = make(map[string]*merkleTree);
+	}
+
+	tree := buildMerkleTree(rm.sharedEntries([]string{peer})[peer]);
+	rm.antiEntropy.trees[peer] = tree;
+	return tree;
+}
+
+// Starts a background goroutine that compares the keys this node shares with each peer every interval
+// and sends the peer the keys it is missing or holds an older version of. Every node does the same,
+// so keys the peer holds newer versions of are sent the other way. peers lists the other nodes that are up.
+func (rm *ReplicationManager) StartAntiEntropy (interval time.Duration, peers func() []string) {
+	go func () {
+		ticker := time.NewTicker(interval);
+		defer ticker.Stop();
+
+		for range ticker.C {
+			nodes := peers();
+			if len(nodes) == 0 {
+				continue;
+			}
+
+			shared := rm.sharedEntries(nodes);
+			for _, peer := range nodes {
+				if err := rm.syncPeer(peer, shared[peer]); err != nil {
+					log.Printf("Anti-entropy with node %s failed: %v", peer, err);
+					rm.antiEntropy.failed.Add(1);
+				}
+			}
+		}
+	}();
+}
+
+// Compares the tree of the keys shared with a peer with the peer's tree, descending only into
+// the subtrees that differ, and sends the peer the keys of the differing leaves it needs
+func (rm *ReplicationManager) syncPeer (peer string, entries []merkleEntry) error {
+	address := rm.nodeManager.GetNodeAddress(peer);
+	if address == "" {
+		return fmt.Errorf("unknown address");
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rm.timeout * 10);
+	defer cancel();
+
+	local := buildMerkleTree(entries);
+	rm.antiEntropy.rounds.Add(1);
+
+	indices := []int{1};
+	for {
+		var remote struct {
+			Hashes []uint64 `json:"hashes"`;
+		}
+		if err := rm.postMerkle(ctx, address + "/replicate/merkle", merkleHashesRequest{Peer: rm.localNode, Nodes: indices}, &remote); err != nil {
+			return err;
+		}
+		if len(remote.Hashes) != len(indices) {
+			return fmt.Errorf("expected %d hashes, got %d", len(indices), len(remote.Hashes));
+		}
+
+		var differing []int;
+		for i, index := range indices {
+			if local.hashes[index] != remote.Hashes[i] {
+				differing = append(differing, index);
+			}
+		}
+
+		if len(differing) == 0 {
+			return nil;
+		}
+
+		if differing[0] >= 1 << merkleDepth {
+			indices = differing;
+			break;
+		}
+
+		indices = indices[:0:0];
+		for _, index := range differing {
+			indices = append(indices, 2*index, 2*index+1);
+		}
+	}
+
+	rm.antiEntropy.diverged.Add(uint64(len(indices)));
+
+	var remote struct {
+		Entries []merkleEntry `json:"entries"`;
+	}
+	if err := rm.postMerkle(ctx, address + "/replicate/merkle/leaves", merkleLeavesRequest{Peer: rm.localNode, Leaves: indices}, &remote); err != nil {
+		return err;
+	}
+
+	theirs := make(map[string]merkleEntry, len(remote.Entries));
+	for _, entry := range remote.Entries {
+		theirs[entry.Key] = entry;
+	}
+
+	var keys []string;
+	var deletes []merkleEntry;
+	for _, index := range indices {
+		for _, entry := range local.leaves[index] {
+			other, found := theirs[entry.Key];
+			if found && (other.Digest == entry.Digest || (!entry.Merge && !entry.Timestamp.After(other.Timestamp))) {
+				continue;
+			}
+
+			if entry.Deleted {
+				deletes = append(deletes, entry);
+			} else {
+				keys = append(keys, entry.Key);
+			}
+		}
+	}
+
+	return rm.push(ctx, peer, address, keys, deletes);
+}
+
+// Sends the current copies of keys and the deletes of tombstoned keys to a peer
+func (rm *ReplicationManager) push (ctx context.Context, peer, address string, keys []string, deletes []merkleEntry) error {
+	var errs []error;
+
+	for start := 0; start < len(keys); start += handoffBatchSize {
+		end := min(start + handoffBatchSize, len(keys));
+
+		n, err := rm.sendHandoff(ctx, address, rm.cache.snapshotRecords(keys[start:end]));
+		rm.antiEntropy.pushed.Add(uint64(n));
+		if err != nil {
+			errs = append(errs, err);
+			break;
+		}
+	}
+
+	// Deletes go through the peer's replication queues, waiting for room until the round times out
+	deadline, ok := ctx.Deadline();
+	if !ok {
+		deadline = time.Now().Add(rm.timeout);
+	}
+
+	results := make(chan error, len(deletes));
+	for _, entry := range deletes {
+		key := entry.Key;
+		done := func (err error) {
+			if err != nil {
+				err = fmt.Errorf("delete of key %s: %w", key, err);
+			}
+			results <- err;
+		};
+		rm.enqueue(peer, queuedWrite{hint: hint{Op: hintOpDelete, Key: key, Timestamp: entry.Timestamp}, done: done}, deadline);
+	}
+
+	for range deletes {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err);
+				continue;
+			}
+			rm.antiEntropy.pushed.Add(1);
+		case <-ctx.Done():
+			return errors.Join(append(errs, ctx.Err())...);
+		}
+	}
+
+	return errors.Join(errs...);
+}
+
+// Posts an anti-entropy request to a peer and decodes its answer into response
+func (rm *ReplicationManager) postMerkle (ctx context.Context, url string, request, response interface{}) error {
+	jsonData, err := json.Marshal(request);
+	if err != nil {
+		return err;
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData));
+	if err != nil {
+		return err;
+	}
+	req.Header.Set("Content-Type", "application/json");
+
+	resp, err := rm.httpClient.Do(req);
+	if err != nil {
+		return err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError{resp.StatusCode};
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response);
+}
+
+// Handles requests of a peer for the hashes of nodes of the tree of the keys it shares with this node
+func (rm *ReplicationManager) HandleMerkleHashes (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var request merkleHashesRequest;
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	// A request for the root starts a new round
+	tree := rm.peerTree(request.Peer, len(request.Nodes) == 1 && request.Nodes[0] == 1);
+	hashes := make([]uint64, len(request.Nodes));
+	for i, index := range request.Nodes {
+		if index < 1 || index >= len(tree.hashes) {
+			http.Error(w, fmt.Sprintf("invalid tree node %d", index), http.StatusBadRequest);
+			return;
+		}
+		hashes[i] = tree.hashes[index];
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {"hashes": hashes});
+}
+
+// Handles requests of a peer for the entries of leaves of the tree of the keys it shares with this node
+func (rm *ReplicationManager) HandleMerkleLeaves (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var request merkleLeavesRequest;
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	tree := rm.peerTree(request.Peer, false);
+	entries := []merkleEntry{};
+	for _, index := range request.Leaves {
+		entries = append(entries, tree.leaves[index]...);
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {"entries": entries});
+}
+
+// Returns the anti-entropy counters
+func (rm *ReplicationManager) AntiEntropyStats () AntiEntropyStats {
+	return AntiEntropyStats{
+		Rounds: rm.antiEntropy.rounds.Load(),
+		Diverged: rm.antiEntropy.diverged.Load(),
+		Pushed: rm.antiEntropy.pushed.Load(),
+		Failed: rm.antiEntropy.failed.Load(),
+	}
+}
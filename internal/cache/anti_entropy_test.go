@@ -0,0 +1,311 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Returns the entries of copies of keys, each stamped with its wall time
+func testMerkleEntries (t *testing.T, walls map[string]int64) []merkleEntry {
+	t.Helper();
+
+	entries := make([]merkleEntry, 0, len(walls));
+	for key, wall := range walls {
+		entry, err := newMerkleEntry(key, "value", Timestamp{Wall: wall, Node: "n1"}, false);
+		if err != nil {
+			t.Fatalf("newMerkleEntry: %v", err);
+		}
+		entries = append(entries, entry);
+	}
+
+	return entries;
+}
+
+// Returns the indices of the tree nodes whose hashes differ
+func differingNodes (a, b *merkleTree) []int {
+	var differing []int;
+	for i := 1; i < len(a.hashes); i++ {
+		if a.hashes[i] != b.hashes[i] {
+			differing = append(differing, i);
+		}
+	}
+
+	return differing;
+}
+
+// Returns the indices of the nodes on the path from the leaf of key to the root
+func merklePath (key string) []int {
+	var path []int;
+	for i := merkleLeaf(key); i >= 1; i /= 2 {
+		path = append(path, i);
+	}
+	slices.Sort(path);
+
+	return path;
+}
+
+func TestMerkleTreeDiff (t *testing.T) {
+	base := map[string]int64{"a": 1, "b": 2, "c": 3, "d": 4, "user:1": 5, "user:2": 6};
+
+	// Returns a copy of base changed by fn
+	changed := func (fn func (walls map[string]int64)) map[string]int64 {
+		walls := make(map[string]int64, len(base));
+		for key, wall := range base {
+			walls[key] = wall;
+		}
+		fn(walls);
+		return walls;
+	};
+
+	tests := []struct {
+		name		string;
+		other		map[string]int64;
+		differing	[]int;	// Nodes whose hashes differ from those of base
+	}{
+		{"same versions", changed(func (walls map[string]int64) {}), nil},
+		{"newer version of a key", changed(func (walls map[string]int64) { walls["c"] = 30 }), merklePath("c")},
+		{"key missing", changed(func (walls map[string]int64) { delete(walls, "user:1") }), merklePath("user:1")},
+		{"extra key", changed(func (walls map[string]int64) { walls["e"] = 7 }), merklePath("e")},
+	};
+
+	tree := buildMerkleTree(testMerkleEntries(t, base));
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			other := buildMerkleTree(testMerkleEntries(t, tt.other));
+			if got := differingNodes(tree, other); !slices.Equal(got, tt.differing) {
+				t.Errorf("differing nodes = %v, want %v", got, tt.differing);
+			}
+		});
+	}
+}
+
+func TestMerkleTreeOrder (t *testing.T) {
+	entries := testMerkleEntries(t, map[string]int64{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5});
+	reversed := slices.Clone(entries);
+	slices.Reverse(reversed);
+
+	if differing := differingNodes(buildMerkleTree(entries), buildMerkleTree(reversed)); len(differing) != 0 {
+		t.Errorf("trees of the same entries in another order differ at %v", differing);
+	}
+}
+
+func TestEmptyMerkleTree (t *testing.T) {
+	for i, hash := range buildMerkleTree(nil).hashes {
+		if hash != 0 {
+			t.Fatalf("hash of node %d of an empty tree = %x", i, hash);
+		}
+	}
+
+	if tree := buildMerkleTree(testMerkleEntries(t, map[string]int64{"a": 1})); tree.hashes[1] == 0 {
+		t.Errorf("root hash of a non-empty tree is zero");
+	}
+}
+
+func TestMerkleEntryDigests (t *testing.T) {
+	stamp := Timestamp{Wall: 1, Node: "n1"};
+	entry := func (key string, value interface{}, ts Timestamp, deleted bool) merkleEntry {
+		e, err := newMerkleEntry(key, value, ts, deleted);
+		if err != nil {
+			t.Fatalf("newMerkleEntry: %v", err);
+		}
+		return e;
+	};
+	hll := func (items ...string) *HyperLogLog {
+		h := NewHyperLogLog();
+		for _, item := range items {
+			h.Add(item);
+		}
+		return h;
+	};
+
+	tests := []struct {
+		name	string;
+		a, b	merkleEntry;
+		equal	bool;
+	}{
+		{"same version", entry("k", "x", stamp, false), entry("k", "y", stamp, false), true},
+		{"other timestamp", entry("k", "x", stamp, false), entry("k", "x", Timestamp{Wall: 2, Node: "n1"}, false), false},
+		{"other key", entry("k", "x", stamp, false), entry("j", "x", stamp, false), false},
+		{"tombstone of the same timestamp", entry("k", "x", stamp, false), entry("k", nil, stamp, true), false},
+		{"unstamped values compared by content", entry("k", "x", Timestamp{}, false), entry("k", "x", Timestamp{}, false), true},
+		{"unstamped values that differ", entry("k", "x", Timestamp{}, false), entry("k", "y", Timestamp{}, false), false},
+		{"mergeable values compared by content", entry("k", hll("a"), stamp, false), entry("k", hll("a"), Timestamp{Wall: 2}, false), true},
+		{"mergeable values that differ", entry("k", hll("a"), stamp, false), entry("k", hll("a", "b"), stamp, false), false},
+	};
+
+	for _, tt := range tests {
+		if equal := tt.a.Digest == tt.b.Digest; equal != tt.equal {
+			t.Errorf("%s: equal digests = %v, want %v", tt.name, equal, tt.equal);
+		}
+	}
+}
+
+// Places every key on all nodes, at addresses filled in once the nodes are serving
+type testLocator struct {
+	nodes []string;
+	addresses map[string]string;
+}
+
+func (l *testLocator) GetNodesForKey (key string, count int) []string {
+	return l.nodes[:min(count, len(l.nodes))];
+}
+
+func (l *testLocator) GetNodeAddress (id string) string {
+	return l.addresses[id];
+}
+
+func (l *testLocator) IsNodeUp (id string) bool {
+	return l.addresses[id] != "";
+}
+
+func (l *testLocator) KeyPlacement (count int) func (key string) []string {
+	return func (key string) []string {
+		return l.GetNodesForKey(key, count);
+	};
+}
+
+// Starts replication managers for nodes replicating every key to each other
+func newTestReplicas (t *testing.T, nodes ...string) map[string]*ReplicationManager {
+	t.Helper();
+
+	locator := &testLocator{nodes: nodes, addresses: make(map[string]string)};
+	replicas := make(map[string]*ReplicationManager, len(nodes));
+
+	for _, node := range nodes {
+		c := NewCache("lru", 1000);
+		c.SetClock(NewHybridClock(node));
+		rm := NewReplicationManager(c, len(nodes) - 1, locator, node);
+
+		mux := http.NewServeMux();
+		rm.SetupHTTPHandlers(mux);
+		server := httptest.NewServer(mux);
+		t.Cleanup(server.Close);
+
+		locator.addresses[node] = server.URL;
+		replicas[node] = rm;
+	}
+
+	return replicas;
+}
+
+// Runs a round of anti-entropy from one node with a peer
+func syncReplica (t *testing.T, rm *ReplicationManager, peer string) {
+	t.Helper();
+
+	if err := rm.syncPeer(peer, rm.sharedEntries([]string{peer})[peer]); err != nil {
+		t.Fatalf("syncPeer: %v", err);
+	}
+}
+
+func TestAntiEntropyConvergence (t *testing.T) {
+	ts := func (wall int64, node string) Timestamp { return Timestamp{Wall: wall, Node: node} };
+
+	// Writes applied to a node before the replicas compare trees
+	type write struct {
+		node	string;
+		key		string;
+		value	string;	// Empty for a delete, "hll:<item>" to merge into a HyperLogLog
+		ts		Timestamp;
+	}
+
+	tests := []struct {
+		name	string;
+		writes	[]write;
+		want	map[string]interface{};	// Values both nodes end up with, nil for a deleted key
+		pushed	uint64;					// Keys sent by both rounds together
+	}{
+		{
+			name: "in sync",
+			writes: []write{{"n1", "a", "x", ts(1, "n1")}, {"n2", "a", "x", ts(1, "n1")}},
+			want: map[string]interface{}{"a": "x"},
+		},
+		{
+			name: "key missing on one node",
+			writes: []write{{"n1", "a", "x", ts(1, "n1")}, {"n1", "b", "y", ts(2, "n1")}, {"n2", "a", "x", ts(1, "n1")}},
+			want: map[string]interface{}{"a": "x", "b": "y"},
+			pushed: 1,
+		},
+		{
+			name: "newer version on either node wins",
+			writes: []write{
+				{"n1", "a", "new", ts(5, "n1")}, {"n2", "a", "old", ts(1, "n2")},
+				{"n1", "b", "old", ts(1, "n1")}, {"n2", "b", "new", ts(5, "n2")},
+			},
+			want: map[string]interface{}{"a": "new", "b": "new"},
+			pushed: 2,
+		},
+		{
+			name: "newer delete removes the key",
+			writes: []write{{"n1", "a", "x", ts(1, "n1")}, {"n2", "a", "x", ts(1, "n1")}, {"n1", "a", "", ts(2, "n1")}},
+			want: map[string]interface{}{"a": nil},
+			pushed: 1,
+		},
+		{
+			name: "older delete loses to a newer write",
+			writes: []write{{"n1", "a", "", ts(1, "n1")}, {"n2", "a", "x", ts(2, "n2")}},
+			want: map[string]interface{}{"a": "x"},
+			pushed: 1,
+		},
+		{
+			name: "mergeable values are merged both ways",
+			writes: []write{{"n1", "visitors", "hll:alice", ts(1, "n1")}, {"n2", "visitors", "hll:bob", ts(2, "n2")}},
+			want: map[string]interface{}{"visitors": uint64(2)},
+			pushed: 2,
+		},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			replicas := newTestReplicas(t, "n1", "n2");
+
+			for _, w := range tt.writes {
+				c := replicas[w.node].cache;
+				switch {
+				case w.value == "":
+					c.applyReplicatedDelete(w.key, w.ts);
+				case len(w.value) > 4 && w.value[:4] == "hll:":
+					hll := NewHyperLogLog();
+					hll.Add(w.value[4:]);
+					if _, err := c.MergeValue(w.key, hll, time.Hour, w.ts); err != nil {
+						t.Fatalf("MergeValue: %v", err);
+					}
+				default:
+					c.applyReplicatedSet(w.key, w.value, time.Hour, w.ts);
+				}
+			}
+
+			syncReplica(t, replicas["n1"], "n2");
+			syncReplica(t, replicas["n2"], "n1");
+
+			pushed := replicas["n1"].AntiEntropyStats().Pushed + replicas["n2"].AntiEntropyStats().Pushed;
+			if pushed != tt.pushed {
+				t.Errorf("pushed %d keys, want %d", pushed, tt.pushed);
+			}
+
+			for node, rm := range replicas {
+				for key, want := range tt.want {
+					result := rm.cache.peekStamped(key);
+					value := result.Value;
+					if hll, ok := value.(*HyperLogLog); ok {
+						value = hll.Count();
+					}
+
+					if result.Found != (want != nil) || (want != nil && value != want) {
+						t.Errorf("%s: %s = %v (found %v), want %v", node, key, value, result.Found, want);
+					}
+				}
+			}
+
+			// A round after converging finds nothing to repair
+			diverged := replicas["n1"].AntiEntropyStats().Diverged;
+			syncReplica(t, replicas["n1"], "n2");
+			if stats := replicas["n1"].AntiEntropyStats(); stats.Diverged != diverged {
+				t.Errorf("replicas still diverge after syncing: %+v", stats);
+			}
+		});
+	}
+}
@@ -0,0 +1,425 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When the append-only log is flushed to stable storage
+const (
+	FsyncAlways = "always";		// After every write, slowest but loses nothing
+	FsyncEverySec = "everysec";	// Once per second, loses at most a second of writes
+	FsyncNo = "no";				// Left to the operating system
+)
+
+// Operations recorded in the append-only log
+const (
+	logOpSet = "set";
+	logOpDelete = "del";
+	logOpLease = "lease";	// The value is the JSON encoded lease of the lock named by the key
+)
+
+// A single write recorded in the append-only log
+type logEntry struct {
+	Op			string			`json:"op"`
+	Key			string			`json:"key"`
+	Value		json.RawMessage	`json:"value,omitempty"`
+	Type		string			`json:"type,omitempty"`	// Encoding of the value, see valueEncoding
+	Expiration	int64			`json:"expiration,omitempty"`
+	Version		uint64			`json:"version,omitempty"`
+	Timestamp	*Timestamp		`json:"timestamp,omitempty"`	// Of sets and of deletes that left a tombstone
+}
+
+// AppendOnlyLog records every write to the cache so writes since the last snapshot survive a crash.
+// The log is split into numbered segments next to the snapshot file. Every snapshot starts a new
+// segment, and the segments it covers are removed once the snapshot is safely on disk.
+type AppendOnlyLog struct {
+	basePath string;
+	fsyncPolicy string;
+	keyring *Keyring;	// Encrypts every entry when set
+	file *os.File;
+	seq int;	// Sequence number of the segment being written
+	size int64;	// Bytes in all live segments
+	dirty bool;	// Written since the last fsync
+	stopping chan struct{};
+	done chan struct{};
+	mu sync.Mutex;
+}
+
+// Checks if the fsync policy is one of the supported ones
+func ValidFsyncPolicy (policy string) bool {
+	return policy == FsyncAlways || policy == FsyncEverySec || policy == FsyncNo;
+}
+
+// Opens a new segment after any existing ones for the snapshot at basePath
+func openAppendOnlyLog (basePath, fsyncPolicy string, keyring *Keyring) (*AppendOnlyLog, error) {
+	segments, err := logSegments(basePath);
+	if err != nil {
+		return nil, err;
+	}
+
+	aof := &AppendOnlyLog{
+		basePath: basePath,
+		fsyncPolicy: fsyncPolicy,
+		keyring: keyring,
+		stopping: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	for _, seq := range segments {
+		if info, err := os.Stat(aof.segmentPath(seq)); err == nil {
+			aof.size += info.Size();
+		}
+		aof.seq = seq;
+	}
+
+	if err := aof.openSegment(aof.seq + 1); err != nil {
+		return nil, err;
+	}
+
+	go aof.syncLoop();
+
+	return aof, nil;
+}
+
+// Returns the path of a log segment
+func (aof *AppendOnlyLog) segmentPath (seq int) string {
+	return fmt.Sprintf("%s.aof.%d", aof.basePath, seq);
+}
+
+// Creates a segment and makes it the one being written. Must hold aof.mu or be the only user.
+func (aof *AppendOnlyLog) openSegment (seq int) error {
+	file, err := os.OpenFile(aof.segmentPath(seq), os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644);
+	if err != nil {
+		return fmt.Errorf("failed to open log segment: %w", err);
+	}
+
+	aof.file = file;
+	aof.seq = seq;
+	return nil;
+}
+
+// Records a write to the key. Called by the cache with its lock held, so entries are in write order.
+func (aof *AppendOnlyLog) record (event, key string, item CacheItem, found bool) {
+	entry := logEntry{Op: logOpDelete, Key: key};
+	if event == EventDelete && !item.Timestamp.IsZero() {
+		entry.Timestamp = &item.Timestamp;
+	}
+
+	if event == EventSet && found {
+		encoding, value, err := EncodeValue(item.Value);
+		if err != nil {
+			log.Printf("Error encoding log entry for key %s: %v", key, err);
+			return;
+		}
+
+		entry = logEntry{
+			Op: logOpSet,
+			Key: key,
+			Value: value,
+			Type: encoding,
+			Expiration: item.Expiration,
+			Version: item.Version,
+			Timestamp: &item.Timestamp,
+		}
+	}
+
+	aof.append(entry);
+}
+
+// Records a change of the lease of a lock. Called by the cache with its lock held.
+func (aof *AppendOnlyLog) recordLease (lease Lease) {
+	value, err := json.Marshal(lease);
+	if err != nil {
+		log.Printf("Error encoding log entry for lock %s: %v", lease.Name, err);
+		return;
+	}
+
+	aof.append(logEntry{Op: logOpLease, Key: lease.Name, Value: value});
+}
+
+// Appends an entry to the segment being written
+func (aof *AppendOnlyLog) append (entry logEntry) {
+	key := entry.Key;
+	line, err := json.Marshal(entry);
+	if err != nil {
+		log.Printf("Error encoding log entry for key %s: %v", key, err);
+		return;
+	}
+
+	if aof.keyring != nil {
+		line, err = aof.keyring.encryptLine(line);
+		if err != nil {
+			log.Printf("Error encrypting log entry for key %s: %v", key, err);
+			return;
+		}
+	}
+	line = append(line, '\n');
+
+	aof.mu.Lock();
+	defer aof.mu.Unlock();
+
+	if aof.file == nil {
+		return;
+	}
+
+	if _, err := aof.file.Write(line); err != nil {
+		log.Printf("Error appending to log: %v", err);
+		return;
+	}
+	aof.size += int64(len(line));
+	aof.dirty = true;
+
+	if aof.fsyncPolicy == FsyncAlways {
+		aof.sync();
+	}
+}
+
+// Flushes the segment being written to stable storage. Must hold aof.mu.
+func (aof *AppendOnlyLog) sync () {
+	if !aof.dirty || aof.file == nil {
+		return;
+	}
+
+	if err := aof.file.Sync(); err != nil {
+		log.Printf("Error syncing log: %v", err);
+		return;
+	}
+	aof.dirty = false;
+}
+
+// Syncs the log once per second under the everysec policy
+func (aof *AppendOnlyLog) syncLoop () {
+	defer close(aof.done);
+
+	if aof.fsyncPolicy != FsyncEverySec {
+		<-aof.stopping;
+		return;
+	}
+
+	ticker := time.NewTicker(time.Second);
+	defer ticker.Stop();
+
+	for {
+		select {
+		case <-ticker.C:
+			aof.mu.Lock();
+			aof.sync();
+			aof.mu.Unlock();
+		case <-aof.stopping:
+			return;
+		}
+	}
+}
+
+// Starts a new segment and returns the sequence number of the last one
+// covered by a snapshot taken now. Called with the cache lock held.
+func (aof *AppendOnlyLog) rotate () (int, error) {
+	aof.mu.Lock();
+	defer aof.mu.Unlock();
+
+	covered := aof.seq;
+	aof.sync();
+
+	if aof.file != nil {
+		if err := aof.file.Close(); err != nil {
+			log.Printf("Error closing log segment: %v", err);
+		}
+	}
+
+	if err := aof.openSegment(covered + 1); err != nil {
+		aof.file = nil;
+		return covered, err;
+	}
+
+	return covered, nil;
+}
+
+// Removes the segments up to and including seq, once a snapshot covering them is on disk
+func (aof *AppendOnlyLog) removeSegmentsUpTo (seq int) {
+	segments, err := logSegments(aof.basePath);
+	if err != nil {
+		log.Printf("Error listing log segments: %v", err);
+		return;
+	}
+
+	aof.mu.Lock();
+	defer aof.mu.Unlock();
+
+	// Oldest first, so a crash midway leaves only the newest covered segments behind
+	for _, s := range segments {
+		if s > seq {
+			break;
+		}
+
+		path := aof.segmentPath(s);
+		info, statErr := os.Stat(path);
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing log segment %s: %v", path, err);
+			return;
+		}
+		if statErr == nil {
+			aof.size -= info.Size();
+		}
+	}
+}
+
+// Returns the size of all live segments in bytes
+func (aof *AppendOnlyLog) Size () int64 {
+	aof.mu.Lock();
+	defer aof.mu.Unlock();
+
+	return aof.size;
+}
+
+// Syncs and closes the log
+func (aof *AppendOnlyLog) Close () {
+	close(aof.stopping);
+	<-aof.done;
+
+	aof.mu.Lock();
+	defer aof.mu.Unlock();
+
+	if aof.file != nil {
+		aof.sync();
+		aof.file.Close();
+		aof.file = nil;
+	}
+}
+
+// Returns the sequence numbers of the log segments of the snapshot at basePath, in order
+func logSegments (basePath string) ([]int, error) {
+	matches, err := filepath.Glob(basePath + ".aof.*");
+	if err != nil {
+		return nil, err;
+	}
+
+	segments := make([]int, 0, len(matches));
+	for _, match := range matches {
+		seq, err := strconv.Atoi(strings.TrimPrefix(match, basePath + ".aof."));
+		if err != nil {
+			continue;
+		}
+		segments = append(segments, seq);
+	}
+	sort.Ints(segments);
+
+	return segments, nil;
+}
+
+// Applies the log segments of the snapshot at basePath to the cache, oldest first.
+// A torn entry at the end of a segment (from a crash mid-write) ends that segment.
+// Encrypted entries are decrypted with the keyring. Returns the number of entries applied.
+func replayAppendOnlyLog (basePath string, c *Cache, keyring *Keyring) (int, error) {
+	segments, err := logSegments(basePath);
+	if err != nil {
+		return 0, err;
+	}
+
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	applied := 0;
+	now := time.Now().UnixNano();
+
+	for _, seq := range segments {
+		path := fmt.Sprintf("%s.aof.%d", basePath, seq);
+		file, err := os.Open(path);
+		if err != nil {
+			return applied, fmt.Errorf("failed to open log segment: %w", err);
+		}
+
+		scanner := bufio.NewScanner(file);
+		scanner.Buffer(make([]byte, 64 * 1024), 64 * 1024 * 1024);
+
+		line := 0;
+		for scanner.Scan() {
+			line++;
+
+			data, err := keyring.decryptLine(scanner.Bytes());
+			if err != nil {
+				log.Printf("Ignoring the rest of log segment %s after unreadable entry on line %d: %v", path, line, err);
+				break;
+			}
+
+			var entry logEntry;
+			if err := json.Unmarshal(data, &entry); err != nil {
+				log.Printf("Ignoring the rest of log segment %s after invalid entry on line %d: %v", path, line, err);
+				break;
+			}
+
+			if err := c.applyLogEntry(entry, now); err != nil {
+				log.Printf("Skipping log entry for key %s in %s: %v", entry.Key, path, err);
+				continue;
+			}
+			applied++;
+		}
+
+		if err := scanner.Err(); err != nil {
+			log.Printf("Error reading log segment %s: %v", path, err);
+		}
+		file.Close();
+	}
+
+	return applied, nil;
+}
+
+// Applies a single log entry during replay. Must hold c.mu.
+func (c *Cache) applyLogEntry (entry logEntry, now int64) error {
+	if entry.Op == logOpLease {
+		var lease Lease;
+		if err := json.Unmarshal(entry.Value, &lease); err != nil {
+			return err;
+		}
+		c.applyLease(lease);
+		return nil;
+	}
+
+	if entry.Op == logOpDelete || (entry.Expiration > 0 && entry.Expiration < now) {
+		delete(c.items, entry.Key);
+		delete(c.accessCount, entry.Key);
+		if entry.Op == logOpDelete && entry.Timestamp != nil {
+			c.clock.Observe(*entry.Timestamp);
+			c.tombstones[entry.Key] = *entry.Timestamp;
+		}
+		return nil;
+	}
+
+	if entry.Op != logOpSet {
+		return fmt.Errorf("unknown operation %q", entry.Op);
+	}
+
+	value, err := decodeValue(entry.Type, entry.Value);
+	if err != nil {
+		return err;
+	}
+
+	var ts Timestamp;
+	if entry.Timestamp != nil {
+		ts = *entry.Timestamp;
+		c.clock.Observe(ts);
+	}
+
+	c.items[entry.Key] = CacheItem{
+		Value: value,
+		Expiration: entry.Expiration,
+		LastAccess: now,
+		Version: c.restoredVersion(entry.Version),
+		Timestamp: ts,
+	}
+	delete(c.tombstones, entry.Key);
+	if _, found := c.accessCount[entry.Key]; !found {
+		c.accessCount[entry.Key] = 1;
+	}
+
+	return nil;
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Opens an append-only log in a temporary directory, returning it with the snapshot path it belongs to
+func openTestLog (t *testing.T, keyring *Keyring) (*AppendOnlyLog, string) {
+	t.Helper();
+
+	basePath := filepath.Join(t.TempDir(), "cache.snap");
+	aof, err := openAppendOnlyLog(basePath, FsyncAlways, keyring);
+	if err != nil {
+		t.Fatalf("openAppendOnlyLog: %v", err);
+	}
+
+	return aof, basePath;
+}
+
+// Replays the log of the snapshot at basePath into a new cache
+func replayTestLog (t *testing.T, basePath string, keyring *Keyring) (*Cache, int) {
+	t.Helper();
+
+	c := NewCache("lru", 100);
+	applied, err := replayAppendOnlyLog(basePath, c, keyring);
+	if err != nil {
+		t.Fatalf("replayAppendOnlyLog: %v", err);
+	}
+
+	return c, applied;
+}
+
+func TestAppendOnlyLogRoundTrip (t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixNano();
+	past := time.Now().Add(-time.Hour).UnixNano();
+	stamp := func (wall int64) Timestamp { return Timestamp{Wall: wall, Node: "node-1"} };
+
+	type write struct {
+		event	string;
+		key		string;
+		item	CacheItem;
+		found	bool;
+	}
+
+	tests := []struct {
+		name		string;
+		writes		[]write;
+		leases		[]Lease;
+		items		map[string]interface{};	// Values of the live items after replay
+		versions	map[string]uint64;
+		tombstones	map[string]Timestamp;
+	}{
+		{
+			name: "typed values",
+			writes: []write{
+				{EventSet, "string", CacheItem{Value: "hello", Version: 1, Timestamp: stamp(1)}, true},
+				{EventSet, "int", CacheItem{Value: 42, Version: 2, Timestamp: stamp(2)}, true},
+				{EventSet, "bytes", CacheItem{Value: []byte("raw"), Expiration: future, Version: 3, Timestamp: stamp(3)}, true},
+				{EventSet, "float", CacheItem{Value: float32(1.5), Version: 4, Timestamp: stamp(4)}, true},
+			},
+			items: map[string]interface{}{"string": "hello", "int": 42, "bytes": []byte("raw"), "float": float32(1.5)},
+			versions: map[string]uint64{"string": 1, "int": 2, "bytes": 3, "float": 4},
+			tombstones: map[string]Timestamp{},
+		},
+		{
+			name: "later writes win",
+			writes: []write{
+				{EventSet, "key", CacheItem{Value: "old", Version: 1, Timestamp: stamp(1)}, true},
+				{EventSet, "key", CacheItem{Value: "new", Version: 2, Timestamp: stamp(2)}, true},
+			},
+			items: map[string]interface{}{"key": "new"},
+			versions: map[string]uint64{"key": 2},
+			tombstones: map[string]Timestamp{},
+		},
+		{
+			name: "delete leaves a tombstone",
+			writes: []write{
+				{EventSet, "key", CacheItem{Value: "value", Version: 1, Timestamp: stamp(1)}, true},
+				{EventDelete, "key", CacheItem{Timestamp: stamp(2)}, false},
+			},
+			items: map[string]interface{}{},
+			tombstones: map[string]Timestamp{"key": stamp(2)},
+		},
+		{
+			name: "set after delete clears the tombstone",
+			writes: []write{
+				{EventDelete, "key", CacheItem{Timestamp: stamp(1)}, false},
+				{EventSet, "key", CacheItem{Value: "back", Version: 3, Timestamp: stamp(2)}, true},
+			},
+			items: map[string]interface{}{"key": "back"},
+			versions: map[string]uint64{"key": 3},
+			tombstones: map[string]Timestamp{},
+		},
+		{
+			name: "evictions and expired sets remove the key",
+			writes: []write{
+				{EventSet, "evicted", CacheItem{Value: 1, Version: 1, Timestamp: stamp(1)}, true},
+				{EventEvict, "evicted", CacheItem{}, false},
+				{EventSet, "expired", CacheItem{Value: 2, Expiration: past, Version: 2, Timestamp: stamp(2)}, true},
+			},
+			items: map[string]interface{}{},
+			tombstones: map[string]Timestamp{},
+		},
+		{
+			name: "leases",
+			leases: []Lease{
+				{Name: "lock", Owner: "a", Token: 1, Version: 1, Expiration: future},
+				{Name: "lock", Owner: "b", Token: 2, Version: 2, Expiration: future},
+			},
+			items: map[string]interface{}{},
+			tombstones: map[string]Timestamp{},
+		},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			aof, basePath := openTestLog(t, nil);
+			for _, w := range tt.writes {
+				aof.record(w.event, w.key, w.item, w.found);
+			}
+			for _, lease := range tt.leases {
+				aof.recordLease(lease);
+			}
+			aof.Close();
+
+			c, applied := replayTestLog(t, basePath, nil);
+			if want := len(tt.writes) + len(tt.leases); applied != want {
+				t.Errorf("applied %d entries, want %d", applied, want);
+			}
+
+			items := make(map[string]interface{});
+			for key, item := range c.items {
+				items[key] = item.Value;
+				if item.Version != tt.versions[key] {
+					t.Errorf("version of %q = %d, want %d", key, item.Version, tt.versions[key]);
+				}
+			}
+			if !reflect.DeepEqual(items, tt.items) {
+				t.Errorf("items = %#v, want %#v", items, tt.items);
+			}
+			if !reflect.DeepEqual(c.tombstones, tt.tombstones) {
+				t.Errorf("tombstones = %v, want %v", c.tombstones, tt.tombstones);
+			}
+
+			if len(tt.leases) > 0 {
+				want := tt.leases[len(tt.leases) - 1];
+				if got := c.leases[want.Name]; got != want {
+					t.Errorf("lease = %+v, want %+v", got, want);
+				}
+			}
+		});
+	}
+}
+
+func TestAppendOnlyLogTornEntry (t *testing.T) {
+	aof, basePath := openTestLog(t, nil);
+	aof.record(EventSet, "a", CacheItem{Value: "first", Version: 1}, true);
+	aof.record(EventSet, "b", CacheItem{Value: "second", Version: 2}, true);
+	path := aof.segmentPath(aof.seq);
+	aof.Close();
+
+	// A crash in the middle of a write leaves half an entry at the end of the segment
+	file, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY, 0644);
+	if err != nil {
+		t.Fatal(err);
+	}
+	file.WriteString(`{"op":"set","key":"c","val`);
+	file.Close();
+
+	// Entries in later segments are still applied
+	next, err := openAppendOnlyLog(basePath, FsyncAlways, nil);
+	if err != nil {
+		t.Fatal(err);
+	}
+	next.record(EventSet, "d", CacheItem{Value: "fourth", Version: 4}, true);
+	next.Close();
+
+	c, applied := replayTestLog(t, basePath, nil);
+	if applied != 3 {
+		t.Errorf("applied %d entries, want 3", applied);
+	}
+	for _, key := range []string{"a", "b", "d"} {
+		if _, found := c.items[key]; !found {
+			t.Errorf("%q missing after replay", key);
+		}
+	}
+	if _, found := c.items["c"]; found {
+		t.Errorf("torn entry for \"c\" was applied");
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// Largest filter that can be created or accepted from another node, 32 MiB of bits
+const maxBloomBits = 1 << 28;
+
+var ErrBloomTooLarge = errors.New("bloom filter too large, use a smaller capacity or a larger error rate");
+
+// BloomFilter is a probabilistic set with no false negatives and a bounded false-positive rate
+type BloomFilter struct {
+	Bits	[]uint64	`json:"bits"`
+	M		uint64		`json:"m"`	// Number of bits
+	K		uint32		`json:"k"`	// Number of hash functions
+}
+
+// Creates a bloom filter sized for the expected number of items and false-positive rate
+func NewBloomFilter (capacity uint64, errorRate float64) (*BloomFilter, error) {
+	if capacity == 0 {
+		return nil, fmt.Errorf("capacity must be positive");
+	}
+	if errorRate <= 0 || errorRate >= 1 {
+		return nil, fmt.Errorf("error rate must be between 0 and 1");
+	}
+
+	// m = -n ln(p) / (ln 2)^2 and k = (m / n) ln 2
+	bits := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2));
+	if bits > maxBloomBits {
+		return nil, ErrBloomTooLarge;
+	}
+	m := uint64(bits);
+	k := uint32(math.Max(1, math.Round(float64(m) / float64(capacity) * math.Ln2)));
+
+	return &BloomFilter{
+		Bits: make([]uint64, (m + 63) / 64),
+		M: m,
+		K: k,
+	}, nil;
+}
+
+// Adds an item to the filter, returns false if it was possibly already present
+func (bf *BloomFilter) Add (item string) bool {
+	h1, h2 := bloomHashes(item);
+	added := false;
+
+	for i := uint32(0); i < bf.K; i++ {
+		bit := (h1 + uint64(i) * h2) % bf.M;
+		mask := uint64(1) << (bit % 64);
+
+		if bf.Bits[bit / 64] & mask == 0 {
+			bf.Bits[bit / 64] |= mask;
+			added = true;
+		}
+	}
+
+	return added;
+}
+
+// Checks if an item is possibly in the filter
+func (bf *BloomFilter) Check (item string) bool {
+	h1, h2 := bloomHashes(item);
+
+	for i := uint32(0); i < bf.K; i++ {
+		bit := (h1 + uint64(i) * h2) % bf.M;
+		if bf.Bits[bit / 64] & (uint64(1) << (bit % 64)) == 0 {
+			return false;
+		}
+	}
+
+	return true;
+}
+
+// Merges another bloom filter with the same parameters into this one
+func (bf *BloomFilter) Merge (other Mergeable) error {
+	o, ok := other.(*BloomFilter);
+	if !ok {
+		return ErrWrongType;
+	}
+
+	if o.M != bf.M || o.K != bf.K || len(o.Bits) != len(bf.Bits) {
+		return fmt.Errorf("cannot merge bloom filters with different parameters");
+	}
+
+	for i := range bf.Bits {
+		bf.Bits[i] |= o.Bits[i];
+	}
+
+	return nil;
+}
+
+// Returns a deep copy of the filter
+func (bf *BloomFilter) Clone () Mergeable {
+	bits := make([]uint64, len(bf.Bits));
+	copy(bits, bf.Bits);
+
+	return &BloomFilter{Bits: bits, M: bf.M, K: bf.K};
+}
+
+// Returns the value type name of the filter
+func (bf *BloomFilter) Type () string {
+	return ValueTypeBloom;
+}
+
+// Validates a filter decoded from disk or from another node
+func (bf *BloomFilter) validate () error {
+	if bf.M == 0 || bf.K == 0 || uint64(len(bf.Bits)) != (bf.M + 63) / 64 {
+		return fmt.Errorf("invalid bloom filter");
+	}
+	if bf.M > maxBloomBits {
+		return ErrBloomTooLarge;
+	}
+
+	return nil;
+}
+
+// Derives the two base hashes used for double hashing
+func bloomHashes (item string) (uint64, uint64) {
+	hasher := fnv.New64a();
+	hasher.Write([]byte(item));
+	h := hasher.Sum64();
+
+	// Make sure the second hash is odd so probing covers all the bits
+	return h, mix64(h) | 1;
+}
+
+// Scrambles the bits of a 64-bit hash (splitmix64 finalizer)
+func mix64 (h uint64) uint64 {
+	h ^= h >> 30;
+	h *= 0xbf58476d1ce4e5b9;
+	h ^= h >> 27;
+	h *= 0x94d049bb133111eb;
+	h ^= h >> 31;
+	return h;
+}
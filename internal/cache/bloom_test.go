@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewBloomFilterSizing (t *testing.T) {
+	tests := []struct {
+		capacity	uint64;
+		errorRate	float64;
+		err			error;	// Only checked with errors.Is when set
+		valid		bool;
+	}{
+		{10000, 0.01, nil, true},
+		{1, 0.5, nil, true},
+		{28000000, 0.01, nil, true},
+		{0, 0.01, nil, false},
+		{100, 0, nil, false},
+		{100, 1, nil, false},
+		{30000000, 0.01, ErrBloomTooLarge, false},
+		{1000000, 1e-300, ErrBloomTooLarge, false},
+		{1 << 62, 0.5, ErrBloomTooLarge, false},
+	};
+
+	for _, tt := range tests {
+		bf, err := NewBloomFilter(tt.capacity, tt.errorRate);
+		if (err == nil) != tt.valid || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("NewBloomFilter(%d, %g): err = %v", tt.capacity, tt.errorRate, err);
+			continue;
+		}
+		if tt.valid && bf.validate() != nil {
+			t.Errorf("NewBloomFilter(%d, %g) created an invalid filter: %v", tt.capacity, tt.errorRate, bf.validate());
+		}
+	}
+}
+
+func TestBloomFilterErrorRate (t *testing.T) {
+	bf, err := NewBloomFilter(1000, 0.01);
+	if err != nil {
+		t.Fatalf("NewBloomFilter: %v", err);
+	}
+
+	for i := 0; i < 1000; i++ {
+		bf.Add(fmt.Sprintf("in-%d", i));
+	}
+	for i := 0; i < 1000; i++ {
+		if !bf.Check(fmt.Sprintf("in-%d", i)) {
+			t.Fatalf("added item in-%d not found", i);
+		}
+	}
+
+	falsePositives := 0;
+	for i := 0; i < 10000; i++ {
+		if bf.Check(fmt.Sprintf("out-%d", i)) {
+			falsePositives++;
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives in 10000 checks, want about 100", falsePositives);
+	}
+}
+
+func TestBloomFilterMerge (t *testing.T) {
+	a, _ := NewBloomFilter(100, 0.01);
+	b, _ := NewBloomFilter(100, 0.01);
+	a.Add("alice");
+	b.Add("bob");
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge: %v", err);
+	}
+	if !a.Check("alice") || !a.Check("bob") {
+		t.Errorf("merged filter lost an item");
+	}
+
+	other, _ := NewBloomFilter(1000, 0.01);
+	if err := a.Merge(other); err == nil {
+		t.Errorf("merged filters with different parameters");
+	}
+	if err := a.Merge(NewHyperLogLog()); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Merge of a HyperLogLog: err = %v, want ErrWrongType", err);
+	}
+}
+
+func TestDecodeBloomFilter (t *testing.T) {
+	tests := []struct {
+		name	string;
+		data	string;
+		valid	bool;
+	}{
+		{"valid", `{"bits":[0,0],"m":100,"k":7}`, true},
+		{"no bits", `{"bits":[],"m":0,"k":7}`, false},
+		{"no hash functions", `{"bits":[0,0],"m":100,"k":0}`, false},
+		{"bits shorter than m", `{"bits":[0],"m":100,"k":7}`, false},
+		{"larger than the limit", fmt.Sprintf(`{"bits":[],"m":%d,"k":7}`, uint64(maxBloomBits + 1)), false},
+	};
+
+	for _, tt := range tests {
+		if _, err := DecodeMergeable(ValueTypeBloom, []byte(tt.data)); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid);
+		}
+	}
+}
+
+func TestBloomAddTooLarge (t *testing.T) {
+	c := NewCache("lru", 100);
+
+	if _, err := c.BloomAdd("seen", []string{"a"}, 1 << 40, 0.01, time.Hour); !errors.Is(err, ErrBloomTooLarge) {
+		t.Fatalf("BloomAdd: err = %v, want ErrBloomTooLarge", err);
+	}
+	if result := c.peekStamped("seen"); result.Found {
+		t.Errorf("oversized filter was stored");
+	}
+}
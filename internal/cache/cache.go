@@ -5,10 +5,20 @@ import (
 	"time"
 )
 
+// Keyspace event types passed to the event listener
+const (
+	EventSet = "set";
+	EventDelete = "delete";
+	EventExpire = "expire";
+	EventEvict = "evict";
+)
+
 type CacheItem struct {
 	Value			interface{}
 	Expiration		int64
 	LastAccess 		int64
+	Version			uint64 // Changes on every write, used to watch for changes
+	Timestamp		Timestamp // When and on which node the value was written, orders writes across nodes
 }
 
 type Cache struct {
@@ -17,6 +27,20 @@ type Cache struct {
 	evictionType string // "lru" or "lfu"
 	maxItems int
 	accessCount map[string]int // Track frequency of access for LFU
+	leases map[string]Lease // Distributed lock leases by lock name
+	listener func(event, key string) // Notified of keyspace events, must not block
+	watchers map[string][]chan struct{} // Closed on the next change of the watched key
+	version uint64 // Last version handed out to a write
+	aof *AppendOnlyLog // Records every write when append-only persistence is enabled
+	changes uint64 // Writes since the last snapshot, drives the save rules
+	disk *diskTier // Holds items evicted from memory when the disk tier is enabled
+	memoryHits uint64 // Reads served from memory
+	memoryEvictions uint64 // Items evicted from memory, into the disk tier if enabled
+	misses uint64 // Reads of keys in no tier
+	clock *HybridClock // Stamps writes made on this node
+	tombstones map[string]Timestamp // Timestamps of deleted keys, so older writes of them are rejected
+	tombstoneTTL time.Duration // How long tombstones are kept
+	siblingPrefixes []string // Keys starting with these keep concurrent writes as siblings
 }
 
 // Creates a new cache instance and returns a pointer to that cache
@@ -26,11 +50,48 @@ func NewCache (evictionType string, maxItems int) *Cache {
 		evictionType: evictionType,
 		maxItems: maxItems,
 		accessCount: make(map[string]int), 
+		leases: make(map[string]Lease),
+		watchers: make(map[string][]chan struct{}),
+		clock: NewHybridClock(""),
+		tombstones: make(map[string]Timestamp),
+		tombstoneTTL: defaultTombstoneTTL,
+	}
+}
+
+// Sets the listener notified of keyspace events.
+// The listener is called with the cache lock held, so it must not block or call back into the cache.
+func (c *Cache) SetEventListener (listener func(event, key string)) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.listener = listener;
+}
+
+// Notifies the watchers of the key and the listener of a keyspace event. Must hold c.mu.
+func (c *Cache) emit (event, key string) {
+	c.changes++;
+	c.notifyWatchers(key);
+
+	if c.aof != nil {
+		item, found := c.items[key];
+		if !found {
+			item.Timestamp = c.tombstones[key];
+		}
+		c.aof.record(event, key, item, found);
+	}
+
+	if c.listener != nil {
+		c.listener(event, key);
 	}
 }
 
 // Adds a new key-value pair to the cache
 func (c *Cache) Set (key string, value interface{}, ttl time.Duration) {
+	c.SetStamped(key, value, ttl);
+}
+
+// Adds a new key-value pair to the cache and returns the timestamp of the write
+func (c *Cache) SetStamped (key string, value interface{}, ttl time.Duration) Timestamp {
 	c.mu.Lock();
 	defer c.mu.Unlock();
 
@@ -39,12 +100,21 @@ func (c *Cache) Set (key string, value interface{}, ttl time.Duration) {
 		c.evict();
 	}
 
+	c.removeFromDisk(key);
+	delete(c.tombstones, key);
+
+	stamp := c.clock.Now();
 	expiration := time.Now().Add(ttl).UnixNano();
 	c.items[key] = CacheItem{
 		Value: value,
 		Expiration: expiration,
 		LastAccess: time.Now().UnixNano(),
+		Version: c.nextVersion(),
+		Timestamp: stamp,
 	}
+	c.emit(EventSet, key);
+
+	return stamp;
 }
 
 // Get a value from the cache
@@ -52,18 +122,29 @@ func (c *Cache) Get (key string) (interface{}, bool) {
 	c.mu.Lock();
 	defer c.mu.Unlock();
 
+	return c.get(key);
+}
+
+// Get a value from the cache, promoting it from the disk tier if it was evicted from memory. Must hold c.mu.
+func (c *Cache) get (key string) (interface{}, bool) {
 	item, found := c.items[key];
 
 	if !found {
-		return nil, false;
-	}
-
-	// Check if the item is expired
-	if item.Expiration > 0 &&  item.Expiration < time.Now().UnixNano() {
+		item, found = c.promote(key);
+		if !found {
+			c.misses++;
+			return nil, false;
+		}
+	} else if item.Expiration > 0 &&  item.Expiration < time.Now().UnixNano() {
+		// The item is expired
 		delete(c.items, key);
 		delete(c.accessCount, key);
+		c.emit(EventExpire, key);
+		c.misses++;
 
 		return nil, false;
+	} else {
+		c.memoryHits++;
 	}
 
 	// Update last access
@@ -71,19 +152,93 @@ func (c *Cache) Get (key string) (interface{}, bool) {
 	c.items[key] = item;
 	c.accessCount[key]++;
 
+	// Hand out a copy of mergeable values so callers never share them with the cache
+	if m, ok := item.Value.(Mergeable); ok {
+		return m.Clone(), true;
+	}
+
 	return item.Value, true;
 }
 
 // Delete a key from the cache
 func (c *Cache) Delete (key string) {
+	c.DeleteStamped(key);
+}
+
+// Deletes a key from the cache, leaving a tombstone so older writes of the key arriving
+// from other nodes cannot bring it back. Returns the timestamp of the delete.
+func (c *Cache) DeleteStamped (key string) Timestamp {
 	c.mu.Lock();
 	defer c.mu.Unlock();
 
-	delete(c.items, key);
-	delete(c.accessCount, key);
+	stamp := c.clock.Now();
+	c.tombstone(key, stamp);
+
+	return stamp;
+}
+
+// Returns the number of items in memory, including expired ones not yet removed
+func (c *Cache) ItemCount () int {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	return len(c.items);
+}
+
+// Returns the keys of all items in memory and in the disk tier, including expired ones not yet removed
+func (c *Cache) Keys () []string {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	keys := make([]string, 0, len(c.items));
+	for key := range c.items {
+		keys = append(keys, key);
+	}
+
+	if c.disk != nil {
+		keys = append(keys, c.disk.keys()...);
+	}
+
+	return keys;
+}
+
+// Removes all expired items from the cache
+func (c *Cache) DeleteExpired () {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	now := time.Now().UnixNano();
+	for key, item := range c.items {
+		if item.Expiration > 0 && item.Expiration < now {
+			delete(c.items, key);
+			delete(c.accessCount, key);
+			c.emit(EventExpire, key);
+		}
+	}
+
+	if c.disk != nil {
+		for _, key := range c.disk.removeExpired(now) {
+			c.emit(EventExpire, key);
+		}
+	}
+
+	c.removeExpiredTombstones(now);
+}
+
+// Starts a background goroutine that removes expired items,
+// so they are reclaimed (and expire events emitted) even if never read again
+func (c *Cache) StartExpirationSweep (interval time.Duration) {
+	go func () {
+		ticker := time.NewTicker(interval);
+		defer ticker.Stop();
+
+		for range ticker.C {
+			c.DeleteExpired();
+		}
+	}();
 }
 
-// Evict an item based on the eviction policy
+// Evict an item from memory based on the eviction policy
 func (c *Cache) evict() {
 	if (c.evictionType == "lru") {
 		c.evictLRU();
@@ -104,8 +259,7 @@ func (c *Cache) evictLRU () {
 		}
 	}
 
-	delete(c.items, oldestKey);
-	delete(c.accessCount, oldestKey);
+	c.demote(oldestKey);
 }
 
 // Evict the least frequently used item
@@ -120,6 +274,5 @@ func (c *Cache) evictLFU () {
 		}
 	}
 
-	delete(c.items, leastUsedKey);
-	delete(c.accessCount, leastUsedKey);
+	c.demote(leastUsedKey);
 }
\ No newline at end of file
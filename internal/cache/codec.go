@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"encoding/json"
+)
+
+// Decoders for plain values that JSON alone would not restore to the same Go type,
+// keyed by the encoding name stored next to the value on disk
+var valueDecoders = map[string]func([]byte) (interface{}, error) {
+	"bytes": decodeAs[[]byte],
+	"raw": decodeAs[json.RawMessage],
+	"int": decodeAs[int],
+	"int8": decodeAs[int8],
+	"int16": decodeAs[int16],
+	"int32": decodeAs[int32],
+	"int64": decodeAs[int64],
+	"uint": decodeAs[uint],
+	"uint8": decodeAs[uint8],
+	"uint16": decodeAs[uint16],
+	"uint32": decodeAs[uint32],
+	"uint64": decodeAs[uint64],
+	"float32": decodeAs[float32],
+}
+
+// Decodes JSON into a value of type T
+func decodeAs[T any] (data []byte) (interface{}, error) {
+	var v T;
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err;
+	}
+
+	return v, nil;
+}
+
+// Returns the name of the encoding that restores the value to the same Go type.
+// Empty for values JSON restores as they were: strings, float64, bools, nil,
+// and the maps and slices JSON decodes into. Other values inside maps and slices
+// are restored the way JSON decodes them.
+func valueEncoding (value interface{}) string {
+	switch v := value.(type) {
+	case Mergeable:
+		return v.Type();
+	case json.RawMessage:
+		return "raw";
+	case []byte:
+		return "bytes";
+	case int:
+		return "int";
+	case int8:
+		return "int8";
+	case int16:
+		return "int16";
+	case int32:
+		return "int32";
+	case int64:
+		return "int64";
+	case uint:
+		return "uint";
+	case uint8:
+		return "uint8";
+	case uint16:
+		return "uint16";
+	case uint32:
+		return "uint32";
+	case uint64:
+		return "uint64";
+	case float32:
+		return "float32";
+	default:
+		return "";
+	}
+}
+
+// Encodes a value for persistence, returning its encoding name and JSON data
+func EncodeValue (value interface{}) (string, []byte, error) {
+	data, err := json.Marshal(value);
+	if err != nil {
+		return "", nil, err;
+	}
+
+	return valueEncoding(value), data, nil;
+}
+
+// Decodes a persisted value. Values without an encoding are decoded as plain JSON,
+// so data written before encodings were recorded still loads.
+func decodeValue (encoding string, data []byte) (interface{}, error) {
+	if encoding == "" {
+		var value interface{};
+		if len(data) == 0 {
+			return nil, nil;
+		}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err;
+		}
+		return value, nil;
+	}
+
+	if decode, found := valueDecoders[encoding]; found {
+		return decode(data);
+	}
+
+	return DecodeMergeable(encoding, data);
+}
@@ -0,0 +1,371 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted file layout:
+//
+//	header:  magic "CFENC" | format version uint8 | key id length uint8 | key id | nonce prefix [8]byte
+//	chunk:   final flag uint8 | sealed length uint32 | AES-GCM sealed chunk
+//
+// Each chunk's nonce is the file's random prefix followed by the chunk number, and the final flag
+// is authenticated, so reordered, dropped or truncated chunks are detected.
+const encryptedMagic = "CFENC";
+
+const encryptedFormatVersion = 1;
+
+// Plaintext bytes per encrypted chunk
+const encryptedChunkSize = 64 * 1024;
+
+// Bytes of the random nonce prefix of an encrypted file
+const noncePrefixSize = 8;
+
+// Prefix of encrypted append-only log lines
+const encryptedLinePrefix = "enc:";
+
+// Size of AES-256 keys in bytes
+const encryptionKeySize = 32;
+
+var ErrNoEncryptionKey = errors.New("no key to decrypt with");
+
+var ErrNotEncrypted = errors.New("data is not encrypted");
+
+// Keyring holds the keys for encrypting persistence files. New files are encrypted with the
+// current key, and files encrypted with any key in the ring can be read, so keys can be rotated
+// by making a new key current while keeping the old ones until no file uses them anymore.
+// Unencrypted files and log lines are rejected unless plaintext is allowed.
+type Keyring struct {
+	current string;
+	aeads map[string]cipher.AEAD;	// AES-GCM by key id
+	allowPlaintext bool;			// Unencrypted data is read as it is, to migrate data from before encryption was enabled
+}
+
+// Creates a keyring from AES-256 keys. The first key is used for encryption.
+func NewKeyring (keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one encryption key is required");
+	}
+
+	kr := &Keyring{aeads: make(map[string]cipher.AEAD)};
+	for i, key := range keys {
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("encryption key %d is %d bytes, expected %d", i + 1, len(key), encryptionKeySize);
+		}
+
+		block, err := aes.NewCipher(key);
+		if err != nil {
+			return nil, err;
+		}
+		aead, err := cipher.NewGCM(block);
+		if err != nil {
+			return nil, err;
+		}
+
+		id := keyId(key);
+		kr.aeads[id] = aead;
+		if i == 0 {
+			kr.current = id;
+		}
+	}
+
+	return kr, nil;
+}
+
+// Parses encryption keys separated by newlines or commas, each hex or base64 encoded.
+// Blank lines and lines starting with # are ignored.
+func ParseEncryptionKeys (text string) ([][]byte, error) {
+	fields := strings.FieldsFunc(text, func (r rune) bool {
+		return r == '\n' || r == ',';
+	})
+
+	var keys [][]byte;
+	for _, field := range fields {
+		field = strings.TrimSpace(field);
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue;
+		}
+
+		var key []byte;
+		var err error;
+		if len(field) == hex.EncodedLen(encryptionKeySize) {
+			key, err = hex.DecodeString(field);
+		} else {
+			key, err = base64.StdEncoding.DecodeString(field);
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d is neither hex nor base64", len(keys) + 1);
+		}
+
+		keys = append(keys, key);
+	}
+
+	return keys, nil;
+}
+
+// Identifies a key without revealing it
+func keyId (key []byte) string {
+	sum := sha256.Sum256(key);
+	return hex.EncodeToString(sum[:4]);
+}
+
+// Returns the id of the key new files are encrypted with
+func (kr *Keyring) CurrentKeyId () string {
+	return kr.current;
+}
+
+// Checks if the data starts with an encrypted file header
+func isEncrypted (prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(encryptedMagic));
+}
+
+// Returns the nonce of a chunk
+func chunkNonce (prefix []byte, chunk uint32) []byte {
+	nonce := make([]byte, 0, noncePrefixSize + 4);
+	nonce = append(nonce, prefix...);
+	return binary.BigEndian.AppendUint32(nonce, chunk);
+}
+
+// encryptWriter encrypts everything written to it into the encrypted file format
+type encryptWriter struct {
+	w io.Writer;
+	aead cipher.AEAD;
+	prefix []byte;
+	chunk uint32;
+	buf []byte;
+}
+
+// Writes the encrypted file header and returns a writer that encrypts into w with the current key.
+// Close must be called to write the final chunk.
+func (kr *Keyring) newEncryptWriter (w io.Writer) (*encryptWriter, error) {
+	ew := &encryptWriter{
+		w: w,
+		aead: kr.aeads[kr.current],
+		prefix: make([]byte, noncePrefixSize),
+		buf: make([]byte, 0, encryptedChunkSize),
+	}
+
+	if _, err := rand.Read(ew.prefix); err != nil {
+		return nil, err;
+	}
+
+	header := []byte(encryptedMagic);
+	header = append(header, encryptedFormatVersion, byte(len(kr.current)));
+	header = append(header, kr.current...);
+	header = append(header, ew.prefix...);
+
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write encryption header: %w", err);
+	}
+
+	return ew, nil;
+}
+
+// Buffers the data, encrypting every full chunk
+func (ew *encryptWriter) Write (p []byte) (int, error) {
+	written := 0;
+	for len(p) > 0 {
+		n := min(len(p), encryptedChunkSize - len(ew.buf));
+		ew.buf = append(ew.buf, p[:n]...);
+		p = p[n:];
+		written += n;
+
+		// Keep a full chunk buffered until more data arrives, so the last chunk can be marked final
+		if len(ew.buf) == encryptedChunkSize && len(p) > 0 {
+			if err := ew.seal(false); err != nil {
+				return written, err;
+			}
+		}
+	}
+
+	return written, nil;
+}
+
+// Encrypts the last chunk. Does not close the underlying writer.
+func (ew *encryptWriter) Close () error {
+	return ew.seal(true);
+}
+
+// Encrypts and writes the buffered chunk
+func (ew *encryptWriter) seal (final bool) error {
+	flag := byte(0);
+	if final {
+		flag = 1;
+	}
+
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.prefix, ew.chunk), ew.buf, []byte{flag});
+
+	frame := make([]byte, 0, 5 + len(sealed));
+	frame = append(frame, flag);
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(sealed)));
+	frame = append(frame, sealed...);
+
+	if _, err := ew.w.Write(frame); err != nil {
+		return err;
+	}
+
+	ew.chunk++;
+	ew.buf = ew.buf[:0];
+	return nil;
+}
+
+// decryptReader decrypts a file in the encrypted file format
+type decryptReader struct {
+	r io.Reader;
+	aead cipher.AEAD;
+	prefix []byte;
+	chunk uint32;
+	plain []byte;
+	final bool;
+}
+
+// Reads the encrypted file header and returns a reader of the decrypted data.
+// The reader fails if the data was tampered with or does not end with the final chunk.
+func (kr *Keyring) newDecryptReader (r io.Reader) (*decryptReader, error) {
+	header := make([]byte, len(encryptedMagic) + 2);
+	if _, err := io.ReadFull(r, header); err != nil || !isEncrypted(header) {
+		return nil, fmt.Errorf("invalid encryption header");
+	}
+
+	if header[len(encryptedMagic)] != encryptedFormatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", header[len(encryptedMagic)]);
+	}
+
+	id := make([]byte, header[len(encryptedMagic) + 1]);
+	prefix := make([]byte, noncePrefixSize);
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, fmt.Errorf("invalid encryption header");
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("invalid encryption header");
+	}
+
+	if kr == nil {
+		return nil, fmt.Errorf("%w: file is encrypted and encryption is not configured", ErrNoEncryptionKey);
+	}
+
+	aead, found := kr.aeads[string(id)];
+	if !found {
+		return nil, fmt.Errorf("%w: file is encrypted with unknown key %s", ErrNoEncryptionKey, id);
+	}
+
+	return &decryptReader{r: r, aead: aead, prefix: prefix}, nil;
+}
+
+// Reads decrypted data, decrypting the next chunk when needed
+func (dr *decryptReader) Read (p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.final {
+			return 0, io.EOF;
+		}
+
+		if err := dr.open(); err != nil {
+			return 0, err;
+		}
+	}
+
+	n := copy(p, dr.plain);
+	dr.plain = dr.plain[n:];
+	return n, nil;
+}
+
+// Reads and decrypts the next chunk
+func (dr *decryptReader) open () error {
+	frame := make([]byte, 5);
+	if _, err := io.ReadFull(dr.r, frame); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF);
+	}
+
+	flag := frame[0];
+	length := binary.BigEndian.Uint32(frame[1:]);
+	if flag > 1 || length > encryptedChunkSize + uint32(dr.aead.Overhead()) {
+		return fmt.Errorf("invalid encrypted chunk");
+	}
+
+	sealed := make([]byte, length);
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF);
+	}
+
+	plain, err := dr.aead.Open(nil, chunkNonce(dr.prefix, dr.chunk), sealed, []byte{flag});
+	if err != nil {
+		return fmt.Errorf("encrypted chunk %d failed authentication", dr.chunk);
+	}
+
+	dr.chunk++;
+	dr.plain = plain;
+	dr.final = flag == 1;
+	return nil;
+}
+
+// Encrypts a single append-only log line with the current key, keeping it on one line
+func (kr *Keyring) encryptLine (line []byte) ([]byte, error) {
+	aead := kr.aeads[kr.current];
+
+	nonce := make([]byte, aead.NonceSize());
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err;
+	}
+	sealed := aead.Seal(nonce, nonce, line, []byte(kr.current));
+
+	return []byte(encryptedLinePrefix + kr.current + ":" + base64.StdEncoding.EncodeToString(sealed)), nil;
+}
+
+// Lets unencrypted files and log lines be read, so a node can be moved to encryption with its data.
+// Otherwise they are rejected, since they could have been planted by anyone able to write the files.
+func (kr *Keyring) AllowPlaintext () {
+	kr.allowPlaintext = true;
+}
+
+// Checks if unencrypted data may be read, which it always may without encryption
+func (kr *Keyring) acceptsPlaintext () bool {
+	return kr == nil || kr.allowPlaintext;
+}
+
+// Decrypts an append-only log line. Lines without the encrypted prefix are returned as they are
+// if the keyring accepts plaintext.
+func (kr *Keyring) decryptLine (line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(encryptedLinePrefix)) {
+		if !kr.acceptsPlaintext() {
+			return nil, fmt.Errorf("%w: log entry is not encrypted and plaintext is not allowed", ErrNotEncrypted);
+		}
+		return line, nil;
+	}
+
+	id, encoded, found := strings.Cut(string(line[len(encryptedLinePrefix):]), ":");
+	if !found {
+		return nil, fmt.Errorf("invalid encrypted log entry");
+	}
+
+	if kr == nil {
+		return nil, fmt.Errorf("%w: log is encrypted and encryption is not configured", ErrNoEncryptionKey);
+	}
+
+	aead, ok := kr.aeads[id];
+	if !ok {
+		return nil, fmt.Errorf("%w: log entry is encrypted with unknown key %s", ErrNoEncryptionKey, id);
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded);
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted log entry");
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id));
+	if err != nil {
+		return nil, fmt.Errorf("encrypted log entry failed authentication");
+	}
+
+	return plain, nil;
+}
@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Returns a key of encryptionKeySize bytes filled with b
+func testKey (b byte) []byte {
+	return bytes.Repeat([]byte{b}, encryptionKeySize);
+}
+
+// Creates a keyring from keys, failing the test on error
+func testKeyring (t *testing.T, keys ...[]byte) *Keyring {
+	t.Helper();
+
+	kr, err := NewKeyring(keys);
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err);
+	}
+
+	return kr;
+}
+
+// Encrypts data into the encrypted file format
+func encryptTestData (t *testing.T, kr *Keyring, data []byte) []byte {
+	t.Helper();
+
+	var buf bytes.Buffer;
+	ew, err := kr.newEncryptWriter(&buf);
+	if err != nil {
+		t.Fatalf("newEncryptWriter: %v", err);
+	}
+	if _, err := ew.Write(data); err != nil {
+		t.Fatalf("Write: %v", err);
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("Close: %v", err);
+	}
+
+	return buf.Bytes();
+}
+
+// Decrypts data in the encrypted file format
+func decryptTestData (kr *Keyring, data []byte) ([]byte, error) {
+	dr, err := kr.newDecryptReader(bytes.NewReader(data));
+	if err != nil {
+		return nil, err;
+	}
+
+	return io.ReadAll(dr);
+}
+
+// Returns n bytes of a repeating pattern, so misplaced chunks do not decrypt to the same data
+func testPlaintext (n int) []byte {
+	data := make([]byte, n);
+	for i := range data {
+		data[i] = byte(i * 7 + i / 251);
+	}
+
+	return data;
+}
+
+func TestEncryptionRoundTrip (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	overhead := kr.aeads[kr.current].Overhead();
+	headerSize := len(encryptedMagic) + 2 + len(kr.current) + noncePrefixSize;
+
+	tests := []struct {
+		size	int;
+		chunks	int;
+	}{
+		{0, 1},
+		{1, 1},
+		{encryptedChunkSize - 1, 1},
+		{encryptedChunkSize, 1},
+		{encryptedChunkSize + 1, 2},
+		{3 * encryptedChunkSize, 3},
+		{3 * encryptedChunkSize + 17, 4},
+	};
+
+	for _, tt := range tests {
+		plain := testPlaintext(tt.size);
+		encrypted := encryptTestData(t, kr, plain);
+
+		if !isEncrypted(encrypted) {
+			t.Errorf("%d bytes: encrypted data lacks the header", tt.size);
+		}
+		if want := headerSize + tt.size + tt.chunks * (5 + overhead); len(encrypted) != want {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d in %d chunks", tt.size, len(encrypted), want, tt.chunks);
+		}
+
+		decrypted, err := decryptTestData(kr, encrypted);
+		if err != nil {
+			t.Errorf("%d bytes: decrypting: %v", tt.size, err);
+			continue;
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("%d bytes: decrypted data differs from the plaintext", tt.size);
+		}
+	}
+}
+
+func TestEncryptionWriteSizes (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	plain := testPlaintext(2 * encryptedChunkSize + 100);
+
+	// Data written in pieces of any size encrypts the same way as in one write
+	for _, piece := range []int{1, 1000, encryptedChunkSize, encryptedChunkSize + 3} {
+		var buf bytes.Buffer;
+		ew, err := kr.newEncryptWriter(&buf);
+		if err != nil {
+			t.Fatal(err);
+		}
+		for rest := plain; len(rest) > 0; {
+			n := min(piece, len(rest));
+			if written, err := ew.Write(rest[:n]); err != nil || written != n {
+				t.Fatalf("pieces of %d: Write = %d, %v", piece, written, err);
+			}
+			rest = rest[n:];
+		}
+		ew.Close();
+
+		decrypted, err := decryptTestData(kr, buf.Bytes());
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Errorf("pieces of %d: round trip failed: %v", piece, err);
+		}
+	}
+}
+
+func TestDecryptTamperedData (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	encrypted := encryptTestData(t, kr, testPlaintext(2 * encryptedChunkSize + 100));
+
+	headerSize := len(encryptedMagic) + 2 + len(kr.current) + noncePrefixSize;
+	frameSize := 5 + encryptedChunkSize + kr.aeads[kr.current].Overhead();
+	chunk := func (i int) int { return headerSize + i * frameSize };
+
+	tests := []struct {
+		name	string;
+		tamper	func (data []byte) []byte;
+	}{
+		{"flipped ciphertext byte", func (data []byte) []byte {
+			data[chunk(1) + 100] ^= 1;
+			return data;
+		}},
+		{"flipped nonce prefix", func (data []byte) []byte {
+			data[headerSize - 1] ^= 1;
+			return data;
+		}},
+		{"first chunk marked final", func (data []byte) []byte {
+			data[chunk(0)] = 1;
+			return data;
+		}},
+		{"swapped chunks", func (data []byte) []byte {
+			swapped := bytes.Clone(data[:chunk(0)]);
+			swapped = append(swapped, data[chunk(1):chunk(2)]...);
+			swapped = append(swapped, data[chunk(0):chunk(1)]...);
+			return append(swapped, data[chunk(2):]...);
+		}},
+		{"final chunk dropped", func (data []byte) []byte { return data[:chunk(2)] }},
+		{"truncated chunk", func (data []byte) []byte { return data[:chunk(1) + 50] }},
+		{"invalid chunk length", func (data []byte) []byte {
+			data[chunk(0) + 1] = 0xff;
+			return data;
+		}},
+	};
+
+	for _, tt := range tests {
+		if _, err := decryptTestData(kr, tt.tamper(bytes.Clone(encrypted))); err == nil {
+			t.Errorf("%s: decrypted without error", tt.name);
+		}
+	}
+}
+
+func TestKeyringRotation (t *testing.T) {
+	oldKey, newKey, otherKey := testKey(1), testKey(2), testKey(3);
+	plain := testPlaintext(1000);
+	line := []byte(`{"op":"set","key":"a"}`);
+
+	encrypted := encryptTestData(t, testKeyring(t, oldKey), plain);
+	encryptedLine, err := testKeyring(t, oldKey).encryptLine(line);
+	if err != nil {
+		t.Fatalf("encryptLine: %v", err);
+	}
+
+	tests := []struct {
+		name	string;
+		keyring	*Keyring;
+		err		error;	// Expected error, nil if decrypting works
+	}{
+		{"same key", testKeyring(t, oldKey), nil},
+		{"old key kept after rotation", testKeyring(t, newKey, oldKey), nil},
+		{"old key dropped", testKeyring(t, newKey, otherKey), ErrNoEncryptionKey},
+		{"encryption not configured", nil, ErrNoEncryptionKey},
+	};
+
+	for _, tt := range tests {
+		decrypted, err := decryptTestData(tt.keyring, encrypted);
+		if !errors.Is(err, tt.err) || (err == nil && !bytes.Equal(decrypted, plain)) {
+			t.Errorf("%s: decrypting a file: err = %v, want %v", tt.name, err, tt.err);
+		}
+
+		decryptedLine, err := tt.keyring.decryptLine(encryptedLine);
+		if !errors.Is(err, tt.err) || (err == nil && !bytes.Equal(decryptedLine, line)) {
+			t.Errorf("%s: decrypting a line: err = %v, want %v", tt.name, err, tt.err);
+		}
+	}
+
+	// Files are encrypted with the first key of the ring
+	rotated := testKeyring(t, newKey, oldKey);
+	if rotated.CurrentKeyId() != keyId(newKey) {
+		t.Errorf("CurrentKeyId = %s, want %s", rotated.CurrentKeyId(), keyId(newKey));
+	}
+	if _, err := decryptTestData(testKeyring(t, newKey), encryptTestData(t, rotated, plain)); err != nil {
+		t.Errorf("file encrypted after rotation not readable with the new key alone: %v", err);
+	}
+}
+
+func TestEncryptedLines (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	line := []byte(`{"op":"set","key":"a","value":"line\nbreak"}`);
+
+	encrypted, err := kr.encryptLine(line);
+	if err != nil {
+		t.Fatalf("encryptLine: %v", err);
+	}
+	if bytes.ContainsAny(encrypted, "\n\r") {
+		t.Errorf("encrypted line spans several lines: %q", encrypted);
+	}
+
+	decrypted, err := kr.decryptLine(encrypted);
+	if err != nil || !bytes.Equal(decrypted, line) {
+		t.Errorf("decryptLine = %q, %v, want %q", decrypted, err, line);
+	}
+
+	// Plain lines are rejected unless plaintext is allowed, or encryption is not configured
+	if _, err := kr.decryptLine(line); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("decryptLine of a plain line: err = %v, want ErrNotEncrypted", err);
+	}
+	migrating := testKeyring(t, testKey(1));
+	migrating.AllowPlaintext();
+	for _, keyring := range []*Keyring{migrating, nil} {
+		if plain, err := keyring.decryptLine(line); err != nil || !bytes.Equal(plain, line) {
+			t.Errorf("decryptLine of a plain line = %q, %v", plain, err);
+		}
+	}
+
+	tampered := bytes.Clone(encrypted);
+	tampered[len(tampered) - 5] ^= 1;
+	for _, bad := range [][]byte{tampered, []byte(encryptedLinePrefix + "nocolon"), []byte(encryptedLinePrefix + kr.current + ":!!!")} {
+		if _, err := kr.decryptLine(bad); err == nil {
+			t.Errorf("decryptLine(%q) succeeded", bad);
+		}
+	}
+}
+
+func TestNewKeyring (t *testing.T) {
+	tests := []struct {
+		name	string;
+		keys	[][]byte;
+		valid	bool;
+	}{
+		{"no keys", nil, false},
+		{"short key", [][]byte{make([]byte, 16)}, false},
+		{"second key invalid", [][]byte{testKey(1), make([]byte, 31)}, false},
+		{"one key", [][]byte{testKey(1)}, true},
+		{"several keys", [][]byte{testKey(1), testKey(2)}, true},
+	};
+
+	for _, tt := range tests {
+		if _, err := NewKeyring(tt.keys); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid);
+		}
+	}
+}
+
+func TestParseEncryptionKeys (t *testing.T) {
+	hexKey := hex.EncodeToString(testKey(1));
+	base64Key := base64.StdEncoding.EncodeToString(testKey(2));
+
+	tests := []struct {
+		name	string;
+		text	string;
+		keys	[][]byte;
+		valid	bool;
+	}{
+		{"empty", "", nil, true},
+		{"hex", hexKey, [][]byte{testKey(1)}, true},
+		{"base64", base64Key, [][]byte{testKey(2)}, true},
+		{"comma separated", hexKey + " , " + base64Key, [][]byte{testKey(1), testKey(2)}, true},
+		{"lines with comments", "# current\n" + base64Key + "\n\n# previous\n" + hexKey + "\n", [][]byte{testKey(2), testKey(1)}, true},
+		{"invalid", "not a key!", nil, false},
+	};
+
+	for _, tt := range tests {
+		keys, err := ParseEncryptionKeys(tt.text);
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid);
+			continue;
+		}
+		if tt.valid && !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: keys = %x, want %x", tt.name, keys, tt.keys);
+		}
+	}
+}
+
+func TestEncryptedAppendOnlyLog (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	aof, basePath := openTestLog(t, kr);
+	aof.record(EventSet, "secret", CacheItem{Value: "value", Version: 1}, true);
+	path := aof.segmentPath(aof.seq);
+	aof.Close();
+
+	c, applied := replayTestLog(t, basePath, kr);
+	if applied != 1 || c.items["secret"].Value != "value" {
+		t.Errorf("replay applied %d entries, items = %v", applied, c.items);
+	}
+
+	// Without the key the entry cannot be read, and the rest of the segment is ignored
+	c, applied = replayTestLog(t, basePath, nil);
+	if applied != 0 || len(c.items) != 0 {
+		t.Errorf("replay without the key applied %d entries", applied);
+	}
+
+	if data, err := os.ReadFile(path); err != nil || bytes.Contains(data, []byte("value")) {
+		t.Errorf("log segment holds the plaintext value (err %v)", err);
+	}
+}
+
+func TestPlaintextWithEncryption (t *testing.T) {
+	kr := testKeyring(t, testKey(1));
+	migrating := testKeyring(t, testKey(1));
+	migrating.AllowPlaintext();
+
+	aof, basePath := openTestLog(t, nil);
+	aof.record(EventSet, "planted", CacheItem{Value: "value", Version: 1}, true);
+	aof.Close();
+	snapshot, _ := writeTestSnapshot(t, testSnapshotRecords());
+
+	tests := []struct {
+		name	string;
+		keyring	*Keyring;
+		loaded	bool;
+	}{
+		{"encryption not configured", nil, true},
+		{"encryption configured", kr, false},
+		{"plaintext allowed", migrating, true},
+	};
+
+	for _, tt := range tests {
+		c, applied := replayTestLog(t, basePath, tt.keyring);
+		if (applied == 1 && c.items["planted"].Value == "value") != tt.loaded {
+			t.Errorf("%s: replay of a plain log applied %d entries, want loaded %v", tt.name, applied, tt.loaded);
+		}
+
+		records := 0;
+		_, err := ReadSnapshotFile(bytes.NewReader(snapshot), tt.keyring, false, func (rec SnapshotRecord) error {
+			records++;
+			return nil;
+		});
+		if tt.loaded && (err != nil || records != len(testSnapshotRecords())) {
+			t.Errorf("%s: read %d records of a plain snapshot, err = %v", tt.name, records, err);
+		}
+		if !tt.loaded && (!errors.Is(err, ErrNotEncrypted) || records != 0) {
+			t.Errorf("%s: read %d records of a plain snapshot, err = %v, want ErrNotEncrypted", tt.name, records, err);
+		}
+	}
+}
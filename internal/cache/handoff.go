@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Number of items sent per handoff request
+const handoffBatchSize = 500;
+
+// The DTO for an item handed off to another node
+type handoffItem struct {
+	Key		string			`json:"key"`
+	Type	string			`json:"type,omitempty"`	// Encoding of the value, empty for plain JSON values
+	Value	json.RawMessage	`json:"value"`
+	TTL		int64			`json:"ttl"`			// Milliseconds left to live, 0 if the item never expires
+	Timestamp	Timestamp	`json:"timestamp"`
+}
+
+// The DTO for handoff requests
+type handoffRequest struct {
+	Items	[]handoffItem	`json:"items"`
+}
+
+// Hands the keys this node is responsible for over to the nodes taking its place once it leaves the cluster.
+// leave is called once the keys are known and must take this node out of the hash ring. Every key is sent
+// to all nodes responsible for it afterwards, since replicas may have missed writes, and the receivers
+// keep the copies they already have. Returns the number of items sent.
+func (rm *ReplicationManager) HandOff (ctx context.Context, leave func()) (int, error) {
+	// Note the keys we are responsible for while we are still in the ring
+	var owned []string;
+	for _, key := range rm.cache.Keys() {
+		if containsNode(rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1), rm.localNode) {
+			owned = append(owned, key);
+		}
+	}
+
+	leave();
+
+	// Group the keys by the nodes responsible for them without us
+	successors := make(map[string][]string);
+	for _, key := range owned {
+		for _, node := range rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1) {
+			if node != "" && node != rm.localNode {
+				successors[node] = append(successors[node], key);
+			}
+		}
+	}
+
+	sent := 0;
+	var errs []error;
+	for node, keys := range successors {
+		address := rm.nodeManager.GetNodeAddress(node);
+		if address == "" {
+			errs = append(errs, fmt.Errorf("unknown address of node %s", node));
+			continue;
+		}
+
+		for start := 0; start < len(keys); start += handoffBatchSize {
+			end := min(start + handoffBatchSize, len(keys));
+
+			n, err := rm.sendHandoff(ctx, address, rm.cache.snapshotRecords(keys[start:end]));
+			sent += n;
+			if err != nil {
+				errs = append(errs, fmt.Errorf("handoff to node %s failed: %w", node, err));
+				break;
+			}
+		}
+	}
+
+	return sent, errors.Join(errs...);
+}
+
+// Sends a batch of items to the node at address
+func (rm *ReplicationManager) sendHandoff (ctx context.Context, address string, records []SnapshotRecord) (int, error) {
+	now := time.Now().UnixNano();
+	request := handoffRequest{Items: make([]handoffItem, 0, len(records))};
+
+	for _, rec := range records {
+		encoding, value, err := EncodeValue(rec.Value);
+		if err != nil {
+			log.Printf("Skipping handoff of key %s: %v", rec.Key, err);
+			continue;
+		}
+
+		item := handoffItem{Key: rec.Key, Type: encoding, Value: value, Timestamp: rec.Timestamp};
+		if rec.Expiration > 0 {
+			item.TTL = max(time.Duration(rec.Expiration - now).Milliseconds(), 1);
+		}
+		request.Items = append(request.Items, item);
+	}
+
+	if len(request.Items) == 0 {
+		return 0, nil;
+	}
+
+	jsonData, err := json.Marshal(request);
+	if err != nil {
+		return 0, err;
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address + "/replicate/handoff", bytes.NewReader(jsonData));
+	if err != nil {
+		return 0, err;
+	}
+	req.Header.Set("Content-Type", "application/json");
+
+	resp, err := rm.httpClient.Do(req);
+	if err != nil {
+		return 0, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode);
+	}
+
+	return len(request.Items), nil;
+}
+
+// Handles items handed off by a node leaving the cluster
+func (rm *ReplicationManager) HandleHandoff (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var request handoffRequest;
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	now := time.Now();
+	records := make([]SnapshotRecord, 0, len(request.Items));
+	for _, item := range request.Items {
+		value, err := decodeValue(item.Type, item.Value);
+		if err != nil {
+			http.Error(w, fmt.Sprintf("key %s: %v", item.Key, err), http.StatusBadRequest);
+			return;
+		}
+
+		rec := SnapshotRecord{Key: item.Key, Value: value, Timestamp: item.Timestamp};
+		if item.TTL > 0 {
+			rec.Expiration = now.Add(time.Duration(item.TTL) * time.Millisecond).UnixNano();
+		}
+		records = append(records, rec);
+	}
+
+	applied := rm.cache.applyHandoff(records);
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {
+		"status": "success",
+		"applied": applied,
+	})
+}
+
+// Stores items handed off by another node. Mergeable values are merged into the local copy, other
+// values, and mergeable ones the key does not hold yet, are only stored if they are newer than the
+// local copy or tombstone of the key.
+// Returns the number of items stored or merged.
+func (c *Cache) applyHandoff (records []SnapshotRecord) int {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	applied := 0;
+	for _, rec := range records {
+		if incoming, ok := rec.Value.(Mergeable); ok {
+			if merged, _ := c.mergeValue(rec.Key, incoming, rec.Expiration, rec.Timestamp); merged {
+				applied++;
+			}
+			continue;
+		}
+
+		_, found := c.liveItem(rec.Key);
+
+		// Without a timestamp, the local copy was written after the node handing off stopped serving the key
+		if rec.Timestamp.IsZero() && found {
+			continue;
+		}
+		ts := c.observe(rec.Timestamp);
+		if !c.supersedes(rec.Key, ts) {
+			continue;
+		}
+
+		if !found && len(c.items) >= c.maxItems {
+			c.evict();
+		}
+
+		c.removeFromDisk(rec.Key);
+		delete(c.tombstones, rec.Key);
+		c.items[rec.Key] = CacheItem{
+			Value: rec.Value,
+			Expiration: rec.Expiration,
+			LastAccess: time.Now().UnixNano(),
+			Version: c.nextVersion(),
+			Timestamp: ts,
+		}
+		c.accessCount[rec.Key] = 1;
+		c.emit(EventSet, rec.Key);
+		applied++;
+	}
+
+	return applied;
+}
+
+// Checks if the node is among the nodes
+func containsNode (nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true;
+		}
+	}
+
+	return false;
+}
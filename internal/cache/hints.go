@@ -0,0 +1,585 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations of replicated writes
+const (
+	hintOpSet = "set";
+	hintOpDelete = "del";
+	hintOpLease = "lease";	// The value is the JSON encoded lease of the lock named by the key
+)
+
+// Extension of the files hints are spilled to, named after the escaped ID of the node they are for
+const hintFileExt = ".hints";
+
+// A replicated write, kept as a hint for a node that could not be reached to replay it once it is back
+type hint struct {
+	Op			string			`json:"op"`
+	Key			string			`json:"key"`
+	Type		string			`json:"type,omitempty"`		// Encoding of the value, empty for plain JSON values
+	Value		json.RawMessage	`json:"value,omitempty"`
+	Expiration	int64			`json:"expiration,omitempty"`	// Of the value in Unix nanoseconds, 0 if it was written without a TTL
+	Timestamp	Timestamp		`json:"timestamp"`
+}
+
+// Returns the TTL to replicate the value of a set with, in seconds, and false if it expired in the meantime
+func (h hint) ttl (now time.Time) (int64, bool) {
+	if h.Expiration == 0 {
+		return 0, true;
+	}
+
+	left := time.Duration(h.Expiration - now.UnixNano());
+	if left <= 0 {
+		return 0, false;
+	}
+
+	return int64(math.Ceil(left.Seconds())), true;
+}
+
+// Counters of the hinted writes of a node
+type HintStats struct {
+	Pending		int		`json:"pending"`	// Hints waiting for their node, in memory and spilled
+	Spilled		int		`json:"spilled"`	// Pending hints in spill files
+	Replayed	uint64	`json:"replayed"`	// Hints their node accepted once it was back
+	Dropped		uint64	`json:"dropped"`	// Hints lost because the limits were reached or their node rejected them
+}
+
+// The hints for one node, oldest first. Once a node has hints in its spill file all newer ones
+// go there too, so the hints in memory are always older than the spilled ones.
+type hintQueue struct {
+	memory []hint;
+	spill *os.File;		// Open for appending and reading, nil if nothing is spilled
+	spillPath string;
+	spillOffset int64;	// Bytes of the spill file already replayed
+	spillSize int64;	// Bytes in the spill file
+	spilled int;		// Hints in the spill file not replayed yet
+	replaying bool;
+}
+
+// HintStore keeps the replicated writes nodes missed while unreachable, in order for each node, so they
+// can be replayed once the node is back. Hints are kept in memory up to a limit shared by all nodes,
+// after which they are appended to a spill file per node that survives restarts, up to a limit on the
+// size of all spill files. Hints beyond both limits are dropped, and so are the hints of nodes that left.
+type HintStore struct {
+	dir string;				// Directory of the spill files, empty if hints are kept in memory only
+	maxMemory int;			// Hints kept in memory across all nodes
+	maxSpillSize int64;		// Bytes in spill files across all nodes
+	keyring *Keyring;		// Encrypts spilled hints when set
+	queues map[string]*hintQueue;
+	left map[string]struct{};	// Nodes that left the cluster, whose hints are dropped until they rejoin
+	memory int;
+	spillSize int64;
+	replayed uint64;
+	dropped uint64;
+	mu sync.Mutex;
+}
+
+// Creates a hint store keeping up to maxMemory hints in memory and spilling up to maxSpillSize bytes of
+// hints to files in dir, which an empty dir disables. Hints spilled before a restart are loaded from dir.
+func NewHintStore (dir string, maxMemory int, maxSpillSize int64, keyring *Keyring) (*HintStore, error) {
+	hs := &HintStore{
+		dir: dir,
+		maxMemory: maxMemory,
+		maxSpillSize: maxSpillSize,
+		keyring: keyring,
+		queues: make(map[string]*hintQueue),
+		left: make(map[string]struct{}),
+	}
+
+	if dir == "" {
+		return hs, nil;
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create hint directory: %w", err);
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*" + hintFileExt));
+	if err != nil {
+		return nil, err;
+	}
+
+	for _, path := range paths {
+		node, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), hintFileExt));
+		if err != nil {
+			log.Printf("Ignoring hint file %s: %v", path, err);
+			continue;
+		}
+
+		if err := hs.loadSpill(node, path); err != nil {
+			return nil, fmt.Errorf("failed to load hint file %s: %w", path, err);
+		}
+	}
+
+	return hs, nil;
+}
+
+// Opens the spill file of a node left by a previous run and counts its hints
+func (hs *HintStore) loadSpill (node, path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600);
+	if err != nil {
+		return err;
+	}
+
+	q := &hintQueue{spill: file, spillPath: path};
+	reader := bufio.NewReader(file);
+	for {
+		line, err := reader.ReadBytes('\n');
+		if err == io.EOF {
+			// A torn hint at the end, from a crash mid-write, is cut off
+			break;
+		}
+		if err != nil {
+			file.Close();
+			return err;
+		}
+
+		q.spillSize += int64(len(line));
+		q.spilled++;
+	}
+
+	if q.spilled == 0 {
+		file.Close();
+		return os.Remove(path);
+	}
+
+	if err := file.Truncate(q.spillSize); err != nil {
+		file.Close();
+		return err;
+	}
+
+	hs.queues[node] = q;
+	hs.spillSize += q.spillSize;
+	log.Printf("Loaded %d spilled hints for node %s", q.spilled, node);
+	return nil;
+}
+
+// Returns the queue of a node, creating it if needed. Must hold hs.mu.
+func (hs *HintStore) queue (node string) *hintQueue {
+	q, exists := hs.queues[node];
+	if !exists {
+		q = &hintQueue{};
+		hs.queues[node] = q;
+	}
+
+	return q;
+}
+
+// Keeps a write for a node that missed it, in memory if the node has no spilled hints and there is
+// room, or else in the node's spill file. Returns false if there was no room and the hint was dropped.
+func (hs *HintStore) add (node string, h hint) bool {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	if _, left := hs.left[node]; left {
+		hs.dropped++;
+		return false;
+	}
+
+	q := hs.queue(node);
+	if q.spill == nil && hs.memory < hs.maxMemory {
+		q.memory = append(q.memory, h);
+		hs.memory++;
+		return true;
+	}
+
+	if err := hs.spill(node, q, h); err != nil {
+		log.Printf("Dropping hint for key %s to node %s: %v", h.Key, node, err);
+		hs.dropped++;
+		return false;
+	}
+
+	return true;
+}
+
+// Appends a hint to the spill file of a node, creating it if needed. Must hold hs.mu.
+func (hs *HintStore) spill (node string, q *hintQueue, h hint) error {
+	if hs.dir == "" || hs.maxSpillSize <= 0 {
+		return fmt.Errorf("hint limit reached");
+	}
+
+	line, err := hs.encodeHint(h);
+	if err != nil {
+		return err;
+	}
+
+	if hs.spillSize + int64(len(line)) > hs.maxSpillSize {
+		return fmt.Errorf("hint spill limit reached");
+	}
+
+	if q.spill == nil {
+		q.spillPath = filepath.Join(hs.dir, url.PathEscape(node) + hintFileExt);
+		q.spill, err = os.OpenFile(q.spillPath, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0600);
+		if err != nil {
+			return err;
+		}
+	}
+
+	if _, err := q.spill.Write(line); err != nil {
+		return err;
+	}
+
+	q.spillSize += int64(len(line));
+	q.spilled++;
+	hs.spillSize += int64(len(line));
+	return nil;
+}
+
+// Encodes a hint as a line of a spill file
+func (hs *HintStore) encodeHint (h hint) ([]byte, error) {
+	line, err := json.Marshal(h);
+	if err != nil {
+		return nil, err;
+	}
+
+	if hs.keyring != nil {
+		line, err = hs.keyring.encryptLine(line);
+		if err != nil {
+			return nil, err;
+		}
+	}
+
+	return append(line, '\n'), nil;
+}
+
+// Marks the hints of a node as being replayed. Returns false if it has none or they are already being replayed.
+func (hs *HintStore) startReplay (node string) bool {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	q, exists := hs.queues[node];
+	if !exists || q.replaying || (len(q.memory) == 0 && q.spilled == 0) {
+		return false;
+	}
+
+	q.replaying = true;
+	return true;
+}
+
+// Marks the hints of a node as no longer being replayed
+func (hs *HintStore) stopReplay (node string) {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	if q, exists := hs.queues[node]; exists {
+		q.replaying = false;
+	}
+}
+
+// Returns the oldest hint for a node without removing it, along with its size in the spill file,
+// or false if there is none. A spilled hint that cannot be read drops the rest of the spill file.
+func (hs *HintStore) peek (node string) (hint, int64, bool) {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	q, exists := hs.queues[node];
+	if !exists {
+		return hint{}, 0, false;
+	}
+
+	if len(q.memory) > 0 {
+		return q.memory[0], 0, true;
+	}
+
+	if q.spill == nil {
+		return hint{}, 0, false;
+	}
+
+	h, size, err := hs.readSpilled(q);
+	if err != nil {
+		log.Printf("Dropping %d spilled hints to node %s after unreadable hint: %v", q.spilled, node, err);
+		hs.dropped += uint64(q.spilled);
+		hs.removeSpill(q);
+		return hint{}, 0, false;
+	}
+
+	return h, size, true;
+}
+
+// Reads the oldest hint not replayed from the spill file of a queue. Must hold hs.mu.
+func (hs *HintStore) readSpilled (q *hintQueue) (hint, int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(q.spill, q.spillOffset, q.spillSize - q.spillOffset));
+	line, err := reader.ReadBytes('\n');
+	if err != nil {
+		return hint{}, 0, err;
+	}
+
+	data, err := hs.keyring.decryptLine(line[:len(line)-1]);
+	if err != nil {
+		return hint{}, 0, err;
+	}
+
+	var h hint;
+	if err := json.Unmarshal(data, &h); err != nil {
+		return hint{}, 0, err;
+	}
+
+	return h, int64(len(line)), nil;
+}
+
+// Removes the oldest hint for a node, returned by peek along with its size in the spill file.
+// The spill file is removed once all its hints are replayed, so newer hints go to memory again.
+func (hs *HintStore) pop (node string, size int64, replayed bool) {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	if replayed {
+		hs.replayed++;
+	} else {
+		hs.dropped++;
+	}
+
+	q, exists := hs.queues[node];
+	if !exists {
+		return;
+	}
+
+	if len(q.memory) > 0 {
+		q.memory[0] = hint{};
+		q.memory = q.memory[1:];
+		hs.memory--;
+		return;
+	}
+
+	q.spillOffset += size;
+	q.spilled--;
+	if q.spilled <= 0 {
+		hs.removeSpill(q);
+	}
+}
+
+// Closes and removes the spill file of a queue. Must hold hs.mu.
+func (hs *HintStore) removeSpill (q *hintQueue) {
+	if q.spill == nil {
+		return;
+	}
+
+	q.spill.Close();
+	if err := os.Remove(q.spillPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing hint file %s: %v", q.spillPath, err);
+	}
+
+	hs.spillSize -= q.spillSize;
+	q.spill = nil;
+	q.spillOffset = 0;
+	q.spillSize = 0;
+	q.spilled = 0;
+}
+
+// Drops the hints of a node that left the cluster and removes its spill file. Hints added for the
+// node afterwards are dropped too, until rejoin is called for it. Returns the number of hints dropped.
+func (hs *HintStore) drop (node string) int {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	hs.left[node] = struct{}{};
+	q, exists := hs.queues[node];
+	if !exists {
+		return 0;
+	}
+
+	dropped := len(q.memory) + q.spilled;
+	hs.memory -= len(q.memory);
+	hs.dropped += uint64(dropped);
+	hs.removeSpill(q);
+	delete(hs.queues, node);
+	return dropped;
+}
+
+// Keeps hints for a node again after it rejoined the cluster
+func (hs *HintStore) rejoin (node string) {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	delete(hs.left, node);
+}
+
+// Returns the hint counters
+func (hs *HintStore) Stats () HintStats {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	stats := HintStats{Pending: hs.memory, Replayed: hs.replayed, Dropped: hs.dropped};
+	for _, q := range hs.queues {
+		stats.Pending += q.spilled;
+		stats.Spilled += q.spilled;
+	}
+
+	return stats;
+}
+
+// Closes the spill files, keeping them for the next run. Hints still in memory are saved to the spill
+// files first, so they survive a restart too. Hints added afterwards are kept in memory only.
+func (hs *HintStore) Close () {
+	hs.mu.Lock();
+	defer hs.mu.Unlock();
+
+	for node, q := range hs.queues {
+		if hs.dir != "" && (len(q.memory) > 0 || q.spillOffset > 0) {
+			if err := hs.rewriteSpill(node, q); err != nil {
+				log.Printf("Error saving %d hints for node %s: %v", len(q.memory) + q.spilled, node, err);
+			}
+		}
+
+		if q.spill != nil {
+			q.spill.Close();
+			q.spill = nil;
+		}
+	}
+
+	hs.dir = "";
+}
+
+// Replaces the spill file of a node with one holding its hints in memory, followed by the spilled
+// hints not replayed yet, since the ones in memory are older. Must hold hs.mu.
+func (hs *HintStore) rewriteSpill (node string, q *hintQueue) error {
+	path := filepath.Join(hs.dir, url.PathEscape(node) + hintFileExt);
+	tempPath := path + ".tmp";
+
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600);
+	if err != nil {
+		return err;
+	}
+	defer os.Remove(tempPath);
+	defer file.Close();
+
+	w := bufio.NewWriter(file);
+	for _, h := range q.memory {
+		line, err := hs.encodeHint(h);
+		if err != nil {
+			return err;
+		}
+		w.Write(line);
+	}
+
+	if q.spill != nil {
+		if _, err := io.Copy(w, io.NewSectionReader(q.spill, q.spillOffset, q.spillSize - q.spillOffset)); err != nil {
+			return err;
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err;
+	}
+	if err := file.Sync(); err != nil {
+		return err;
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return err;
+	}
+
+	hs.memory -= len(q.memory);
+	q.spilled += len(q.memory);
+	q.memory = nil;
+	return nil;
+}
+
+// Enables hinted handoff: writes that replicas miss are kept as hints in a store with the given limits,
+// see NewHintStore, and replayed to them by ReplayHints
+func (rm *ReplicationManager) EnableHints (dir string, maxMemory int, maxSpillSize int64, keyring *Keyring) error {
+	hints, err := NewHintStore(dir, maxMemory, maxSpillSize, keyring);
+	if err != nil {
+		return err;
+	}
+
+	rm.hints = hints;
+	return nil;
+}
+
+// Keeps a write a node failed to accept as a hint, unless hinted handoff is disabled or the node
+// rejected the write itself, in which case replaying it would fail the same way
+func (rm *ReplicationManager) addHint (node string, h hint, err error) {
+	if rm.hints == nil || !retryable(err) {
+		return;
+	}
+
+	rm.hints.add(node, h);
+}
+
+// Replays the hints kept for a node in the background, oldest first, once it is back up.
+// Stops at the first hint the node cannot be reached for, keeping it and all newer ones for the
+// next time the node comes back. Hints the node rejects are dropped.
+func (rm *ReplicationManager) ReplayHints (node string) {
+	if rm.hints == nil {
+		return;
+	}
+
+	rm.hints.rejoin(node);
+	if !rm.hints.startReplay(node) {
+		return;
+	}
+
+	rm.inflight.Add(1);
+	go func () {
+		defer rm.inflight.Done();
+		defer rm.hints.stopReplay(node);
+
+		replayed := 0;
+		for {
+			h, size, found := rm.hints.peek(node);
+			if !found {
+				break;
+			}
+
+			if err := rm.send(node, h); err != nil {
+				if retryable(err) {
+					log.Printf("Stopped replaying hints to node %s after %d: %v", node, replayed, err);
+					return;
+				}
+				log.Printf("Dropping hint for key %s rejected by node %s: %v", h.Key, node, err);
+				rm.hints.pop(node, size, false);
+				continue;
+			}
+
+			rm.hints.pop(node, size, true);
+			replayed++;
+		}
+
+		log.Printf("Replayed %d hints to node %s", replayed, node);
+	}();
+}
+
+// Drops the hints kept for a node that left the cluster, along with its spill file, so they are not
+// kept around for a node that may never come back. Writes its queues still fail while they drain are
+// dropped as well. Hints are kept for the node again once it rejoins and ReplayHints is called for it.
+func (rm *ReplicationManager) DropHints (node string) {
+	if rm.hints == nil {
+		return;
+	}
+
+	if dropped := rm.hints.drop(node); dropped > 0 {
+		log.Printf("Dropped %d hints for node %s, which left the cluster", dropped, node);
+	}
+}
+
+// Returns the hint counters, or nil if hinted handoff is disabled
+func (rm *ReplicationManager) HintStats () *HintStats {
+	if rm.hints == nil {
+		return nil;
+	}
+
+	stats := rm.hints.Stats();
+	return &stats;
+}
+
+// Closes the hint store, keeping spilled hints for the next run
+func (rm *ReplicationManager) CloseHints () {
+	if rm.hints != nil {
+		rm.hints.Close();
+	}
+}
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Returns a hint setting key
+func testHint (key string) hint {
+	return hint{Op: hintOpSet, Key: key, Value: []byte(`"value"`), Timestamp: Timestamp{Wall: 1, Node: "n1"}};
+}
+
+// Adds hints for keys to a node, failing if any is dropped
+func addTestHints (t *testing.T, hs *HintStore, node string, keys ...string) {
+	t.Helper();
+
+	for _, key := range keys {
+		if !hs.add(node, testHint(key)) {
+			t.Fatalf("hint for %s to %s was dropped", key, node);
+		}
+	}
+}
+
+// Pops all hints of a node, returning their keys in the order they came out
+func popTestHints (hs *HintStore, node string) []string {
+	var keys []string;
+	for {
+		h, size, found := hs.peek(node);
+		if !found {
+			return keys;
+		}
+		hs.pop(node, size, true);
+		keys = append(keys, h.Key);
+	}
+}
+
+// Returns the path of the spill file of a node in dir
+func hintSpillPath (dir, node string) string {
+	return filepath.Join(dir, node + hintFileExt);
+}
+
+func TestHintSpill (t *testing.T) {
+	dir := t.TempDir();
+	hs, err := NewHintStore(dir, 2, 1 << 20, nil);
+	if err != nil {
+		t.Fatalf("NewHintStore: %v", err);
+	}
+
+	addTestHints(t, hs, "n1", "k0", "k1", "k2", "k3", "k4");
+	if stats := hs.Stats(); stats.Pending != 5 || stats.Spilled != 3 {
+		t.Errorf("stats = %+v, want 5 pending of which 3 spilled", stats);
+	}
+	if _, err := os.Stat(hintSpillPath(dir, "n1")); err != nil {
+		t.Fatalf("spill file: %v", err);
+	}
+
+	if keys := popTestHints(hs, "n1"); !slices.Equal(keys, []string{"k0", "k1", "k2", "k3", "k4"}) {
+		t.Errorf("hints replayed in order %v", keys);
+	}
+	if stats := hs.Stats(); stats.Pending != 0 || stats.Replayed != 5 {
+		t.Errorf("stats = %+v after replaying all hints", stats);
+	}
+
+	// The spill file is removed once replayed, so hints go to memory again
+	if _, err := os.Stat(hintSpillPath(dir, "n1")); !os.IsNotExist(err) {
+		t.Errorf("spill file left after replaying it: %v", err);
+	}
+	addTestHints(t, hs, "n1", "k5");
+	if stats := hs.Stats(); stats.Spilled != 0 {
+		t.Errorf("stats = %+v, want the hint kept in memory", stats);
+	}
+}
+
+func TestHintLimits (t *testing.T) {
+	line, err := (&HintStore{}).encodeHint(testHint("k0"));
+	if err != nil {
+		t.Fatalf("encodeHint: %v", err);
+	}
+
+	tests := []struct {
+		name			string;
+		dir				bool;
+		maxSpillSize	int64;
+		kept			int;
+	}{
+		{"spilling disabled", false, 1 << 20, 1},
+		{"no spill size", true, 0, 1},
+		{"spill size of two hints", true, int64(2 * len(line)), 3},
+	};
+
+	for _, tt := range tests {
+		dir := "";
+		if tt.dir {
+			dir = t.TempDir();
+		}
+		hs, err := NewHintStore(dir, 1, tt.maxSpillSize, nil);
+		if err != nil {
+			t.Fatalf("NewHintStore: %v", err);
+		}
+
+		kept := 0;
+		for i := 0; i < 5; i++ {
+			if hs.add("n1", testHint(fmt.Sprintf("k%d", i))) {
+				kept++;
+			}
+		}
+		if stats := hs.Stats(); kept != tt.kept || stats.Pending != tt.kept || stats.Dropped != uint64(5 - tt.kept) {
+			t.Errorf("%s: kept %d hints, stats %+v, want %d kept", tt.name, kept, stats, tt.kept);
+		}
+	}
+}
+
+func TestHintReload (t *testing.T) {
+	keyrings := map[string]*Keyring{"plain": nil, "encrypted": testKeyring(t, testKey(1))};
+
+	for name, keyring := range keyrings {
+		t.Run(name, func (t *testing.T) {
+			dir := t.TempDir();
+			hs, err := NewHintStore(dir, 2, 1 << 20, keyring);
+			if err != nil {
+				t.Fatalf("NewHintStore: %v", err);
+			}
+
+			addTestHints(t, hs, "n1", "k0", "k1", "k2", "k3");
+			addTestHints(t, hs, "node/2", "j0");
+
+			// Replay part of the hints before closing, those must not come back
+			h, size, _ := hs.peek("n1");
+			hs.pop("n1", size, true);
+			if h.Key != "k0" {
+				t.Fatalf("first hint = %s, want k0", h.Key);
+			}
+			hs.Close();
+
+			// A hint torn by a crash mid-write is cut off
+			file, err := os.OpenFile(hintSpillPath(dir, "n1"), os.O_WRONLY|os.O_APPEND, 0600);
+			if err != nil {
+				t.Fatalf("spill file: %v", err);
+			}
+			file.WriteString(`{"op":"set","key":"torn"`);
+			file.Close();
+
+			reloaded, err := NewHintStore(dir, 2, 1 << 20, keyring);
+			if err != nil {
+				t.Fatalf("NewHintStore: %v", err);
+			}
+			if stats := reloaded.Stats(); stats.Pending != 4 || stats.Spilled != 4 {
+				t.Errorf("stats = %+v after reloading, want 4 spilled hints", stats);
+			}
+			if keys := popTestHints(reloaded, "n1"); !slices.Equal(keys, []string{"k1", "k2", "k3"}) {
+				t.Errorf("reloaded hints for n1 = %v, want [k1 k2 k3]", keys);
+			}
+			if keys := popTestHints(reloaded, "node/2"); !slices.Equal(keys, []string{"j0"}) {
+				t.Errorf("reloaded hints for node/2 = %v, want [j0]", keys);
+			}
+		});
+	}
+}
+
+func TestHintDrop (t *testing.T) {
+	dir := t.TempDir();
+	hs, err := NewHintStore(dir, 2, 1 << 20, nil);
+	if err != nil {
+		t.Fatalf("NewHintStore: %v", err);
+	}
+
+	addTestHints(t, hs, "n1", "k0", "k1", "k2", "k3");
+	addTestHints(t, hs, "n2", "j0");
+
+	if dropped := hs.drop("n1"); dropped != 4 {
+		t.Errorf("dropped %d hints, want 4", dropped);
+	}
+	if _, err := os.Stat(hintSpillPath(dir, "n1")); !os.IsNotExist(err) {
+		t.Errorf("spill file of a dropped node left: %v", err);
+	}
+	if stats := hs.Stats(); stats.Pending != 1 || stats.Dropped != 4 {
+		t.Errorf("stats = %+v after dropping n1", stats);
+	}
+	if keys := popTestHints(hs, "n2"); !slices.Equal(keys, []string{"j0"}) {
+		t.Errorf("hints of n2 = %v after dropping n1", keys);
+	}
+
+	// Hints for the node are dropped until it rejoins, and are not reloaded after a restart
+	if hs.add("n1", testHint("k4")) {
+		t.Errorf("hint for a node that left was kept");
+	}
+	hs.Close();
+
+	reloaded, err := NewHintStore(dir, 2, 1 << 20, nil);
+	if err != nil {
+		t.Fatalf("NewHintStore: %v", err);
+	}
+	if stats := reloaded.Stats(); stats.Pending != 0 {
+		t.Errorf("stats = %+v after reloading, want no hints", stats);
+	}
+
+	hs.rejoin("n1");
+	if !hs.add("n1", testHint("k5")) {
+		t.Errorf("hint for a node that rejoined was dropped");
+	}
+}
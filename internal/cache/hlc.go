@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a reading of a hybrid logical clock. It follows wall time but never goes backwards,
+// and orders every write across the cluster: by wall time, then the logical counter, then the node.
+type Timestamp struct {
+	Wall	int64	`json:"wall"`				// Wall time in nanoseconds
+	Logical	uint32	`json:"logical,omitempty"`	// Orders events that share a wall time
+	Node	string	`json:"node,omitempty"`		// Node that made the write, breaks ties
+}
+
+// Checks if the timestamp is unset, as on items written before timestamps existed
+func (t Timestamp) IsZero () bool {
+	return t.Wall == 0 && t.Logical == 0 && t.Node == "";
+}
+
+// Compares two timestamps, returning -1, 0 or 1
+func (t Timestamp) Compare (other Timestamp) int {
+	switch {
+	case t.Wall != other.Wall:
+		return cmpInt(t.Wall, other.Wall);
+	case t.Logical != other.Logical:
+		return cmpInt(t.Logical, other.Logical);
+	default:
+		return strings.Compare(t.Node, other.Node);
+	}
+}
+
+// Checks if the timestamp is later than other
+func (t Timestamp) After (other Timestamp) bool {
+	return t.Compare(other) > 0;
+}
+
+// Formats the timestamp as <wall>.<logical>.<node>, which ParseTimestamp reads back
+func (t Timestamp) String () string {
+	return fmt.Sprintf("%d.%d.%s", t.Wall, t.Logical, t.Node);
+}
+
+// Parses a timestamp formatted by Timestamp.String
+func ParseTimestamp (s string) (Timestamp, error) {
+	parts := strings.SplitN(s, ".", 3);
+	if len(parts) != 3 {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q", s);
+	}
+
+	wall, err := strconv.ParseInt(parts[0], 10, 64);
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q: %w", s, err);
+	}
+
+	logical, err := strconv.ParseUint(parts[1], 10, 32);
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid timestamp %q: %w", s, err);
+	}
+
+	return Timestamp{Wall: wall, Logical: uint32(logical), Node: parts[2]}, nil;
+}
+
+// Compares two integers, returning -1, 0 or 1
+func cmpInt [T int64 | uint32] (a, b T) int {
+	switch {
+	case a < b:
+		return -1;
+	case a > b:
+		return 1;
+	default:
+		return 0;
+	}
+}
+
+// HybridClock hands out timestamps that are unique to the node and increase on every call,
+// even if the wall clock stalls or steps back, and that follow the timestamps seen from other
+// nodes so a write made after seeing another is ordered after it.
+type HybridClock struct {
+	mu sync.Mutex;
+	node string;
+	last Timestamp;
+}
+
+// Creates a clock stamping writes with the node ID
+func NewHybridClock (node string) *HybridClock {
+	return &HybridClock{node: node};
+}
+
+// Returns a timestamp later than every one returned or observed before
+func (h *HybridClock) Now () Timestamp {
+	h.mu.Lock();
+	defer h.mu.Unlock();
+
+	wall := time.Now().UnixNano();
+	if wall > h.last.Wall {
+		h.last = Timestamp{Wall: wall};
+	} else {
+		h.last.Logical++;
+	}
+	h.last.Node = h.node;
+
+	return h.last;
+}
+
+// Returns the latest timestamp handed out or observed
+func (h *HybridClock) reading () Timestamp {
+	h.mu.Lock();
+	defer h.mu.Unlock();
+
+	return h.last;
+}
+
+// Sets the clock back to an earlier reading, forgetting the timestamps observed since.
+// Only for discarding data whose timestamps were never handed on, such as a failed load.
+func (h *HybridClock) rewind (reading Timestamp) {
+	h.mu.Lock();
+	defer h.mu.Unlock();
+
+	h.last = reading;
+}
+
+// Moves the clock past a timestamp received from another node
+func (h *HybridClock) Observe (remote Timestamp) {
+	h.mu.Lock();
+	defer h.mu.Unlock();
+
+	if remote.Wall > h.last.Wall || (remote.Wall == h.last.Wall && remote.Logical > h.last.Logical) {
+		h.last.Wall = remote.Wall;
+		h.last.Logical = remote.Logical;
+	}
+}
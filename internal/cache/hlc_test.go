@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampCompare (t *testing.T) {
+	tests := []struct {
+		a, b	Timestamp;
+		want	int;
+	}{
+		{Timestamp{}, Timestamp{}, 0},
+		{Timestamp{Wall: 1, Logical: 2, Node: "a"}, Timestamp{Wall: 1, Logical: 2, Node: "a"}, 0},
+		{Timestamp{Wall: 1}, Timestamp{Wall: 2}, -1},
+		{Timestamp{Wall: 2, Logical: 0}, Timestamp{Wall: 1, Logical: 9}, 1},
+		{Timestamp{Wall: 1, Logical: 1}, Timestamp{Wall: 1, Logical: 2}, -1},
+		{Timestamp{Wall: 1, Logical: 3, Node: "a"}, Timestamp{Wall: 1, Logical: 2, Node: "z"}, 1},
+		{Timestamp{Wall: 1, Node: "a"}, Timestamp{Wall: 1, Node: "b"}, -1},
+		{Timestamp{Wall: 1, Node: "b"}, Timestamp{Wall: 1}, 1},
+		{Timestamp{Wall: -1}, Timestamp{}, -1},
+	};
+
+	for _, tt := range tests {
+		if got := tt.a.Compare(tt.b); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tt.a, tt.b, got, tt.want);
+		}
+		if got := tt.b.Compare(tt.a); got != -tt.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tt.b, tt.a, got, -tt.want);
+		}
+		if got := tt.a.After(tt.b); got != (tt.want > 0) {
+			t.Errorf("%v.After(%v) = %v", tt.a, tt.b, got);
+		}
+	}
+}
+
+func TestParseTimestamp (t *testing.T) {
+	tests := []struct {
+		s		string;
+		want	Timestamp;
+		valid	bool;
+	}{
+		{"0.0.", Timestamp{}, true},
+		{"1700000000000000000.3.node-1", Timestamp{Wall: 1700000000000000000, Logical: 3, Node: "node-1"}, true},
+		{"5.0.host.example.com", Timestamp{Wall: 5, Node: "host.example.com"}, true},
+		{"-5.1.n", Timestamp{Wall: -5, Logical: 1, Node: "n"}, true},
+		{"", Timestamp{}, false},
+		{"1.2", Timestamp{}, false},
+		{"x.1.n", Timestamp{}, false},
+		{"1.-1.n", Timestamp{}, false},
+		{"1.4294967296.n", Timestamp{}, false},
+	};
+
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.s);
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseTimestamp(%q): err = %v, want valid %v", tt.s, err, tt.valid);
+			continue;
+		}
+		if got != tt.want {
+			t.Errorf("ParseTimestamp(%q) = %+v, want %+v", tt.s, got, tt.want);
+		}
+		if tt.valid && got.String() != tt.s {
+			t.Errorf("ParseTimestamp(%q).String() = %q", tt.s, got.String());
+		}
+	}
+}
+
+func TestHybridClockIncreases (t *testing.T) {
+	clock := NewHybridClock("node-1");
+
+	last := clock.Now();
+	for i := 0; i < 10000; i++ {
+		ts := clock.Now();
+		if !ts.After(last) {
+			t.Fatalf("Now() = %v after %v", ts, last);
+		}
+		if ts.Node != "node-1" {
+			t.Fatalf("Now() stamped node %q", ts.Node);
+		}
+		last = ts;
+	}
+}
+
+func TestHybridClockObserve (t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixNano();
+	past := time.Now().Add(-time.Hour).UnixNano();
+
+	tests := []struct {
+		name		string;
+		observed	[]Timestamp;
+		after		Timestamp;	// Now must be later than this
+		followsWall	bool;		// Now must be taken from the wall clock, not the observed timestamps
+	}{
+		{"nothing observed", nil, Timestamp{}, true},
+		{"remote in the past", []Timestamp{{Wall: past, Logical: 7, Node: "z"}}, Timestamp{Wall: past, Logical: 7, Node: "z"}, true},
+		{"remote ahead", []Timestamp{{Wall: future, Logical: 7, Node: "a"}}, Timestamp{Wall: future, Logical: 7, Node: "z"}, false},
+		{"later logical at the same wall", []Timestamp{{Wall: future, Logical: 2}, {Wall: future, Logical: 9}}, Timestamp{Wall: future, Logical: 9, Node: "z"}, false},
+		{"older remote after a newer one", []Timestamp{{Wall: future, Logical: 9}, {Wall: future, Logical: 2}}, Timestamp{Wall: future, Logical: 9, Node: "z"}, false},
+	};
+
+	for _, tt := range tests {
+		clock := NewHybridClock("node-1");
+		for _, ts := range tt.observed {
+			clock.Observe(ts);
+		}
+
+		before := time.Now().UnixNano();
+		ts := clock.Now();
+		if !ts.After(tt.after) {
+			t.Errorf("%s: Now() = %v, want after %v", tt.name, ts, tt.after);
+		}
+		if ts.Node != "node-1" {
+			t.Errorf("%s: Now() stamped node %q", tt.name, ts.Node);
+		}
+		if tt.followsWall && (ts.Wall < before || ts.Logical != 0) {
+			t.Errorf("%s: Now() = %v, want the wall time", tt.name, ts);
+		}
+		if !tt.followsWall && ts.Wall != tt.after.Wall {
+			t.Errorf("%s: Now() = %v, want the observed wall time", tt.name, ts);
+		}
+	}
+}
+
+func TestHybridClockRewind (t *testing.T) {
+	clock := NewHybridClock("node-1");
+	reading := clock.reading();
+
+	future := Timestamp{Wall: time.Now().Add(time.Hour).UnixNano(), Node: "remote"};
+	clock.Observe(future);
+	clock.rewind(reading);
+
+	if ts := clock.Now(); ts.Wall >= future.Wall {
+		t.Errorf("Now() = %v after rewinding, still follows the discarded %v", ts, future);
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Number of bits of the hash used to pick a register
+const hllPrecision = 14;
+
+// Number of registers (2^precision), giving a standard error of about 0.81%
+const hllRegisters = 1 << hllPrecision;
+
+// HyperLogLog estimates the number of distinct items added to it in fixed memory
+type HyperLogLog struct {
+	Registers	[]uint8	`json:"registers"`
+}
+
+// Creates an empty HyperLogLog
+func NewHyperLogLog () *HyperLogLog {
+	return &HyperLogLog{
+		Registers: make([]uint8, hllRegisters),
+	}
+}
+
+// Adds an item, returns true if the estimate may have changed
+func (h *HyperLogLog) Add (item string) bool {
+	hasher := fnv.New64a();
+	hasher.Write([]byte(item));
+	hash := mix64(hasher.Sum64());
+
+	// The first bits pick the register, the rest give the rank
+	idx := hash >> (64 - hllPrecision);
+	rank := uint8(bits.LeadingZeros64(hash << hllPrecision | 1 << (hllPrecision - 1)) + 1);
+
+	if rank > h.Registers[idx] {
+		h.Registers[idx] = rank;
+		return true;
+	}
+
+	return false;
+}
+
+// Returns the estimated number of distinct items
+func (h *HyperLogLog) Count () uint64 {
+	m := float64(hllRegisters);
+	sum := 0.0;
+	zeros := 0;
+
+	for _, r := range h.Registers {
+		sum += 1.0 / float64(uint64(1) << r);
+		if r == 0 {
+			zeros++;
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079 / m);
+	estimate := alpha * m * m / sum;
+
+	// Use linear counting for small cardinalities
+	if estimate <= 2.5 * m && zeros > 0 {
+		estimate = m * math.Log(m / float64(zeros));
+	}
+
+	return uint64(estimate + 0.5);
+}
+
+// Merges another HyperLogLog into this one by taking the max of each register
+func (h *HyperLogLog) Merge (other Mergeable) error {
+	o, ok := other.(*HyperLogLog);
+	if !ok {
+		return ErrWrongType;
+	}
+
+	if len(o.Registers) != len(h.Registers) {
+		return fmt.Errorf("cannot merge hyperloglogs with different precision");
+	}
+
+	for i, r := range o.Registers {
+		if r > h.Registers[i] {
+			h.Registers[i] = r;
+		}
+	}
+
+	return nil;
+}
+
+// Returns a deep copy of the HyperLogLog
+func (h *HyperLogLog) Clone () Mergeable {
+	registers := make([]uint8, len(h.Registers));
+	copy(registers, h.Registers);
+
+	return &HyperLogLog{Registers: registers};
+}
+
+// Returns the value type name of the HyperLogLog
+func (h *HyperLogLog) Type () string {
+	return ValueTypeHLL;
+}
+
+// Validates a HyperLogLog decoded from disk or from another node
+func (h *HyperLogLog) validate () error {
+	if len(h.Registers) != hllRegisters {
+		return fmt.Errorf("invalid hyperloglog");
+	}
+
+	return nil;
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// Returns a HyperLogLog of count distinct items named prefix-i
+func testHyperLogLog (prefix string, count int) *HyperLogLog {
+	h := NewHyperLogLog();
+	for i := 0; i < count; i++ {
+		h.Add(fmt.Sprintf("%s-%d", prefix, i));
+	}
+
+	return h;
+}
+
+func TestHyperLogLogCount (t *testing.T) {
+	for _, count := range []int{0, 1, 100, 10000, 200000} {
+		h := testHyperLogLog("item", count);
+
+		// Adding the same items again does not change the estimate
+		before := h.Count();
+		for i := 0; i < count && i < 1000; i++ {
+			if h.Add(fmt.Sprintf("item-%d", i)) {
+				t.Fatalf("adding item-%d again changed a register", i);
+			}
+		}
+		if h.Count() != before {
+			t.Errorf("count of %d items changed from %d to %d by duplicates", count, before, h.Count());
+		}
+
+		// Within 5% of the true count, the standard error being about 0.81%
+		if diff := math.Abs(float64(before) - float64(count)); diff > 0.05 * float64(count) + 1 {
+			t.Errorf("count of %d items = %d", count, before);
+		}
+	}
+}
+
+func TestHyperLogLogMerge (t *testing.T) {
+	a := testHyperLogLog("a", 5000);
+	b := testHyperLogLog("b", 5000);
+	overlap := testHyperLogLog("a", 2500);
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge: %v", err);
+	}
+	if err := a.Merge(overlap); err != nil {
+		t.Fatalf("Merge: %v", err);
+	}
+	if count := a.Count(); count < 9500 || count > 10500 {
+		t.Errorf("merged count = %d, want about 10000", count);
+	}
+
+	// Merging is idempotent
+	before := a.Count();
+	a.Merge(a.Clone());
+	if a.Count() != before {
+		t.Errorf("merging a copy changed the count from %d to %d", before, a.Count());
+	}
+
+	if err := a.Merge(&HyperLogLog{Registers: make([]uint8, 16)}); err == nil {
+		t.Errorf("merged hyperloglogs with different precision");
+	}
+	if err := a.Merge(&BloomFilter{}); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Merge of a BloomFilter: err = %v, want ErrWrongType", err);
+	}
+}
+
+func TestDecodeHyperLogLog (t *testing.T) {
+	valid, err := json.Marshal(NewHyperLogLog());
+	if err != nil {
+		t.Fatalf("Marshal: %v", err);
+	}
+
+	tests := []struct {
+		name	string;
+		data	string;
+		valid	bool;
+	}{
+		{"valid", string(valid), true},
+		{"no registers", `{"registers":null}`, false},
+		{"too few registers", `{"registers":"AAAA"}`, false},
+	};
+
+	for _, tt := range tests {
+		if _, err := DecodeMergeable(ValueTypeHLL, []byte(tt.data)); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid);
+		}
+	}
+}
+
+func TestHLLMerge (t *testing.T) {
+	c := NewCache("lru", 100);
+	c.HLLAdd("monday", []string{"alice", "bob"}, time.Hour);
+	c.HLLAdd("tuesday", []string{"bob", "carol"}, time.Hour);
+
+	if count, err := c.HLLCount("monday", "tuesday"); err != nil || count != 3 {
+		t.Errorf("HLLCount = %d, %v, want 3", count, err);
+	}
+	if err := c.HLLMerge("week", "monday", "tuesday"); err != nil {
+		t.Fatalf("HLLMerge: %v", err);
+	}
+	if count, err := c.HLLCount("week"); err != nil || count != 3 {
+		t.Errorf("HLLCount of the merged key = %d, %v, want 3", count, err);
+	}
+
+	c.Set("name", "alice", time.Hour);
+	if _, err := c.HLLCount("name"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("HLLCount of a string: err = %v, want ErrWrongType", err);
+	}
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrLockHeld = errors.New("lock is held by another owner");
+	ErrLockNotHeld = errors.New("lock is not held by this owner");
+)
+
+// Lease represents a named lock held by an owner until it expires
+type Lease struct {
+	Name		string	`json:"name"`;
+	Owner		string	`json:"owner"`;
+	Token		uint64	`json:"token"`;	// Fencing token, increases on every acquisition
+	Version		uint64	`json:"version"`;	// Increases on every change of the lease, so replicas apply them in order
+	Expiration	int64	`json:"expiration"`;
+}
+
+// Checks if the lease is free to be acquired
+func (l Lease) isFree (now int64) bool {
+	return l.Owner == "" || l.Expiration < now;
+}
+
+// Checks if the lease is a later state of the lock than other, by fencing token and then version
+func (l Lease) newerThan (other Lease) bool {
+	if l.Token != other.Token {
+		return l.Token > other.Token;
+	}
+
+	return l.Version > other.Version;
+}
+
+// Stores a lease and records it in the append-only log. Must hold c.mu.
+func (c *Cache) storeLease (lease Lease) {
+	c.leases[lease.Name] = lease;
+
+	if c.aof != nil {
+		c.aof.recordLease(lease);
+	}
+}
+
+// Stores a lease unless the cache holds the same or a later state of the lock. Must hold c.mu.
+// Returns false if the lease was stale.
+func (c *Cache) applyLease (lease Lease) bool {
+	if current, found := c.leases[lease.Name]; found && !lease.newerThan(current) {
+		return false;
+	}
+
+	c.storeLease(lease);
+	return true;
+}
+
+// Acquires the named lock for the owner, issuing a new fencing token.
+// Acquiring a lock the owner already holds extends it and keeps the token.
+func (c *Cache) AcquireLock (name, owner string, ttl time.Duration) (Lease, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	now := time.Now().UnixNano();
+	lease := c.leases[name];
+
+	if !lease.isFree(now) && lease.Owner != owner {
+		return lease, ErrLockHeld;
+	}
+
+	if lease.isFree(now) {
+		// The token survives releases, so it only ever moves forward
+		lease.Token++;
+	}
+
+	lease.Name = name;
+	lease.Owner = owner;
+	lease.Version++;
+	lease.Expiration = now + int64(ttl);
+	c.storeLease(lease);
+
+	return lease, nil;
+}
+
+// Extends the lease held by the owner with the given fencing token
+func (c *Cache) RenewLock (name, owner string, token uint64, ttl time.Duration) (Lease, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	now := time.Now().UnixNano();
+	lease, found := c.leases[name];
+
+	if !found || lease.isFree(now) || lease.Owner != owner || lease.Token != token {
+		return lease, ErrLockNotHeld;
+	}
+
+	lease.Version++;
+	lease.Expiration = now + int64(ttl);
+	c.storeLease(lease);
+
+	return lease, nil;
+}
+
+// Releases the lease held by the owner with the given fencing token
+func (c *Cache) ReleaseLock (name, owner string, token uint64) (Lease, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	now := time.Now().UnixNano();
+	lease, found := c.leases[name];
+
+	if !found || lease.isFree(now) || lease.Owner != owner || lease.Token != token {
+		return lease, ErrLockNotHeld;
+	}
+
+	// Keep the entry so the next acquisition continues from this token
+	lease.Owner = "";
+	lease.Version++;
+	lease.Expiration = 0;
+	c.storeLease(lease);
+
+	return lease, nil;
+}
+
+// Returns the current lease for the named lock
+func (c *Cache) GetLease (name string) (Lease, bool) {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	lease, found := c.leases[name];
+	if !found || lease.isFree(time.Now().UnixNano()) {
+		return lease, false;
+	}
+
+	return lease, true;
+}
+
+// Applies a lease replicated from the lock's primary node. Leases that are not later than the local one,
+// such as a renewal arriving after the release that followed it, are ignored. Returns false if it was stale.
+func (c *Cache) ApplyLease (lease Lease) bool {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	return c.applyLease(lease);
+}
+
+// Copies every lease, including released ones whose fencing token must survive, into snapshot records
+func (c *Cache) leaseRecords () []SnapshotRecord {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	records := make([]SnapshotRecord, 0, len(c.leases));
+	for name, lease := range c.leases {
+		records = append(records, SnapshotRecord{Key: name, Lease: &lease});
+	}
+
+	return records;
+}
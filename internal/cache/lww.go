@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"time"
+)
+
+// How long tombstones of deleted keys are kept unless configured otherwise
+const defaultTombstoneTTL = time.Hour;
+
+// Sets the clock that stamps writes made on this node, normally one with the node's ID
+func (c *Cache) SetClock (clock *HybridClock) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.clock = clock;
+}
+
+// Sets how long tombstones of deleted keys are kept. Writes of a key older than its delete
+// are only rejected while the tombstone is kept, so this should outlast any replication delay.
+func (c *Cache) SetTombstoneTTL (ttl time.Duration) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.tombstoneTTL = ttl;
+}
+
+// Checks if a write stamped ts is later than the live copy of key or, if there is none,
+// the tombstone of key. Must hold c.mu.
+func (c *Cache) supersedes (key string, ts Timestamp) bool {
+	now := time.Now().UnixNano();
+
+	if item, found := c.items[key]; found && (item.Expiration == 0 || item.Expiration >= now) {
+		return ts.After(item.Timestamp);
+	}
+
+	if c.disk != nil {
+		if stamp, found := c.disk.timestamp(key, now); found {
+			return ts.After(stamp);
+		}
+	}
+
+	if stamp, found := c.tombstones[key]; found {
+		return ts.After(stamp);
+	}
+
+	return true;
+}
+
+// Deletes key and records its tombstone. Must hold c.mu.
+func (c *Cache) tombstone (key string, ts Timestamp) {
+	_, found := c.items[key];
+	delete(c.items, key);
+	delete(c.accessCount, key);
+	c.tombstones[key] = ts;
+
+	if c.removeFromDisk(key) || found {
+		c.emit(EventDelete, key);
+	}
+}
+
+// Drops the tombstones older than the tombstone TTL. Must hold c.mu.
+func (c *Cache) removeExpiredTombstones (now int64) {
+	cutoff := now - int64(c.tombstoneTTL);
+
+	for key, ts := range c.tombstones {
+		if ts.Wall < cutoff {
+			delete(c.tombstones, key);
+		}
+	}
+}
+
+// Stores a value replicated from another node, unless the local copy or tombstone of key is newer
+// because writes arrived out of order. A zero timestamp, from a node that predates timestamps,
+// is replaced by a local one. Returns false if the value was older and dropped.
+func (c *Cache) applyReplicatedSet (key string, value interface{}, ttl time.Duration, ts Timestamp) bool {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	ts = c.observe(ts);
+	if !c.supersedes(key, ts) {
+		return false;
+	}
+
+	if _, found := c.items[key]; !found && len(c.items) >= c.maxItems {
+		c.evict();
+	}
+
+	c.removeFromDisk(key);
+	delete(c.tombstones, key);
+
+	c.items[key] = CacheItem{
+		Value: value,
+		Expiration: time.Now().Add(ttl).UnixNano(),
+		LastAccess: time.Now().UnixNano(),
+		Version: c.nextVersion(),
+		Timestamp: ts,
+	}
+	c.emit(EventSet, key);
+
+	return true;
+}
+
+// Stores a value replicated from another node. Mergeable values are merged with the local copy so
+// replicas converge, others are applied by applyReplicatedSet.
+func (c *Cache) applyReplicated (key string, value interface{}, ttl time.Duration, ts Timestamp) error {
+	if m, ok := value.(Mergeable); ok {
+		_, err := c.MergeValue(key, m, ttl, ts);
+		return err;
+	}
+
+	c.applyReplicatedSet(key, value, ttl, ts);
+	return nil;
+}
+
+// Deletes a key on behalf of another node, unless the local copy was written after the delete.
+// Returns false if the delete was older and dropped.
+func (c *Cache) applyReplicatedDelete (key string, ts Timestamp) bool {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	ts = c.observe(ts);
+	if !c.supersedes(key, ts) {
+		return false;
+	}
+
+	c.tombstone(key, ts);
+	return true;
+}
+
+// Moves the clock past a timestamp received from another node, or stamps the write locally
+// if it has no timestamp. Returns the timestamp to store. Must hold c.mu.
+func (c *Cache) observe (ts Timestamp) Timestamp {
+	if ts.IsZero() {
+		return c.clock.Now();
+	}
+
+	c.clock.Observe(ts);
+	return ts;
+}
+
+// Reads a value along with its version, expiration and timestamp without promoting it from the disk
+// tier or counting the access, so reads by other nodes and read repair leave eviction order and hit
+// rates alone. For a missing key the timestamp is that of its tombstone, or zero if there is none.
+// Mergeable values are copied.
+func (c *Cache) peekStamped (key string) ReadResult {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	item, found := c.items[key];
+	if !found && c.disk != nil {
+		item, _, found = c.disk.peek(key);
+	}
+	if !found || (item.Expiration > 0 && item.Expiration < time.Now().UnixNano()) {
+		return ReadResult{Timestamp: c.tombstones[key]};
+	}
+
+	value := item.Value;
+	if m, ok := value.(Mergeable); ok {
+		value = m.Clone();
+	}
+
+	return ReadResult{Value: value, Version: item.Version, Expiration: item.Expiration, Timestamp: item.Timestamp, Found: true};
+}
+
+// Copies the tombstones into snapshot records, so deletes are still known after a restart
+func (c *Cache) tombstoneRecords () []SnapshotRecord {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	records := make([]SnapshotRecord, 0, len(c.tombstones));
+	for key, ts := range c.tombstones {
+		records = append(records, SnapshotRecord{Key: key, Timestamp: ts, Deleted: true});
+	}
+
+	return records;
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// A write replicated from another node
+type remoteWrite struct {
+	op		string;	// "set", "del" or "hll"
+	value	string;	// Value of a set, or item added to a HyperLogLog
+	ts		Timestamp;
+}
+
+// Applies replicated writes to a new cache, returning whether each was applied
+func applyReplicatedWrites (t *testing.T, writes []remoteWrite) (*Cache, []bool) {
+	t.Helper();
+
+	c := NewCache("lru", 100);
+	c.SetClock(NewHybridClock("local"));
+
+	applied := make([]bool, 0, len(writes));
+	for _, w := range writes {
+		switch w.op {
+		case "set":
+			applied = append(applied, c.applyReplicatedSet("key", w.value, time.Hour, w.ts));
+		case "del":
+			applied = append(applied, c.applyReplicatedDelete("key", w.ts));
+		case "hll":
+			hll := NewHyperLogLog();
+			hll.Add(w.value);
+			ok, err := c.MergeValue("key", hll, time.Hour, w.ts);
+			if err != nil {
+				t.Fatalf("MergeValue: %v", err);
+			}
+			applied = append(applied, ok);
+		}
+	}
+
+	return c, applied;
+}
+
+func TestLastWriteWins (t *testing.T) {
+	stamp := func (wall int64, node string) Timestamp { return Timestamp{Wall: wall, Node: node} };
+
+	tests := []struct {
+		name		string;
+		writes		[]remoteWrite;
+		applied		[]bool;
+		value		interface{};	// Expected value of key, nil if it is deleted
+		timestamp	Timestamp;		// Of the item, or of the tombstone if deleted. Zero if stamped locally.
+	}{
+		{
+			name: "in order",
+			writes: []remoteWrite{{"set", "a", stamp(1, "n1")}, {"set", "b", stamp(2, "n1")}},
+			applied: []bool{true, true},
+			value: "b",
+			timestamp: stamp(2, "n1"),
+		},
+		{
+			name: "out of order",
+			writes: []remoteWrite{{"set", "b", stamp(2, "n1")}, {"set", "a", stamp(1, "n1")}},
+			applied: []bool{true, false},
+			value: "b",
+			timestamp: stamp(2, "n1"),
+		},
+		{
+			name: "same wall time, higher node wins",
+			writes: []remoteWrite{{"set", "from n2", stamp(5, "n2")}, {"set", "from n1", stamp(5, "n1")}},
+			applied: []bool{true, false},
+			value: "from n2",
+			timestamp: stamp(5, "n2"),
+		},
+		{
+			name: "same wall time, higher logical counter wins",
+			writes: []remoteWrite{{"set", "a", Timestamp{Wall: 5, Logical: 1, Node: "n2"}}, {"set", "b", Timestamp{Wall: 5, Logical: 2, Node: "n1"}}},
+			applied: []bool{true, true},
+			value: "b",
+			timestamp: Timestamp{Wall: 5, Logical: 2, Node: "n1"},
+		},
+		{
+			name: "duplicate write",
+			writes: []remoteWrite{{"set", "a", stamp(3, "n1")}, {"set", "a", stamp(3, "n1")}},
+			applied: []bool{true, false},
+			value: "a",
+			timestamp: stamp(3, "n1"),
+		},
+		{
+			name: "delete after set",
+			writes: []remoteWrite{{"set", "a", stamp(1, "n1")}, {"del", "", stamp(2, "n2")}},
+			applied: []bool{true, true},
+			timestamp: stamp(2, "n2"),
+		},
+		{
+			name: "older delete is dropped",
+			writes: []remoteWrite{{"set", "a", stamp(2, "n1")}, {"del", "", stamp(1, "n2")}},
+			applied: []bool{true, false},
+			value: "a",
+			timestamp: stamp(2, "n1"),
+		},
+		{
+			name: "tombstone rejects an older set",
+			writes: []remoteWrite{{"del", "", stamp(3, "n1")}, {"set", "a", stamp(2, "n2")}},
+			applied: []bool{true, false},
+			timestamp: stamp(3, "n1"),
+		},
+		{
+			name: "newer set replaces the tombstone",
+			writes: []remoteWrite{{"del", "", stamp(3, "n1")}, {"set", "a", stamp(4, "n2")}},
+			applied: []bool{true, true},
+			value: "a",
+			timestamp: stamp(4, "n2"),
+		},
+		{
+			name: "tombstone rejects an older merge",
+			writes: []remoteWrite{{"hll", "x", stamp(1, "n1")}, {"del", "", stamp(3, "n1")}, {"hll", "y", stamp(2, "n2")}},
+			applied: []bool{true, true, false},
+			timestamp: stamp(3, "n1"),
+		},
+		{
+			name: "newer merge replaces the tombstone",
+			writes: []remoteWrite{{"del", "", stamp(3, "n1")}, {"hll", "y", stamp(4, "n2")}},
+			applied: []bool{true, true},
+			value: uint64(1),
+			timestamp: stamp(4, "n2"),
+		},
+		{
+			name: "merges combine regardless of order, restamped as a new write",
+			writes: []remoteWrite{{"hll", "x", stamp(2, "n1")}, {"hll", "y", stamp(1, "n2")}},
+			applied: []bool{true, true},
+			value: uint64(2),
+		},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c, applied := applyReplicatedWrites(t, tt.writes);
+
+			for i := range applied {
+				if applied[i] != tt.applied[i] {
+					t.Errorf("write %d applied = %v, want %v", i, applied[i], tt.applied[i]);
+				}
+			}
+
+			result := c.peekStamped("key");
+			value := result.Value;
+			if hll, ok := value.(*HyperLogLog); ok {
+				value = hll.Count();
+			}
+
+			if result.Found != (tt.value != nil) || (tt.value != nil && value != tt.value) {
+				t.Errorf("key = %v (found %v), want %v", value, result.Found, tt.value);
+			}
+			if tt.timestamp.IsZero() {
+				for _, w := range tt.writes {
+					if result.Timestamp.Node != "local" || !result.Timestamp.After(w.ts) {
+						t.Errorf("timestamp = %v, want a local one after %v", result.Timestamp, w.ts);
+					}
+				}
+			} else if result.Timestamp != tt.timestamp {
+				t.Errorf("timestamp = %v, want %v", result.Timestamp, tt.timestamp);
+			}
+
+			// Local writes are ordered after every write seen from other nodes
+			if local := c.clock.Now(); !local.After(tt.writes[len(tt.writes) - 1].ts) {
+				t.Errorf("local timestamp %v not after the replicated writes", local);
+			}
+		});
+	}
+}
+
+func TestReplicatedWriteWithoutTimestamp (t *testing.T) {
+	c, applied := applyReplicatedWrites(t, []remoteWrite{{"del", "", Timestamp{Wall: 1, Node: "n1"}}, {"set", "a", Timestamp{}}});
+
+	// Writes from nodes that predate timestamps are stamped locally, so they are treated as new
+	if !applied[1] {
+		t.Fatalf("unstamped set was dropped");
+	}
+	if result := c.peekStamped("key"); !result.Found || result.Timestamp.Node != "local" {
+		t.Errorf("unstamped set = %+v, want it stamped by the local clock", result);
+	}
+}
+
+func TestExpiredTombstones (t *testing.T) {
+	old := Timestamp{Wall: time.Now().Add(-2 * time.Hour).UnixNano(), Node: "n1"};
+	recent := Timestamp{Wall: time.Now().Add(-time.Minute).UnixNano(), Node: "n1"};
+
+	c := NewCache("lru", 100);
+	c.SetTombstoneTTL(time.Hour);
+	c.applyReplicatedDelete("old", old);
+	c.applyReplicatedDelete("recent", recent);
+
+	c.mu.Lock();
+	c.removeExpiredTombstones(time.Now().UnixNano());
+	c.mu.Unlock();
+
+	if _, found := c.tombstones["old"]; found {
+		t.Errorf("tombstone older than the TTL was kept");
+	}
+	if _, found := c.tombstones["recent"]; !found {
+		t.Errorf("tombstone within the TTL was dropped");
+	}
+
+	// Once the tombstone is gone, a write older than the delete is accepted again
+	before := Timestamp{Wall: old.Wall - 1, Node: "n2"};
+	if !c.applyReplicatedSet("old", "value", time.Hour, before) {
+		t.Errorf("set of a key without a tombstone was dropped");
+	}
+	if c.applyReplicatedSet("recent", "value", time.Hour, Timestamp{Wall: recent.Wall - 1, Node: "n2"}) {
+		t.Errorf("set older than a kept tombstone was applied");
+	}
+}
@@ -0,0 +1,323 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Value type names used on the wire and on disk
+const (
+	ValueTypeBloom = "bloom";
+	ValueTypeHLL = "hll";
+	ValueTypeSiblings = "siblings";
+)
+
+var ErrWrongType = errors.New("operation against a key holding the wrong kind of value");
+
+// Mergeable is a value type whose copies on different nodes can be reconciled by merging
+type Mergeable interface {
+	Merge(other Mergeable) error
+	Clone() Mergeable
+	Type() string
+}
+
+// Decodes a JSON encoded mergeable value of the given type
+func DecodeMergeable (valueType string, data []byte) (Mergeable, error) {
+	switch valueType {
+	case ValueTypeBloom:
+		bf := &BloomFilter{};
+		if err := json.Unmarshal(data, bf); err != nil {
+			return nil, err;
+		}
+		return bf, bf.validate();
+	case ValueTypeHLL:
+		h := &HyperLogLog{};
+		if err := json.Unmarshal(data, h); err != nil {
+			return nil, err;
+		}
+		return h, h.validate();
+	case ValueTypeSiblings:
+		s := &SiblingSet{};
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err;
+		}
+		return s, s.validate();
+	default:
+		return nil, fmt.Errorf("unknown value type %q", valueType);
+	}
+}
+
+// Returns the expiration timestamp for a ttl, where zero means the item never expires
+func expirationFor (ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0;
+	}
+
+	return time.Now().Add(ttl).UnixNano();
+}
+
+// Returns the live item stored at key, removing it if it has expired. Must hold c.mu.
+func (c *Cache) liveItem (key string) (CacheItem, bool) {
+	item, found := c.items[key];
+	if !found {
+		return c.promote(key);
+	}
+
+	if item.Expiration > 0 && item.Expiration < time.Now().UnixNano() {
+		delete(c.items, key);
+		delete(c.accessCount, key);
+		c.emit(EventExpire, key);
+		return item, false;
+	}
+
+	return item, true;
+}
+
+// Stores a new mergeable value written locally, evicting if needed. Must hold c.mu.
+func (c *Cache) storeMergeable (key string, value Mergeable, ttl time.Duration) {
+	c.storeMergeableStamped(key, value, expirationFor(ttl), c.clock.Now());
+}
+
+// Stores a new mergeable value with the timestamp of its write, evicting if needed. Must hold c.mu.
+func (c *Cache) storeMergeableStamped (key string, value Mergeable, expiration int64, ts Timestamp) {
+	if _, exists := c.items[key]; !exists && len(c.items) >= c.maxItems {
+		c.evict();
+	}
+
+	c.removeFromDisk(key);
+	c.items[key] = CacheItem{
+		Value: value,
+		Expiration: expiration,
+		LastAccess: time.Now().UnixNano(),
+		Version: c.nextVersion(),
+		Timestamp: ts,
+	}
+	delete(c.tombstones, key);
+}
+
+// Adds items to the bloom filter at key, creating it with the given capacity and error rate if missing.
+// Returns for each item whether it was newly added.
+func (c *Cache) BloomAdd (key string, items []string, capacity uint64, errorRate float64, ttl time.Duration) ([]bool, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	var bf *BloomFilter;
+	changed := false;
+	if item, found := c.liveItem(key); found {
+		existing, ok := item.Value.(*BloomFilter);
+		if !ok {
+			return nil, ErrWrongType;
+		}
+		bf = existing;
+	} else {
+		created, err := NewBloomFilter(capacity, errorRate);
+		if err != nil {
+			return nil, err;
+		}
+		bf = created;
+		c.storeMergeable(key, bf, ttl);
+		changed = true;
+	}
+
+	added := make([]bool, len(items));
+	for i, item := range items {
+		added[i] = bf.Add(item);
+		changed = changed || added[i];
+	}
+	c.accessCount[key]++;
+
+	if changed {
+		c.bumpVersion(key);
+		c.emit(EventSet, key);
+	}
+
+	return added, nil;
+}
+
+// Checks items against the bloom filter at key.
+// Returns false for every item if the filter does not exist.
+func (c *Cache) BloomCheck (key string, items []string) ([]bool, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	results := make([]bool, len(items));
+
+	item, found := c.liveItem(key);
+	if !found {
+		return results, nil;
+	}
+
+	bf, ok := item.Value.(*BloomFilter);
+	if !ok {
+		return nil, ErrWrongType;
+	}
+
+	for i, it := range items {
+		results[i] = bf.Check(it);
+	}
+	c.accessCount[key]++;
+
+	return results, nil;
+}
+
+// Adds items to the HyperLogLog at key, creating it if missing.
+// Returns true if the estimated cardinality may have changed.
+func (c *Cache) HLLAdd (key string, items []string, ttl time.Duration) (bool, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	var h *HyperLogLog;
+	changed := false;
+	if item, found := c.liveItem(key); found {
+		existing, ok := item.Value.(*HyperLogLog);
+		if !ok {
+			return false, ErrWrongType;
+		}
+		h = existing;
+	} else {
+		h = NewHyperLogLog();
+		c.storeMergeable(key, h, ttl);
+		changed = true;
+	}
+
+	for _, item := range items {
+		if h.Add(item) {
+			changed = true;
+		}
+	}
+	c.accessCount[key]++;
+
+	if changed {
+		c.bumpVersion(key);
+		c.emit(EventSet, key);
+	}
+
+	return changed, nil;
+}
+
+// Returns the estimated cardinality of the union of the HyperLogLogs at the given keys.
+// Missing keys count as empty.
+func (c *Cache) HLLCount (keys ...string) (uint64, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	union := NewHyperLogLog();
+	for _, key := range keys {
+		item, found := c.liveItem(key);
+		if !found {
+			continue;
+		}
+
+		h, ok := item.Value.(*HyperLogLog);
+		if !ok {
+			return 0, ErrWrongType;
+		}
+
+		union.Merge(h);
+		c.accessCount[key]++;
+	}
+
+	return union.Count(), nil;
+}
+
+// Merges the HyperLogLogs at the source keys into the one at dest, creating it if missing
+func (c *Cache) HLLMerge (dest string, sources ...string) error {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	merged := NewHyperLogLog();
+	for _, key := range append([]string{dest}, sources...) {
+		item, found := c.liveItem(key);
+		if !found {
+			continue;
+		}
+
+		h, ok := item.Value.(*HyperLogLog);
+		if !ok {
+			return ErrWrongType;
+		}
+
+		merged.Merge(h);
+	}
+
+	if item, found := c.liveItem(dest); found {
+		item.Value = merged;
+		item.LastAccess = time.Now().UnixNano();
+		item.Version = c.nextVersion();
+		item.Timestamp = c.clock.Now();
+		c.items[dest] = item;
+	} else {
+		c.storeMergeable(dest, merged, 0);
+	}
+	c.accessCount[dest]++;
+	c.emit(EventSet, dest);
+
+	return nil;
+}
+
+// Merges a value received from another node, written at ts, into the value at key. If the key is
+// missing or holds a different type, the value replaces it unless the local copy or the tombstone of
+// the key is later. A zero timestamp, from nodes that predate timestamps, is stamped locally.
+// Returns false if the value was dropped.
+func (c *Cache) MergeValue (key string, value Mergeable, ttl time.Duration, ts Timestamp) (bool, error) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	return c.mergeValue(key, value, expirationFor(ttl), ts);
+}
+
+// Merges a value received from another node into the value at key, see MergeValue. Must hold c.mu.
+func (c *Cache) mergeValue (key string, value Mergeable, expiration int64, ts Timestamp) (bool, error) {
+	ts = c.observe(ts);
+
+	if item, found := c.liveItem(key); found {
+		if existing, ok := item.Value.(Mergeable); ok && existing.Type() == value.Type() {
+			if err := existing.Merge(value); err != nil {
+				return false, err;
+			}
+			c.bumpVersion(key);
+			c.emit(EventSet, key);
+			return true, nil;
+		}
+	}
+
+	// A delete later than the write keeps its tombstone
+	if !c.supersedes(key, ts) {
+		return false, nil;
+	}
+
+	c.storeMergeableStamped(key, value.Clone(), expiration, ts);
+	c.accessCount[key] = max(c.accessCount[key], 1);
+	c.emit(EventSet, key);
+	return true, nil;
+}
+
+// Returns a copy of the mergeable value at key, its remaining ttl and the timestamp of its last write, for replication
+func (c *Cache) GetMergeable (key string) (Mergeable, time.Duration, Timestamp, bool) {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	item, found := c.items[key];
+	if !found {
+		return nil, 0, Timestamp{}, false;
+	}
+
+	now := time.Now().UnixNano();
+	if item.Expiration > 0 && item.Expiration < now {
+		return nil, 0, Timestamp{}, false;
+	}
+
+	m, ok := item.Value.(Mergeable);
+	if !ok {
+		return nil, 0, Timestamp{}, false;
+	}
+
+	var ttl time.Duration;
+	if item.Expiration > 0 {
+		ttl = time.Duration(item.Expiration - now);
+	}
+
+	return m.Clone(), ttl, item.Timestamp, true;
+}
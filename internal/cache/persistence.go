@@ -1,89 +1,301 @@
 package cache
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type PersistenceManager struct {
 	cache *Cache;
 	filePath string;
-	saveInterval time.Duration;
 	stopping chan struct{};
+	stopOnce sync.Once;
+	done chan struct{};	// Closed once the final save on stopping is complete
 	mu sync.Mutex;
+	fsyncPolicy string;	// Append-only log fsync policy, empty when the log is disabled
+	rewriteSize int64;	// Log size that triggers a rewrite into a snapshot
+	aof *AppendOnlyLog;
+	compression string;	// Compression applied to new snapshots
+	retention int;		// Number of snapshots kept on disk
+	keyring *Keyring;	// Encrypts snapshots and the log when set
+	ready chan struct{};	// Closed once the data on disk is loaded
+	loaded atomic.Uint64;	// Items restored so far by the snapshot being loaded
+	store SnapshotStore;	// Where snapshots are kept
+	status SaveStatus;	// Outcome of the last save
+	lastSuccess time.Time;	// When the last successful save started, or the manager was created
+	rules []SaveRule;	// When to save automatically
+	statusMu sync.Mutex;	// Guards status, lastSuccess and rules
 }
 
+// Modes for restoring a snapshot into a running cache
+const (
+	RestoreReplace = "replace";	// The cache ends up holding exactly the snapshot's keys
+	RestoreMerge = "merge";		// The snapshot's keys are written over the cache, other keys are kept
+)
+
+var (
+	ErrSaveInProgress = errors.New("a save is already in progress");
+	ErrSnapshotNotFound = errors.New("snapshot not found");
+)
+
+// SaveStatus describes the last save and whether one is running
+type SaveStatus struct {
+	InProgress	bool		`json:"inProgress"`
+	LastSave	time.Time	`json:"lastSave"`		// When the last save finished
+	DurationMs	int64		`json:"durationMs"`
+	Snapshot	string		`json:"snapshot"`		// Name of the snapshot written
+	Size		int64		`json:"size"`			// Size of the snapshot written in bytes
+	Items		uint64		`json:"items"`
+	Changes		uint64		`json:"changes"`		// Changes made since the last save
+	Error		string		`json:"error,omitempty"`	// Why the last save failed, if it did
+}
+
+// RestoreResult describes a snapshot restored into the cache
+type RestoreResult struct {
+	Snapshot	string			`json:"snapshot"`
+	Mode		string			`json:"mode"`
+	Restored	int				`json:"restored"`	// Keys written from the snapshot
+	Removed		int				`json:"removed"`	// Keys removed because the snapshot did not have them
+	Report		SnapshotReport	`json:"report"`
+}
+
+// Number of snapshots kept unless configured otherwise
+const defaultSnapshotRetention = 3;
+
+// Creates a persistence manager that saves every saveInterval if anything changed.
+// Use SetSaveRules to save on other schedules.
 func NewPersistenceManager (cache *Cache, filePath string, saveInterval time.Duration) *PersistenceManager {
 	return &PersistenceManager{
 		cache: cache,
 		filePath: filePath,
-		saveInterval: saveInterval,
+		store: NewLocalSnapshotStore(filepath.Dir(filePath)),
 		stopping: make(chan struct{}),
+		done: make(chan struct{}),
+		ready: make(chan struct{}),
+		lastSuccess: time.Now(),
+		rules: []SaveRule{{Seconds: max(int64(saveInterval / time.Second), 1), Changes: 1}},
+		compression: SnapshotCompressionNone,
+		retention: defaultSnapshotRetention,
 	}
 }
 
-// Starts the persistence manager
-func (pm *PersistenceManager) Start() {
-	// Try to load cached data
-	pm.loadFromDisk();
+// Sets the compression of new snapshots and how many snapshots are kept, so an
+// earlier snapshot can be rolled back to if the latest one is bad. Must be called before Start.
+func (pm *PersistenceManager) SetSnapshotPolicy (compression string, retention int) error {
+	if !ValidSnapshotCompression(compression) {
+		return fmt.Errorf("invalid snapshot compression %q", compression);
+	}
+
+	if retention < 1 {
+		return fmt.Errorf("at least one snapshot must be kept");
+	}
+
+	pm.compression = compression;
+	pm.retention = retention;
+	return nil;
+}
+
+// Enables the append-only log, which records every write between snapshots.
+// The log is rewritten into a snapshot once it grows past rewriteSize bytes.
+// Must be called before Start.
+func (pm *PersistenceManager) EnableAppendOnlyLog (fsyncPolicy string, rewriteSize int64) error {
+	if !ValidFsyncPolicy(fsyncPolicy) {
+		return fmt.Errorf("invalid fsync policy %q", fsyncPolicy);
+	}
+
+	if rewriteSize <= 0 {
+		return fmt.Errorf("rewrite size must be positive");
+	}
+
+	pm.fsyncPolicy = fsyncPolicy;
+	pm.rewriteSize = rewriteSize;
+	return nil;
+}
 
-	// Start periodic save
+// Starts the persistence manager. The data on disk is loaded in the background and
+// Ready is closed once it is; nothing is saved before then.
+func (pm *PersistenceManager) Start() {
 	go func () {
-		ticker := time.NewTicker(pm.saveInterval);
-		defer ticker.Stop();
+		start := time.Now();
+
+		// Try to load cached data
+		if err := pm.loadFromDisk(); err != nil {
+			log.Printf("Error loading cache from disk: %v", err);
+		}
+
+		if pm.fsyncPolicy != "" {
+			pm.startAppendOnlyLog();
+		}
+		pm.cache.fitToCapacity();
+
+		log.Printf("Restored %d items from disk in %s", pm.cache.ItemCount(), time.Since(start).Round(time.Millisecond));
+		close(pm.ready);
+
+		pm.saveLoop();
+		close(pm.done);
+	}();
+}
+
+// Returns a channel that is closed once the data on disk has been loaded
+func (pm *PersistenceManager) Ready () <-chan struct{} {
+	return pm.ready;
+}
+
+// Returns the number of items restored so far by the snapshot being loaded
+func (pm *PersistenceManager) LoadProgress () uint64 {
+	return pm.loaded.Load();
+}
+
+// Saves by the save rules, rewrites the log when it grows too big and saves one last time when stopped
+func (pm *PersistenceManager) saveLoop () {
+	// Check the save rules and the log size every second
+	ticker := time.NewTicker(time.Second);
+	defer ticker.Stop();
 
-		for {
-			select {
-			case <- ticker.C:
+	for {
+		select {
+		case now := <- ticker.C:
+			if pm.saveDue(now) {
 				if err := pm.saveToDisk(); err != nil {
 					log.Printf("Error saving cache to disk: %v", err);
 				}
-			case <- pm.stopping:
-				// One last save before stopping
+			} else if pm.aof != nil && pm.aof.Size() >= pm.rewriteSize {
+				log.Printf("Rewriting append-only log of %d bytes into a snapshot", pm.aof.Size());
 				if err := pm.saveToDisk(); err != nil {
-					log.Printf("Error saving cache to disk during shutdown: %v", err);
+					log.Printf("Error rewriting append-only log: %v", err);
 				}
-				return;
 			}
+		case <- pm.stopping:
+			// One last save before stopping
+			if err := pm.saveToDisk(); err != nil {
+				log.Printf("Error saving cache to disk during shutdown: %v", err);
+			}
+
+			if pm.aof != nil {
+				pm.aof.Close();
+			}
+			return;
 		}
-	}()
+	}
 }
 
-// Stops the persistence manager
-func (pm *PersistenceManager) Stop () {
-	pm.mu.Lock();
-	defer pm.mu.Unlock();
+// Sets where snapshots are kept, instead of next to the base file.
+// The append-only log always stays next to the base file. Must be called before Start.
+func (pm *PersistenceManager) SetSnapshotStore (store SnapshotStore) {
+	pm.store = store;
+}
+
+// Encrypts new snapshots and log entries with the keyring's current key.
+// Files encrypted with any key in the ring can still be loaded, and unencrypted files too if the keyring
+// allows plaintext, so rotating keys or enabling encryption takes effect on the next save. Must be called before Start.
+func (pm *PersistenceManager) SetEncryption (keyring *Keyring) {
+	pm.keyring = keyring;
+}
 
-	close(pm.stopping);
+// Replays the append-only log on top of the loaded snapshot and starts recording writes
+func (pm *PersistenceManager) startAppendOnlyLog () {
+	applied, err := replayAppendOnlyLog(pm.filePath, pm.cache, pm.keyring);
+	if err != nil {
+		log.Printf("Error replaying append-only log: %v", err);
+	} else if applied > 0 {
+		log.Printf("Replayed %d writes from the append-only log", applied);
+	}
+
+	aof, err := openAppendOnlyLog(pm.filePath, pm.fsyncPolicy, pm.keyring);
+	if err != nil {
+		log.Printf("Error opening append-only log, writes will only be saved in snapshots: %v", err);
+		return;
+	}
+
+	pm.cache.mu.Lock();
+	pm.cache.aof = aof;
+	pm.cache.mu.Unlock();
+
+	pm.aof = aof;
 }
 
-// Saves the cache to the disk
+// Stops the persistence manager, saving one last time.
+// Waits until the final save is complete, returning its error, or until ctx is done.
+// If the data on disk is still loading, the final save is made once it is loaded.
+func (pm *PersistenceManager) Stop (ctx context.Context) error {
+	pm.stopOnce.Do(func () {
+		close(pm.stopping);
+	})
+
+	select {
+	case <-pm.done:
+	case <-ctx.Done():
+		return fmt.Errorf("final save did not complete: %w", ctx.Err());
+	}
+
+	if status := pm.LastSave(); status.Error != "" {
+		return errors.New(status.Error);
+	}
+
+	return nil;
+}
+
+// Number of keys copied out of the cache per lock acquisition while saving
+const snapshotBatchSize = 1000;
+
+// Saves the cache to the disk.
+// Items are streamed out in batches instead of being copied out all at once, so writes are only
+// blocked briefly. Writes made while saving may or may not be in the snapshot; the append-only
+// log segment started at the beginning of the save records them either way.
 func (pm *PersistenceManager) saveToDisk () error {
 	pm.mu.Lock();
 	defer pm.mu.Unlock();
 
-	// Extract data from cache
-	pm.cache.mu.RLock();
-	data := make(map[string]interface{});
-	now := time.Now().UnixNano();
+	pm.statusMu.Lock();
+	pm.status.InProgress = true;
+	pm.statusMu.Unlock();
 
-	for key, item := range pm.cache.items {
-		// Skip expired items
-		if item.Expiration > 0 && item.Expiration < now {
-			continue;
-		}
+	start := time.Now();
+	snapshot, items, size, err := pm.writeSnapshot();
+	if err == nil {
+		pm.statusMu.Lock();
+		pm.lastSuccess = start;
+		pm.statusMu.Unlock();
+	}
+	pm.recordSave(start, snapshot, items, size, err);
 
-		// Store the item with its metadata
-		data[key] = map[string]interface{} {
-			"value": item.Value,
-			"expiration": item.Expiration,
-			"lastAccess":item.LastAccess,
+	return err;
+}
+
+// Writes a new snapshot of the cache to a local temp file, then hands it to the snapshot store.
+// Returns the snapshot's name, the number of items in it and its size. Must hold pm.mu.
+func (pm *PersistenceManager) writeSnapshot () (string, uint64, int64, error) {
+	// Take the list of keys and start a new log segment while writes are blocked,
+	// so the snapshot covers everything recorded in the segments before it
+	pm.cache.mu.RLock();
+	keys := make([]string, 0, len(pm.cache.items));
+	for key := range pm.cache.items {
+		keys = append(keys, key);
+	}
+	// Items in the disk tier are saved too, they are moved back into it when memory fills up on load
+	if pm.cache.disk != nil {
+		keys = append(keys, pm.cache.disk.keys()...);
+	}
+	changes := pm.cache.changes;
+
+	coveredSegment := 0;
+	if pm.aof != nil {
+		covered, err := pm.aof.rotate();
+		if err != nil {
+			log.Printf("Error rotating append-only log: %v", err);
 		}
+		coveredSegment = covered;
 	}
 	pm.cache.mu.RUnlock();
 
@@ -91,82 +303,464 @@ func (pm *PersistenceManager) saveToDisk () error {
 	tempFilePath := pm.filePath + ".tmp";
 	file, err := os.Create(tempFilePath);
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err);
+		return "", 0, 0, fmt.Errorf("failed to create temp file: %w", err);
 	}
+	defer os.Remove(tempFilePath);
 	defer file.Close();
 
+	// Encrypt and compress the snapshot stream if enabled, compressing first
+	out, err := NewSnapshotFileWriter(file, pm.compression, pm.keyring);
+	if err != nil {
+		return "", 0, 0, err;
+	}
+
+	writer, err := NewSnapshotWriter(out);
+	if err != nil {
+		return "", 0, 0, err;
+	}
+
 	// Write data to file
-	encoder := json.NewEncoder(file);
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("failed to encode cache data: %w", err);
+	for start := 0; start < len(keys); start += snapshotBatchSize {
+		end := min(start + snapshotBatchSize, len(keys));
+
+		for _, rec := range pm.cache.snapshotRecords(keys[start:end]) {
+			if err := writer.WriteRecord(rec); err != nil {
+				return "", 0, 0, fmt.Errorf("failed to encode cache data: %w", err);
+			}
+		}
 	}
 
-	// Ensure data is written to disk
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file: %w", err);
+	for _, rec := range append(pm.cache.tombstoneRecords(), pm.cache.leaseRecords()...) {
+		if err := writer.WriteRecord(rec); err != nil {
+			return "", 0, 0, fmt.Errorf("failed to encode cache data: %w", err);
+		}
 	}
 
-	// Rename temp file to the actual file name (atomic operation)
-	if err := os.Rename(tempFilePath, pm.filePath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err);
+	if err := writer.Close(); err != nil {
+		return "", 0, 0, fmt.Errorf("failed to encode cache data: %w", err);
 	}
 
-	log.Printf("Cache successfully saved to %s", pm.filePath);
+	if err := out.Close(); err != nil {
+		return "", 0, 0, err;
+	}
+
+	// Hand the finished snapshot to the store under a new timestamped name
+	size, err := file.Seek(0, io.SeekCurrent);
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to size snapshot: %w", err);
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, 0, fmt.Errorf("failed to rewind snapshot: %w", err);
+	}
+
+	snapshotName := pm.snapshotName(time.Now());
+	if err := pm.store.Put(snapshotName, file, size); err != nil {
+		return "", 0, 0, fmt.Errorf("failed to store snapshot: %w", err);
+	}
+
+	// The snapshot now holds everything in the covered segments
+	if pm.aof != nil {
+		pm.aof.removeSegmentsUpTo(coveredSegment);
+	}
+	pm.cache.markSaved(changes);
+	pm.pruneSnapshots();
+
+	log.Printf("Cache successfully saved to %s with %d items", snapshotName, writer.Count());
+	return snapshotName, writer.Count(), size, nil;
+}
+
+// Records the outcome of a save in the save status
+func (pm *PersistenceManager) recordSave (start time.Time, snapshot string, items uint64, size int64, err error) {
+	pm.statusMu.Lock();
+	defer pm.statusMu.Unlock();
+
+	pm.status.InProgress = false;
+	pm.status.LastSave = time.Now();
+	pm.status.DurationMs = time.Since(start).Milliseconds();
+	pm.status.Error = "";
+
+	if err != nil {
+		pm.status.Error = err.Error();
+		return;
+	}
+
+	pm.status.Snapshot = snapshot;
+	pm.status.Items = items;
+	pm.status.Size = size;
+}
+
+// Saves the cache right away, waiting for the snapshot to be on disk
+func (pm *PersistenceManager) Save () (SaveStatus, error) {
+	err := pm.saveToDisk();
+	return pm.LastSave(), err;
+}
+
+// Starts saving the cache in the background. Fails if a save is already running.
+func (pm *PersistenceManager) BackgroundSave () error {
+	pm.statusMu.Lock();
+	if pm.status.InProgress {
+		pm.statusMu.Unlock();
+		return ErrSaveInProgress;
+	}
+	pm.status.InProgress = true;
+	pm.statusMu.Unlock();
+
+	go func () {
+		if err := pm.saveToDisk(); err != nil {
+			log.Printf("Error saving cache to disk in the background: %v", err);
+		}
+	}();
+
 	return nil;
 }
 
+// Returns the outcome of the last save
+func (pm *PersistenceManager) LastSave () SaveStatus {
+	pm.statusMu.Lock();
+	status := pm.status;
+	pm.statusMu.Unlock();
+
+	status.Changes = pm.cache.Changes();
+	return status;
+}
+
+// Loads the named snapshot into the running cache, then saves so the restored state is the newest snapshot.
+// Without salvage, a damaged snapshot is rejected and the cache is left untouched.
+func (pm *PersistenceManager) Restore (name, mode string, salvage bool) (RestoreResult, error) {
+	result := RestoreResult{Snapshot: name, Mode: mode};
+
+	if mode != RestoreReplace && mode != RestoreMerge {
+		return result, fmt.Errorf("invalid restore mode %q", mode);
+	}
+
+	records, report, err := pm.readNamedSnapshot(name, salvage);
+	result.Report = report;
+	if err != nil {
+		return result, err;
+	}
+
+	result.Restored, result.Removed = pm.cache.applySnapshot(records, mode == RestoreReplace);
+	log.Printf("Restored %d keys from snapshot %s (%s), removed %d", result.Restored, name, mode, result.Removed);
+
+	if err := pm.saveToDisk(); err != nil {
+		log.Printf("Error saving cache after restore: %v", err);
+	}
+
+	return result, nil;
+}
+
+// Reads all records of the named snapshot into memory
+func (pm *PersistenceManager) readNamedSnapshot (name string, salvage bool) ([]SnapshotRecord, SnapshotReport, error) {
+	pm.mu.Lock();
+	defer pm.mu.Unlock();
+
+	snapshots, err := pm.ListSnapshots();
+	if err != nil {
+		return nil, SnapshotReport{}, fmt.Errorf("failed to list snapshots: %w", err);
+	}
+
+	// Only names from the listing are accepted, so no other file can be read
+	for _, snapshot := range snapshots {
+		if snapshot.Name != name {
+			continue;
+		}
+
+		file, err := pm.store.Get(snapshot.Name);
+		if err != nil {
+			return nil, SnapshotReport{}, fmt.Errorf("failed to open snapshot: %w", err);
+		}
+		defer file.Close();
+
+		var records []SnapshotRecord;
+		report, err := ReadSnapshotFile(file, pm.keyring, salvage, func (rec SnapshotRecord) error {
+			records = append(records, rec);
+			return nil;
+		})
+
+		return records, report, err;
+	}
+
+	return nil, SnapshotReport{}, ErrSnapshotNotFound;
+}
+
+// Copies the live items at the given keys into snapshot records
+func (c *Cache) snapshotRecords (keys []string) []SnapshotRecord {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	records := make([]SnapshotRecord, 0, len(keys));
+	now := time.Now().UnixNano();
+
+	for _, key := range keys {
+		item, found := c.items[key];
+		accessCount := c.accessCount[key];
+
+		// Items moved to the disk tier since the keys were listed are read back from there
+		if !found && c.disk != nil {
+			item, accessCount, found = c.disk.peek(key);
+		}
+
+		// Skip deleted and expired items
+		if !found || (item.Expiration > 0 && item.Expiration < now) {
+			continue;
+		}
+
+		// Copy mergeable values so they are not modified while being encoded
+		value := item.Value;
+		if m, ok := value.(Mergeable); ok {
+			value = m.Clone();
+		}
+
+		records = append(records, SnapshotRecord{
+			Key: key,
+			Value: value,
+			Expiration: item.Expiration,
+			LastAccess: item.LastAccess,
+			Version: item.Version,
+			AccessCount: accessCount,
+			Timestamp: item.Timestamp,
+		})
+	}
+
+	return records;
+}
+
+// Loads the newest snapshot into the cache. Damaged parts of a binary snapshot are
+// skipped and reported, and every valid record around them is restored.
+// If the newest snapshot cannot be read at all, the ones before it are tried in turn.
 func (pm *PersistenceManager) loadFromDisk () error {
 	pm.mu.Lock();
 	defer pm.mu.Unlock();
 
-	// Check if the file exists
-	if _, err := os.Stat(pm.filePath); os.IsNotExist(err) {
-		log.Printf("No cache file found at %s, starting with empty cache", pm.filePath);
+	snapshots, err := pm.ListSnapshots();
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err);
+	}
+
+	if len(snapshots) == 0 {
+		log.Printf("No snapshot found for %s, starting with empty cache", pm.filePath);
 		return nil;
 	}
 
-	// Open the file
-	file, err := os.Open(pm.filePath);
+	for _, snapshot := range snapshots {
+		if err := pm.loadSnapshot(snapshot.Name); err != nil {
+			log.Printf("Error loading snapshot %s, trying an older one: %v", snapshot.Name, err);
+			continue;
+		}
+		return nil;
+	}
+
+	log.Printf("No readable snapshot found for %s, starting with empty cache", pm.filePath);
+	return nil;
+}
+
+// Restores a snapshot record into the cache while the node loads, skipping expired ones and ones older
+// than what was already restored for the key, such as a tombstone that came earlier in the file.
+// Nothing else writes to the cache during the load, since requests are refused until it is ready. Must hold c.mu.
+// The item keeps its version and access count, so watchers and LFU eviction carry on as before a restart.
+func (c *Cache) restoreRecord (rec SnapshotRecord, now int64) {
+	if rec.Lease != nil {
+		c.applyLease(*rec.Lease);
+		return;
+	}
+
+	if !rec.Timestamp.IsZero() {
+		c.clock.Observe(rec.Timestamp);
+	}
+
+	if rec.Deleted {
+		if rec.Timestamp.Wall >= now - int64(c.tombstoneTTL) && c.supersedes(rec.Key, rec.Timestamp) {
+			c.tombstone(rec.Key, rec.Timestamp);
+		}
+		return;
+	}
+
+	if rec.Expiration > 0 && rec.Expiration < now {
+		return;
+	}
+
+	if !c.supersedes(rec.Key, rec.Timestamp) {
+		return;
+	}
+
+	c.items[rec.Key] = CacheItem{
+		Value: rec.Value,
+		Expiration: rec.Expiration,
+		LastAccess: rec.LastAccess,
+		Version: c.restoredVersion(rec.Version),
+		Timestamp: rec.Timestamp,
+	}
+	delete(c.tombstones, rec.Key);
+
+	// Update access count for LFU
+	c.accessCount[rec.Key] = max(rec.AccessCount, 1);
+}
+
+// Writes snapshot records into the live cache, emitting events so watchers, subscribers and the
+// append-only log see the change. With replace, keys missing from the snapshot are deleted.
+// Returns the number of keys written and removed.
+func (c *Cache) applySnapshot (records []SnapshotRecord, replace bool) (int, int) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	restored, removed := 0, 0;
+	now := time.Now().UnixNano();
+
+	if replace {
+		// Only the snapshot's live keys stay, its tombstones and expired items are removed like missing keys
+		keep := make(map[string]struct{}, len(records));
+		for _, rec := range records {
+			if rec.Lease == nil && !rec.Deleted && (rec.Expiration == 0 || rec.Expiration >= now) {
+				keep[rec.Key] = struct{}{};
+			}
+		}
+
+		var remove []string;
+		for key := range c.items {
+			if _, found := keep[key]; !found {
+				remove = append(remove, key);
+			}
+		}
+		if c.disk != nil {
+			for _, key := range c.disk.keys() {
+				if _, found := keep[key]; !found {
+					remove = append(remove, key);
+				}
+			}
+		}
+
+		// Removed keys are stamped like deletes, so the removal wins over their copies on other nodes
+		for _, key := range remove {
+			c.tombstone(key, c.clock.Now());
+			removed++;
+		}
+	}
+
+	for _, rec := range records {
+		// Leases only move forward, so a restored one never takes back a later acquisition
+		if rec.Lease != nil {
+			c.applyLease(*rec.Lease);
+			continue;
+		}
+
+		if rec.Deleted || (rec.Expiration > 0 && rec.Expiration < now) {
+			continue;
+		}
+
+		c.removeFromDisk(rec.Key);
+		if _, exists := c.items[rec.Key]; !exists && len(c.items) >= c.maxItems {
+			c.evict();
+		}
+
+		c.items[rec.Key] = CacheItem{
+			Value: rec.Value,
+			Expiration: rec.Expiration,
+			LastAccess: rec.LastAccess,
+			Version: c.nextVersion(),
+			Timestamp: c.clock.Now(),
+		}
+		delete(c.tombstones, rec.Key);
+		if _, found := c.accessCount[rec.Key]; !found {
+			c.accessCount[rec.Key] = max(rec.AccessCount, 1);
+		}
+
+		c.emit(EventSet, rec.Key);
+		restored++;
+	}
+
+	return restored, removed;
+}
+
+// Reads a snapshot in either the binary or the legacy JSON format, compressed or not.
+// Encrypted snapshots are decrypted with the keyring.
+func ReadSnapshotFile (r io.Reader, keyring *Keyring, salvage bool, fn func(SnapshotRecord) error) (SnapshotReport, error) {
+	br, err := openSnapshotStream(r, keyring);
 	if err != nil {
-		return fmt.Errorf("failed to open ache file: %w", err);
+		return SnapshotReport{}, err;
 	}
-	defer file.Close();
 
-	// Read data from file
-	data := make(map[string]map[string]interface{});
+	prefix, _ := br.Peek(len(snapshotMagic));
+	if IsBinarySnapshot(prefix) {
+		return ReadSnapshot(br, salvage, fn);
+	}
+
+	return ReadLegacySnapshot(br, fn);
+}
+
+// Unwraps the encryption and compression of a snapshot file, returning a reader of the snapshot itself.
+// Unencrypted snapshots are rejected if the keyring does not accept plaintext.
+func openSnapshotStream (r io.Reader, keyring *Keyring) (*bufio.Reader, error) {
+	br := bufio.NewReader(r);
+
+	prefix, _ := br.Peek(len(snapshotMagic));
+	if isEncrypted(prefix) {
+		decrypter, err := keyring.newDecryptReader(br);
+		if err != nil {
+			return nil, err;
+		}
+
+		br = bufio.NewReader(decrypter);
+		prefix, _ = br.Peek(len(snapshotMagic));
+	} else if !keyring.acceptsPlaintext() {
+		return nil, fmt.Errorf("%w: snapshot is not encrypted and plaintext is not allowed", ErrNotEncrypted);
+	}
+
+	if isGzip(prefix) {
+		decompressor, err := gzip.NewReader(br);
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err);
+		}
+
+		br = bufio.NewReader(decompressor);
+	}
 
-	decoder := json.NewDecoder(file);
-	if err := decoder.Decode(&data); err != nil {
+	return br, nil;
+}
+
+// Reads a snapshot in the legacy JSON format, a single object of keys to items
+func ReadLegacySnapshot (r io.Reader, fn func(SnapshotRecord) error) (SnapshotReport, error) {
+	report := SnapshotReport{FormatVersion: 0};
+
+	var data map[string]jsonSnapshotItem;
+
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
 		if err == io.EOF {
 			// Empty file, hence not an error
-			return nil;
+			report.Complete = true;
+			return report, nil;
 		}
-		return fmt.Errorf("failed to decode cached data: %w", err);
+		return report, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err);
 	}
 
-	// Restore the data to the cache
-	pm.cache.mu.Lock();
-	defer pm.cache.mu.Unlock();
-
-	now := time.Now().UnixNano();
 	for key, itemData := range data {
-		// Skip expired items
-		expiration, ok := itemData["expiration"].(float64);
-		if ok && expiration > 0 && int64(expiration) < now {
-			continue;
+		rec := SnapshotRecord{
+			Key: key,
+			Expiration: itemData.Expiration,
+			LastAccess: itemData.LastAccess,
+			Version: itemData.Version,
+			AccessCount: itemData.AccessCount,
+			Deleted: itemData.Deleted,
+		}
+		if itemData.Timestamp != nil {
+			rec.Timestamp = *itemData.Timestamp;
 		}
 
-		// Restore
-		pm.cache.items[key] = CacheItem{
-			Value: itemData["value"],
-			Expiration: int64(expiration),
-			LastAccess: int64(itemData["lastAccess"].(float64)),
+		// Restore the concrete type of mergeable values
+		if !rec.Deleted {
+			value, err := decodeValue(itemData.Type, itemData.Value);
+			if err != nil {
+				log.Printf("Skipping key %s, failed to decode value: %v", key, err);
+				continue;
+			}
+			rec.Value = value;
 		}
 
-		// Update access count for LFU
-		pm.cache.accessCount[key] = 1;
+		report.Records++;
+		if err := fn(rec); err != nil {
+			return report, err;
+		}
 	}
 
-	log.Printf("Cache successfully loaded from %s with %d items", pm.filePath, len(pm.cache.items));
-	return nil;
-}
\ No newline at end of file
+	report.Complete = true;
+	return report, nil;
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"maps"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Counters of read repair
+type RepairStats struct {
+	Divergent	uint64	`json:"divergent"`	// Reads that found copies older than the newest one
+	Repaired	uint64	`json:"repaired"`	// Older copies written over with the newest one
+	Failed		uint64	`json:"failed"`		// Repairs the node did not accept, kept as hints if it could not be reached
+	Sampled		uint64	`json:"sampled"`	// Keys read by the background sampler
+}
+
+// Counters of read repair, updated concurrently by reads
+type repairCounters struct {
+	divergent atomic.Uint64;
+	repaired atomic.Uint64;
+	failed atomic.Uint64;
+	sampled atomic.Uint64;
+}
+
+// Writes the newest copy of key back to the nodes that answered a read with an older one, through their replication queues.
+// Keys in sibling mode are repaired on the nodes missing versions of the merged set.
+func (rm *ReplicationManager) repair (key string, newest ReadResult, results []ReadResult) {
+	if len(results) < 2 {
+		return;
+	}
+
+	var stale []string;
+	for _, result := range results {
+		if olderCopy(result, newest) {
+			stale = append(stale, result.Node);
+		}
+	}
+
+	if len(stale) == 0 {
+		return;
+	}
+
+	h, ok := repairHint(key, newest);
+	if !ok {
+		return;
+	}
+
+	rm.repairs.divergent.Add(1);
+	for _, node := range stale {
+		if node == rm.localNode {
+			rm.repaired(key, node, rm.cache.applyHint(h));
+			continue;
+		}
+
+		// Repairs never wait for room in a replica's queue, they are kept as hints instead
+		rm.enqueue(node, queuedWrite{hint: h, done: func (err error) { rm.repaired(key, node, err); }}, time.Time{});
+	}
+}
+
+// Counts the outcome of repairing key on a node
+func (rm *ReplicationManager) repaired (key, node string, err error) {
+	if err != nil {
+		log.Printf("Error repairing key %s on node %s: %v", key, node, err);
+		rm.repairs.failed.Add(1);
+		return;
+	}
+
+	rm.repairs.repaired.Add(1);
+}
+
+// Checks if a node's copy of a key is older than the newest copy a read found
+func olderCopy (result, newest ReadResult) bool {
+	if set, ok := newest.Value.(*SiblingSet); ok {
+		other, ok := result.Value.(*SiblingSet);
+		return !ok || !maps.Equal(other.Context(), set.Context());
+	}
+
+	return newest.Timestamp.After(result.Timestamp) || (newest.Found && !result.Found && result.Timestamp.IsZero());
+}
+
+// Builds the write that brings a copy of key up to the newest one: a set of its value, or a delete
+// if the key was deleted. Returns false if there is nothing to write.
+func repairHint (key string, newest ReadResult) (hint, bool) {
+	if !newest.Found {
+		return hint{Op: hintOpDelete, Key: key, Timestamp: newest.Timestamp}, !newest.Timestamp.IsZero();
+	}
+
+	encoding, encoded, err := EncodeValue(newest.Value);
+	if err != nil {
+		log.Printf("Error encoding key %s for repair: %v", key, err);
+		return hint{}, false;
+	}
+
+	return hint{Op: hintOpSet, Key: key, Type: encoding, Value: encoded, Expiration: newest.Expiration, Timestamp: newest.Timestamp}, true;
+}
+
+// Applies a replicated write to the local copy of its key
+func (c *Cache) applyHint (h hint) error {
+	if h.Op == hintOpDelete {
+		c.applyReplicatedDelete(h.Key, h.Timestamp);
+		return nil;
+	}
+
+	ttl, live := h.ttl(time.Now());
+	if !live {
+		return nil;
+	}
+
+	value, err := decodeValue(h.Type, h.Value);
+	if err != nil {
+		return err;
+	}
+
+	return c.applyReplicated(h.Key, value, time.Duration(ttl) * time.Second, h.Timestamp);
+}
+
+// Starts a background goroutine that reads up to samples random keys this node is the primary of
+// from all their nodes every interval, and repairs the copies that are out of date, so keys that
+// are rarely read converge too
+func (rm *ReplicationManager) StartRepairSampler (interval time.Duration, samples int) {
+	go func () {
+		ticker := time.NewTicker(interval);
+		defer ticker.Stop();
+
+		for range ticker.C {
+			rm.sampleRepair(samples);
+		}
+	}();
+}
+
+// Reads up to samples random keys this node is the primary of from all their nodes
+func (rm *ReplicationManager) sampleRepair (samples int) {
+	keys := rm.cache.Keys();
+	if len(keys) == 0 {
+		return;
+	}
+
+	// Give up after a few misses per sample, when few of the keys are ours
+	sampled := make(map[string]struct{}, samples);
+	for tries := 0; tries < samples * 4 && len(sampled) < samples; tries++ {
+		key := keys[rand.Intn(len(keys))];
+		if _, done := sampled[key]; done {
+			continue;
+		}
+
+		nodes := rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1);
+		if nodes[0] != rm.localNode || len(nodes) < 2 {
+			continue;
+		}
+		sampled[key] = struct{}{};
+
+		ctx, cancel := context.WithTimeout(context.Background(), rm.timeout);
+		rm.readNewest(ctx, key, nodes, RequiredAcks(ConsistencyAll, len(nodes)));
+		cancel();
+		rm.repairs.sampled.Add(1);
+	}
+}
+
+// Returns the read repair counters
+func (rm *ReplicationManager) RepairStats () RepairStats {
+	return RepairStats{
+		Divergent: rm.repairs.divergent.Load(),
+		Repaired: rm.repairs.repaired.Load(),
+		Failed: rm.repairs.failed.Load(),
+		Sampled: rm.repairs.sampled.Load(),
+	}
+}
@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The result of reading a key from its nodes
+type ReadResult struct {
+	Value	interface{}
+	Version	uint64
+	Expiration	int64	// Of the value in Unix nanoseconds, 0 if it never expires
+	Timestamp	Timestamp	// Of the value, or of the key's tombstone if it is not found
+	Found	bool
+	Node	string	// The node whose copy was returned
+}
+
+// The DTO for reads of a replica's local copy
+type replicaGetResponse struct {
+	Found	bool			`json:"found"`
+	Type	string			`json:"type,omitempty"`	// Encoding of the value, empty for plain JSON values
+	Value	json.RawMessage	`json:"value,omitempty"`
+	Version	uint64			`json:"version"`
+	Expiration	int64		`json:"expiration,omitempty"`	// Of the value in Unix nanoseconds, 0 if it never expires
+	Timestamp	Timestamp	`json:"timestamp"`	// Of the value, or of the key's tombstone if it is not found
+}
+
+// Parses a read consistency level, ignoring case
+func ParseReadConsistency (level string) (string, error) {
+	switch strings.ToLower(level) {
+	case ConsistencyOne:
+		return ConsistencyOne, nil;
+	case ConsistencyQuorum:
+		return ConsistencyQuorum, nil;
+	case ConsistencyAll:
+		return ConsistencyAll, nil;
+	case ConsistencyPrimary:
+		return ConsistencyPrimary, nil;
+	default:
+		return "", fmt.Errorf("invalid consistency level %q, expected one, quorum, all or primary", level);
+	}
+}
+
+// Sets the consistency level of reads that do not ask for one
+func (rm *ReplicationManager) SetReadConsistency (level string) error {
+	level, err := ParseReadConsistency(level);
+	if err != nil {
+		return err;
+	}
+
+	rm.readConsistency = level;
+	return nil;
+}
+
+// Returns the consistency level of reads that do not ask for one
+func (rm *ReplicationManager) ReadConsistency () string {
+	return rm.readConsistency;
+}
+
+// Reads key from its nodes at the consistency level. ONE reads the local copy if this node is one of
+// the key's nodes, or else any of them that answers. QUORUM and ALL ask all of them and return the
+// copy with the latest timestamp once enough have answered, which is not found if the latest write
+// was a delete, or the versions of all copies of a key in sibling mode. PRIMARY is served like ONE from the primary alone.
+// An empty level means the default read consistency.
+func (rm *ReplicationManager) Read (key, level string) (ReadResult, error) {
+	if level == "" {
+		level = rm.readConsistency;
+	}
+
+	nodes := rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1);
+	if level == ConsistencyPrimary {
+		nodes = nodes[:1];
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rm.timeout);
+	defer cancel();
+
+	if level == ConsistencyOne || level == ConsistencyPrimary {
+		return rm.readAny(ctx, key, nodes);
+	}
+
+	return rm.readNewest(ctx, key, nodes, RequiredAcks(level, len(nodes)));
+}
+
+// Reads key from the local node if it is among the nodes, or else from the first of them
+// to answer, trying them in random order to spread the load
+func (rm *ReplicationManager) readAny (ctx context.Context, key string, nodes []string) (ReadResult, error) {
+	if containsNode(nodes, rm.localNode) {
+		return rm.readLocal(key), nil;
+	}
+
+	var errs []error;
+	for _, i := range rand.Perm(len(nodes)) {
+		if nodes[i] == "" {
+			continue;
+		}
+
+		result, err := rm.fetch(ctx, nodes[i], key);
+		if err == nil {
+			return result, nil;
+		}
+
+		log.Printf("Error reading key %s from node %s: %v", key, nodes[i], err);
+		errs = append(errs, fmt.Errorf("node %s: %w", nodes[i], err));
+	}
+
+	return ReadResult{}, fmt.Errorf("%w: no node answered: %v", ErrConsistencyNotMet, errors.Join(errs...));
+}
+
+// Reads key from all nodes in parallel and returns the copy with the latest timestamp
+// once required of them have answered. Nodes that answered with an older copy are repaired.
+func (rm *ReplicationManager) readNewest (ctx context.Context, key string, nodes []string, required int) (ReadResult, error) {
+	type answer struct {
+		result ReadResult;
+		err error;
+	}
+
+	answers := make(chan answer, len(nodes));
+	pending := 0;
+	for _, node := range nodes {
+		if node == "" {
+			continue;
+		}
+
+		pending++;
+		go func (node string) {
+			if node == rm.localNode {
+				answers <- answer{result: rm.readLocal(key)};
+				return;
+			}
+
+			result, err := rm.fetch(ctx, node, key);
+			if err != nil {
+				log.Printf("Error reading key %s from node %s: %v", key, node, err);
+				err = fmt.Errorf("node %s: %w", node, err);
+			}
+			answers <- answer{result, err};
+		}(node);
+	}
+
+	var newest ReadResult;
+	var results []ReadResult;
+	var failures []error;
+	for len(results) < required && pending > 0 {
+		select {
+		case a := <-answers:
+			pending--;
+			if a.err != nil {
+				failures = append(failures, a.err);
+				continue;
+			}
+
+			results = append(results, a.result);
+
+			// Concurrent versions of keys in sibling mode are merged across the answers
+			if set, ok := a.result.Value.(*SiblingSet); ok {
+				if newestSet, ok := newest.Value.(*SiblingSet); ok {
+					newestSet.Merge(set);
+					continue;
+				}
+				a.result.Value = set.Clone();
+			}
+
+			if a.result.Timestamp.After(newest.Timestamp) || (a.result.Found && !newest.Found && newest.Timestamp.IsZero()) {
+				newest = a.result;
+			}
+		case <-ctx.Done():
+			rm.repair(key, newest, results);
+			return ReadResult{}, fmt.Errorf("%w: %d of %d answers within %s", ErrConsistencyNotMet, len(results), required, rm.timeout);
+		}
+	}
+
+	rm.repair(key, newest, results);
+
+	if len(results) < required {
+		return ReadResult{}, fmt.Errorf("%w: %d of %d answers: %v", ErrConsistencyNotMet, len(results), required, errors.Join(failures...));
+	}
+
+	return newest, nil;
+}
+
+// Reads the local copy of key
+func (rm *ReplicationManager) readLocal (key string) ReadResult {
+	result := rm.cache.peekStamped(key);
+	result.Node = rm.localNode;
+	return result;
+}
+
+// Reads the copy of key held by a node
+func (rm *ReplicationManager) fetch (ctx context.Context, node, key string) (ReadResult, error) {
+	address := rm.nodeManager.GetNodeAddress(node);
+	if address == "" {
+		return ReadResult{}, fmt.Errorf("unknown address");
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address + "/replicate/get?key=" + url.QueryEscape(key), nil);
+	if err != nil {
+		return ReadResult{}, err;
+	}
+
+	resp, err := rm.httpClient.Do(req);
+	if err != nil {
+		return ReadResult{}, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return ReadResult{}, fmt.Errorf("status %d", resp.StatusCode);
+	}
+
+	var data replicaGetResponse;
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return ReadResult{}, err;
+	}
+
+	result := ReadResult{Version: data.Version, Expiration: data.Expiration, Timestamp: data.Timestamp, Found: data.Found, Node: node};
+	if data.Found {
+		result.Value, err = decodeValue(data.Type, data.Value);
+		if err != nil {
+			return ReadResult{}, err;
+		}
+	}
+
+	return result, nil;
+}
+
+// Handles reads of the local copy of a key by other nodes
+func (rm *ReplicationManager) HandleReplicaGet (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	key := r.URL.Query().Get("key");
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest);
+		return;
+	}
+
+	result := rm.cache.peekStamped(key);
+	data := replicaGetResponse{Timestamp: result.Timestamp};
+	if result.Found {
+		encoding, encoded, err := EncodeValue(result.Value);
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError);
+			return;
+		}
+
+		data = replicaGetResponse{Found: true, Type: encoding, Value: encoded, Version: result.Version, Expiration: result.Expiration, Timestamp: result.Timestamp};
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(data);
+}
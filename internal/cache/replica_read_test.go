@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Moves key of a cache into its disk tier
+func demoteTestKey (t *testing.T, c *Cache, key string) {
+	t.Helper();
+
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.demote(key);
+	if _, found := c.disk.index[key]; !found {
+		t.Fatalf("%s was not moved to the disk tier", key);
+	}
+}
+
+func TestReadRepair (t *testing.T) {
+	replicas := newTestReplicas(t, "n1", "n2");
+	n1, n2 := replicas["n1"], replicas["n2"];
+	if err := n2.cache.EnableDiskTier(filepath.Join(t.TempDir(), "tier"), 10, nil); err != nil {
+		t.Fatalf("EnableDiskTier: %v", err);
+	}
+
+	n1.cache.applyReplicatedSet("a", "new", time.Hour, Timestamp{Wall: 5, Node: "n1"});
+	n2.cache.applyReplicatedSet("a", "old", time.Hour, Timestamp{Wall: 1, Node: "n1"});
+	demoteTestKey(t, n2.cache, "a");
+	before := n2.cache.TierStats();
+
+	result, err := n1.Read("a", ConsistencyAll);
+	if err != nil {
+		t.Fatalf("Read: %v", err);
+	}
+	if !result.Found || result.Value != "new" {
+		t.Errorf("Read = %+v, want the newest copy", result);
+	}
+
+	// Reading the stale copy left it on disk without counting a hit
+	if after := n2.cache.TierStats(); after.Memory != before.Memory || *after.Disk != *before.Disk || after.Misses != before.Misses {
+		t.Errorf("tier stats changed by a replica read: %+v, %+v before", after, before);
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second);
+	defer cancel();
+	if err := n1.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err);
+	}
+
+	if stats := n1.RepairStats(); stats.Divergent != 1 || stats.Repaired != 1 {
+		t.Errorf("repair stats = %+v, want one repaired copy", stats);
+	}
+	if result := n2.cache.peekStamped("a"); result.Value != "new" {
+		t.Errorf("repaired copy = %+v, want the newest value", result);
+	}
+
+	// Once repaired, reading again finds nothing to repair
+	if _, err := n1.Read("a", ConsistencyAll); err != nil {
+		t.Fatalf("Read: %v", err);
+	}
+	if stats := n1.RepairStats(); stats.Divergent != 1 {
+		t.Errorf("repair stats = %+v after the copies converged", stats);
+	}
+}
+
+func TestSampleRepair (t *testing.T) {
+	replicas := newTestReplicas(t, "n1", "n2");
+	n1, n2 := replicas["n1"], replicas["n2"];
+	if err := n1.cache.EnableDiskTier(filepath.Join(t.TempDir(), "tier"), 10, nil); err != nil {
+		t.Fatalf("EnableDiskTier: %v", err);
+	}
+
+	// Sampling the keys of the primary does not bring its disk tier back into memory
+	n1.cache.applyReplicatedSet("a", "x", time.Hour, Timestamp{Wall: 1, Node: "n1"});
+	demoteTestKey(t, n1.cache, "a");
+	before := n1.cache.TierStats();
+
+	n1.sampleRepair(1);
+
+	if after := n1.cache.TierStats(); after.Memory != before.Memory || *after.Disk != *before.Disk || after.Misses != before.Misses {
+		t.Errorf("tier stats changed by sampling: %+v, %+v before", after, before);
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second);
+	defer cancel();
+	if err := n1.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err);
+	}
+
+	if stats := n1.RepairStats(); stats.Sampled != 1 || stats.Repaired != 1 {
+		t.Errorf("repair stats = %+v, want the sampled key repaired", stats);
+	}
+	if result := n2.cache.peekStamped("a"); result.Value != "x" {
+		t.Errorf("copy of the replica = %+v, want it repaired", result);
+	}
+}
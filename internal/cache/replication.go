@@ -2,111 +2,325 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Consistency levels: how many of a key's nodes must acknowledge a write, or answer a read, before it succeeds
+const (
+	ConsistencyOne = "one";			// The primary alone for writes, any one of the key's nodes for reads
+	ConsistencyQuorum = "quorum";	// A majority of the primary and its replicas
+	ConsistencyAll = "all";			// The primary and all of its replicas
+	ConsistencyPrimary = "primary";	// Reads only: the primary alone
+)
+
+// Time to wait for replicas to acknowledge a write unless configured otherwise
+const defaultReplicationTimeout = 2 * time.Second;
+
+var ErrConsistencyNotMet = errors.New("consistency level not met");
+
+// Parses a write consistency level, ignoring case
+func ParseConsistency (level string) (string, error) {
+	switch strings.ToLower(level) {
+	case ConsistencyOne:
+		return ConsistencyOne, nil;
+	case ConsistencyQuorum:
+		return ConsistencyQuorum, nil;
+	case ConsistencyAll:
+		return ConsistencyAll, nil;
+	default:
+		return "", fmt.Errorf("invalid consistency level %q, expected one, quorum or all", level);
+	}
+}
+
+// Returns the number of acks a consistency level requires from a key's nodes
+func RequiredAcks (level string, nodes int) int {
+	switch level {
+	case ConsistencyAll:
+		return max(nodes, 1);
+	case ConsistencyQuorum:
+		return nodes / 2 + 1;
+	default:
+		return 1;
+	}
+}
+
+// Resolves the nodes responsible for a key and their addresses
+type NodeLocator interface {
+	GetNodesForKey(key string, count int) []string
+	GetNodeAddress(id string) string
+	IsNodeUp(id string) bool
+	KeyPlacement(count int) func(key string) []string	// Places many keys like GetNodesForKey
+}
+
 // Handles cache data replication
 type ReplicationManager struct {
 	cache *Cache
 	replicaCount int
-	nodeManager interface{ GetNodesForKey(key string, count int) []string}
+	nodeManager NodeLocator
 	localNode string
+	inflight sync.WaitGroup // Replication requests still being sent
+	writeConsistency string // Used by writes that do not ask for a level
+	readConsistency string // Used by reads that do not ask for a level
+	timeout time.Duration // How long writes wait for acks from replicas, and reads for their answers
+	httpClient *http.Client // Shared, so connections to replicas are kept alive
+	queues replicationQueues // Writes waiting to be sent to each replica
+	hints *HintStore // Writes replicas missed, nil if hinted handoff is disabled
+	repairs repairCounters
+	antiEntropy antiEntropy
 }
 
 // Creates a new replication manager
-func NewReplicationManager (cache *Cache, replicaCount int, nodeManager interface{ GetNodesForKey(key string, count int) []string}, localNode string) *ReplicationManager {
+func NewReplicationManager (cache *Cache, replicaCount int, nodeManager NodeLocator, localNode string) *ReplicationManager {
+	// Keep enough idle connections for every queue of a replica to reuse one
+	transport := http.DefaultTransport.(*http.Transport).Clone();
+	transport.MaxIdleConnsPerHost = 4 * replicationLanes;
+
 	return &ReplicationManager{
 		cache: cache,
 		replicaCount: replicaCount,
 		nodeManager: nodeManager,
 		localNode: localNode,
+		writeConsistency: ConsistencyOne,
+		readConsistency: ConsistencyPrimary,
+		timeout: defaultReplicationTimeout,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		queues: replicationQueues{batchSize: defaultReplicationBatchSize, queueSize: defaultReplicationQueueSize},
 	}
 }
 
-// Replicates a set operation to replica nodes
-func (rm *ReplicationManager) ReplicateSet (key string, value interface{}, ttl time.Duration) {
-	// Get replica nodes
-	nodes := rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1);	// +1 for the primary node
+// Sets the consistency level of writes that do not ask for one, and how long writes wait for acks
+func (rm *ReplicationManager) SetWriteConsistency (level string, timeout time.Duration) error {
+	level, err := ParseConsistency(level);
+	if err != nil {
+		return err;
+	}
+
+	if timeout <= 0 {
+		return fmt.Errorf("replication timeout must be positive");
+	}
+
+	rm.writeConsistency = level;
+	rm.timeout = timeout;
+	return nil;
+}
+
+// Returns the number of replicas kept for each key besides the primary
+func (rm *ReplicationManager) ReplicaCount () int {
+	return rm.replicaCount;
+}
+
+// Sends a set to the replicas of the key and waits for the acks the consistency level requires,
+// counting the local write as one. Replicas only apply the set if its timestamp is later than their
+// copy of the key, a zero timestamp has them stamp it themselves. An empty level means the default
+// write consistency. Returns the number of acks received.
+func (rm *ReplicationManager) ReplicateSet (key string, value interface{}, ttl time.Duration, ts Timestamp, level string) (int, error) {
+	encoding, encoded, err := EncodeValue(value);
+	if err != nil {
+		return 1, fmt.Errorf("failed to encode value: %w", err);
+	}
+
+	h := hint{Op: hintOpSet, Key: key, Type: encoding, Value: encoded, Timestamp: ts};
+	if ttl > 0 {
+		h.Expiration = time.Now().Add(ttl).UnixNano();
+	}
+
+	return rm.replicate(h, level);
+}
 
-	// Replicate to the other nodes
+// Sends a delete to the replicas of the key and waits for the acks the consistency level requires,
+// counting the local delete as one. Replicas only apply the delete if its timestamp is later than
+// their copy of the key. An empty level means the default write consistency.
+// Returns the number of acks received.
+func (rm *ReplicationManager) ReplicateDelete (key string, ts Timestamp, level string) (int, error) {
+	return rm.replicate(hint{Op: hintOpDelete, Key: key, Timestamp: ts}, level);
+}
+
+// Queues a write to every replica of its key but the local node and waits until enough of them
+// acknowledged it to meet the consistency level, all of them failed or the replication timeout passed.
+// Writes still queued when it returns are sent in the background. Replicas that are down, or whose
+// queue is full while the level can be met without them, are not waited for: the write is kept as
+// a hint for them.
+func (rm *ReplicationManager) replicate (h hint, level string) (int, error) {
+	if level == "" {
+		level = rm.writeConsistency;
+	}
+
+	nodes := rm.nodeManager.GetNodesForKey(h.Key, rm.replicaCount+1);
+	required := RequiredAcks(level, len(nodes));
+	acks := 1;
+
+	// Queueing and waiting for acks share the timeout, so a full queue does not extend it
+	deadline := time.Now().Add(rm.timeout);
+	results := make(chan error, len(nodes));
+	write := queuedWrite{hint: h, done: func (err error) { results <- err }};
+
+	pending, queued := 0, 0;
+	var full []string;
 	for _, node := range nodes {
 		// Skip the local node
-		if node == rm.localNode {
+		if node == rm.localNode || node == "" {
 			continue;
 		}
 
-		// Replicate asynchronously
-		go func (node string) {
-			// Create replication request
-			url := fmt.Sprintf("%s/replicate/set", node);
-			data := map[string]interface{}{
-				"key": key,
-				"value": value,
-				"ttl": int64(ttl.Seconds()),
-			}
+		pending++;
+		if !rm.nodeManager.IsNodeUp(node) {
+			rm.queues.skipped.Add(1);
+			rm.reject(node, write, fmt.Errorf("node is down"));
+			continue;
+		}
 
-			jsonData, err := json.Marshal(data);
-			if err != nil {
-				log.Printf("Error marshaling replication data: %v", err);
-				return;
-			}
+		if rm.offer(node, write) {
+			queued++;
+		} else {
+			full = append(full, node);
+		}
+	}
 
-			// Send replication request
-			resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData));
+	// Only wait for room in full queues if the level cannot be met through the others
+	for _, node := range full {
+		if acks + queued >= required {
+			rm.enqueue(node, write, time.Time{});
+			continue;
+		}
+
+		rm.enqueue(node, write, deadline);
+		queued++;
+	}
+
+	timeout := time.NewTimer(time.Until(deadline));
+	defer timeout.Stop();
+
+	var failures []error;
+	for acks < required && pending > 0 {
+		select {
+		case err := <-results:
+			pending--;
 			if err != nil {
-				log.Printf("Error replicating to node %s: %v", node, err);
-				return;
+				failures = append(failures, err);
+			} else {
+				acks++;
 			}
-			defer resp.Body.Close();
+		case <-timeout.C:
+			return acks, fmt.Errorf("%w: %d of %d acks within %s", ErrConsistencyNotMet, acks, required, rm.timeout);
+		}
+	}
 
-			if (resp.StatusCode != http.StatusOK) {
-				log.Printf("Replication to node %s failed with status %d", node, resp.StatusCode)
-			}
-		}(node);
+	if acks < required {
+		return acks, fmt.Errorf("%w: %d of %d acks: %v", ErrConsistencyNotMet, acks, required, errors.Join(failures...));
 	}
+
+	return acks, nil;
 }
 
-// Replicates delete operation to the replica nodes
-func (rm *ReplicationManager) ReplicateDelete (key string) {
-	// Get replica nodes
-	nodes := rm.nodeManager.GetNodesForKey(key, rm.replicaCount+1);
+// A replication request a node answered with an error status
+type statusError struct {
+	code int;
+}
 
-	// Replicate to other nodes
-	for _, node := range nodes {
-		// Skip local node
-		if node == rm.localNode {
-			continue;
+func (e statusError) Error () string {
+	return fmt.Sprintf("status %d", e.code);
+}
+
+// Checks if a failed replication request may succeed later. Writes a node rejected as invalid never will.
+func retryable (err error) bool {
+	var status statusError;
+	return !errors.As(err, &status) || status.code >= http.StatusInternalServerError;
+}
+
+// Sends a replicated write to a node, failing unless it answers 200 OK.
+// Sets whose value expired in the meantime are not sent.
+func (rm *ReplicationManager) send (node string, h hint) error {
+	address := rm.nodeManager.GetNodeAddress(node);
+	if address == "" {
+		return fmt.Errorf("unknown address");
+	}
+
+	var req *http.Request;
+	var err error;
+	switch h.Op {
+	case hintOpDelete:
+		query := url.Values{"key": {h.Key}, "timestamp": {h.Timestamp.String()}};
+		req, err = http.NewRequest(http.MethodDelete, address + "/replicate/delete?" + query.Encode(), nil);
+	case hintOpLease:
+		req, err = http.NewRequest(http.MethodPost, address + "/replicate/lock", bytes.NewReader(h.Value));
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json");
+		}
+	default:
+		ttl, live := h.ttl(time.Now());
+		if !live {
+			return nil;
 		}
 
-		// Replicate asynchronously
-		go func (node string) {
-			// Create replication request
-			url := fmt.Sprintf("%s/replication/delete?key=%s", node, key);
+		var jsonData []byte;
+		jsonData, err = json.Marshal(map[string]interface{}{
+			"key": h.Key,
+			"value": h.Value,
+			"type": h.Type,
+			"ttl": ttl,
+			"timestamp": h.Timestamp,
+		});
+		if err != nil {
+			return fmt.Errorf("failed to encode replication data: %w", err);
+		}
 
-			req, err := http.NewRequest(http.MethodDelete, url, nil);
-			if err != nil {
-				log.Printf("Error creating delete request: %v", err);
-				return;
-			}
+		req, err = http.NewRequest(http.MethodPost, address + "/replicate/set", bytes.NewReader(jsonData));
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json");
+		}
+	}
+	if err != nil {
+		return err;
+	}
 
-			// Send replication request
-			client := &http.Client{};
-			resp, err := client.Do(req);
-			if err != nil {
-				log.Printf("Error replicating delete to node %s: %v", node, err);
-				return;
-			}
+	resp, err := rm.httpClient.Do(req);
+	if err != nil {
+		return err;
+	}
+	defer resp.Body.Close();
+	io.Copy(io.Discard, resp.Body);
 
-			defer resp.Body.Close();
+	if resp.StatusCode != http.StatusOK {
+		return statusError{resp.StatusCode};
+	}
 
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("Delete replication to node %s failed with status %d", node, resp.StatusCode);
-			}
-		}(node);
+	return nil;
+}
+
+// Replicates a lock lease to the replica nodes of the lock and waits for a quorum of them,
+// counting the local node as one, so a replica taking over the lock knows the lease and its token.
+// Returns the number of acks received.
+func (rm *ReplicationManager) ReplicateLease (lease Lease) (int, error) {
+	jsonData, err := json.Marshal(lease);
+	if err != nil {
+		return 1, fmt.Errorf("failed to encode lease: %w", err);
+	}
+
+	return rm.replicate(hint{Op: hintOpLease, Key: lease.Name, Value: jsonData}, ConsistencyQuorum);
+}
+
+// Waits until the replication requests already started have been sent, or until ctx is done
+func (rm *ReplicationManager) Flush (ctx context.Context) error {
+	done := make(chan struct{});
+	go func () {
+		rm.inflight.Wait();
+		close(done);
+	}();
+
+	select {
+	case <-done:
+		return nil;
+	case <-ctx.Done():
+		return fmt.Errorf("replication requests still pending: %w", ctx.Err());
 	}
 }
 
@@ -117,19 +331,17 @@ func (rm *ReplicationManager) HandleReplicateSet (w http.ResponseWriter, r *http
 		return;
 	}
 
-	var data struct {
-		Key string `json:"key"`;
-		Value interface{} `json:"value"`;
-		TTL int64 `json:"ttl"`;
-	}
-
+	var data replicatedWrite;
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest);
 		return;
 	}
 
-	ttl := time.Duration(data.TTL) * time.Second;
-	rm.cache.Set(data.Key, data.Value, ttl);
+	data.Op = hintOpSet;
+	if status, err := rm.applyWrite(data); err != nil {
+		http.Error(w, err.Error(), status);
+		return;
+	}
 
 	w.Header().Set("Content-Type", "application/json");
 	json.NewEncoder(w).Encode(map[string]string {"status": "success"});
@@ -149,14 +361,55 @@ func (rm *ReplicationManager) HandleReplicateDelete (w http.ResponseWriter, r *h
 		return;
 	}
 
-	rm.cache.Delete(key);
+	// Deletes from nodes that predate timestamps are stamped locally
+	var ts Timestamp;
+	if param := r.URL.Query().Get("timestamp"); param != "" {
+		var err error;
+		ts, err = ParseTimestamp(param);
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest);
+			return;
+		}
+	}
+
+	rm.cache.applyReplicatedDelete(key, ts);
 
 	w.Header().Set("Content-Type", "application/json");
-	json.NewEncoder(w).Encode(map[string]string{"status": "succcess"});
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"});
+}
+
+// Handles the incoming lease replication requests
+func (rm *ReplicationManager) HandleReplicateLease (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var lease Lease;
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	if lease.Name == "" {
+		http.Error(w, "Lock name is required", http.StatusBadRequest);
+		return;
+	}
+
+	rm.cache.ApplyLease(lease);
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]string {"status": "success"});
 }
 
 // Sets up the HTTP handlers for replication
 func (rm *ReplicationManager) SetupHTTPHandlers (mux *http.ServeMux) {
 	mux.HandleFunc("/replicate/set", rm.HandleReplicateSet);
 	mux.HandleFunc("/replicate/delete", rm.HandleReplicateDelete);
+	mux.HandleFunc("/replicate/batch", rm.HandleReplicateBatch);
+	mux.HandleFunc("/replicate/get", rm.HandleReplicaGet);
+	mux.HandleFunc("/replicate/lock", rm.HandleReplicateLease);
+	mux.HandleFunc("/replicate/handoff", rm.HandleHandoff);
+	mux.HandleFunc("/replicate/merkle", rm.HandleMerkleHashes);
+	mux.HandleFunc("/replicate/merkle/leaves", rm.HandleMerkleLeaves);
 }
@@ -0,0 +1,400 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of queues, each sending one batch at a time, that writes to a peer are spread over by key.
+// Writes of a key always go through the same queue, so they are applied in order.
+const replicationLanes = 4;
+
+// Batch size and queue capacity per peer unless configured otherwise
+const (
+	defaultReplicationBatchSize = 128;
+	defaultReplicationQueueSize = 1024;
+)
+
+// A write waiting in a queue to be sent to a peer
+type queuedWrite struct {
+	hint hint;
+	done func(err error);	// Told the outcome from the queue's goroutine, must not block
+}
+
+// The queues of writes to one peer
+type peerQueue struct {
+	lanes [replicationLanes]chan queuedWrite;
+	closed bool;		// Set once the peer left, the lanes are closed
+	mu sync.RWMutex;	// Held for reading while queueing, so the lanes are not closed meanwhile
+}
+
+// Counters of replication to peers
+type ReplicationStats struct {
+	Queued		int		`json:"queued"`		// Writes waiting to be sent
+	Batches		uint64	`json:"batches"`	// Batches sent
+	Writes		uint64	`json:"writes"`		// Writes sent in batches
+	Rejected	uint64	`json:"rejected"`	// Writes that found the queue to a peer full, kept as hints
+	Skipped		uint64	`json:"skipped"`	// Writes for peers that were down, kept as hints
+}
+
+// Replication queues of a replication manager
+type replicationQueues struct {
+	peers map[string]*peerQueue;
+	batchSize int;
+	queueSize int;	// Writes queued per peer, across its lanes
+	mu sync.Mutex;
+	batches atomic.Uint64;
+	writes atomic.Uint64;
+	rejected atomic.Uint64;
+	skipped atomic.Uint64;
+}
+
+// The DTO for a write in a replication batch
+type replicatedWrite struct {
+	Op			string			`json:"op"`
+	Key			string			`json:"key"`
+	Type		string			`json:"type,omitempty"`	// Encoding of the value, empty for plain JSON values
+	Value		json.RawMessage	`json:"value,omitempty"`
+	TTL			int64			`json:"ttl,omitempty"`		// Seconds
+	Timestamp	Timestamp		`json:"timestamp"`
+}
+
+// The DTO for replication batches
+type replicationBatch struct {
+	Writes	[]replicatedWrite	`json:"writes"`
+}
+
+// Sets how many writes are sent to a peer in one request, and how many may wait for a peer
+// before further writes to it are failed and kept as hints
+func (rm *ReplicationManager) SetReplicationQueues (batchSize, queueSize int) error {
+	if batchSize <= 0 || queueSize < replicationLanes {
+		return fmt.Errorf("replication batch size must be positive and queue size at least %d", replicationLanes);
+	}
+
+	rm.queues.mu.Lock();
+	defer rm.queues.mu.Unlock();
+
+	rm.queues.batchSize = batchSize;
+	rm.queues.queueSize = queueSize;
+	return nil;
+}
+
+// Returns the queues of a peer, starting them if needed
+func (rm *ReplicationManager) peerQueue (node string) *peerQueue {
+	rm.queues.mu.Lock();
+	defer rm.queues.mu.Unlock();
+
+	if pq, exists := rm.queues.peers[node]; exists {
+		return pq;
+	}
+
+	if rm.queues.peers == nil {
+		rm.queues.peers = make(map[string]*peerQueue);
+	}
+
+	pq := &peerQueue{};
+	for i := range pq.lanes {
+		pq.lanes[i] = make(chan queuedWrite, rm.queues.queueSize / replicationLanes);
+		go rm.sendLane(node, pq.lanes[i]);
+	}
+
+	rm.queues.peers[node] = pq;
+	return pq;
+}
+
+// Returns the lane of a peer's queues the writes of key go through
+func (pq *peerQueue) lane (key string) chan queuedWrite {
+	h32 := fnv.New32a();
+	h32.Write([]byte(key));
+	return pq.lanes[h32.Sum32() % replicationLanes];
+}
+
+// Queues a write to a peer if its queue has room. Returns false, without telling done anything, if it is full.
+func (rm *ReplicationManager) offer (node string, write queuedWrite) bool {
+	pq := rm.peerQueue(node);
+	pq.mu.RLock();
+	defer pq.mu.RUnlock();
+
+	if pq.closed {
+		rm.reject(node, write, fmt.Errorf("node left the cluster"));
+		return true;
+	}
+
+	rm.inflight.Add(1);
+	select {
+	case pq.lane(write.hint.Key) <- write:
+		return true;
+	default:
+		rm.inflight.Done();
+		return false;
+	}
+}
+
+// Queues a write to a peer, telling done its outcome once the peer answered. If the queue is full
+// because the peer falls behind, waits for room until deadline and then fails the write, keeping it
+// as a hint. A zero deadline fails the write right away.
+func (rm *ReplicationManager) enqueue (node string, write queuedWrite, deadline time.Time) {
+	if rm.offer(node, write) {
+		return;
+	}
+
+	wait := time.Until(deadline);
+	if wait <= 0 {
+		rm.queues.rejected.Add(1);
+		rm.reject(node, write, fmt.Errorf("replication queue full"));
+		return;
+	}
+
+	pq := rm.peerQueue(node);
+	pq.mu.RLock();
+	defer pq.mu.RUnlock();
+
+	if pq.closed {
+		rm.reject(node, write, fmt.Errorf("node left the cluster"));
+		return;
+	}
+
+	timeout := time.NewTimer(wait);
+	defer timeout.Stop();
+
+	rm.inflight.Add(1);
+	select {
+	case pq.lane(write.hint.Key) <- write:
+	case <-timeout.C:
+		rm.queues.rejected.Add(1);
+		rm.complete(node, []queuedWrite{write}, fmt.Errorf("replication queue full"));
+	}
+}
+
+// Fails a write without queueing it, keeping it as a hint for the peer
+func (rm *ReplicationManager) reject (node string, write queuedWrite, err error) {
+	rm.inflight.Add(1);
+	rm.complete(node, []queuedWrite{write}, err);
+}
+
+// Stops the queues of a peer that left the cluster. Writes still queued are sent, or kept as hints,
+// before its goroutines exit.
+func (rm *ReplicationManager) RemovePeer (node string) {
+	rm.queues.mu.Lock();
+	pq, exists := rm.queues.peers[node];
+	delete(rm.queues.peers, node);
+	rm.queues.mu.Unlock();
+
+	if !exists {
+		return;
+	}
+
+	pq.mu.Lock();
+	defer pq.mu.Unlock();
+
+	pq.closed = true;
+	for _, lane := range pq.lanes {
+		close(lane);
+	}
+}
+
+// Sends the writes queued in a lane to a peer, one batch at a time. A batch holds the writes
+// that queued up while the previous one was being sent, so batches grow with the load.
+func (rm *ReplicationManager) sendLane (node string, lane chan queuedWrite) {
+	for write := range lane {
+		batch := []queuedWrite{write};
+
+	fill:
+		for len(batch) < rm.queues.batchSize {
+			select {
+			case write := <-lane:
+				batch = append(batch, write);
+			default:
+				break fill;
+			}
+		}
+
+		rm.sendBatch(node, batch);
+	}
+}
+
+// Sends a batch of writes to a peer and tells each write its outcome
+func (rm *ReplicationManager) sendBatch (node string, batch []queuedWrite) {
+	now := time.Now();
+	request := replicationBatch{Writes: make([]replicatedWrite, 0, len(batch))};
+	sent := make([]queuedWrite, 0, len(batch));
+
+	for _, write := range batch {
+		h := write.hint;
+		ttl, live := h.ttl(now);
+		if !live {
+			// Expired while queued
+			rm.complete(node, []queuedWrite{write}, nil);
+			continue;
+		}
+
+		request.Writes = append(request.Writes, replicatedWrite{Op: h.Op, Key: h.Key, Type: h.Type, Value: h.Value, TTL: ttl, Timestamp: h.Timestamp});
+		sent = append(sent, write);
+	}
+
+	if len(sent) == 0 {
+		return;
+	}
+
+	statuses, err := rm.postBatch(node, request);
+
+	// Peers that predate batches are sent the writes one by one
+	var status statusError;
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		for _, write := range sent {
+			rm.complete(node, []queuedWrite{write}, rm.send(node, write.hint));
+		}
+		return;
+	}
+
+	if err != nil {
+		log.Printf("Error replicating %d writes to node %s: %v", len(sent), node, err);
+		rm.complete(node, sent, err);
+		return;
+	}
+
+	rm.queues.batches.Add(1);
+	rm.queues.writes.Add(uint64(len(sent)));
+
+	for i, write := range sent {
+		var err error;
+		if statuses[i] != http.StatusOK {
+			err = statusError{statuses[i]};
+			log.Printf("Error replicating key %s to node %s: %v", write.hint.Key, node, err);
+		}
+		rm.complete(node, []queuedWrite{write}, err);
+	}
+}
+
+// Posts a batch of writes to a peer. Returns the status of each write.
+func (rm *ReplicationManager) postBatch (node string, request replicationBatch) ([]int, error) {
+	address := rm.nodeManager.GetNodeAddress(node);
+	if address == "" {
+		return nil, fmt.Errorf("unknown address");
+	}
+
+	jsonData, err := json.Marshal(request);
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode replication data: %w", err);
+	}
+
+	resp, err := rm.httpClient.Post(address + "/replicate/batch", "application/json", bytes.NewReader(jsonData));
+	if err != nil {
+		return nil, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError{resp.StatusCode};
+	}
+
+	var response struct {
+		Statuses []int `json:"statuses"`;
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err;
+	}
+	if len(response.Statuses) != len(request.Writes) {
+		return nil, fmt.Errorf("expected %d statuses, got %d", len(request.Writes), len(response.Statuses));
+	}
+
+	return response.Statuses, nil;
+}
+
+// Tells writes their outcome, keeping the failed ones as hints for the peer
+func (rm *ReplicationManager) complete (node string, writes []queuedWrite, err error) {
+	for _, write := range writes {
+		if err != nil {
+			rm.addHint(node, write.hint, err);
+			write.done(fmt.Errorf("node %s: %w", node, err));
+		} else {
+			write.done(nil);
+		}
+		rm.inflight.Done();
+	}
+}
+
+// Applies a replicated write to the local copy of its key. Returns the status to answer it with.
+func (rm *ReplicationManager) applyWrite (write replicatedWrite) (int, error) {
+	if write.Key == "" {
+		return http.StatusBadRequest, fmt.Errorf("key is required");
+	}
+
+	switch write.Op {
+	case hintOpDelete:
+		rm.cache.applyReplicatedDelete(write.Key, write.Timestamp);
+		return http.StatusOK, nil;
+	case hintOpLease:
+		var lease Lease;
+		if err := json.Unmarshal(write.Value, &lease); err != nil || lease.Name != write.Key {
+			return http.StatusBadRequest, fmt.Errorf("invalid lease");
+		}
+		rm.cache.ApplyLease(lease);
+		return http.StatusOK, nil;
+	}
+
+	value, err := decodeValue(write.Type, write.Value);
+	if err != nil {
+		return http.StatusBadRequest, err;
+	}
+
+	if err := rm.cache.applyReplicated(write.Key, value, time.Duration(write.TTL) * time.Second, write.Timestamp); err != nil {
+		return http.StatusConflict, err;
+	}
+
+	return http.StatusOK, nil;
+}
+
+// Handles batches of replicated writes, applied in order
+func (rm *ReplicationManager) HandleReplicateBatch (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var batch replicationBatch;
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	statuses := make([]int, len(batch.Writes));
+	for i, write := range batch.Writes {
+		var err error;
+		statuses[i], err = rm.applyWrite(write);
+		if err != nil {
+			log.Printf("Rejected replicated write of key %s: %v", write.Key, err);
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]interface{} {"statuses": statuses});
+}
+
+// Returns the replication counters
+func (rm *ReplicationManager) ReplicationStats () ReplicationStats {
+	rm.queues.mu.Lock();
+	queued := 0;
+	for _, pq := range rm.queues.peers {
+		for _, lane := range pq.lanes {
+			queued += len(lane);
+		}
+	}
+	rm.queues.mu.Unlock();
+
+	return ReplicationStats{
+		Queued: queued,
+		Batches: rm.queues.batches.Load(),
+		Writes: rm.queues.writes.Load(),
+		Rejected: rm.queues.rejected.Load(),
+		Skipped: rm.queues.skipped.Load(),
+	}
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A peer that records the replication batches it is sent, holding every request until released
+type testPeer struct {
+	received chan struct{};	// Told about every request as it arrives
+	release chan struct{};	// Closed to let requests through
+	batches [][]replicatedWrite;
+	mu sync.Mutex;
+}
+
+// Starts a peer and a replication manager sending to it as node n2
+func newTestPeer (t *testing.T, batchSize, queueSize int) (*ReplicationManager, *testPeer) {
+	t.Helper();
+
+	peer := &testPeer{received: make(chan struct{}, 1000), release: make(chan struct{})};
+	server := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		var batch replicationBatch;
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest);
+			return;
+		}
+		peer.received <- struct{}{};
+		<-peer.release;
+
+		peer.mu.Lock();
+		peer.batches = append(peer.batches, batch.Writes);
+		peer.mu.Unlock();
+
+		statuses := make([]int, len(batch.Writes));
+		for i := range statuses {
+			statuses[i] = http.StatusOK;
+		}
+		json.NewEncoder(w).Encode(map[string]interface{} {"statuses": statuses});
+	}));
+	t.Cleanup(server.Close);
+
+	locator := &testLocator{nodes: []string{"n1", "n2"}, addresses: map[string]string{"n2": server.URL}};
+	rm := NewReplicationManager(NewCache("lru", 100), 1, locator, "n1");
+	if err := rm.SetReplicationQueues(batchSize, queueSize); err != nil {
+		t.Fatalf("SetReplicationQueues: %v", err);
+	}
+
+	return rm, peer;
+}
+
+// Returns a queued write of key at wall, counting failures in failed
+func testWrite (key string, wall int64, failed *atomic.Int64) queuedWrite {
+	h := hint{Op: hintOpSet, Key: key, Value: []byte(fmt.Sprintf("%d", wall)), Timestamp: Timestamp{Wall: wall, Node: "n1"}};
+
+	return queuedWrite{hint: h, done: func (err error) {
+		if err != nil {
+			failed.Add(1);
+		}
+	}};
+}
+
+// Waits for the replication manager to finish sending
+func flushTestReplicas (t *testing.T, rm *ReplicationManager) {
+	t.Helper();
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second);
+	defer cancel();
+	if err := rm.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err);
+	}
+}
+
+func TestReplicationQueueOrder (t *testing.T) {
+	rm, peer := newTestPeer(t, 16, 1024);
+
+	// Writes queue up behind the first batches, which the peer holds
+	var failed atomic.Int64;
+	for i := 1; i <= 200; i++ {
+		rm.enqueue("n2", testWrite(fmt.Sprintf("k%d", i % 10), int64(i), &failed), time.Time{});
+	}
+	close(peer.release);
+	flushTestReplicas(t, rm);
+
+	if failed.Load() != 0 {
+		t.Errorf("%d writes failed", failed.Load());
+	}
+
+	// Every write arrived once, after the earlier writes of its key
+	last := make(map[string]int64);
+	writes := 0;
+	for _, batch := range peer.batches {
+		if len(batch) > 16 {
+			t.Errorf("batch of %d writes, want at most 16", len(batch));
+		}
+		for _, write := range batch {
+			if write.Timestamp.Wall <= last[write.Key] {
+				t.Errorf("write of %s at %d arrived after the one at %d", write.Key, write.Timestamp.Wall, last[write.Key]);
+			}
+			last[write.Key] = write.Timestamp.Wall;
+			writes++;
+		}
+	}
+	if writes != 200 {
+		t.Errorf("peer got %d writes, want 200", writes);
+	}
+
+	stats := rm.ReplicationStats();
+	if stats.Writes != 200 || stats.Batches != uint64(len(peer.batches)) || stats.Batches >= 200 || stats.Queued != 0 {
+		t.Errorf("stats = %+v, want 200 writes sent in batches", stats);
+	}
+}
+
+func TestReplicationQueueBackpressure (t *testing.T) {
+	rm, peer := newTestPeer(t, 1, replicationLanes);
+	if err := rm.EnableHints("", 100, 0, nil); err != nil {
+		t.Fatalf("EnableHints: %v", err);
+	}
+
+	// The first write is being sent and the second waits in the lane, filling it
+	var failed atomic.Int64;
+	rm.enqueue("n2", testWrite("a", 1, &failed), time.Time{});
+	<-peer.received;
+	rm.enqueue("n2", testWrite("a", 2, &failed), time.Time{});
+
+	// Further writes of the key fail, right away or once their deadline passes, and are kept as hints
+	rm.enqueue("n2", testWrite("a", 3, &failed), time.Time{});
+	rm.enqueue("n2", testWrite("a", 4, &failed), time.Now().Add(20 * time.Millisecond));
+	if stats := rm.ReplicationStats(); failed.Load() != 2 || stats.Rejected != 2 || stats.Queued != 1 {
+		t.Errorf("%d writes failed, stats %+v, want 2 rejected", failed.Load(), stats);
+	}
+	if stats := rm.HintStats(); stats.Pending != 2 {
+		t.Errorf("hint stats = %+v, want the rejected writes kept", stats);
+	}
+
+	close(peer.release);
+	flushTestReplicas(t, rm);
+
+	if len(peer.batches) != 2 || peer.batches[0][0].Timestamp.Wall != 1 || peer.batches[1][0].Timestamp.Wall != 2 {
+		t.Errorf("peer got %v, want the two queued writes in order", peer.batches);
+	}
+}
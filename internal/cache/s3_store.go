@@ -0,0 +1,284 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash sent with S3 requests, so bodies can be streamed without hashing them first
+const unsignedPayload = "UNSIGNED-PAYLOAD";
+
+// S3SnapshotStore keeps snapshots in a bucket of an S3-compatible object store,
+// addressed path-style (endpoint/bucket/key) so it also works with local stand-ins.
+// Requests are signed with AWS Signature Version 4 when credentials are set.
+type S3SnapshotStore struct {
+	endpoint *url.URL;
+	bucket string;
+	prefix string;	// Prepended to every snapshot name to form the object key
+	region string;
+	accessKey string;
+	secretKey string;
+	httpClient *http.Client;
+}
+
+// Creates a snapshot store for the bucket at the endpoint, e.g. https://s3.us-east-1.amazonaws.com.
+// Leave the keys empty to send unsigned requests.
+func NewS3SnapshotStore (endpoint, bucket, prefix, region, accessKey, secretKey string) (*S3SnapshotStore, error) {
+	u, err := url.Parse(endpoint);
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint);
+	}
+
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required");
+	}
+
+	return &S3SnapshotStore{
+		endpoint: u,
+		bucket: bucket,
+		prefix: prefix,
+		region: region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+	}, nil;
+}
+
+// Uploads the snapshot as a single object
+func (s3 *S3SnapshotStore) Put (name string, r io.Reader, size int64) error {
+	req, err := s3.newRequest(http.MethodPut, s3.prefix + name, nil, r);
+	if err != nil {
+		return err;
+	}
+	req.ContentLength = size;
+
+	resp, err := s3.do(req);
+	if err != nil {
+		return err;
+	}
+	resp.Body.Close();
+
+	return nil;
+}
+
+// Downloads a snapshot object
+func (s3 *S3SnapshotStore) Get (name string) (io.ReadCloser, error) {
+	req, err := s3.newRequest(http.MethodGet, s3.prefix + name, nil, nil);
+	if err != nil {
+		return nil, err;
+	}
+
+	resp, err := s3.do(req);
+	if err != nil {
+		return nil, err;
+	}
+
+	return resp.Body, nil;
+}
+
+// Response of the ListObjectsV2 call
+type listBucketResult struct {
+	Contents []struct {
+		Key				string		`xml:"Key"`
+		Size			int64		`xml:"Size"`
+		LastModified	time.Time	`xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated				bool	`xml:"IsTruncated"`
+	NextContinuationToken	string	`xml:"NextContinuationToken"`
+}
+
+// Lists the snapshot objects whose names start with prefix, following continuation tokens
+func (s3 *S3SnapshotStore) List (prefix string) ([]StoredSnapshot, error) {
+	var snapshots []StoredSnapshot;
+	token := "";
+
+	for {
+		query := url.Values{};
+		query.Set("list-type", "2");
+		query.Set("prefix", s3.prefix + prefix);
+		if token != "" {
+			query.Set("continuation-token", token);
+		}
+
+		req, err := s3.newRequest(http.MethodGet, "", query, nil);
+		if err != nil {
+			return nil, err;
+		}
+
+		resp, err := s3.do(req);
+		if err != nil {
+			return nil, err;
+		}
+
+		var result listBucketResult;
+		err = xml.NewDecoder(resp.Body).Decode(&result);
+		resp.Body.Close();
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object listing: %w", err);
+		}
+
+		for _, object := range result.Contents {
+			snapshots = append(snapshots, StoredSnapshot{
+				Name: strings.TrimPrefix(object.Key, s3.prefix),
+				Size: object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return snapshots, nil;
+		}
+		token = result.NextContinuationToken;
+	}
+}
+
+// Deletes a snapshot object
+func (s3 *S3SnapshotStore) Delete (name string) error {
+	req, err := s3.newRequest(http.MethodDelete, s3.prefix + name, nil, nil);
+	if err != nil {
+		return err;
+	}
+
+	resp, err := s3.do(req);
+	if err != nil {
+		return err;
+	}
+	resp.Body.Close();
+
+	return nil;
+}
+
+// Builds a signed request for an object key, or for the bucket if the key is empty
+func (s3 *S3SnapshotStore) newRequest (method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s3.endpoint;
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s3.bucket;
+	if key != "" {
+		u.Path += "/" + key;
+	}
+	u.RawPath = s3UriEncode(u.Path, false);
+	u.RawQuery = s3CanonicalQuery(query);
+
+	req, err := http.NewRequest(method, u.String(), body);
+	if err != nil {
+		return nil, err;
+	}
+
+	if s3.accessKey != "" {
+		s3.sign(req, time.Now().UTC());
+	}
+
+	return req, nil;
+}
+
+// Sends a request, turning error statuses into errors
+func (s3 *S3SnapshotStore) do (req *http.Request) (*http.Response, error) {
+	resp, err := s3.httpClient.Do(req);
+	if err != nil {
+		return nil, fmt.Errorf("S3 request failed: %w", err);
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode == http.StatusNotFound && req.Method == http.MethodGet {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, req.URL.Path);
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024));
+	return nil, fmt.Errorf("S3 %s %s returned status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(message)));
+}
+
+// Signs a request with AWS Signature Version 4
+func (s3 *S3SnapshotStore) sign (req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z");
+	date := now.Format("20060102");
+
+	req.Header.Set("X-Amz-Date", amzDate);
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload);
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date";
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n";
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n");
+
+	scope := date + "/" + s3.region + "/s3/aws4_request";
+	requestHash := sha256.Sum256([]byte(canonicalRequest));
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:]);
+
+	key := s3SigningKey(s3.secretKey, date, s3.region, "s3");
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign));
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3.accessKey, scope, signedHeaders, signature));
+}
+
+// Derives the Signature Version 4 key for a day, region and service from the secret key
+func s3SigningKey (secretKey, date, region, service string) []byte {
+	key := hmacSha256([]byte("AWS4" + secretKey), date);
+	key = hmacSha256(key, region);
+	key = hmacSha256(key, service);
+	return hmacSha256(key, "aws4_request");
+}
+
+// Computes an HMAC-SHA256
+func hmacSha256 (key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key);
+	mac.Write([]byte(data));
+	return mac.Sum(nil);
+}
+
+// Percent-encodes everything but unreserved characters, as required by Signature Version 4.
+// Slashes are kept unless encodeSlash is set.
+func s3UriEncode (s string, encodeSlash bool) string {
+	var b strings.Builder;
+	for i := 0; i < len(s); i++ {
+		c := s[i];
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c);
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c);
+		default:
+			fmt.Fprintf(&b, "%%%02X", c);
+		}
+	}
+
+	return b.String();
+}
+
+// Encodes query parameters sorted by name, as required by Signature Version 4
+func s3CanonicalQuery (query url.Values) string {
+	keys := make([]string, 0, len(query));
+	for key := range query {
+		keys = append(keys, key);
+	}
+	sort.Strings(keys);
+
+	parts := make([]string, 0, len(keys));
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3UriEncode(key, true) + "=" + s3UriEncode(value, true));
+		}
+	}
+
+	return strings.Join(parts, "&");
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait before retrying a save rule after a failed save
+const saveRetryDelay = 5 * time.Second;
+
+// SaveRule saves the cache once at least Changes writes were made and Seconds passed since the last save
+type SaveRule struct {
+	Seconds	int64	`json:"seconds"`
+	Changes	uint64	`json:"changes"`
+}
+
+// Parses save rules written as "seconds changes" pairs, e.g. "900 1 300 10 60 10000".
+// An empty string yields no rules, which disables automatic saves.
+func ParseSaveRules (spec string) ([]SaveRule, error) {
+	fields := strings.Fields(spec);
+	if len(fields) % 2 != 0 {
+		return nil, fmt.Errorf("save rules must be pairs of seconds and changes");
+	}
+
+	rules := make([]SaveRule, 0, len(fields) / 2);
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64);
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid seconds %q in save rules", fields[i]);
+		}
+
+		changes, err := strconv.ParseUint(fields[i + 1], 10, 64);
+		if err != nil || changes == 0 {
+			return nil, fmt.Errorf("invalid changes %q in save rules", fields[i + 1]);
+		}
+
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes});
+	}
+
+	return rules, nil;
+}
+
+// Replaces the save rules. Takes effect immediately, also while running.
+func (pm *PersistenceManager) SetSaveRules (rules []SaveRule) error {
+	for _, rule := range rules {
+		if rule.Seconds <= 0 || rule.Changes == 0 {
+			return fmt.Errorf("save rules need positive seconds and changes");
+		}
+	}
+
+	pm.statusMu.Lock();
+	defer pm.statusMu.Unlock();
+
+	pm.rules = append([]SaveRule(nil), rules...);
+	return nil;
+}
+
+// Returns the save rules
+func (pm *PersistenceManager) SaveRules () []SaveRule {
+	pm.statusMu.Lock();
+	defer pm.statusMu.Unlock();
+
+	return append([]SaveRule(nil), pm.rules...);
+}
+
+// Checks if any save rule is met by the changes made since the last save
+func (pm *PersistenceManager) saveDue (now time.Time) bool {
+	changes := pm.cache.Changes();
+	if changes == 0 {
+		return false;
+	}
+
+	pm.statusMu.Lock();
+	defer pm.statusMu.Unlock();
+
+	if pm.status.InProgress {
+		return false;
+	}
+
+	// Back off after a failed save instead of retrying every second
+	if pm.status.Error != "" && now.Sub(pm.status.LastSave) < saveRetryDelay {
+		return false;
+	}
+
+	elapsed := now.Sub(pm.lastSuccess);
+	for _, rule := range pm.rules {
+		if changes >= rule.Changes && elapsed >= time.Duration(rule.Seconds) * time.Second {
+			return true;
+		}
+	}
+
+	return false;
+}
+
+// Returns the number of changes made to the cache since the last save
+func (c *Cache) Changes () uint64 {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	return c.changes;
+}
+
+// Subtracts the changes covered by a snapshot, keeping those made while it was written
+func (c *Cache) markSaved (changes uint64) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.changes -= min(changes, c.changes);
+}
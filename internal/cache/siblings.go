@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// VectorClock counts, for every node, the writes of a key coordinated by that node that a version has seen
+type VectorClock map[string]uint64
+
+// Returns a copy of the clock
+func (vc VectorClock) Clone () VectorClock {
+	clone := make(VectorClock, len(vc));
+	for node, counter := range vc {
+		clone[node] = counter;
+	}
+
+	return clone;
+}
+
+// Checks if the clock has seen the write numbered counter coordinated by node
+func (vc VectorClock) Covers (node string, counter uint64) bool {
+	return vc[node] >= counter;
+}
+
+// Encodes the clock as an opaque context string for clients
+func (vc VectorClock) Encode () string {
+	data, _ := json.Marshal(vc);
+	return base64.RawURLEncoding.EncodeToString(data);
+}
+
+// Decodes a context string returned by Encode, an empty string is an empty clock
+func DecodeVectorClock (context string) (VectorClock, error) {
+	vc := make(VectorClock);
+	if context == "" {
+		return vc, nil;
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(context);
+	if err != nil {
+		return nil, fmt.Errorf("invalid context: %w", err);
+	}
+
+	if err := json.Unmarshal(data, &vc); err != nil {
+		return nil, fmt.Errorf("invalid context: %w", err);
+	}
+
+	return vc, nil;
+}
+
+// Sibling is one version of a key. The write that made it is identified by the node that coordinated it
+// and that node's counter, and Clock is what the writer had seen, so the version replaces the versions
+// its clock covers and is concurrent with all others.
+type Sibling struct {
+	Value	json.RawMessage	`json:"value,omitempty"`
+	Type	string			`json:"type,omitempty"`		// Encoding of the value, empty for plain JSON values
+	Deleted	bool			`json:"deleted,omitempty"`	// Written by a delete, hides the versions it replaces
+	Node	string			`json:"node"`
+	Counter	uint64			`json:"counter"`
+	Clock	VectorClock		`json:"clock,omitempty"`
+}
+
+// SiblingSet holds the versions of a key that were written concurrently, none of which has seen the others.
+// Copies on different nodes merge into the versions neither has seen replaced, Dynamo-style.
+type SiblingSet struct {
+	Siblings	[]Sibling	`json:"siblings"`
+}
+
+// Returns the value type name of the set
+func (s *SiblingSet) Type () string {
+	return ValueTypeSiblings;
+}
+
+// Returns a deep copy of the set
+func (s *SiblingSet) Clone () Mergeable {
+	clone := &SiblingSet{Siblings: make([]Sibling, len(s.Siblings))};
+	for i, sib := range s.Siblings {
+		sib.Clock = sib.Clock.Clone();
+		clone.Siblings[i] = sib;
+	}
+
+	return clone;
+}
+
+// Merges the versions of another copy, dropping the versions either copy has seen replaced
+func (s *SiblingSet) Merge (other Mergeable) error {
+	o, ok := other.(*SiblingSet);
+	if !ok {
+		return ErrWrongType;
+	}
+
+	all := append(s.Siblings[:len(s.Siblings):len(s.Siblings)], o.Clone().(*SiblingSet).Siblings...);
+	s.Siblings = liveSiblings(all);
+	return nil;
+}
+
+// Returns the versions no other version has replaced, without duplicates
+func liveSiblings (siblings []Sibling) []Sibling {
+	live := make([]Sibling, 0, len(siblings));
+	seen := make(map[string]struct{}, len(siblings));
+
+	for _, sib := range siblings {
+		id := fmt.Sprintf("%s/%d", sib.Node, sib.Counter);
+		if _, dup := seen[id]; dup {
+			continue;
+		}
+		seen[id] = struct{}{};
+
+		replaced := false;
+		for _, other := range siblings {
+			if other.Clock.Covers(sib.Node, sib.Counter) {
+				replaced = true;
+				break;
+			}
+		}
+		if !replaced {
+			live = append(live, sib);
+		}
+	}
+
+	return live;
+}
+
+// Returns the causal context of the set: every write its versions have seen or are
+func (s *SiblingSet) Context () VectorClock {
+	context := make(VectorClock);
+	for _, sib := range s.Siblings {
+		for node, counter := range sib.Clock {
+			context[node] = max(context[node], counter);
+		}
+		context[sib.Node] = max(context[sib.Node], sib.Counter);
+	}
+
+	return context;
+}
+
+// Adds a version written by node after seeing context, replacing the versions the context covers
+func (s *SiblingSet) put (sib Sibling, context VectorClock, node string) {
+	sib.Node = node;
+	sib.Counter = max(s.Context()[node], context[node]) + 1;
+	sib.Clock = context.Clone();
+
+	s.Siblings = liveSiblings(append(s.Siblings, sib));
+}
+
+// Returns the values of the versions that were not written by deletes
+func (s *SiblingSet) Values () ([]interface{}, error) {
+	values := make([]interface{}, 0, len(s.Siblings));
+	for _, sib := range s.Siblings {
+		if sib.Deleted {
+			continue;
+		}
+
+		value, err := decodeValue(sib.Type, sib.Value);
+		if err != nil {
+			return nil, err;
+		}
+		values = append(values, value);
+	}
+
+	return values, nil;
+}
+
+// Validates a set decoded from disk or from another node
+func (s *SiblingSet) validate () error {
+	for _, sib := range s.Siblings {
+		if sib.Node == "" || sib.Counter == 0 {
+			return fmt.Errorf("invalid sibling set: version without a writer");
+		}
+	}
+
+	return nil;
+}
+
+// Sets the key prefixes whose keys keep concurrent writes as siblings instead of the last write winning
+func (c *Cache) SetSiblingPrefixes (prefixes []string) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.siblingPrefixes = prefixes;
+}
+
+// Checks if the key keeps concurrent writes as siblings
+func (c *Cache) UsesSiblings (key string) bool {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	for _, prefix := range c.siblingPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true;
+		}
+	}
+
+	return false;
+}
+
+// Writes a version of a key in sibling mode, coordinated by this node. The versions the context covers
+// are replaced and the others kept as siblings. A delete writes a version without a value, which keeps
+// the key's expiration, other writes set it from ttl, where zero means the key never expires.
+// Returns a copy of the key's versions after the write and the timestamp of the write.
+func (c *Cache) PutSibling (key string, value interface{}, deleted bool, context VectorClock, ttl time.Duration) (*SiblingSet, Timestamp, error) {
+	sib := Sibling{Deleted: deleted};
+	if !deleted {
+		var err error;
+		sib.Type, sib.Value, err = EncodeValue(value);
+		if err != nil {
+			return nil, Timestamp{}, err;
+		}
+	}
+
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	// liveItem returns an expired item as not found, whose versions must not be carried over
+	item, found := c.liveItem(key);
+	set, ok := item.Value.(*SiblingSet);
+	if !found || !ok {
+		// Values written before the key used siblings are replaced
+		set = &SiblingSet{};
+	}
+
+	set.put(sib, context, c.clock.node);
+
+	expiration := item.Expiration;
+	if !deleted || !found {
+		expiration = expirationFor(ttl);
+	}
+
+	if !found && len(c.items) >= c.maxItems {
+		c.evict();
+	}
+
+	stamp := c.clock.Now();
+	c.items[key] = CacheItem{
+		Value: set,
+		Expiration: expiration,
+		LastAccess: time.Now().UnixNano(),
+		Version: c.nextVersion(),
+		Timestamp: stamp,
+	}
+	delete(c.tombstones, key);
+	c.accessCount[key]++;
+	c.emit(EventSet, key);
+
+	return set.Clone().(*SiblingSet), stamp, nil;
+}
@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestVectorClockContext (t *testing.T) {
+	clocks := []VectorClock{
+		{},
+		{"n1": 1},
+		{"n1": 3, "n2": 7, "node with spaces": 1 << 40},
+	};
+
+	for _, vc := range clocks {
+		decoded, err := DecodeVectorClock(vc.Encode());
+		if err != nil {
+			t.Errorf("DecodeVectorClock(%v.Encode()): %v", vc, err);
+			continue;
+		}
+		if !reflect.DeepEqual(decoded, vc) {
+			t.Errorf("DecodeVectorClock(%v.Encode()) = %v", vc, decoded);
+		}
+	}
+
+	if vc, err := DecodeVectorClock(""); err != nil || len(vc) != 0 {
+		t.Errorf("DecodeVectorClock(\"\") = %v, %v, want an empty clock", vc, err);
+	}
+	for _, context := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := DecodeVectorClock(context); err == nil {
+			t.Errorf("DecodeVectorClock(%q) accepted an invalid context", context);
+		}
+	}
+}
+
+// A step of a sibling scenario: a write to a replica's copy of a key, or a merge of one copy into another
+type siblingStep struct {
+	replica	string;	// Copy written, or merged into
+	node	string;	// Node coordinating the write, empty for a merge
+	value	string;	// Value written, empty for a delete
+	context	string;	// Copy whose context the writer had read, empty for a blind write
+	from	string;	// Copy merged from
+}
+
+// Returns the sorted values of the versions of a set
+func siblingValues (t *testing.T, set *SiblingSet) []string {
+	t.Helper();
+
+	values, err := set.Values();
+	if err != nil {
+		t.Fatalf("Values: %v", err);
+	}
+
+	strs := make([]string, 0, len(values));
+	for _, value := range values {
+		strs = append(strs, fmt.Sprint(value));
+	}
+	sort.Strings(strs);
+
+	return strs;
+}
+
+func TestSiblingResolution (t *testing.T) {
+	write := func (replica, node, value, context string) siblingStep {
+		return siblingStep{replica: replica, node: node, value: value, context: context};
+	};
+	merge := func (replica, from string) siblingStep {
+		return siblingStep{replica: replica, from: from};
+	};
+
+	tests := []struct {
+		name		string;
+		steps		[]siblingStep;
+		values		map[string][]string;	// Values of each copy at the end
+		versions	map[string]int;			// Versions kept by each copy, including deletes
+	}{
+		{
+			name: "write after reading replaces",
+			steps: []siblingStep{write("r1", "n1", "a", ""), write("r1", "n1", "b", "r1")},
+			values: map[string][]string{"r1": {"b"}},
+			versions: map[string]int{"r1": 1},
+		},
+		{
+			name: "blind writes are kept as siblings",
+			steps: []siblingStep{write("r1", "n1", "a", ""), write("r1", "n1", "b", "")},
+			values: map[string][]string{"r1": {"a", "b"}},
+			versions: map[string]int{"r1": 2},
+		},
+		{
+			name: "concurrent writes on two nodes merge into siblings",
+			steps: []siblingStep{write("r1", "n1", "a", ""), write("r2", "n2", "b", ""), merge("r1", "r2"), merge("r2", "r1")},
+			values: map[string][]string{"r1": {"a", "b"}, "r2": {"a", "b"}},
+			versions: map[string]int{"r1": 2, "r2": 2},
+		},
+		{
+			name: "write after reading both siblings resolves them",
+			steps: []siblingStep{
+				write("r1", "n1", "a", ""), write("r2", "n2", "b", ""), merge("r1", "r2"),
+				write("r1", "n1", "resolved", "r1"), merge("r2", "r1"),
+			},
+			values: map[string][]string{"r1": {"resolved"}, "r2": {"resolved"}},
+			versions: map[string]int{"r1": 1, "r2": 1},
+		},
+		{
+			name: "write on a stale copy is concurrent with the newer one",
+			steps: []siblingStep{
+				write("r1", "n1", "a", ""), merge("r2", "r1"),
+				write("r2", "n2", "b", "r2"), write("r1", "n1", "c", "r1"),
+				merge("r1", "r2"),
+			},
+			values: map[string][]string{"r1": {"b", "c"}, "r2": {"b"}},
+			versions: map[string]int{"r1": 2, "r2": 1},
+		},
+		{
+			name: "older version arriving late is dropped",
+			steps: []siblingStep{
+				write("r1", "n1", "a", ""), merge("r2", "r1"), write("r2", "n2", "b", "r2"),
+				merge("r2", "r1"), merge("r1", "r2"),
+			},
+			values: map[string][]string{"r1": {"b"}, "r2": {"b"}},
+			versions: map[string]int{"r1": 1, "r2": 1},
+		},
+		{
+			name: "merging is idempotent",
+			steps: []siblingStep{write("r1", "n1", "a", ""), write("r2", "n2", "b", ""), merge("r1", "r2"), merge("r1", "r2"), merge("r1", "r1")},
+			values: map[string][]string{"r1": {"a", "b"}},
+			versions: map[string]int{"r1": 2},
+		},
+		{
+			name: "delete after reading hides the value",
+			steps: []siblingStep{write("r1", "n1", "a", ""), write("r1", "n1", "", "r1")},
+			values: map[string][]string{"r1": {}},
+			versions: map[string]int{"r1": 1},
+		},
+		{
+			name: "delete concurrent with a write keeps the write",
+			steps: []siblingStep{write("r1", "n1", "a", ""), merge("r2", "r1"), write("r1", "n1", "", "r1"), write("r2", "n2", "b", "r2"), merge("r1", "r2")},
+			values: map[string][]string{"r1": {"b"}},
+			versions: map[string]int{"r1": 2},
+		},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			copies := make(map[string]*SiblingSet);
+			get := func (replica string) *SiblingSet {
+				if copies[replica] == nil {
+					copies[replica] = &SiblingSet{};
+				}
+				return copies[replica];
+			};
+
+			for _, step := range tt.steps {
+				if step.from != "" {
+					if err := get(step.replica).Merge(get(step.from).Clone()); err != nil {
+						t.Fatalf("Merge: %v", err);
+					}
+					continue;
+				}
+
+				sib := Sibling{Deleted: step.value == ""};
+				if !sib.Deleted {
+					sib.Type, sib.Value, _ = EncodeValue(step.value);
+				}
+				context := VectorClock{};
+				if step.context != "" {
+					context = get(step.context).Context();
+				}
+				get(step.replica).put(sib, context, step.node);
+			}
+
+			for replica, want := range tt.values {
+				set := get(replica);
+				if got := siblingValues(t, set); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s values = %v, want %v", replica, got, want);
+				}
+				if len(set.Siblings) != tt.versions[replica] {
+					t.Errorf("%s keeps %d versions, want %d", replica, len(set.Siblings), tt.versions[replica]);
+				}
+				if err := set.validate(); err != nil {
+					t.Errorf("%s: %v", replica, err);
+				}
+			}
+		});
+	}
+}
+
+func TestSiblingSetMergeWrongType (t *testing.T) {
+	if err := (&SiblingSet{}).Merge(NewHyperLogLog()); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Merge of a HyperLogLog: err = %v, want ErrWrongType", err);
+	}
+}
+
+func TestPutSibling (t *testing.T) {
+	c := NewCache("lru", 100);
+	c.SetClock(NewHybridClock("n1"));
+
+	set, first, err := c.PutSibling("cart:1", "a", false, VectorClock{}, time.Hour);
+	if err != nil {
+		t.Fatalf("PutSibling: %v", err);
+	}
+	if _, _, err := c.PutSibling("cart:1", "b", false, VectorClock{}, time.Hour); err != nil {
+		t.Fatalf("PutSibling: %v", err);
+	}
+
+	set, second, err := c.PutSibling("cart:1", "c", false, set.Context(), time.Hour);
+	if err != nil {
+		t.Fatalf("PutSibling: %v", err);
+	}
+	if got := siblingValues(t, set); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("values = %v, want [b c]", got);
+	}
+	if !second.After(first) {
+		t.Errorf("timestamp %v of a later write not after %v", second, first);
+	}
+
+	// The versions of an expired set are not carried over
+	c.mu.Lock();
+	item := c.items["cart:1"];
+	item.Expiration = time.Now().Add(-time.Second).UnixNano();
+	c.items["cart:1"] = item;
+	c.mu.Unlock();
+
+	set, _, err = c.PutSibling("cart:1", "d", false, VectorClock{}, time.Hour);
+	if err != nil {
+		t.Fatalf("PutSibling: %v", err);
+	}
+	if got := siblingValues(t, set); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("values after expiry = %v, want [d]", got);
+	}
+}
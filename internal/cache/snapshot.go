@@ -0,0 +1,480 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Binary snapshot layout:
+//
+//	header:  magic "CFSNAP" | format version uint16 | flags uint16 | created at int64 | header CRC uint32
+//	record:  payload length uint32 | payload CRC uint32 | payload
+//	payload: key | expiration | last access | version | access count | timestamp | flags | value encoding | value
+//	timestamp: wall time | logical counter | node
+//	footer:  zero length uint32 | record count uint64 | CRC uint32 of all record bytes
+//
+// All integers are big endian. Every record carries its own checksum, so a damaged
+// record can be skipped and the records after it salvaged.
+const snapshotMagic = "CFSNAP";
+
+// Current version of the snapshot format.
+// Version 2 added the item version, the access count and encodings of plain values.
+// Version 3 added the timestamp, and tombstones of deleted keys.
+// Version 4 added the leases of locks.
+const SnapshotFormatVersion = 4;
+
+// Record flags
+const (
+	snapshotFlagDeleted = 1 << iota; // A tombstone, with an empty value
+	snapshotFlagLease; // The lease of the lock named by the key, JSON encoded in the value
+)
+
+// Size of the fixed snapshot header in bytes
+const snapshotHeaderSize = len(snapshotMagic) + 2 + 2 + 8 + 4;
+
+// Largest record accepted, anything bigger is treated as corruption
+const maxSnapshotRecordSize = 256 * 1024 * 1024;
+
+var ErrSnapshotCorrupt = errors.New("snapshot is corrupt");
+
+// SnapshotRecord is a single cache item stored in a snapshot
+type SnapshotRecord struct {
+	Key			string
+	Value		interface{}
+	Expiration	int64
+	LastAccess	int64
+	Version		uint64	// Zero if the snapshot predates versions
+	AccessCount	int		// Access frequency for LFU, zero if the snapshot predates it
+	Timestamp	Timestamp	// Zero if the snapshot predates timestamps
+	Deleted		bool	// A tombstone of a deleted key, without a value
+	Lease		*Lease	// The lease of the lock named by the key instead of a cache item
+}
+
+// SnapshotReport describes what was found while reading a snapshot
+type SnapshotReport struct {
+	FormatVersion	int			`json:"formatVersion"`
+	CreatedAt		time.Time	`json:"createdAt"`
+	Records			uint64		`json:"records"`					// Valid records read
+	Corrupted		bool		`json:"corrupted"`				// Damaged data was found
+	SkippedBytes	int64		`json:"skippedBytes"`			// Bytes skipped over while salvaging
+	Complete		bool		`json:"complete"`				// The footer was found and matches the records
+	Problems		[]string	`json:"problems,omitempty"`		// Descriptions of the damage found
+}
+
+// SnapshotWriter streams cache items into the binary snapshot format
+type SnapshotWriter struct {
+	w *bufio.Writer;
+	count uint64;
+	checksum hash.Hash32;
+}
+
+// Writes the snapshot header and returns a writer for the records
+func NewSnapshotWriter (w io.Writer) (*SnapshotWriter, error) {
+	sw := &SnapshotWriter{
+		w: bufio.NewWriterSize(w, 256 * 1024),
+		checksum: crc32.NewIEEE(),
+	}
+
+	header := make([]byte, 0, snapshotHeaderSize);
+	header = append(header, snapshotMagic...);
+	header = binary.BigEndian.AppendUint16(header, SnapshotFormatVersion);
+	header = binary.BigEndian.AppendUint16(header, 0);
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().UnixNano()));
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(header));
+
+	if _, err := sw.w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot header: %w", err);
+	}
+
+	return sw, nil;
+}
+
+// Appends a record to the snapshot
+func (sw *SnapshotWriter) WriteRecord (rec SnapshotRecord) error {
+	payload, err := encodeSnapshotRecord(rec);
+	if err != nil {
+		return fmt.Errorf("failed to encode key %s: %w", rec.Key, err);
+	}
+
+	if len(payload) > maxSnapshotRecordSize {
+		return fmt.Errorf("key %s is too large for a snapshot record", rec.Key);
+	}
+
+	frame := make([]byte, 8, 8 + len(payload));
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)));
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload));
+	frame = append(frame, payload...);
+
+	if _, err := sw.w.Write(frame); err != nil {
+		return err;
+	}
+	sw.checksum.Write(frame);
+	sw.count++;
+
+	return nil;
+}
+
+// Writes the footer and flushes the snapshot. Does not close the underlying writer.
+func (sw *SnapshotWriter) Close () error {
+	footer := make([]byte, 0, 16);
+	footer = binary.BigEndian.AppendUint32(footer, 0);
+	footer = binary.BigEndian.AppendUint64(footer, sw.count);
+	footer = binary.BigEndian.AppendUint32(footer, sw.checksum.Sum32());
+
+	if _, err := sw.w.Write(footer); err != nil {
+		return fmt.Errorf("failed to write snapshot footer: %w", err);
+	}
+
+	return sw.w.Flush();
+}
+
+// Returns the number of records written so far
+func (sw *SnapshotWriter) Count () uint64 {
+	return sw.count;
+}
+
+// Checks if the data starts with a binary snapshot header
+func IsBinarySnapshot (prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(snapshotMagic));
+}
+
+// Reads a binary snapshot, calling fn for every valid record.
+// Without salvage, reading stops at the first damaged record with an error wrapping ErrSnapshotCorrupt.
+// With salvage, damaged bytes are skipped until the next valid record and the damage is only reported.
+func ReadSnapshot (r io.Reader, salvage bool, fn func(SnapshotRecord) error) (SnapshotReport, error) {
+	return readSnapshotFrames(r, salvage, func (payload []byte, formatVersion int) error {
+		rec, err := decodeSnapshotRecord(payload, formatVersion);
+		if err != nil {
+			return &undecodableRecordError{err};
+		}
+
+		return fn(rec);
+	})
+}
+
+// Returned by frame callbacks for a record whose checksum matches but whose payload cannot be decoded
+type undecodableRecordError struct {
+	err error;
+}
+
+func (e *undecodableRecordError) Error () string {
+	return "undecodable record: " + e.err.Error();
+}
+
+// Reads the frames of a binary snapshot, calling fn with the payload of every frame whose checksum
+// matches. The payload is only valid until fn returns. Reading and salvaging work as in ReadSnapshot;
+// fn can return an *undecodableRecordError to have the record treated as damaged.
+func readSnapshotFrames (r io.Reader, salvage bool, fn func(payload []byte, formatVersion int) error) (SnapshotReport, error) {
+	var report SnapshotReport;
+	br := bufio.NewReaderSize(r, 1024 * 1024);
+
+	header := make([]byte, snapshotHeaderSize);
+	if _, err := io.ReadFull(br, header); err != nil {
+		return report, fmt.Errorf("%w: truncated header", ErrSnapshotCorrupt);
+	}
+
+	if !IsBinarySnapshot(header) {
+		return report, fmt.Errorf("%w: not a binary snapshot", ErrSnapshotCorrupt);
+	}
+
+	crcOffset := snapshotHeaderSize - 4;
+	if crc32.ChecksumIEEE(header[:crcOffset]) != binary.BigEndian.Uint32(header[crcOffset:]) {
+		return report, fmt.Errorf("%w: header checksum mismatch", ErrSnapshotCorrupt);
+	}
+
+	versionOffset := len(snapshotMagic);
+	report.FormatVersion = int(binary.BigEndian.Uint16(header[versionOffset:]));
+	report.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(header[versionOffset + 4:])));
+
+	if report.FormatVersion > SnapshotFormatVersion {
+		return report, fmt.Errorf("unsupported snapshot format version %d", report.FormatVersion);
+	}
+
+	checksum := crc32.NewIEEE();
+	offset := int64(snapshotHeaderSize);
+	resyncing := false;
+
+	// Records problems, and fails unless salvaging
+	damaged := func (format string, args ...interface{}) error {
+		problem := fmt.Sprintf("offset %d: ", offset) + fmt.Sprintf(format, args...);
+		report.Corrupted = true;
+
+		if !salvage {
+			return fmt.Errorf("%w: %s", ErrSnapshotCorrupt, problem);
+		}
+
+		// Only report the start of each damaged region
+		if !resyncing {
+			report.Problems = append(report.Problems, problem);
+		}
+		return nil;
+	}
+
+	// Skips a byte while looking for the next valid record
+	skip := func () {
+		br.Discard(1);
+		offset++;
+		report.SkippedBytes++;
+		resyncing = true;
+	}
+
+	for {
+		frameHeader, _ := br.Peek(8);
+		if len(frameHeader) < 4 {
+			if err := damaged("truncated, footer missing"); err != nil {
+				return report, err;
+			}
+			return report, nil;
+		}
+
+		length := binary.BigEndian.Uint32(frameHeader[0:4]);
+
+		// A zero length marks the footer, which must be the last thing in the snapshot
+		if length == 0 {
+			footer, _ := br.Peek(17);
+			if len(footer) == 16 {
+				count := binary.BigEndian.Uint64(footer[4:12]);
+				sum := binary.BigEndian.Uint32(footer[12:16]);
+
+				if count == report.Records && sum == checksum.Sum32() && !report.Corrupted {
+					report.Complete = true;
+					return report, nil;
+				}
+
+				if !report.Corrupted {
+					if err := damaged("footer expects %d records, found %d", count, report.Records); err != nil {
+						return report, err;
+					}
+				}
+				return report, nil;
+			}
+
+			if err := damaged("invalid footer"); err != nil {
+				return report, err;
+			}
+			skip();
+			continue;
+		}
+
+		// While resyncing, a length too big to peek at is far more likely garbage than a record
+		if len(frameHeader) < 8 || length > maxSnapshotRecordSize || (resyncing && int(length) + 8 > br.Size()) {
+			if err := damaged("invalid record length %d", length); err != nil {
+				return report, err;
+			}
+			skip();
+			continue;
+		}
+
+		// Records bigger than the read buffer have to be read out in full,
+		// so reading cannot resync inside them if they turn out damaged
+		frame, err := br.Peek(8 + int(length));
+		consumed := false;
+		if errors.Is(err, bufio.ErrBufferFull) {
+			frame = make([]byte, 8 + int(length));
+			if _, err := io.ReadFull(br, frame); err != nil {
+				if err := damaged("truncated record"); err != nil {
+					return report, err;
+				}
+				return report, nil;
+			}
+			consumed = true;
+		} else if err != nil {
+			if err := damaged("truncated record"); err != nil {
+				return report, err;
+			}
+			skip();
+			continue;
+		}
+
+		payload := frame[8:];
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:8]) {
+			if err := damaged("record checksum mismatch"); err != nil {
+				return report, err;
+			}
+
+			if consumed {
+				offset += int64(len(frame));
+				resyncing = true;
+			} else {
+				skip();
+			}
+			continue;
+		}
+
+		// The frame is intact, so the next one starts right after it even if the payload is undecodable
+		checksum.Write(frame);
+		err = fn(payload, report.FormatVersion);
+		if !consumed {
+			br.Discard(len(frame));
+		}
+		resyncing = false;
+
+		var undecodable *undecodableRecordError;
+		if errors.As(err, &undecodable) {
+			if err := damaged("%v", undecodable); err != nil {
+				return report, err;
+			}
+			offset += int64(len(frame));
+			continue;
+		}
+		if err != nil {
+			return report, err;
+		}
+
+		offset += int64(len(frame));
+		report.Records++;
+	}
+}
+
+// Encodes the payload of a record
+func encodeSnapshotRecord (rec SnapshotRecord) ([]byte, error) {
+	var encoding string;
+	var value []byte;
+	var flags uint64;
+	if rec.Lease != nil {
+		flags |= snapshotFlagLease;
+
+		var err error;
+		value, err = json.Marshal(rec.Lease);
+		if err != nil {
+			return nil, err;
+		}
+	} else if rec.Deleted {
+		flags |= snapshotFlagDeleted;
+	} else {
+		var err error;
+		encoding, value, err = EncodeValue(rec.Value);
+		if err != nil {
+			return nil, err;
+		}
+	}
+
+	buf := make([]byte, 0, len(rec.Key) + len(rec.Timestamp.Node) + len(encoding) + len(value) + 72);
+	buf = binary.AppendUvarint(buf, uint64(len(rec.Key)));
+	buf = append(buf, rec.Key...);
+	buf = binary.AppendVarint(buf, rec.Expiration);
+	buf = binary.AppendVarint(buf, rec.LastAccess);
+	buf = binary.AppendUvarint(buf, rec.Version);
+	buf = binary.AppendUvarint(buf, uint64(max(rec.AccessCount, 0)));
+	buf = binary.AppendVarint(buf, rec.Timestamp.Wall);
+	buf = binary.AppendUvarint(buf, uint64(rec.Timestamp.Logical));
+	buf = binary.AppendUvarint(buf, uint64(len(rec.Timestamp.Node)));
+	buf = append(buf, rec.Timestamp.Node...);
+	buf = binary.AppendUvarint(buf, flags);
+	buf = binary.AppendUvarint(buf, uint64(len(encoding)));
+	buf = append(buf, encoding...);
+	buf = binary.AppendUvarint(buf, uint64(len(value)));
+	buf = append(buf, value...);
+
+	return buf, nil;
+}
+
+// Decodes the payload of a record written in the given format version
+func decodeSnapshotRecord (payload []byte, formatVersion int) (SnapshotRecord, error) {
+	var rec SnapshotRecord;
+	var flags uint64;
+	d := &payloadDecoder{buf: payload};
+
+	rec.Key = string(d.bytes());
+	rec.Expiration = d.varint();
+	rec.LastAccess = d.varint();
+	if formatVersion >= 2 {
+		rec.Version = d.uvarint();
+		rec.AccessCount = int(d.uvarint());
+	}
+	if formatVersion >= 3 {
+		rec.Timestamp.Wall = d.varint();
+		rec.Timestamp.Logical = uint32(d.uvarint());
+		rec.Timestamp.Node = string(d.bytes());
+		flags = d.uvarint();
+		rec.Deleted = flags & snapshotFlagDeleted != 0;
+	}
+	encoding := string(d.bytes());
+	value := d.bytes();
+
+	if d.err != nil {
+		return rec, d.err;
+	}
+	if len(d.buf) != 0 {
+		return rec, fmt.Errorf("trailing bytes in record");
+	}
+	if flags & snapshotFlagLease != 0 {
+		rec.Lease = &Lease{};
+		return rec, json.Unmarshal(value, rec.Lease);
+	}
+	if rec.Deleted {
+		return rec, nil;
+	}
+
+	decoded, err := decodeValue(encoding, value);
+	if err != nil {
+		return rec, err;
+	}
+	rec.Value = decoded;
+
+	return rec, nil;
+}
+
+// Reads varint fields from a record payload, remembering the first error
+type payloadDecoder struct {
+	buf []byte;
+	err error;
+}
+
+// Reads a signed varint
+func (d *payloadDecoder) varint () int64 {
+	if d.err != nil {
+		return 0;
+	}
+
+	v, n := binary.Varint(d.buf);
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint");
+		return 0;
+	}
+	d.buf = d.buf[n:];
+
+	return v;
+}
+
+// Reads an unsigned varint
+func (d *payloadDecoder) uvarint () uint64 {
+	if d.err != nil {
+		return 0;
+	}
+
+	v, n := binary.Uvarint(d.buf);
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid uvarint");
+		return 0;
+	}
+	d.buf = d.buf[n:];
+
+	return v;
+}
+
+// Reads a length-prefixed byte string
+func (d *payloadDecoder) bytes () []byte {
+	length := d.uvarint();
+	if d.err != nil {
+		return nil;
+	}
+
+	if length > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("field length %d exceeds record", length);
+		return nil;
+	}
+
+	b := d.buf[:length];
+	d.buf = d.buf[length:];
+
+	return b;
+}
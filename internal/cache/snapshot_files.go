@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Compression applied to snapshot files
+const (
+	SnapshotCompressionNone = "none";
+	SnapshotCompressionGzip = "gzip";
+)
+
+// Timestamp in snapshot file names, sorts in creation order
+const snapshotTimeLayout = "20060102T150405.000000000Z";
+
+// Leading bytes of a gzip stream
+var gzipMagic = []byte{0x1f, 0x8b};
+
+// SnapshotInfo describes a snapshot file on disk
+type SnapshotInfo struct {
+	Name		string		`json:"name"`
+	CreatedAt	time.Time	`json:"createdAt"`
+	Size		int64		`json:"size"`
+	Compressed	bool		`json:"compressed"`
+	Encrypted	bool		`json:"encrypted"`
+}
+
+// Checks if the compression is one of the supported ones
+func ValidSnapshotCompression (compression string) bool {
+	return compression == SnapshotCompressionNone || compression == SnapshotCompressionGzip;
+}
+
+// Checks if the data starts with a gzip header
+func isGzip (prefix []byte) bool {
+	return bytes.HasPrefix(prefix, gzipMagic);
+}
+
+// SnapshotFileWriter compresses and then encrypts a snapshot stream the way snapshot files are stored
+type SnapshotFileWriter struct {
+	out io.Writer;
+	compressor *gzip.Writer;
+	encrypter *encryptWriter;
+}
+
+// Returns a writer that compresses everything written to it as given and then encrypts it
+// into w with the keyring's current key, leaving out encryption if keyring is nil
+func NewSnapshotFileWriter (w io.Writer, compression string, keyring *Keyring) (*SnapshotFileWriter, error) {
+	if !ValidSnapshotCompression(compression) {
+		return nil, fmt.Errorf("unknown snapshot compression %q", compression);
+	}
+
+	fw := &SnapshotFileWriter{out: w};
+	if keyring != nil {
+		encrypter, err := keyring.newEncryptWriter(w);
+		if err != nil {
+			return nil, fmt.Errorf("failed to start encryption: %w", err);
+		}
+		fw.encrypter = encrypter;
+		fw.out = encrypter;
+	}
+
+	if compression == SnapshotCompressionGzip {
+		fw.compressor = gzip.NewWriter(fw.out);
+		fw.out = fw.compressor;
+	}
+
+	return fw, nil;
+}
+
+func (fw *SnapshotFileWriter) Write (p []byte) (int, error) {
+	return fw.out.Write(p);
+}
+
+// Finishes the compressed and encrypted streams. Does not close the underlying writer.
+func (fw *SnapshotFileWriter) Close () error {
+	if fw.compressor != nil {
+		if err := fw.compressor.Close(); err != nil {
+			return fmt.Errorf("failed to compress snapshot: %w", err);
+		}
+	}
+
+	if fw.encrypter != nil {
+		if err := fw.encrypter.Close(); err != nil {
+			return fmt.Errorf("failed to encrypt snapshot: %w", err);
+		}
+	}
+
+	return nil;
+}
+
+// Returns the name of a new snapshot taken at the given time.
+// Snapshots are named after the base file, e.g. cache-<id>-<timestamp>.dat.gz.enc for cache-<id>.dat.
+func (pm *PersistenceManager) snapshotName (at time.Time) string {
+	name := pm.snapshotPrefix() + at.UTC().Format(snapshotTimeLayout) + ".dat";
+	if pm.compression == SnapshotCompressionGzip {
+		name += ".gz";
+	}
+	if pm.keyring != nil {
+		name += ".enc";
+	}
+
+	return name;
+}
+
+// Returns the part of the snapshot names before the timestamp
+func (pm *PersistenceManager) snapshotPrefix () string {
+	return strings.TrimSuffix(filepath.Base(pm.filePath), ".dat") + "-";
+}
+
+// Lists the snapshots in the snapshot store, newest first. A snapshot named after the
+// base file by older versions is listed too, dated by its modification time.
+func (pm *PersistenceManager) ListSnapshots () ([]SnapshotInfo, error) {
+	prefix := pm.snapshotPrefix();
+	legacyName := filepath.Base(pm.filePath);
+
+	stored, err := pm.store.List(strings.TrimSuffix(prefix, "-"));
+	if err != nil {
+		return nil, err;
+	}
+
+	snapshots := make([]SnapshotInfo, 0, len(stored));
+	for _, object := range stored {
+		if object.Name == legacyName {
+			snapshots = append(snapshots, SnapshotInfo{
+				Name: object.Name,
+				CreatedAt: object.ModTime,
+				Size: object.Size,
+			})
+			continue;
+		}
+
+		if !strings.HasPrefix(object.Name, prefix) {
+			continue;
+		}
+
+		name := strings.TrimPrefix(object.Name, prefix);
+		encrypted := strings.HasSuffix(name, ".enc");
+		name = strings.TrimSuffix(name, ".enc");
+		compressed := strings.HasSuffix(name, ".gz");
+		name = strings.TrimSuffix(name, ".gz");
+		if !strings.HasSuffix(name, ".dat") {
+			continue;
+		}
+
+		// Skips other nodes' snapshots whose ids start with this one's
+		createdAt, err := time.Parse(snapshotTimeLayout, strings.TrimSuffix(name, ".dat"));
+		if err != nil {
+			continue;
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{
+			Name: object.Name,
+			CreatedAt: createdAt,
+			Size: object.Size,
+			Compressed: compressed,
+			Encrypted: encrypted,
+		})
+	}
+
+	sort.Slice(snapshots, func (i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt);
+	})
+
+	return snapshots, nil;
+}
+
+// Removes the snapshots beyond the newest ones kept by the retention policy
+func (pm *PersistenceManager) pruneSnapshots () {
+	snapshots, err := pm.ListSnapshots();
+	if err != nil {
+		log.Printf("Error listing snapshots: %v", err);
+		return;
+	}
+
+	if len(snapshots) <= pm.retention {
+		return;
+	}
+
+	for _, snapshot := range snapshots[pm.retention:] {
+		if err := pm.store.Delete(snapshot.Name); err != nil {
+			log.Printf("Error removing old snapshot %s: %v", snapshot.Name, err);
+			continue;
+		}
+		log.Printf("Removed old snapshot %s", snapshot.Name);
+	}
+}
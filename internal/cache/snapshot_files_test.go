@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a persistence manager saving a new cache into dir with the given snapshot policy
+func newTestPersistence (t *testing.T, dir, compression string, retention int) (*Cache, *PersistenceManager) {
+	t.Helper();
+
+	c := NewCache("lru", 100);
+	c.SetClock(NewHybridClock("n1"));
+	pm := NewPersistenceManager(c, filepath.Join(dir, "cache-n1.dat"), time.Hour);
+	if err := pm.SetSnapshotPolicy(compression, retention); err != nil {
+		t.Fatalf("SetSnapshotPolicy: %v", err);
+	}
+
+	return c, pm;
+}
+
+// Sets key and saves, returning the name of the snapshot written
+func saveTestSnapshot (t *testing.T, c *Cache, pm *PersistenceManager, key, value string) string {
+	t.Helper();
+
+	c.Set(key, value, time.Hour);
+	status, err := pm.Save();
+	if err != nil {
+		t.Fatalf("Save: %v", err);
+	}
+	time.Sleep(time.Millisecond);
+
+	return status.Snapshot;
+}
+
+func TestSnapshotRetention (t *testing.T) {
+	dir := t.TempDir();
+	c, pm := newTestPersistence(t, dir, SnapshotCompressionGzip, 2);
+
+	saveTestSnapshot(t, c, pm, "a", "1");
+	second := saveTestSnapshot(t, c, pm, "a", "2");
+	third := saveTestSnapshot(t, c, pm, "a", "3");
+
+	// Only the newest snapshots are kept, each compressed under its own name
+	snapshots, err := pm.ListSnapshots();
+	if err != nil {
+		t.Fatalf("ListSnapshots: %v", err);
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != third || snapshots[1].Name != second {
+		t.Fatalf("snapshots = %+v, want %s and %s", snapshots, third, second);
+	}
+	for _, snapshot := range snapshots {
+		data, err := os.ReadFile(filepath.Join(dir, snapshot.Name));
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err);
+		}
+		if !snapshot.Compressed || !strings.HasSuffix(snapshot.Name, ".dat.gz") || !isGzip(data) {
+			t.Errorf("snapshot %+v is not gzip compressed", snapshot);
+		}
+	}
+
+	// Rolling back to the earlier snapshot makes it the newest one
+	c.Set("b", "x", time.Hour);
+	result, err := pm.Restore(second, RestoreReplace, false);
+	if err != nil {
+		t.Fatalf("Restore: %v", err);
+	}
+	if result.Restored != 1 || result.Removed != 1 {
+		t.Errorf("restore result = %+v, want a restored and b removed", result);
+	}
+	if value, found := c.Get("a"); !found || value != "2" {
+		t.Errorf("a = %v (found %v) after rolling back, want 2", value, found);
+	}
+	if snapshots, _ := pm.ListSnapshots(); len(snapshots) != 2 || snapshots[1].Name != third {
+		t.Errorf("snapshots = %+v after rolling back, want the restored state saved", snapshots);
+	}
+
+	if _, err := pm.Restore("cache-n1.dat", RestoreReplace, false); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Restore of a missing snapshot: err = %v", err);
+	}
+}
+
+func TestLoadOlderSnapshot (t *testing.T) {
+	dir := t.TempDir();
+	c, pm := newTestPersistence(t, dir, SnapshotCompressionNone, 3);
+	saveTestSnapshot(t, c, pm, "a", "1");
+	newest := saveTestSnapshot(t, c, pm, "a", "2");
+
+	// The newest snapshot cannot be read, so the one before it is loaded
+	if err := os.WriteFile(filepath.Join(dir, newest), []byte("not a snapshot"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err);
+	}
+
+	loaded, pm := newTestPersistence(t, dir, SnapshotCompressionNone, 3);
+	pm.Start();
+	<-pm.Ready();
+	defer pm.Stop(context.Background());
+
+	if value, found := loaded.Get("a"); !found || value != "1" {
+		t.Errorf("a = %v (found %v), want the value of the older snapshot", value, found);
+	}
+}
+
+func TestSetSnapshotPolicy (t *testing.T) {
+	tests := []struct {
+		compression	string;
+		retention	int;
+		valid		bool;
+	}{
+		{SnapshotCompressionNone, 1, true},
+		{SnapshotCompressionGzip, 10, true},
+		{"zstd", 1, false},
+		{SnapshotCompressionGzip, 0, false},
+	};
+
+	for _, tt := range tests {
+		pm := NewPersistenceManager(NewCache("lru", 1), filepath.Join(t.TempDir(), "cache.dat"), time.Hour);
+		if err := pm.SetSnapshotPolicy(tt.compression, tt.retention); (err == nil) != tt.valid {
+			t.Errorf("SetSnapshotPolicy(%q, %d): err = %v, want valid %v", tt.compression, tt.retention, err, tt.valid);
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// An item in the JSON snapshot format. Version, access count, timestamp and tombstones were added
+// after the format was superseded by the binary one and are missing in snapshots written before that.
+type jsonSnapshotItem struct {
+	Value		json.RawMessage	`json:"value"`
+	Type		string			`json:"type,omitempty"`	// Encoding of the value, empty for plain JSON values
+	Expiration	int64			`json:"expiration"`
+	LastAccess	int64			`json:"lastAccess"`
+	Version		uint64			`json:"version,omitempty"`
+	AccessCount	int				`json:"accessCount,omitempty"`
+	Timestamp	*Timestamp		`json:"timestamp,omitempty"`
+	Deleted		bool			`json:"deleted,omitempty"`	// A tombstone, with a null value
+}
+
+// JSONSnapshotWriter streams cache items into the legacy JSON snapshot format,
+// a single object of keys to items that ReadLegacySnapshot reads back
+type JSONSnapshotWriter struct {
+	w *bufio.Writer;
+	count uint64;
+}
+
+// Opens the JSON object and returns a writer for the records
+func NewJSONSnapshotWriter (w io.Writer) (*JSONSnapshotWriter, error) {
+	jw := &JSONSnapshotWriter{w: bufio.NewWriterSize(w, 256 * 1024)};
+
+	if _, err := jw.w.WriteString("{"); err != nil {
+		return nil, err;
+	}
+
+	return jw, nil;
+}
+
+// Appends a record to the snapshot
+func (jw *JSONSnapshotWriter) WriteRecord (rec SnapshotRecord) error {
+	// Keys and lock names may clash in the single object, so leases are left out
+	if rec.Lease != nil {
+		return nil;
+	}
+
+	var encoding string;
+	var value []byte;
+	if !rec.Deleted {
+		var err error;
+		encoding, value, err = EncodeValue(rec.Value);
+		if err != nil {
+			return fmt.Errorf("failed to encode key %s: %w", rec.Key, err);
+		}
+	}
+
+	key, err := json.Marshal(rec.Key);
+	if err != nil {
+		return err;
+	}
+
+	data := jsonSnapshotItem{
+		Value: value,
+		Type: encoding,
+		Expiration: rec.Expiration,
+		LastAccess: rec.LastAccess,
+		Version: rec.Version,
+		AccessCount: rec.AccessCount,
+		Deleted: rec.Deleted,
+	}
+	if !rec.Timestamp.IsZero() {
+		data.Timestamp = &rec.Timestamp;
+	}
+
+	item, err := json.Marshal(data);
+	if err != nil {
+		return fmt.Errorf("failed to encode key %s: %w", rec.Key, err);
+	}
+
+	separator := ",\n";
+	if jw.count == 0 {
+		separator = "\n";
+	}
+
+	jw.w.WriteString(separator);
+	jw.w.Write(key);
+	jw.w.WriteString(":");
+	if _, err := jw.w.Write(item); err != nil {
+		return err;
+	}
+	jw.count++;
+
+	return nil;
+}
+
+// Closes the JSON object and flushes the snapshot. Does not close the underlying writer.
+func (jw *JSONSnapshotWriter) Close () error {
+	if _, err := jw.w.WriteString("\n}\n"); err != nil {
+		return err;
+	}
+
+	return jw.w.Flush();
+}
+
+// Returns the number of records written so far
+func (jw *JSONSnapshotWriter) Count () uint64 {
+	return jw.count;
+}
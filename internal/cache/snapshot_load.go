@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Records decoded and restored per batch while loading a snapshot
+const loadBatchSize = 1000;
+
+// How often progress is logged while loading a snapshot
+const loadProgressInterval = 2 * time.Second;
+
+// A batch of record payloads waiting to be decoded
+type payloadBatch struct {
+	payloads [][]byte;
+	formatVersion int;
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader;
+	n atomic.Int64;
+}
+
+func (cr *countingReader) Read (p []byte) (int, error) {
+	n, err := cr.r.Read(p);
+	cr.n.Add(int64(n));
+	return n, err;
+}
+
+// Loads a single snapshot into the cache. Must hold pm.mu.
+// Binary snapshots are read as a stream while records are decoded on every CPU, and the cache lock is
+// only held to insert each decoded batch. On failure anything already restored from the file is discarded.
+func (pm *PersistenceManager) loadSnapshot (name string) error {
+	file, err := pm.store.Get(name);
+	if err != nil {
+		return fmt.Errorf("failed to open cache file: %w", err);
+	}
+	defer file.Close();
+
+	counter := &countingReader{r: file};
+	br, err := openSnapshotStream(counter, pm.keyring);
+	if err != nil {
+		return fmt.Errorf("failed to decode cached data: %w", err);
+	}
+
+	pm.loaded.Store(0);
+	start := time.Now();
+	clock := pm.cache.clock.reading();
+	stopProgress := pm.logLoadProgress(name, counter);
+
+	var report SnapshotReport;
+	prefix, _ := br.Peek(len(snapshotMagic));
+	if IsBinarySnapshot(prefix) {
+		report, err = pm.restoreParallel(br);
+	} else {
+		pm.cache.mu.Lock();
+		now := time.Now().UnixNano();
+		report, err = ReadLegacySnapshot(br, func (rec SnapshotRecord) error {
+			pm.cache.restoreRecord(rec, now);
+			pm.loaded.Add(1);
+			return nil;
+		})
+		pm.cache.mu.Unlock();
+	}
+	stopProgress();
+
+	if err != nil {
+		pm.cache.discardLoad(clock);
+		return fmt.Errorf("failed to decode cached data: %w", err);
+	}
+
+	if report.Corrupted {
+		log.Printf("Snapshot %s is damaged, salvaged %d records and skipped %d bytes:", name, report.Records, report.SkippedBytes);
+		for _, problem := range report.Problems {
+			log.Printf("  %s", problem);
+		}
+	}
+
+	log.Printf("Cache successfully loaded from %s with %d items in %s", name, pm.cache.ItemCount(), time.Since(start).Round(time.Millisecond));
+	return nil;
+}
+
+// Drops everything a failed load restored, the items, tombstones and leases along with the timestamps
+// the clock observed, setting the clock back to its reading before the load
+func (c *Cache) discardLoad (clock Timestamp) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.items = make(map[string]CacheItem);
+	c.accessCount = make(map[string]int);
+	c.tombstones = make(map[string]Timestamp);
+	c.leases = make(map[string]Lease);
+	c.clock.rewind(clock);
+}
+
+// Reads a binary snapshot in salvage mode, decoding and restoring its records on a pool of workers
+func (pm *PersistenceManager) restoreParallel (r io.Reader) (SnapshotReport, error) {
+	batches := make(chan payloadBatch, runtime.GOMAXPROCS(0));
+	now := time.Now().UnixNano();
+
+	var undecodable atomic.Uint64;
+	var wg sync.WaitGroup;
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1);
+		go func () {
+			defer wg.Done();
+
+			for batch := range batches {
+				records := make([]SnapshotRecord, 0, len(batch.payloads));
+				for _, payload := range batch.payloads {
+					rec, err := decodeSnapshotRecord(payload, batch.formatVersion);
+					if err != nil {
+						undecodable.Add(1);
+						continue;
+					}
+					records = append(records, rec);
+				}
+
+				pm.cache.mu.Lock();
+				for _, rec := range records {
+					pm.cache.restoreRecord(rec, now);
+				}
+				pm.cache.mu.Unlock();
+
+				pm.loaded.Add(uint64(len(records)));
+			}
+		}();
+	}
+
+	batch := payloadBatch{payloads: make([][]byte, 0, loadBatchSize)};
+	report, err := readSnapshotFrames(r, true, func (payload []byte, formatVersion int) error {
+		// The payload is only valid during the call, so it is copied for the workers
+		batch.formatVersion = formatVersion;
+		batch.payloads = append(batch.payloads, bytes.Clone(payload));
+
+		if len(batch.payloads) == loadBatchSize {
+			batches <- batch;
+			batch = payloadBatch{payloads: make([][]byte, 0, loadBatchSize)};
+		}
+		return nil;
+	})
+
+	if len(batch.payloads) > 0 {
+		batches <- batch;
+	}
+	close(batches);
+	wg.Wait();
+
+	// Records are only decoded by the workers, after their frames were counted as valid
+	if skipped := undecodable.Load(); skipped > 0 {
+		report.Corrupted = true;
+		report.Complete = false;
+		report.Records -= skipped;
+		report.Problems = append(report.Problems, fmt.Sprintf("%d records could not be decoded", skipped));
+	}
+
+	return report, err;
+}
+
+// Logs the progress of loading a snapshot until the returned function is called
+func (pm *PersistenceManager) logLoadProgress (name string, counter *countingReader) func () {
+	done := make(chan struct{});
+
+	go func () {
+		ticker := time.NewTicker(loadProgressInterval);
+		defer ticker.Stop();
+
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Loading %s: %d items restored, %.1f MB read", name, pm.loaded.Load(), float64(counter.n.Load()) / (1024 * 1024));
+			case <-done:
+				return;
+			}
+		}
+	}();
+
+	return func () {
+		close(done);
+	};
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiscardLoad (t *testing.T) {
+	c := NewCache("lru", 100);
+	c.SetClock(NewHybridClock("local"));
+	clock := c.clock.reading();
+
+	future := Timestamp{Wall: time.Now().Add(time.Hour).UnixNano(), Node: "remote"};
+	expiration := time.Now().Add(time.Hour).UnixNano();
+
+	c.mu.Lock();
+	now := time.Now().UnixNano();
+	for _, rec := range []SnapshotRecord{
+		{Key: "item", Value: "value", Expiration: expiration, Version: 3, Timestamp: future},
+		{Key: "deleted", Deleted: true, Timestamp: future},
+		{Key: "lock", Lease: &Lease{Name: "lock", Owner: "worker", Token: 1, Version: 1, Expiration: expiration}},
+	} {
+		c.restoreRecord(rec, now);
+	}
+	c.mu.Unlock();
+
+	if len(c.items) != 1 || len(c.tombstones) != 1 || len(c.leases) != 1 {
+		t.Fatalf("restored %d items, %d tombstones and %d leases, want one of each", len(c.items), len(c.tombstones), len(c.leases));
+	}
+
+	c.discardLoad(clock);
+
+	if len(c.items) != 0 || len(c.accessCount) != 0 || len(c.tombstones) != 0 || len(c.leases) != 0 {
+		t.Errorf("after discarding, %d items, %d access counts, %d tombstones and %d leases are left",
+			len(c.items), len(c.accessCount), len(c.tombstones), len(c.leases));
+	}
+
+	// A write after the failed load is not stamped after the discarded records
+	if ts := c.clock.Now(); ts.Wall >= future.Wall {
+		t.Errorf("Now() = %v, still follows the discarded %v", ts, future);
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StoredSnapshot describes a snapshot object held by a snapshot store
+type StoredSnapshot struct {
+	Name	string
+	Size	int64
+	ModTime	time.Time
+}
+
+// SnapshotStore is where snapshots are kept. Snapshots are written to a local temp file
+// first and then handed to the store, so stores never see partially written snapshots.
+type SnapshotStore interface {
+	// Stores the snapshot read from r, which holds size bytes, replacing any snapshot with the same name
+	Put(name string, r io.Reader, size int64) error
+	// Opens a stored snapshot, failing with an error wrapping ErrSnapshotNotFound if there is none
+	Get(name string) (io.ReadCloser, error)
+	// Lists the stored snapshots whose names start with prefix
+	List(prefix string) ([]StoredSnapshot, error)
+	// Removes a stored snapshot
+	Delete(name string) error
+}
+
+// LocalSnapshotStore keeps snapshots as files in a local directory
+type LocalSnapshotStore struct {
+	dir string;
+}
+
+// Creates a snapshot store in the directory
+func NewLocalSnapshotStore (dir string) *LocalSnapshotStore {
+	return &LocalSnapshotStore{dir: dir};
+}
+
+// Returns the path of a snapshot, refusing names that would leave the directory
+func (ls *LocalSnapshotStore) path (name string) (string, error) {
+	if name == "" || name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid snapshot name %q", name);
+	}
+
+	return filepath.Join(ls.dir, name), nil;
+}
+
+// Writes the snapshot to a temp file and renames it into place once it is synced
+func (ls *LocalSnapshotStore) Put (name string, r io.Reader, size int64) error {
+	path, err := ls.path(name);
+	if err != nil {
+		return err;
+	}
+
+	tempPath := path + ".part";
+	file, err := os.Create(tempPath);
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err);
+	}
+	defer os.Remove(tempPath);
+	defer file.Close();
+
+	written, err := io.Copy(file, r);
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err);
+	}
+	if written != size {
+		return fmt.Errorf("wrote %d bytes of a %d byte snapshot", written, size);
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot file: %w", err);
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename snapshot file: %w", err);
+	}
+
+	return nil;
+}
+
+// Opens a snapshot file
+func (ls *LocalSnapshotStore) Get (name string) (io.ReadCloser, error) {
+	path, err := ls.path(name);
+	if err != nil {
+		return nil, err;
+	}
+
+	file, err := os.Open(path);
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name);
+	}
+
+	return file, err;
+}
+
+// Lists the snapshot files whose names start with prefix
+func (ls *LocalSnapshotStore) List (prefix string) ([]StoredSnapshot, error) {
+	entries, err := os.ReadDir(ls.dir);
+	if os.IsNotExist(err) {
+		return nil, nil;
+	}
+	if err != nil {
+		return nil, err;
+	}
+
+	var snapshots []StoredSnapshot;
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue;
+		}
+
+		info, err := entry.Info();
+		if err != nil {
+			continue;
+		}
+
+		snapshots = append(snapshots, StoredSnapshot{
+			Name: entry.Name(),
+			Size: info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return snapshots, nil;
+}
+
+// Removes a snapshot file
+func (ls *LocalSnapshotStore) Delete (name string) error {
+	path, err := ls.path(name);
+	if err != nil {
+		return err;
+	}
+
+	return os.Remove(path);
+}
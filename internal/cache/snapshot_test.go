@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Records covering every kind of value a snapshot holds
+func testSnapshotRecords () []SnapshotRecord {
+	stamp := Timestamp{Wall: 1700000000000000000, Logical: 3, Node: "node-1"};
+
+	return []SnapshotRecord{
+		{Key: "string", Value: "hello", Expiration: 1800000000000000000, LastAccess: 1700000000000000000, Version: 1, AccessCount: 4, Timestamp: stamp},
+		{Key: "int", Value: 42, Version: 2, Timestamp: stamp},
+		{Key: "int64", Value: int64(-7), Version: 3, Timestamp: stamp},
+		{Key: "uint8", Value: uint8(200), Version: 4, Timestamp: stamp},
+		{Key: "float", Value: 2.5, Version: 5, Timestamp: stamp},
+		{Key: "bytes", Value: []byte{0, 1, 2, 255}, Version: 6, Timestamp: stamp},
+		{Key: "raw", Value: json.RawMessage(`{"a":1}`), Version: 7, Timestamp: stamp},
+		{Key: "map", Value: map[string]interface{}{"a": "b", "n": 1.0}, Version: 8, Timestamp: stamp},
+		{Key: "nil", Value: nil, Version: 9, Timestamp: stamp},
+		{Key: "deleted", Deleted: true, Timestamp: stamp},
+		{Key: "lock", Lease: &Lease{Name: "lock", Owner: "worker", Token: 5, Version: 9, Expiration: 1800000000000000000}},
+	};
+}
+
+// Writes records into a binary snapshot, returning the snapshot and the offset of every record's frame
+func writeTestSnapshot (t *testing.T, recs []SnapshotRecord) ([]byte, []int) {
+	t.Helper();
+
+	var buf bytes.Buffer;
+	sw, err := NewSnapshotWriter(&buf);
+	if err != nil {
+		t.Fatalf("NewSnapshotWriter: %v", err);
+	}
+
+	offsets := make([]int, 0, len(recs));
+	offset := snapshotHeaderSize;
+	for _, rec := range recs {
+		payload, err := encodeSnapshotRecord(rec);
+		if err != nil {
+			t.Fatalf("encodeSnapshotRecord(%q): %v", rec.Key, err);
+		}
+		offsets = append(offsets, offset);
+		offset += 8 + len(payload);
+
+		if err := sw.WriteRecord(rec); err != nil {
+			t.Fatalf("WriteRecord(%q): %v", rec.Key, err);
+		}
+	}
+
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err);
+	}
+
+	return buf.Bytes(), offsets;
+}
+
+// Reads a snapshot, returning the keys of the records read
+func readTestSnapshot (data []byte, salvage bool) ([]string, SnapshotReport, error) {
+	var keys []string;
+	report, err := ReadSnapshot(bytes.NewReader(data), salvage, func (rec SnapshotRecord) error {
+		keys = append(keys, rec.Key);
+		return nil;
+	});
+
+	return keys, report, err;
+}
+
+func TestSnapshotRoundTrip (t *testing.T) {
+	recs := testSnapshotRecords();
+	data, _ := writeTestSnapshot(t, recs);
+
+	if !IsBinarySnapshot(data) {
+		t.Fatalf("IsBinarySnapshot = false for a written snapshot");
+	}
+
+	var got []SnapshotRecord;
+	report, err := ReadSnapshot(bytes.NewReader(data), false, func (rec SnapshotRecord) error {
+		got = append(got, rec);
+		return nil;
+	});
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err);
+	}
+
+	if report.FormatVersion != SnapshotFormatVersion || report.Records != uint64(len(recs)) || !report.Complete || report.Corrupted {
+		t.Errorf("report = %+v, want a complete, undamaged snapshot of %d records", report, len(recs));
+	}
+
+	if len(got) != len(recs) {
+		t.Fatalf("read %d records, want %d", len(got), len(recs));
+	}
+	for i := range recs {
+		if !reflect.DeepEqual(got[i], recs[i]) {
+			t.Errorf("record %d = %#v, want %#v", i, got[i], recs[i]);
+		}
+	}
+}
+
+func TestDecodeOlderSnapshotRecords (t *testing.T) {
+	// Version 1 payload: key | expiration | last access | value encoding | value
+	v1 := []byte{3, 'k', 'e', 'y', 4, 2, 3, 'i', 'n', 't', 2, '4', '2'};
+	rec, err := decodeSnapshotRecord(v1, 1);
+	if err != nil {
+		t.Fatalf("decodeSnapshotRecord: %v", err);
+	}
+
+	want := SnapshotRecord{Key: "key", Value: 42, Expiration: 2, LastAccess: 1};
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("decodeSnapshotRecord = %#v, want %#v", rec, want);
+	}
+
+	if _, err := decodeSnapshotRecord(append(v1, 0), 1); err == nil {
+		t.Errorf("decodeSnapshotRecord accepted trailing bytes");
+	}
+	if _, err := decodeSnapshotRecord(v1[:5], 1); err == nil {
+		t.Errorf("decodeSnapshotRecord accepted a truncated payload");
+	}
+}
+
+func TestReadDamagedSnapshot (t *testing.T) {
+	recs := []SnapshotRecord{
+		{Key: "a", Value: "first"},
+		{Key: "b", Value: "second"},
+		{Key: "c", Value: "third"},
+	};
+	clean, offsets := writeTestSnapshot(t, recs);
+	footer := len(clean) - 16;
+
+	tests := []struct {
+		name		string;
+		damage		func (data []byte) []byte;
+		salvaged	[]string;	// Keys read with salvage
+		unsalvaged	[]string;	// Keys read before failing without salvage
+		complete	bool;
+	}{
+		{
+			name: "intact",
+			damage: func (data []byte) []byte { return data },
+			salvaged: []string{"a", "b", "c"},
+			unsalvaged: []string{"a", "b", "c"},
+			complete: true,
+		},
+		{
+			name: "flipped payload byte",
+			damage: func (data []byte) []byte {
+				data[offsets[1] + 10] ^= 0xff;
+				return data;
+			},
+			salvaged: []string{"a", "c"},
+			unsalvaged: []string{"a"},
+		},
+		{
+			name: "garbage between records",
+			damage: func (data []byte) []byte {
+				garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0x01};
+				return append(data[:offsets[1]:offsets[1]], append(garbage, data[offsets[1]:]...)...);
+			},
+			salvaged: []string{"a", "b", "c"},
+			unsalvaged: []string{"a"},
+		},
+		{
+			name: "truncated record",
+			damage: func (data []byte) []byte { return data[:offsets[2] + 5] },
+			salvaged: []string{"a", "b"},
+			unsalvaged: []string{"a", "b"},
+		},
+		{
+			name: "missing footer",
+			damage: func (data []byte) []byte { return data[:footer] },
+			salvaged: []string{"a", "b", "c"},
+			unsalvaged: []string{"a", "b", "c"},
+		},
+		{
+			name: "footer count mismatch",
+			damage: func (data []byte) []byte {
+				data[footer + 11]++;
+				return data;
+			},
+			salvaged: []string{"a", "b", "c"},
+			unsalvaged: []string{"a", "b", "c"},
+		},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			damaged := tt.damage(bytes.Clone(clean));
+
+			keys, report, err := readTestSnapshot(damaged, true);
+			if err != nil {
+				t.Fatalf("salvaging: %v", err);
+			}
+			if !reflect.DeepEqual(keys, tt.salvaged) {
+				t.Errorf("salvaged keys = %v, want %v", keys, tt.salvaged);
+			}
+			if report.Complete != tt.complete || report.Corrupted == tt.complete {
+				t.Errorf("report = %+v, want complete %v", report, tt.complete);
+			}
+			if !tt.complete && len(report.Problems) == 0 {
+				t.Errorf("salvaging reported no problems");
+			}
+
+			keys, _, err = readTestSnapshot(damaged, false);
+			if tt.complete != (err == nil) {
+				t.Errorf("reading without salvage: err = %v", err);
+			}
+			if err != nil && !errors.Is(err, ErrSnapshotCorrupt) {
+				t.Errorf("reading without salvage: err = %v, want ErrSnapshotCorrupt", err);
+			}
+			if !reflect.DeepEqual(keys, tt.unsalvaged) {
+				t.Errorf("keys read without salvage = %v, want %v", keys, tt.unsalvaged);
+			}
+		});
+	}
+}
+
+func TestReadSnapshotHeader (t *testing.T) {
+	clean, _ := writeTestSnapshot(t, nil);
+
+	tests := []struct {
+		name	string;
+		data	[]byte;
+	}{
+		{"empty", nil},
+		{"truncated header", clean[:snapshotHeaderSize - 1]},
+		{"not a snapshot", append([]byte("{\"items\":{}}"), make([]byte, snapshotHeaderSize)...)},
+		{"header checksum", func () []byte {
+			data := bytes.Clone(clean);
+			data[len(snapshotMagic) + 5] ^= 1;
+			return data;
+		}()},
+	};
+
+	for _, tt := range tests {
+		for _, salvage := range []bool{false, true} {
+			if _, _, err := readTestSnapshot(tt.data, salvage); !errors.Is(err, ErrSnapshotCorrupt) {
+				t.Errorf("%s (salvage %v): err = %v, want ErrSnapshotCorrupt", tt.name, salvage, err);
+			}
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Disk tier file layout, a log of records appended as items are demoted:
+//
+//	record:  payload length uint32 | payload CRC uint32 | payload
+//
+// The payload is a snapshot record payload, sealed with the current encryption key when
+// persistence is encrypted. Records of items that were promoted, overwritten or deleted stay
+// in the log as garbage until a compaction copies the live records into a new file.
+const diskRecordHeaderSize = 8;
+
+// Garbage in bytes below which the disk tier is never compacted
+const diskTierCompactMinGarbage = 4 * 1024 * 1024;
+
+// Where the record of an item lives in the disk tier log, along with what is needed to
+// expire, evict and watch the item without reading it back
+type diskEntry struct {
+	offset int64;
+	size int64;	// Bytes of the whole record
+	expiration int64;
+	lastAccess int64;
+	version uint64;
+	timestamp Timestamp;
+	accessCount int;
+	digest uint64;	// Compared by anti-entropy, see newMerkleEntry
+	merge bool;		// The value is mergeable
+}
+
+// diskTier holds items evicted from memory in a log-structured file with an in-memory index,
+// so they can be promoted back on their next access instead of being lost.
+// The file starts empty on every start. Its items are saved in snapshots like the ones in memory,
+// and moved back into it once loading them fills memory. All methods must be called with the cache
+// lock held, peek and read only need the read lock.
+type diskTier struct {
+	path string;
+	file *os.File;
+	keyring *Keyring;
+	evictionType string;
+	maxItems int;
+	index map[string]diskEntry;
+	size int64;	// Bytes in the log
+	garbage int64;	// Bytes of records no longer in the index
+	hits uint64;	// Reads served by promoting an item
+	evictions uint64;	// Items dropped to make room, lost for good
+}
+
+// TierUsage describes the items held by a storage tier and how they were used
+type TierUsage struct {
+	Items		int		`json:"items"`
+	Capacity	int		`json:"capacity"`
+	Hits		uint64	`json:"hits"`					// Reads served by the tier
+	Evictions	uint64	`json:"evictions"`				// Items pushed out of the tier, into the next tier if there is one
+	Bytes		int64	`json:"bytes,omitempty"`		// Size of the tier's file
+	LiveBytes	int64	`json:"liveBytes,omitempty"`	// Bytes of the file holding live items
+}
+
+// TierStats describes the memory tier and, if enabled, the disk tier
+type TierStats struct {
+	Memory	TierUsage	`json:"memory"`
+	Disk	*TierUsage	`json:"disk,omitempty"`
+	Misses	uint64		`json:"misses"`	// Reads no tier could serve
+}
+
+// Enables the disk tier: items evicted from memory are written to the file at path instead of being
+// dropped, and read back into memory on their next access. The disk tier holds up to maxItems items,
+// evicted by the cache's eviction policy once full. Items are encrypted if keyring is not nil.
+func (c *Cache) EnableDiskTier (path string, maxItems int, keyring *Keyring) error {
+	if maxItems <= 0 {
+		return fmt.Errorf("disk tier capacity must be positive");
+	}
+
+	// Items left by a previous run are stale, their keys may have changed since
+	file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600);
+	if err != nil {
+		return fmt.Errorf("failed to open disk tier file: %w", err);
+	}
+
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	c.disk = &diskTier{
+		path: path,
+		file: file,
+		keyring: keyring,
+		evictionType: c.evictionType,
+		maxItems: maxItems,
+		index: make(map[string]diskEntry),
+	}
+
+	return nil;
+}
+
+// Returns the usage of the memory and disk tiers
+func (c *Cache) TierStats () TierStats {
+	c.mu.RLock();
+	defer c.mu.RUnlock();
+
+	stats := TierStats{
+		Memory: TierUsage{
+			Items: len(c.items),
+			Capacity: c.maxItems,
+			Hits: c.memoryHits,
+			Evictions: c.memoryEvictions,
+		},
+		Misses: c.misses,
+	}
+
+	if c.disk != nil {
+		stats.Disk = &TierUsage{
+			Items: len(c.disk.index),
+			Capacity: c.disk.maxItems,
+			Hits: c.disk.hits,
+			Evictions: c.disk.evictions,
+			Bytes: c.disk.size,
+			LiveBytes: c.disk.size - c.disk.garbage,
+		}
+	}
+
+	return stats;
+}
+
+// Moves an item out of memory, into the disk tier if there is one. Must hold c.mu.
+func (c *Cache) demote (key string) {
+	item, found := c.items[key];
+	if !found {
+		return;
+	}
+	accessCount := c.accessCount[key];
+
+	delete(c.items, key);
+	delete(c.accessCount, key);
+	c.memoryEvictions++;
+
+	if c.disk != nil {
+		dropped, err := c.disk.put(key, item, accessCount);
+		if err == nil {
+			for _, k := range dropped {
+				c.emit(EventEvict, k);
+			}
+			return;
+		}
+		log.Printf("Failed to move %q to the disk tier: %v", key, err);
+	}
+
+	c.emit(EventEvict, key);
+}
+
+// Moves the items memory holds beyond its capacity out of memory, into the disk tier if there is one,
+// in the order of the eviction policy. Loading does not evict, since snapshots hold the items of
+// the disk tier too, so this is done once everything is loaded.
+func (c *Cache) fitToCapacity () {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	excess := len(c.items) - c.maxItems;
+	if excess <= 0 {
+		return;
+	}
+
+	keys := make([]string, 0, len(c.items));
+	for key := range c.items {
+		keys = append(keys, key);
+	}
+
+	if c.evictionType == "lru" {
+		sort.Slice(keys, func (i, j int) bool {
+			return c.items[keys[i]].LastAccess < c.items[keys[j]].LastAccess;
+		});
+	} else {
+		sort.Slice(keys, func (i, j int) bool {
+			return c.accessCount[keys[i]] < c.accessCount[keys[j]];
+		});
+	}
+
+	for _, key := range keys[:excess] {
+		c.demote(key);
+	}
+}
+
+// Moves an item from the disk tier back into memory, evicting from memory if it is full.
+// Returns false if the disk tier does not hold a live item at key. Must hold c.mu.
+func (c *Cache) promote (key string) (CacheItem, bool) {
+	if c.disk == nil {
+		return CacheItem{}, false;
+	}
+
+	item, accessCount, found, err := c.disk.take(key);
+	if !found {
+		return item, false;
+	}
+	if err != nil {
+		log.Printf("Failed to read %q from the disk tier: %v", key, err);
+		c.emit(EventEvict, key);
+		return item, false;
+	}
+
+	if item.Expiration > 0 && item.Expiration < time.Now().UnixNano() {
+		c.emit(EventExpire, key);
+		return item, false;
+	}
+
+	if len(c.items) >= c.maxItems {
+		c.evict();
+	}
+
+	c.items[key] = item;
+	c.accessCount[key] = accessCount;
+	return item, true;
+}
+
+// Drops the disk tier's copy of key, returning true if there was one. Must hold c.mu.
+func (c *Cache) removeFromDisk (key string) bool {
+	if c.disk == nil {
+		return false;
+	}
+
+	return c.disk.remove(key);
+}
+
+// Appends an item to the log, evicting items once the tier is over capacity.
+// Returns the keys of the evicted items.
+func (dt *diskTier) put (key string, item CacheItem, accessCount int) ([]string, error) {
+	payload, err := encodeSnapshotRecord(SnapshotRecord{
+		Key: key,
+		Value: item.Value,
+		Expiration: item.Expiration,
+		LastAccess: item.LastAccess,
+		Version: item.Version,
+		AccessCount: accessCount,
+		Timestamp: item.Timestamp,
+	})
+	if err != nil {
+		return nil, err;
+	}
+
+	if dt.keyring != nil {
+		if payload, err = dt.keyring.encryptLine(payload); err != nil {
+			return nil, err;
+		}
+	}
+
+	record := make([]byte, 0, diskRecordHeaderSize + len(payload));
+	record = binary.BigEndian.AppendUint32(record, uint32(len(payload)));
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload));
+	record = append(record, payload...);
+
+	if _, err := dt.file.WriteAt(record, dt.size); err != nil {
+		return nil, err;
+	}
+
+	// The value was just encoded, so its entry can be built too
+	merkle, _ := newMerkleEntry(key, item.Value, item.Timestamp, false);
+
+	dt.remove(key);
+	dt.index[key] = diskEntry{
+		offset: dt.size,
+		size: int64(len(record)),
+		expiration: item.Expiration,
+		lastAccess: item.LastAccess,
+		version: item.Version,
+		timestamp: item.Timestamp,
+		accessCount: accessCount,
+		digest: merkle.Digest,
+		merge: merkle.Merge,
+	}
+	dt.size += int64(len(record));
+
+	var dropped []string;
+	for len(dt.index) > dt.maxItems {
+		victim := dt.victim();
+		dt.remove(victim);
+		dt.evictions++;
+		dropped = append(dropped, victim);
+	}
+
+	dt.maybeCompact();
+	return dropped, nil;
+}
+
+// Removes an item from the tier and reads it back. Returns false if the tier does not hold key.
+// The item is gone from the tier even if reading it fails.
+func (dt *diskTier) take (key string) (CacheItem, int, bool, error) {
+	entry, found := dt.index[key];
+	if !found {
+		return CacheItem{}, 0, false, nil;
+	}
+
+	rec, err := dt.read(entry);
+	dt.remove(key);
+	dt.maybeCompact();
+	if err != nil {
+		return CacheItem{}, 0, true, err;
+	}
+
+	dt.hits++;
+	return CacheItem{
+		Value: rec.Value,
+		Expiration: rec.Expiration,
+		LastAccess: time.Now().UnixNano(),
+		Version: rec.Version,
+		Timestamp: rec.Timestamp,
+	}, max(rec.AccessCount, 1), true, nil;
+}
+
+// Reads an item without removing it from the tier. Returns false if the tier does not hold key
+// or reading it fails. Only reads the file, so holding the cache read lock is enough.
+func (dt *diskTier) peek (key string) (CacheItem, int, bool) {
+	entry, found := dt.index[key];
+	if !found {
+		return CacheItem{}, 0, false;
+	}
+
+	rec, err := dt.read(entry);
+	if err != nil {
+		log.Printf("Failed to read %q from the disk tier: %v", key, err);
+		return CacheItem{}, 0, false;
+	}
+
+	return CacheItem{
+		Value: rec.Value,
+		Expiration: rec.Expiration,
+		LastAccess: rec.LastAccess,
+		Version: rec.Version,
+		Timestamp: rec.Timestamp,
+	}, rec.AccessCount, true;
+}
+
+// Reads and decodes the record of an entry
+func (dt *diskTier) read (entry diskEntry) (SnapshotRecord, error) {
+	record := make([]byte, entry.size);
+	if _, err := dt.file.ReadAt(record, entry.offset); err != nil {
+		return SnapshotRecord{}, err;
+	}
+
+	payload := record[diskRecordHeaderSize:];
+	if int(binary.BigEndian.Uint32(record)) != len(payload) || binary.BigEndian.Uint32(record[4:]) != crc32.ChecksumIEEE(payload) {
+		return SnapshotRecord{}, fmt.Errorf("disk tier record at offset %d is corrupt", entry.offset);
+	}
+
+	if dt.keyring != nil {
+		var err error;
+		if payload, err = dt.keyring.decryptLine(payload); err != nil {
+			return SnapshotRecord{}, err;
+		}
+	}
+
+	return decodeSnapshotRecord(payload, SnapshotFormatVersion);
+}
+
+// Drops an item from the index, leaving its record as garbage. Returns false if there was none.
+func (dt *diskTier) remove (key string) bool {
+	entry, found := dt.index[key];
+	if !found {
+		return false;
+	}
+
+	delete(dt.index, key);
+	dt.garbage += entry.size;
+	return true;
+}
+
+// Returns the version of the live item at key, or 0 if there is none
+func (dt *diskTier) version (key string, now int64) uint64 {
+	entry, found := dt.index[key];
+	if !found || (entry.expiration > 0 && entry.expiration < now) {
+		return 0;
+	}
+
+	return entry.version;
+}
+
+// Returns the timestamp of the live item at key, or false if the tier does not hold one
+func (dt *diskTier) timestamp (key string, now int64) (Timestamp, bool) {
+	entry, found := dt.index[key];
+	if !found || (entry.expiration > 0 && entry.expiration < now) {
+		return Timestamp{}, false;
+	}
+
+	return entry.timestamp, true;
+}
+
+// Removes the expired items and returns their keys
+func (dt *diskTier) removeExpired (now int64) []string {
+	var expired []string;
+	for key, entry := range dt.index {
+		if entry.expiration > 0 && entry.expiration < now {
+			expired = append(expired, key);
+		}
+	}
+
+	for _, key := range expired {
+		dt.remove(key);
+	}
+	dt.maybeCompact();
+
+	return expired;
+}
+
+// Returns the keys of all items in the tier
+func (dt *diskTier) keys () []string {
+	keys := make([]string, 0, len(dt.index));
+	for key := range dt.index {
+		keys = append(keys, key);
+	}
+
+	return keys;
+}
+
+// Picks the item to evict according to the eviction policy
+func (dt *diskTier) victim () string {
+	var victim string;
+	first := true;
+
+	for key, entry := range dt.index {
+		older := entry.lastAccess < dt.index[victim].lastAccess;
+		if dt.evictionType != "lru" {
+			older = entry.accessCount < dt.index[victim].accessCount;
+		}
+
+		if first || older {
+			victim = key;
+			first = false;
+		}
+	}
+
+	return victim;
+}
+
+// Compacts the log once most of it is garbage
+func (dt *diskTier) maybeCompact () {
+	if len(dt.index) == 0 && dt.size > 0 {
+		// Nothing live, so start the log over
+		if err := dt.file.Truncate(0); err == nil {
+			dt.size, dt.garbage = 0, 0;
+		}
+		return;
+	}
+
+	if dt.garbage < diskTierCompactMinGarbage || dt.garbage < dt.size / 2 {
+		return;
+	}
+
+	if err := dt.compact(); err != nil {
+		log.Printf("Failed to compact the disk tier: %v", err);
+	}
+}
+
+// Copies the live records into a new log and swaps it in
+func (dt *diskTier) compact () error {
+	tempPath := dt.path + ".compact";
+	file, err := os.OpenFile(tempPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600);
+	if err != nil {
+		return err;
+	}
+
+	index := make(map[string]diskEntry, len(dt.index));
+	var size int64;
+	for key, entry := range dt.index {
+		record := make([]byte, entry.size);
+		if _, err = dt.file.ReadAt(record, entry.offset); err == nil {
+			_, err = file.WriteAt(record, size);
+		}
+		if err != nil {
+			file.Close();
+			os.Remove(tempPath);
+			return err;
+		}
+
+		entry.offset = size;
+		index[key] = entry;
+		size += entry.size;
+	}
+
+	if err := os.Rename(tempPath, dt.path); err != nil {
+		file.Close();
+		os.Remove(tempPath);
+		return err;
+	}
+
+	dt.file.Close();
+	dt.file = file;
+	dt.index = index;
+	dt.size = size;
+	dt.garbage = 0;
+	return nil;
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Creates a cache holding maxItems in memory and diskItems in a disk tier, recording the events it emits
+func newTieredTestCache (t *testing.T, maxItems, diskItems int, keyring *Keyring) (*Cache, string, *[]string) {
+	t.Helper();
+
+	c := NewCache("lru", maxItems);
+	c.SetClock(NewHybridClock("n1"));
+	path := filepath.Join(t.TempDir(), "tier.log");
+	if err := c.EnableDiskTier(path, diskItems, keyring); err != nil {
+		t.Fatalf("EnableDiskTier: %v", err);
+	}
+
+	var events []string;
+	c.SetEventListener(func (event, key string) {
+		events = append(events, event + " " + key);
+	});
+
+	return c, path, &events;
+}
+
+// Sets keys in order, each accessed later than the one before
+func setTestKeys (c *Cache, keys ...string) {
+	for _, key := range keys {
+		c.Set(key, "value of " + key, time.Hour);
+		time.Sleep(time.Millisecond);
+	}
+}
+
+func TestDiskTierRoundTrip (t *testing.T) {
+	keyrings := map[string]*Keyring{"plain": nil, "encrypted": testKeyring(t, testKey(1))};
+
+	for name, keyring := range keyrings {
+		t.Run(name, func (t *testing.T) {
+			c, path, events := newTieredTestCache(t, 2, 10, keyring);
+			visitors := NewHyperLogLog();
+			visitors.Add("alice");
+			visitors.Add("bob");
+			if _, err := c.MergeValue("visitors", visitors, time.Hour, Timestamp{}); err != nil {
+				t.Fatalf("MergeValue: %v", err);
+			}
+			time.Sleep(time.Millisecond);
+			setTestKeys(c, "a", "b");
+			version := c.peekStamped("a").Version;
+			setTestKeys(c, "c");
+			*events = nil;
+
+			// The least recently used items went to disk, without being reported as evicted
+			stats := c.TierStats();
+			if stats.Memory.Items != 2 || stats.Disk.Items != 2 || stats.Memory.Evictions != 2 || stats.Disk.Evictions != 0 {
+				t.Errorf("stats = %+v, disk %+v, want two items in each tier", stats, *stats.Disk);
+			}
+
+			// Reading an item on disk moves it back into memory, pushing the next one out
+			value, got, found := c.GetVersioned("a");
+			if !found || value != "value of a" || got != version {
+				t.Fatalf("a = %v, version %d (found %v), want its value at version %d", value, got, found, version);
+			}
+			if len(*events) != 0 {
+				t.Errorf("moving items between tiers emitted %v", *events);
+			}
+			if stats := c.TierStats(); stats.Disk.Hits != 1 || stats.Memory.Items != 2 || stats.Disk.Items != 2 {
+				t.Errorf("stats = %+v, disk %+v after promoting a", stats, *stats.Disk);
+			}
+			if _, onDisk := c.disk.index["b"]; !onDisk {
+				t.Errorf("b, the least recently used item in memory, was not moved to disk");
+			}
+
+			// Mergeable values survive the round trip
+			value, found = c.Get("visitors");
+			if hll, ok := value.(*HyperLogLog); !found || !ok || hll.Count() != 2 {
+				t.Errorf("visitors = %v (found %v), want a HyperLogLog of 2", value, found);
+			}
+
+			data, err := os.ReadFile(path);
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err);
+			}
+			if encrypted := !bytes.Contains(data, []byte("value of")); encrypted != (keyring != nil) {
+				t.Errorf("disk tier encrypted = %v, want %v", encrypted, keyring != nil);
+			}
+		});
+	}
+}
+
+func TestDiskTierEviction (t *testing.T) {
+	c, _, events := newTieredTestCache(t, 1, 2, nil);
+	setTestKeys(c, "a", "b", "c", "d");
+
+	// Memory holds d, the disk b and c, and a was dropped for good
+	if stats := c.TierStats(); stats.Disk.Items != 2 || stats.Disk.Evictions != 1 {
+		t.Errorf("disk stats = %+v, want 2 items and 1 eviction", *stats.Disk);
+	}
+	if !slices.Equal(*events, []string{"set a", "set b", "set c", "evict a", "set d"}) {
+		t.Errorf("events = %v, want a evicted once it left the disk tier", *events);
+	}
+	if _, found := c.Get("a"); found {
+		t.Errorf("a found after it was evicted from the disk tier");
+	}
+	if stats := c.TierStats(); stats.Misses != 1 {
+		t.Errorf("misses = %d, want 1", stats.Misses);
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if value, found := c.Get(key); !found || value != "value of " + key {
+			t.Errorf("%s = %v (found %v)", key, value, found);
+		}
+	}
+}
+
+func TestDiskTierExpiry (t *testing.T) {
+	c, _, events := newTieredTestCache(t, 10, 10, nil);
+	setTestKeys(c, "a", "b");
+
+	c.mu.Lock();
+	item := c.items["a"];
+	item.Expiration = time.Now().Add(-time.Second).UnixNano();
+	c.items["a"] = item;
+	c.mu.Unlock();
+	demoteTestKey(t, c, "a");
+	demoteTestKey(t, c, "b");
+	*events = nil;
+
+	if _, found := c.Get("a"); found {
+		t.Errorf("expired item on disk was found");
+	}
+	if !slices.Equal(*events, []string{"expire a"}) {
+		t.Errorf("events = %v, want a expired", *events);
+	}
+	if _, found := c.Get("b"); !found {
+		t.Errorf("live item on disk not found");
+	}
+	if stats := c.TierStats(); stats.Disk.Items != 0 {
+		t.Errorf("disk tier still holds %d items", stats.Disk.Items);
+	}
+}
+
+func TestDiskTierCompaction (t *testing.T) {
+	c, _, _ := newTieredTestCache(t, 10, 10, nil);
+	setTestKeys(c, "a", "b", "c");
+	for _, key := range []string{"a", "b", "c"} {
+		demoteTestKey(t, c, key);
+	}
+
+	// Promoting and overwriting leave garbage behind
+	c.Get("a");
+	c.Set("b", "new value of b", time.Hour);
+	demoteTestKey(t, c, "b");
+
+	c.mu.Lock();
+	before := c.disk.size;
+	err := c.disk.compact();
+	c.mu.Unlock();
+	if err != nil {
+		t.Fatalf("compact: %v", err);
+	}
+
+	stats := c.TierStats();
+	if stats.Disk.Bytes >= before || stats.Disk.LiveBytes != stats.Disk.Bytes {
+		t.Errorf("disk stats = %+v after compacting %d bytes, want only live records left", *stats.Disk, before);
+	}
+	want := map[string]string{"a": "value of a", "b": "new value of b", "c": "value of c"};
+	for key, value := range want {
+		if got, found := c.Get(key); !found || got != value {
+			t.Errorf("%s = %v (found %v) after compacting, want %q", key, got, found, value);
+		}
+	}
+}
+
+func TestDiskTierDelete (t *testing.T) {
+	c, _, _ := newTieredTestCache(t, 10, 10, nil);
+	setTestKeys(c, "a");
+	demoteTestKey(t, c, "a");
+
+	c.Delete("a");
+	if _, found := c.Get("a"); found {
+		t.Errorf("deleted item found on disk");
+	}
+	if keys := c.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %v after deleting the only one", keys);
+	}
+}
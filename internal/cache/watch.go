@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Returns the next version for a write. Must hold c.mu.
+func (c *Cache) nextVersion () uint64 {
+	c.version++;
+	return c.version;
+}
+
+// Returns the version to give an item loaded from disk, keeping its saved version if it has one
+// so versions seen by watchers before a restart stay valid. Must hold c.mu.
+func (c *Cache) restoredVersion (saved uint64) uint64 {
+	if saved == 0 {
+		return c.nextVersion();
+	}
+
+	c.version = max(c.version, saved);
+	return saved;
+}
+
+// Gives the item at key a new version and timestamp after it was modified in place. Must hold c.mu.
+func (c *Cache) bumpVersion (key string) {
+	if item, found := c.items[key]; found {
+		item.Version = c.nextVersion();
+		item.Timestamp = c.clock.Now();
+		c.items[key] = item;
+	}
+}
+
+// Wakes up everyone waiting for the key to change. Must hold c.mu.
+func (c *Cache) notifyWatchers (key string) {
+	for _, ch := range c.watchers[key] {
+		close(ch);
+	}
+	delete(c.watchers, key);
+}
+
+// Returns the version of the live item at key, or 0 if there is none. Must hold c.mu.
+func (c *Cache) currentVersion (key string) uint64 {
+	now := time.Now().UnixNano();
+	item, found := c.items[key];
+	if !found {
+		if c.disk != nil {
+			return c.disk.version(key, now);
+		}
+		return 0;
+	}
+	if item.Expiration > 0 && item.Expiration < now {
+		return 0;
+	}
+
+	return item.Version;
+}
+
+// Get a value from the cache along with its version.
+// The version of a missing key is 0.
+func (c *Cache) GetVersioned (key string) (interface{}, uint64, bool) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	value, found := c.get(key);
+	if !found {
+		return nil, 0, false;
+	}
+
+	return value, c.currentVersion(key), true;
+}
+
+// Blocks until the version of key differs from the given version or ctx is done.
+// Events that leave the version as it was, such as moving the item between memory and the disk tier,
+// do not end the wait. Returns false if ctx was done first.
+func (c *Cache) WaitForChange (ctx context.Context, key string, version uint64) bool {
+	for {
+		c.mu.Lock();
+
+		if c.currentVersion(key) != version {
+			c.mu.Unlock();
+			return true;
+		}
+
+		ch := make(chan struct{});
+		c.watchers[key] = append(c.watchers[key], ch);
+		c.mu.Unlock();
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.removeWatcher(key, ch);
+			return false;
+		}
+	}
+}
+
+// Stops a watcher from waiting for a change of key
+func (c *Cache) removeWatcher (key string, ch chan struct{}) {
+	c.mu.Lock();
+	defer c.mu.Unlock();
+
+	watchers := c.watchers[key];
+	for i, w := range watchers {
+		if w == ch {
+			watchers = append(watchers[:i], watchers[i+1:]...);
+			break;
+		}
+	}
+
+	if len(watchers) == 0 {
+		delete(c.watchers, key);
+	} else {
+		c.watchers[key] = watchers;
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Starts waiting for key to change from its current version, returning the channel the result is sent on
+func watchTestKey (c *Cache, key string) chan bool {
+	_, version, _ := c.GetVersioned(key);
+
+	changed := make(chan bool, 1);
+	go func () {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second);
+		defer cancel();
+		changed <- c.WaitForChange(ctx, key, version);
+	}();
+
+	return changed;
+}
+
+func TestWaitForChange (t *testing.T) {
+	tests := []struct {
+		name	string;
+		change	func (c *Cache);
+		wakes	bool;
+	}{
+		{"set", func (c *Cache) { c.Set("key", "new", time.Hour) }, true},
+		{"delete", func (c *Cache) { c.Delete("key") }, true},
+		{"other key", func (c *Cache) { c.Set("other", "value", time.Hour) }, false},
+		{"event without a new version", func (c *Cache) {
+			c.mu.Lock();
+			c.notifyWatchers("key");
+			c.mu.Unlock();
+		}, false},
+	};
+
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c := NewCache("lru", 100);
+			c.Set("key", "value", time.Hour);
+
+			changed := watchTestKey(c, "key");
+			time.Sleep(20 * time.Millisecond);
+			tt.change(c);
+
+			select {
+			case ok := <-changed:
+				if !tt.wakes || !ok {
+					t.Errorf("watch ended with %v, want it to keep waiting", ok);
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wakes {
+					t.Errorf("watch did not end after the key changed");
+				}
+			}
+		});
+	}
+}
+
+func TestWaitForChangeAlreadyChanged (t *testing.T) {
+	c := NewCache("lru", 100);
+	c.Set("key", "value", time.Hour);
+
+	if !c.WaitForChange(context.Background(), "key", 0) {
+		t.Errorf("watch from version 0 of an existing key did not return at once");
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond);
+	defer cancel();
+	_, version, _ := c.GetVersioned("key");
+	if c.WaitForChange(ctx, "key", version) {
+		t.Errorf("watch of an unchanged key returned true after the context was done");
+	}
+	if len(c.watchers["key"]) != 0 {
+		t.Errorf("%d watchers left after the context was done", len(c.watchers["key"]));
+	}
+}
@@ -1,9 +1,14 @@
 package cluster
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,6 +19,7 @@ type NodeStatus string;
 const (
 	NodeStatusUp NodeStatus = "up";
 	NodeStatusDown NodeStatus = "down";
+	NodeStatusLeft NodeStatus = "left";	// Only reported to the status listener, the node is no longer known
 )
 
 // Node represents a cache node in the cluster
@@ -30,6 +36,8 @@ type NodeManager struct {
 	hash *ConsistentHash;
 	localNode *Node;
 	nodeCheckTime time.Duration;
+	heartbeatClient *http.Client;
+	statusListener func(id string, status NodeStatus);	// Told when a node goes down, comes back up or leaves
 	mu sync.RWMutex;
 }
 
@@ -47,6 +55,7 @@ func NewNodeManager (localId, localAddr string, checkTime time.Duration) *NodeMa
 		hash: NewConsistentHash(10), // 10 virtual nodes for each physical node in the cluster
 		localNode: localNode,
 		nodeCheckTime: checkTime,
+		heartbeatClient: &http.Client{Timeout: checkTime},
 	}
 
 	// Add the local node
@@ -56,16 +65,38 @@ func NewNodeManager (localId, localAddr string, checkTime time.Duration) *NodeMa
 	return nm;
 }
 
+// Sets the function told when a node goes down, comes back up or leaves. A node registering again
+// is reported up even if it was not seen down, since it may have restarted in between.
+func (nm *NodeManager) SetStatusListener (listener func(id string, status NodeStatus)) {
+	nm.mu.Lock();
+	defer nm.mu.Unlock();
+
+	nm.statusListener = listener;
+}
+
+// Tells the status listener, if any, that a node changed status. Must not hold nm.mu.
+func (nm *NodeManager) notifyStatus (id string, status NodeStatus) {
+	nm.mu.RLock();
+	listener := nm.statusListener;
+	nm.mu.RUnlock();
+
+	if listener != nil {
+		listener(id, status);
+	}
+}
+
 // Registers a new node in the node cluster
 func (nm *NodeManager) RegisterNode (id, addrs string) {
 	nm.mu.Lock();
-	defer nm.mu.Unlock();
 
 	if node, exists := nm.nodes[id]; exists {
 		// Update the existing node
 		node.Address = addrs;
 		node.Status = NodeStatusUp;
 		node.LastSeen = time.Now();
+		nm.mu.Unlock();
+
+		nm.notifyStatus(id, NodeStatusUp);
 		return;
 	}
 
@@ -79,8 +110,94 @@ func (nm *NodeManager) RegisterNode (id, addrs string) {
 
 	nm.nodes[id] = newNode;
 	nm.hash.Add(id);
+	nm.mu.Unlock();
 
 	log.Printf("Node %s registered at %s", id, addrs);
+	nm.notifyStatus(id, NodeStatusUp);
+}
+
+// Records that a known node was heard from, and tells the status listener if it was down.
+// Returns false if the node is not known.
+func (nm *NodeManager) markSeen (id string) bool {
+	nm.mu.Lock();
+
+	node, exists := nm.nodes[id];
+	if !exists {
+		nm.mu.Unlock();
+		return false;
+	}
+
+	wasDown := node.Status == NodeStatusDown;
+	node.LastSeen = time.Now();
+	node.Status = NodeStatusUp;
+	nm.mu.Unlock();
+
+	if wasDown {
+		log.Printf("Node %s at %s is back up", id, node.Address);
+		nm.notifyStatus(id, NodeStatusUp);
+	}
+
+	return true;
+}
+
+// Removes a node that left the cluster, so its keys are placed on the remaining nodes
+func (nm *NodeManager) RemoveNode (id string) {
+	nm.mu.Lock();
+
+	if _, exists := nm.nodes[id]; !exists || id == nm.localNode.ID {
+		nm.mu.Unlock();
+		return;
+	}
+
+	delete(nm.nodes, id);
+	nm.hash.Remove(id);
+	nm.mu.Unlock();
+
+	log.Printf("Node %s left the cluster", id);
+	nm.notifyStatus(id, NodeStatusLeft);
+}
+
+// Takes the local node out of the hash ring and tells the other nodes that it is leaving.
+// Keys are placed on the remaining nodes from then on, locally and on every node that was told.
+func (nm *NodeManager) Leave (ctx context.Context) error {
+	nm.mu.Lock();
+	nm.hash.Remove(nm.localNode.ID);
+	nm.localNode.Status = NodeStatusDown;
+	nm.mu.Unlock();
+
+	jsonData, err := json.Marshal(map[string]string {
+		"id": nm.localNode.ID,
+	})
+	if err != nil {
+		return err;
+	}
+
+	var errs []error;
+	for _, node := range nm.GetAllNodes() {
+		if node.ID == nm.localNode.ID || node.Status != NodeStatusUp {
+			continue;
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, node.Address + "/nodes/deregister", bytes.NewReader(jsonData));
+		if err != nil {
+			errs = append(errs, err);
+			continue;
+		}
+		req.Header.Set("Content-Type", "application/json");
+
+		resp, err := http.DefaultClient.Do(req);
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to deregister from node %s: %w", node.ID, err));
+			continue;
+		}
+		resp.Body.Close();
+
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Errorf("failed to deregister from node %s, status: %s", node.ID, resp.Status));
+		}
+	}
+
+	return errors.Join(errs...);
 }
 
 // Returns the node responsible for the given key
@@ -92,6 +209,49 @@ func (nm *NodeManager) GetNodeForKey (key string) *Node {
 	return nm.nodes[nodeId];
 }
 
+// Returns the node with the given ID, or nil if it is not known
+func (nm *NodeManager) GetNode (id string) *Node {
+	nm.mu.RLock();
+	defer nm.mu.RUnlock();
+
+	return nm.nodes[id];
+}
+
+// Returns the address of the node with the given ID, or an empty string if it is not known
+func (nm *NodeManager) GetNodeAddress (id string) string {
+	if node := nm.GetNode(id); node != nil {
+		return node.Address;
+	}
+
+	return "";
+}
+
+// Checks if the node with the given ID is known and up
+func (nm *NodeManager) IsNodeUp (id string) bool {
+	nm.mu.RLock();
+	defer nm.mu.RUnlock();
+
+	node, exists := nm.nodes[id];
+	return exists && node.Status == NodeStatusUp;
+}
+
+// Returns the first node that is up among the count nodes responsible for the key.
+// Falls back to the primary if none of them are up.
+func (nm *NodeManager) GetLiveNodeForKey (key string, count int) *Node {
+	nodeIds := nm.GetNodesForKey(key, count);
+
+	nm.mu.RLock();
+	defer nm.mu.RUnlock();
+
+	for _, id := range nodeIds {
+		if node, exists := nm.nodes[id]; exists && node.Status == NodeStatusUp {
+			return node;
+		}
+	}
+
+	return nm.nodes[nodeIds[0]];
+}
+
 // Get all nodes in the node cluster
 func (nm *NodeManager) GetAllNodes () []*Node {
 	nm.mu.RLock();
@@ -105,21 +265,69 @@ func (nm *NodeManager) GetAllNodes () []*Node {
 	return nodes;
 }
 
-// Starts a background goroutine to check node health
+// Starts a background goroutine to send heartbeats to the other nodes and check node health
 func (nm *NodeManager) StartHealthCheck () {
 	go func () {
 		ticker := time.NewTicker(nm.nodeCheckTime);
 		defer ticker.Stop();
 
 		for range ticker.C {
+			nm.sendHeartbeats();
 			nm.checkNodeHealth();
 		}
 	}();
 }
 
+// Sends a heartbeat to every other node, including the ones that are down, so they are seen
+// as soon as they come back. The heartbeat carries our address, so nodes that do not know us
+// yet register us. Stops once the local node has left the cluster.
+func (nm *NodeManager) sendHeartbeats () {
+	nm.mu.RLock();
+	left := nm.localNode.Status != NodeStatusUp;
+	nm.mu.RUnlock();
+
+	if left {
+		return;
+	}
+
+	jsonData, err := json.Marshal(map[string]string {
+		"id": nm.localNode.ID,
+		"address": nm.localNode.Address,
+	})
+	if err != nil {
+		log.Printf("Error encoding heartbeat: %v", err);
+		return;
+	}
+
+	for _, node := range nm.GetAllNodes() {
+		if node.ID == nm.localNode.ID {
+			continue;
+		}
+
+		go func (id, address string) {
+			resp, err := nm.heartbeatClient.Post(address + "/nodes/heartbeat", "application/json", bytes.NewReader(jsonData));
+			if err != nil {
+				return;
+			}
+			resp.Body.Close();
+
+			if resp.StatusCode == http.StatusOK {
+				nm.markSeen(id);
+			}
+		}(node.ID, node.Address);
+	}
+}
+
 func (nm *NodeManager) checkNodeHealth () {
+	var down []string;
+
 	nm.mu.Lock();
-	defer nm.mu.Unlock();
+	defer func () {
+		nm.mu.Unlock();
+		for _, id := range down {
+			nm.notifyStatus(id, NodeStatusDown);
+		}
+	}();
 
 	for id, node := range nm.nodes {
 		// Skip local node
@@ -130,9 +338,10 @@ func (nm *NodeManager) checkNodeHealth () {
 
 		// Check if the node is alive
 		// Waiting twice the check interval ensures we don’t mistakenly remove a healthy but slow-responding node.
-		if time.Since(node.LastSeen) > nm.nodeCheckTime * 2 {
+		if time.Since(node.LastSeen) > nm.nodeCheckTime * 2 && node.Status != NodeStatusDown {
 			log.Printf("Node %s at %s is down", node.ID, node.Address);
 			node.Status = NodeStatusDown;
+			down = append(down, id);
 		}
 
 		// In a real system, we would attempt to contact the node 
@@ -144,6 +353,7 @@ func (nm *NodeManager) checkNodeHealth () {
 func (nm *NodeManager) SetupHTTPHandlers (mux *http.ServeMux) {
 	mux.HandleFunc("/nodes/register", nm.handleRegister);
 	mux.HandleFunc("/nodes/heartbeat", nm.handleHeartbeat);
+	mux.HandleFunc("/nodes/deregister", nm.handleDeregister);
 	mux.HandleFunc("/nodes/list", nm.handleListNodes);
 }
 
@@ -172,6 +382,30 @@ func (nm *NodeManager) handleRegister (w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Handles requests of nodes leaving the cluster
+func (nm *NodeManager) handleDeregister (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed);
+		return;
+	}
+
+	var data struct {
+		ID	string	`json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest);
+		return;
+	}
+
+	nm.RemoveNode(data.ID);
+
+	w.Header().Set("Content-Type", "application/json");
+	json.NewEncoder(w).Encode(map[string]string {
+		"status": "success",
+	})
+}
+
 // Handles node heartbeat requests i.e. this node sent a heartbeat i.e. it is up
 func (nm *NodeManager) handleHeartbeat (w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -181,6 +415,7 @@ func (nm *NodeManager) handleHeartbeat (w http.ResponseWriter, r *http.Request)
 
 	var data struct {
 		ID	string 	`json:"id"`
+		Address	string	`json:"address"`	// Lets nodes that do not know the sender yet register it
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
@@ -188,15 +423,10 @@ func (nm *NodeManager) handleHeartbeat (w http.ResponseWriter, r *http.Request)
 		return;
 	}
 
-	nm.mu.Lock();
-
-	if node, exists := nm.nodes[data.ID]; exists {
-		node.LastSeen = time.Now();
-		node.Status = NodeStatusUp;
+	if !nm.markSeen(data.ID) && data.Address != "" && data.ID != nm.localNode.ID {
+		nm.RegisterNode(data.ID, data.Address);
 	}
 
-	nm.mu.Unlock();
-
 	w.Header().Set("Content-Type", "application/json");
 	json.NewEncoder(w).Encode(map[string]string {
 		"status": "success",
@@ -242,8 +472,47 @@ func (nm *NodeManager) GetNodesForKey (key string, count int) []string {
 	nm.mu.Lock();
 	defer nm.mu.Unlock();
 
-	// Get primary node
-	primaryNodeId := nm.hash.Get(key);
+	return nm.nodesForPrimary(nm.hash.Get(key), count);
+}
+
+// Returns a function that places keys like GetNodesForKey does on the ring as it is now.
+// The nodes of every range of the ring are resolved up front, so placing a key takes no lock.
+func (nm *NodeManager) KeyPlacement (count int) func(key string) []string {
+	nm.mu.Lock();
+	defer nm.mu.Unlock();
+
+	ring := append([]uint32(nil), nm.hash.GetHashRing()...);
+	if len(ring) == 0 {
+		return func (string) []string { return []string{""}; };
+	}
+
+	byPrimary := make(map[string][]string);
+	placed := make([][]string, len(ring));
+	for i, hash := range ring {
+		primary := nm.hash.GetNodeForHash(hash);
+		if _, exists := byPrimary[primary]; !exists {
+			byPrimary[primary] = nm.nodesForPrimary(primary, count);
+		}
+		placed[i] = byPrimary[primary];
+	}
+
+	return func (key string) []string {
+		hash := nm.hash.hashKey(key);
+		idx := sort.Search(len(ring), func (i int) bool {
+			return ring[i] >= hash;
+		});
+
+		// Wrap around to the first node (since it is a ring)
+		if idx == len(ring) {
+			idx = 0;
+		}
+
+		return placed[idx];
+	};
+}
+
+// Returns the primary node and the count - 1 nodes that follow it on the ring. Must hold nm.mu.
+func (nm *NodeManager) nodesForPrimary (primaryNodeId string, count int) []string {
 	nodes := []string{primaryNodeId};
 
 	// If we only need one node, return the primary
@@ -0,0 +1,217 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Channel name used for keyspace events emitted by the cache
+const KeyspaceChannel = "__keyspace__";
+
+// Number of messages buffered per subscriber before new ones are dropped
+const subscriberBuffer = 256;
+
+// Message is a single notification delivered to subscribers
+type Message struct {
+	Channel	string	`json:"channel"`
+	Event	string	`json:"event,omitempty"`	// Keyspace event type (set, delete, expire, evict)
+	Key		string	`json:"key,omitempty"`		// Key the keyspace event is about
+	Data	json.RawMessage	`json:"data,omitempty"`	// Payload of a published message
+	Node	string	`json:"node"`				// Node the message originated on
+	Time	int64	`json:"time"`
+}
+
+// Filter selects the messages a subscription receives
+type Filter struct {
+	KeyPatterns []string;		// Glob patterns matched against keys of keyspace events
+	Channels []string;			// Names of channels to receive published messages from
+	ChannelPatterns []string;	// Glob patterns matched against channel names
+}
+
+// Checks if the filter selects the message
+func (f Filter) Matches (msg Message) bool {
+	if msg.Channel == KeyspaceChannel {
+		for _, pattern := range f.KeyPatterns {
+			if MatchPattern(pattern, msg.Key) {
+				return true;
+			}
+		}
+		return false;
+	}
+
+	for _, channel := range f.Channels {
+		if channel == msg.Channel {
+			return true;
+		}
+	}
+
+	for _, pattern := range f.ChannelPatterns {
+		if MatchPattern(pattern, msg.Channel) {
+			return true;
+		}
+	}
+
+	return false;
+}
+
+// Checks if the filter selects any published channel messages
+func (f Filter) HasChannels () bool {
+	return len(f.Channels) > 0 || len(f.ChannelPatterns) > 0;
+}
+
+// Subscription receives the messages matching its filter
+type Subscription struct {
+	hub *Hub;
+	filter Filter;
+	messages chan Message;
+	dropped atomic.Int64;
+	closeOnce sync.Once;
+}
+
+// Returns the channel messages are delivered on. It is closed when the subscription is closed.
+func (s *Subscription) Messages () <-chan Message {
+	return s.messages;
+}
+
+// Returns the filter of the subscription
+func (s *Subscription) Filter () Filter {
+	return s.filter;
+}
+
+// Returns how many messages were dropped because the subscriber fell behind
+func (s *Subscription) Dropped () int64 {
+	return s.dropped.Load();
+}
+
+// Delivers a message without blocking, dropping it if the subscriber is behind.
+// Used by the hub and by relays that feed messages from other nodes.
+func (s *Subscription) Send (msg Message) {
+	s.hub.mu.RLock();
+	defer s.hub.mu.RUnlock();
+
+	if _, active := s.hub.subscriptions[s]; !active {
+		return;
+	}
+
+	s.send(msg);
+}
+
+// Delivers a message without blocking. Must hold hub.mu.
+func (s *Subscription) send (msg Message) {
+	select {
+	case s.messages <- msg:
+	default:
+		s.dropped.Add(1);
+	}
+}
+
+// Removes the subscription from the hub and closes its channel
+func (s *Subscription) Close () {
+	s.closeOnce.Do(func () {
+		s.hub.mu.Lock();
+		defer s.hub.mu.Unlock();
+
+		delete(s.hub.subscriptions, s);
+		close(s.messages);
+	});
+}
+
+// Hub fans out messages published on this node to local subscriptions
+type Hub struct {
+	nodeId string;
+	subscriptions map[*Subscription]struct{};
+	mu sync.RWMutex;
+}
+
+// Creates a new hub for the given node
+func NewHub (nodeId string) *Hub {
+	return &Hub{
+		nodeId: nodeId,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Creates a new subscription for the messages matching the filter
+func (h *Hub) Subscribe (filter Filter) *Subscription {
+	h.mu.Lock();
+	defer h.mu.Unlock();
+
+	sub := &Subscription{
+		hub: h,
+		filter: filter,
+		messages: make(chan Message, subscriberBuffer),
+	}
+	h.subscriptions[sub] = struct{}{};
+
+	return sub;
+}
+
+// Delivers a message to every matching subscription and returns how many received it. Never blocks.
+func (h *Hub) Publish (msg Message) int {
+	h.mu.RLock();
+	defer h.mu.RUnlock();
+
+	receivers := 0;
+	for sub := range h.subscriptions {
+		if sub.filter.Matches(msg) {
+			sub.send(msg);
+			receivers++;
+		}
+	}
+
+	return receivers;
+}
+
+// Creates a message originating on this node for a channel
+func (h *Hub) NewMessage (channel string, data json.RawMessage) Message {
+	return Message{
+		Channel: channel,
+		Data: data,
+		Node: h.nodeId,
+		Time: time.Now().UnixNano(),
+	}
+}
+
+// Publishes a keyspace event emitted by the local cache.
+// Matches the cache event listener signature.
+func (h *Hub) PublishKeyspaceEvent (event, key string) {
+	h.Publish(Message{
+		Channel: KeyspaceChannel,
+		Event: event,
+		Key: key,
+		Node: h.nodeId,
+		Time: time.Now().UnixNano(),
+	})
+}
+
+// Reports whether s matches the glob pattern, where * matches any
+// sequence of characters (including none) and ? matches a single character
+func MatchPattern (pattern, s string) bool {
+	p, i := 0, 0;
+	starP, starI := -1, 0;
+
+	for i < len(s) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]) {
+			p++;
+			i++;
+		} else if p < len(pattern) && pattern[p] == '*' {
+			// Remember the star and try matching it against nothing first
+			starP, starI = p, i;
+			p++;
+		} else if starP != -1 {
+			// Let the last star swallow one more character
+			starI++;
+			p, i = starP + 1, starI;
+		} else {
+			return false;
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++;
+	}
+
+	return p == len(pattern);
+}
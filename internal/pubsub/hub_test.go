@@ -0,0 +1,46 @@
+package pubsub
+
+import "testing"
+
+func TestMatchPattern (t *testing.T) {
+	tests := []struct {
+		pattern	string;
+		s	string;
+		want	bool;
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"news", "news", true},
+		{"news", "news.sport", false},
+		{"news", "new", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"news.*", "news.", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "weather.sport", false},
+		{"*.sport", "news.sport", true},
+		{"*.sport", "news.sports", false},
+		{"n*s", "ns", true},
+		{"n*s", "news", true},
+		{"n*s", "newsx", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a*b", "abab", true},
+		{"**", "abc", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"?", "ab", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"user:*:?", "user:42:a", true},
+		{"*?", "", false},
+		{"*?", "a", true},
+	};
+
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want);
+		}
+	}
+}
@@ -23,7 +23,17 @@ func NewClient (serverAddr string) (*Client) {
 
 // Retrieves a value from the cache
 func (c *Client) Get (key string) (interface{}, error) {
+	return c.GetWithConsistency(key, "");
+}
+
+// Retrieves a value from the cache at a consistency level: one to read from any of the key's nodes,
+// quorum or all to read the newest copy of a majority or all of them, or primary.
+// An empty level uses the server's default.
+func (c *Client) GetWithConsistency (key, consistency string) (interface{}, error) {
 	url := fmt.Sprintf("%s/get?key=%s", c.serverAddr, key);
+	if consistency != "" {
+		url += "&consistency=" + consistency;
+	}
 
 	resp, err := c.httpClient.Get(url);
 	if err != nil {
@@ -49,6 +59,12 @@ func (c *Client) Get (key string) (interface{}, error) {
 
 // Adds a value to the cache
 func (c *Client) Set (key string, value interface{}, ttl int64) error {
+	return c.SetWithConsistency(key, value, ttl, "");
+}
+
+// Adds a value to the cache, waiting for as many replicas as the consistency level
+// (one, quorum or all) requires. An empty level uses the server's default.
+func (c *Client) SetWithConsistency (key string, value interface{}, ttl int64, consistency string) error {
 	url := fmt.Sprintf("%s/set", c.serverAddr);
 
 	data := map[string]interface{} {
@@ -56,6 +72,9 @@ func (c *Client) Set (key string, value interface{}, ttl int64) error {
 		"value": value,
 		"ttl": ttl,
 	}
+	if consistency != "" {
+		data["consistency"] = consistency;
+	}
 
 	jsonData, err := json.Marshal(data);
 	if err != nil {
@@ -77,7 +96,16 @@ func (c *Client) Set (key string, value interface{}, ttl int64) error {
 
 // Removes a value from the cache
 func (c *Client) Delete (key string) error {
+	return c.DeleteWithConsistency(key, "");
+}
+
+// Removes a value from the cache, waiting for as many replicas as the consistency level
+// (one, quorum or all) requires. An empty level uses the server's default.
+func (c *Client) DeleteWithConsistency (key, consistency string) error {
 	url := fmt.Sprintf("%s/delete?key=%s", c.serverAddr, key);
+	if consistency != "" {
+		url += "&consistency=" + consistency;
+	}
 
 	req, err := http.NewRequest(http.MethodDelete, url, nil);
 	if err != nil {
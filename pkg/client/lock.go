@@ -0,0 +1,141 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Returned when the lock is held by someone else or no longer held by us
+var ErrLockConflict = errors.New("lock conflict");
+
+// Lock represents a distributed lock held by this client.
+// The lease is renewed in the background until it is released or lost.
+type Lock struct {
+	client *Client;
+	name string;
+	owner string;
+	ttl int64;
+	token uint64;
+	stopping chan struct{};
+	lost chan struct{};
+	done chan struct{};
+	once sync.Once;
+}
+
+// The lease as returned by the server
+type leaseResponse struct {
+	Name string `json:"name"`;
+	Owner string `json:"owner"`;
+	Token uint64 `json:"token"`;
+	Version uint64 `json:"version"`;
+	Expiration int64 `json:"expiration"`;
+}
+
+// Acquires the named lock for the owner with a ttl in seconds and starts renewing it
+func (c *Client) AcquireLock (name, owner string, ttl int64) (*Lock, error) {
+	lease, err := c.lockRequest("/lock/acquire", name, owner, 0, ttl);
+	if err != nil {
+		return nil, err;
+	}
+
+	lock := &Lock{
+		client: c,
+		name: name,
+		owner: owner,
+		ttl: ttl,
+		token: lease.Token,
+		stopping: make(chan struct{}),
+		lost: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go lock.renewLoop();
+
+	return lock, nil;
+}
+
+// Returns the fencing token of the lock, to be passed along with protected writes
+func (l *Lock) Token () uint64 {
+	return l.token;
+}
+
+// Returns a channel that is closed if the lock could not be renewed
+func (l *Lock) Lost () <-chan struct{} {
+	return l.lost;
+}
+
+// Stops renewing the lock and releases it
+func (l *Lock) Release () error {
+	l.once.Do(func () {
+		close(l.stopping);
+	});
+	<-l.done;
+
+	_, err := l.client.lockRequest("/lock/release", l.name, l.owner, l.token, 0);
+	return err;
+}
+
+// Renews the lease a few times per ttl until it is released or renewal fails
+func (l *Lock) renewLoop () {
+	defer close(l.done);
+
+	ticker := time.NewTicker(time.Duration(l.ttl) * time.Second / 3);
+	defer ticker.Stop();
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := l.client.lockRequest("/lock/renew", l.name, l.owner, l.token, l.ttl); err != nil {
+				log.Printf("Failed to renew lock %s: %v", l.name, err);
+				close(l.lost);
+				return;
+			}
+		case <-l.stopping:
+			return;
+		}
+	}
+}
+
+// Sends a lock request to the server and decodes the returned lease
+func (c *Client) lockRequest (path, name, owner string, token uint64, ttl int64) (*leaseResponse, error) {
+	url := fmt.Sprintf("%s%s", c.serverAddr, path);
+
+	data := map[string]interface{} {
+		"name": name,
+		"owner": owner,
+		"token": token,
+		"ttl": ttl,
+	}
+
+	jsonData, err := json.Marshal(data);
+	if err != nil {
+		return nil, err;
+	}
+
+	resp, err := c.httpClient.Post(url, "application/json", bytes.NewBuffer(jsonData));
+	if err != nil {
+		return nil, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil, ErrLockConflict;
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode);
+	}
+
+	var lease leaseResponse;
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, err;
+	}
+
+	return &lease, nil;
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// The versions of a key in sibling mode, as returned by the server
+type Siblings struct {
+	Values []interface{} `json:"siblings"`; // Values of the versions written concurrently
+	Context string `json:"context"`; // Pass to the next write to replace these versions
+}
+
+// Retrieves all concurrent versions of a key in sibling mode, along with their causal context.
+// Returns nil if the key is not found.
+func (c *Client) GetSiblings (key string) (*Siblings, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/get?key=%s", c.serverAddr, url.QueryEscape(key)));
+	if err != nil {
+		return nil, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil;
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status: %d", resp.StatusCode);
+	}
+
+	var siblings Siblings;
+	if err := json.NewDecoder(resp.Body).Decode(&siblings); err != nil {
+		return nil, err;
+	}
+
+	return &siblings, nil;
+}
+
+// Writes a value to a key in sibling mode, replacing the versions the context of a previous read covers.
+// Versions written concurrently are kept as siblings. Returns the context of the key after the write.
+func (c *Client) SetWithContext (key string, value interface{}, ttl int64, context string) (string, error) {
+	jsonData, err := json.Marshal(map[string]interface{} {
+		"key": key,
+		"value": value,
+		"ttl": ttl,
+		"context": context,
+	});
+	if err != nil {
+		return "", err;
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/set", c.serverAddr), "application/json", bytes.NewBuffer(jsonData));
+	if err != nil {
+		return "", err;
+	}
+
+	return decodeContext(resp);
+}
+
+// Deletes the versions of a key in sibling mode that the context of a previous read covers.
+// Returns the context of the key after the delete.
+func (c *Client) DeleteWithContext (key, context string) (string, error) {
+	query := url.Values{"key": {key}, "context": {context}};
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/delete?%s", c.serverAddr, query.Encode()), nil);
+	if err != nil {
+		return "", err;
+	}
+
+	resp, err := c.httpClient.Do(req);
+	if err != nil {
+		return "", err;
+	}
+
+	return decodeContext(resp);
+}
+
+// Reads the context from the response to a write in sibling mode
+func decodeContext (resp *http.Response) (string, error) {
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body);
+		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message));
+	}
+
+	var result struct {
+		Context string `json:"context"`;
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err;
+	}
+
+	return result.Context, nil;
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Longest wait between attempts to reconnect a subscription
+const maxReconnectBackoff = 30 * time.Second;
+
+// Message is a notification received from a subscription
+type Message struct {
+	Channel string `json:"channel"`;
+	Event string `json:"event,omitempty"`;	// Keyspace event type, for keyspace notifications
+	Key string `json:"key,omitempty"`;		// Key the keyspace event is about
+	Data json.RawMessage `json:"data,omitempty"`;	// Payload of a published message
+	Node string `json:"node"`;
+	Time int64 `json:"time"`;
+}
+
+// Selects what a subscription receives
+type SubscribeOptions struct {
+	Channels []string;			// Channel names to receive published messages from
+	ChannelPatterns []string;	// Glob patterns of channel names
+	KeyPatterns []string;		// Glob patterns of keys to receive keyspace events for
+}
+
+// Publishes a message on a channel and returns how many subscribers received it
+func (c *Client) Publish (channel string, data interface{}) (int, error) {
+	url := fmt.Sprintf("%s/publish", c.serverAddr);
+
+	payload, err := json.Marshal(data);
+	if err != nil {
+		return 0, err;
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{} {
+		"channel": channel,
+		"data": json.RawMessage(payload),
+	});
+	if err != nil {
+		return 0, err;
+	}
+
+	resp, err := c.httpClient.Post(url, "application/json", bytes.NewBuffer(jsonData));
+	if err != nil {
+		return 0, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned status %d", resp.StatusCode);
+	}
+
+	var result struct {
+		Receivers int `json:"receivers"`;
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err;
+	}
+
+	return result.Receivers, nil;
+}
+
+// Subscribes to channels and keyspace events. Messages are delivered on the returned
+// channel, which is closed once ctx is done. Dropped connections are re-established
+// automatically; messages published while disconnected are not delivered.
+func (c *Client) Subscribe (ctx context.Context, opts SubscribeOptions) (<-chan Message, error) {
+	if len(opts.Channels) == 0 && len(opts.ChannelPatterns) == 0 && len(opts.KeyPatterns) == 0 {
+		return nil, fmt.Errorf("nothing to subscribe to");
+	}
+
+	query := url.Values{};
+	for _, channel := range opts.Channels {
+		query.Add("channel", channel);
+	}
+	for _, pattern := range opts.ChannelPatterns {
+		query.Add("channel-pattern", pattern);
+	}
+	for _, pattern := range opts.KeyPatterns {
+		query.Add("pattern", pattern);
+	}
+	streamUrl := fmt.Sprintf("%s/subscribe?%s", c.serverAddr, query.Encode());
+
+	messages := make(chan Message, 64);
+
+	go func () {
+		defer close(messages);
+
+		backoff := time.Second;
+		for {
+			received, err := c.readStream(ctx, streamUrl, messages);
+			if ctx.Err() != nil {
+				return;
+			}
+
+			// Start over quickly if the last connection was healthy
+			if received {
+				backoff = time.Second;
+			}
+			log.Printf("Subscription stream ended, reconnecting in %s: %v", backoff, err);
+
+			select {
+			case <-ctx.Done():
+				return;
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2;
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff;
+			}
+		}
+	}();
+
+	return messages, nil;
+}
+
+// Reads one connection of a subscription stream into messages.
+// Returns whether the connection was established.
+func (c *Client) readStream (ctx context.Context, streamUrl string, messages chan<- Message) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamUrl, nil);
+	if err != nil {
+		return false, err;
+	}
+
+	resp, err := c.httpClient.Do(req);
+	if err != nil {
+		return false, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server returned status %d", resp.StatusCode);
+	}
+
+	scanner := bufio.NewScanner(resp.Body);
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024);
+
+	for scanner.Scan() {
+		line := scanner.Text();
+		if !strings.HasPrefix(line, "data: ") {
+			continue;
+		}
+
+		var msg Message;
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+			log.Printf("Error decoding subscription message: %v", err);
+			continue;
+		}
+
+		select {
+		case messages <- msg:
+		case <-ctx.Done():
+			return true, ctx.Err();
+		}
+	}
+
+	return true, scanner.Err();
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long each watch request waits on the server before starting over
+const watchPollTimeout = 30;
+
+// Update describes the state of a watched key after a change
+type Update struct {
+	Key string `json:"key"`;
+	Value interface{} `json:"value"`;
+	Version uint64 `json:"version"`;
+	Found bool `json:"found"`;	// False if the key was deleted or expired
+}
+
+// Watches a key for changes. The current state of the key is delivered first,
+// followed by an update for every change observed. The channel is closed once ctx is done.
+func (c *Client) Watch (ctx context.Context, key string) (<-chan Update, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key is required");
+	}
+
+	updates := make(chan Update, 1);
+
+	go func () {
+		defer close(updates);
+
+		// No live key has this version, so the first request returns the current state right away
+		version := ^uint64(0);
+		backoff := time.Second;
+
+		for {
+			update, changed, err := c.watchOnce(ctx, key, version);
+			if ctx.Err() != nil {
+				return;
+			}
+
+			if err != nil {
+				log.Printf("Watch on key %s failed, retrying in %s: %v", key, backoff, err);
+
+				select {
+				case <-ctx.Done():
+					return;
+				case <-time.After(backoff):
+				}
+
+				backoff = min(backoff * 2, maxReconnectBackoff);
+				continue;
+			}
+			backoff = time.Second;
+
+			if !changed {
+				continue;
+			}
+
+			version = update.Version;
+
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+				return;
+			}
+		}
+	}();
+
+	return updates, nil;
+}
+
+// Sends a single watch request. Returns whether the key changed from version.
+func (c *Client) watchOnce (ctx context.Context, key string, version uint64) (Update, bool, error) {
+	var update Update;
+
+	query := url.Values{};
+	query.Set("key", key);
+	query.Set("version", fmt.Sprint(version));
+	query.Set("timeout", fmt.Sprint(watchPollTimeout));
+
+	watchUrl := fmt.Sprintf("%s/watch?%s", c.serverAddr, query.Encode());
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, watchUrl, nil);
+	if err != nil {
+		return update, false, err;
+	}
+
+	resp, err := c.httpClient.Do(req);
+	if err != nil {
+		return update, false, err;
+	}
+	defer resp.Body.Close();
+
+	if resp.StatusCode == http.StatusNotModified {
+		return update, false, nil;
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return update, false, fmt.Errorf("server returned status %d", resp.StatusCode);
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&update); err != nil {
+		return update, false, err;
+	}
+
+	return update, true, nil;
+}